@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/go-ozzo/ozzo-dbx"
+	_ "github.com/lib/pq"
+	"users-balance-microservice/internal/config"
+	"users-balance-microservice/internal/ledger"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+var flagConfig = flag.String("config", "./config/dev.yml", "path to the config file")
+
+// backfill-ledger writes the postings of the transactions which were made before the ledger was introduced,
+// so that the balances of all the deposits are backed by the ledger.
+func main() {
+	flag.Parse()
+	logger := log.New()
+
+	// load application configurations
+	cfg, err := config.Load(*flagConfig, logger)
+	if err != nil {
+		logger.Errorf("failed to load application configuration: %s", err)
+		os.Exit(-1)
+	}
+
+	// connect to the database
+	db, err := dbx.MustOpen("postgres", cfg.DSN)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Error(err)
+		}
+	}()
+
+	dbc := dbcontext.New(db)
+	ledgerService := ledger.NewService(ledger.NewRepository(dbc, logger), logger)
+	var posted, opened int64
+	err = dbc.Transactional(context.Background(), func(ctx context.Context) error {
+		posted, opened, err = ledgerService.Backfill(ctx)
+		return err
+	})
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	logger.Infof("postings of %d transactions and opening balances of %d deposits are backfilled", posted, opened)
+}
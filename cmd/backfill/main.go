@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/go-ozzo/ozzo-dbx"
+	_ "github.com/lib/pq"
+	"users-balance-microservice/internal/config"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/transaction"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+var flagConfig = flag.String("config", "./config/dev.yml", "path to the config file")
+
+// backfill computes the balances after each transaction which was created before they started to be stored.
+func main() {
+	flag.Parse()
+	logger := log.New()
+
+	// load application configurations
+	cfg, err := config.Load(*flagConfig, logger)
+	if err != nil {
+		logger.Errorf("failed to load application configuration: %s", err)
+		os.Exit(-1)
+	}
+
+	rounding, err := money.ParseRoundingMode(cfg.Rounding)
+	if err != nil {
+		logger.Errorf("failed to configure rounding: %s", err)
+		os.Exit(-1)
+	}
+
+	// connect to the database
+	db, err := dbx.MustOpen("postgres", cfg.DSN)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Error(err)
+		}
+	}()
+
+	txService := transaction.NewService(transaction.NewRepository(dbcontext.New(db), logger), rounding, logger)
+	updated, err := txService.BackfillBalances(context.Background())
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	logger.Infof("balances of %d transactions are backfilled", updated)
+}
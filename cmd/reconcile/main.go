@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/go-ozzo/ozzo-dbx"
+	_ "github.com/lib/pq"
+	"users-balance-microservice/internal/config"
+	"users-balance-microservice/internal/ledger"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+var flagConfig = flag.String("config", "./config/dev.yml", "path to the config file")
+
+// reconcile checks the balance of every deposit against the sum of all its postings. It is meant to be run
+// periodically, since operations only check the balances against the running balances kept in the postings.
+// It exits with an error if any balance differs.
+func main() {
+	flag.Parse()
+	logger := log.New()
+
+	// load application configurations
+	cfg, err := config.Load(*flagConfig, logger)
+	if err != nil {
+		logger.Errorf("failed to load application configuration: %s", err)
+		os.Exit(-1)
+	}
+
+	// connect to the database
+	db, err := dbx.MustOpen("postgres", cfg.DSN)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Error(err)
+		}
+	}()
+
+	ledgerService := ledger.NewService(ledger.NewRepository(dbcontext.New(db), logger), logger)
+	items, err := ledgerService.Mismatches(context.Background())
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	for _, m := range items {
+		logger.Errorf("%s balance of account %s is %d, but its postings sum up to %d", m.Currency, m.OwnerId, m.Balance, m.LedgerBalance)
+	}
+	if len(items) > 0 {
+		os.Exit(-1)
+	}
+	logger.Infof("balances of all deposits match the ledger")
+}
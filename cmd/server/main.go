@@ -16,8 +16,14 @@ import (
 	_ "github.com/lib/pq"
 	"users-balance-microservice/internal/config"
 	"users-balance-microservice/internal/deposit"
+	"users-balance-microservice/internal/entity"
 	"users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/idempotency"
+	"users-balance-microservice/internal/ledger"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/quote"
 	"users-balance-microservice/internal/rates"
+	"users-balance-microservice/internal/reservation"
 	"users-balance-microservice/internal/transaction"
 	"users-balance-microservice/pkg/accesslog"
 	"users-balance-microservice/pkg/dbcontext"
@@ -39,6 +45,19 @@ func main() {
 		os.Exit(-1)
 	}
 
+	// choose the source of currency rates
+	ratesProvider, err := rates.NewProvider(cfg.RatesProvider, cfg.RatesURL, cfg.RatesFile)
+	if err != nil {
+		logger.Errorf("failed to configure currency rates: %s", err)
+		os.Exit(-1)
+	}
+
+	rounding, err := money.ParseRoundingMode(cfg.Rounding)
+	if err != nil {
+		logger.Errorf("failed to configure rounding: %s", err)
+		os.Exit(-1)
+	}
+
 	// connect to the database
 	db, err := dbx.MustOpen("postgres", cfg.DSN)
 	if err != nil {
@@ -53,11 +72,25 @@ func main() {
 		}
 	}()
 
+	// the balances must be backed by the ledger, the ones created before it are backfilled by a separate command
+	if err := checkLedger(dbcontext.New(db), logger); err != nil {
+		logger.Errorf("failed to check the ledger: %s", err)
+		os.Exit(-1)
+	}
+
+	// fetched rates are kept in the database to convert amounts as of past dates
+	ratesRepository := rates.NewRepository(dbcontext.New(db), logger)
+	ratesService := rates.NewService(cfg.RatesExpiration, cfg.RatesMaxStale, cfg.RatesTimeout, ratesProvider, ratesRepository, logger)
+	go ratesService.KeepFresh(context.Background(), cfg.RatesRefreshAhead)
+
+	// quotes which were not used in time are marked expired in the background, at most one lifetime late
+	go quote.KeepExpired(context.Background(), quote.NewExpirer(dbcontext.New(db), logger), cfg.QuoteExpiration, logger)
+
 	// build HTTP server
 	address := fmt.Sprintf(":%v", cfg.ServerPort)
 	hs := &http.Server{
 		Addr:    address,
-		Handler: buildHandler(logger, dbcontext.New(db), cfg),
+		Handler: buildHandler(logger, dbcontext.New(db), cfg, ratesService, rounding),
 	}
 
 	// start the HTTP server with graceful shutdown
@@ -69,8 +102,31 @@ func main() {
 	}
 }
 
+// checkLedger reports every deposit whose balance differs from the sum of its postings.
+// It fails if there are any, nothing is written.
+func checkLedger(db *dbcontext.DB, logger log.Logger) error {
+	ledgerService := ledger.NewService(ledger.NewRepository(db, logger), logger)
+	items, err := ledgerService.Mismatches(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, m := range items {
+		logger.Errorf("%s balance of account %s is %d, but its postings sum up to %d", m.Currency, m.OwnerId, m.Balance, m.LedgerBalance)
+	}
+	if len(items) > 0 {
+		return fmt.Errorf("balances of %d deposits are not backed by the ledger, run backfill-ledger", len(items))
+	}
+	return nil
+}
+
 // buildHandler sets up the HTTP routing and builds an HTTP handler.
-func buildHandler(logger log.Logger, db *dbcontext.DB, cfg *config.Config) http.Handler {
+func buildHandler(
+	logger log.Logger,
+	db *dbcontext.DB,
+	cfg *config.Config,
+	ratesService rates.Service,
+	rounding money.RoundingMode,
+) http.Handler {
 	router := routing.New()
 
 	router.Use(
@@ -82,14 +138,37 @@ func buildHandler(logger log.Logger, db *dbcontext.DB, cfg *config.Config) http.
 
 	rg := router.Group("/v1")
 
+	transactionService := transaction.NewService(transaction.NewRepository(db, logger), rounding, logger)
+	quoteService := quote.NewService(quote.NewRepository(db, logger), ratesService, cfg.QuoteExpiration, rounding, logger)
 	deposit.RegisterHandlers(
 		rg.Group(""),
-		deposit.NewService(deposit.NewRepository(db, logger), rates.NewService(cfg.RatesExpiration, logger), logger),
-		transaction.NewService(transaction.NewRepository(db, logger), logger),
+		deposit.NewService(
+			deposit.NewRepository(db, logger),
+			transactionService,
+			ledger.NewService(ledger.NewRepository(db, logger), logger),
+			reservation.NewService(reservation.NewRepository(db, logger), cfg.ReservationExpiration, logger),
+			idempotency.NewService(idempotency.NewRepository(db, logger), cfg.IdempotencyKeyExpiration, logger),
+			ratesService,
+			quoteService,
+			cfg.MaxBatchSize,
+			entity.SpendingLimits{
+				DailyAmountLimit:   cfg.DailyAmountLimit,
+				DailyCountLimit:    cfg.DailyCountLimit,
+				MonthlyAmountLimit: cfg.MonthlyAmountLimit,
+				MonthlyCountLimit:  cfg.MonthlyCountLimit,
+			},
+			rounding,
+			logger,
+		),
+		transactionService,
 		logger,
 		db.TransactionHandler(),
+		db.ReadOnlyTransactionHandler(),
 	)
 
+	rates.RegisterHandlers(rg.Group(""), ratesService, logger)
+	quote.RegisterHandlers(rg.Group(""), quoteService, logger)
+
 	return router
 }
 
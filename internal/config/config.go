@@ -17,6 +17,39 @@ type Config struct {
 	ServerPort int `yaml:"server_port" env:"SERVER_PORT"`
 	// the expiration time of currency rates. Defaults to 10 minutes.
 	RatesExpiration time.Duration `yaml:"rates_expiration"`
+	// the time during which expired currency rates are still used if they can't be fetched. Defaults to 1 hour.
+	RatesMaxStale time.Duration `yaml:"rates_max_stale"`
+	// the time before the expiration of currency rates when they are refreshed in the background. Zero disables
+	// the refresh. Defaults to 1 minute.
+	RatesRefreshAhead time.Duration `yaml:"rates_refresh_ahead"`
+	// the timeout of fetching currency rates. Defaults to 10 seconds.
+	RatesTimeout time.Duration `yaml:"rates_timeout"`
+	// the source of currency rates: exchangerate.host, cbr or file. Defaults to exchangerate.host.
+	RatesProvider string `yaml:"rates_provider" env:"RATES_PROVIDER"`
+	// the address of the exchangerate.host or cbr provider. Defaults to the public address of the provider.
+	RatesURL string `yaml:"rates_url" env:"RATES_URL"`
+	// the path to the YAML or JSON file with currency rates. Required for the file provider.
+	RatesFile string `yaml:"rates_file" env:"RATES_FILE"`
+	// the rounding of balances converted into another currency: half_even, half_up or down. Defaults to half_even.
+	Rounding string `yaml:"rounding" env:"ROUNDING"`
+	// the time after which uncaptured reservations expire. Defaults to 30 minutes.
+	ReservationExpiration time.Duration `yaml:"reservation_expiration"`
+	// the time during which exchange rate quotes can be used by transfers. Defaults to 1 minute.
+	QuoteExpiration time.Duration `yaml:"quote_expiration"`
+	// the time during which idempotency keys can't be reused for other requests. Defaults to 24 hours.
+	IdempotencyKeyExpiration time.Duration `yaml:"idempotency_key_expiration"`
+	// the maximum number of operations in a batch request. Defaults to 100.
+	MaxBatchSize int `yaml:"max_batch_size"`
+	// the default limit of money withdrawn or transferred by a user during a day, in minor units of the default
+	// currency. Zero means no limit.
+	DailyAmountLimit int64 `yaml:"daily_amount_limit"`
+	// the default limit of withdrawals and transfers made by a user during a day. Zero means no limit.
+	DailyCountLimit int64 `yaml:"daily_count_limit"`
+	// the default limit of money withdrawn or transferred by a user during a month, in minor units of the default
+	// currency. Zero means no limit.
+	MonthlyAmountLimit int64 `yaml:"monthly_amount_limit"`
+	// the default limit of withdrawals and transfers made by a user during a month. Zero means no limit.
+	MonthlyCountLimit int64 `yaml:"monthly_count_limit"`
 	// the data source name (DSN) for connecting to the database. Required.
 	DSN string `yaml:"dsn"`
 }
@@ -25,8 +58,17 @@ type Config struct {
 func Load(file string, logger log.Logger) (*Config, error) {
 	// default config
 	c := Config{
-		ServerPort:      defaultServerPort,
-		RatesExpiration: 10 * time.Minute,
+		ServerPort:               defaultServerPort,
+		RatesExpiration:          10 * time.Minute,
+		RatesMaxStale:            time.Hour,
+		RatesRefreshAhead:        time.Minute,
+		RatesTimeout:             10 * time.Second,
+		RatesProvider:            "exchangerate.host",
+		Rounding:                 "half_even",
+		ReservationExpiration:    30 * time.Minute,
+		QuoteExpiration:          time.Minute,
+		IdempotencyKeyExpiration: 24 * time.Hour,
+		MaxBatchSize:             100,
 	}
 
 	// load from YAML config file
@@ -1,13 +1,22 @@
 package deposit
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
 	"github.com/go-ozzo/ozzo-routing/v2"
 	"users-balance-microservice/internal/errors"
 	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/internal/statement"
 	"users-balance-microservice/internal/transaction"
 	"users-balance-microservice/pkg/log"
 )
 
+// idempotencyKeyHeader is the HTTP header which can be used instead of the idempotency_key request field.
+const idempotencyKeyHeader = "Idempotency-Key"
+
 // RegisterHandlers sets up the routing of the HTTP handlers.
 func RegisterHandlers(
 	r *routing.RouteGroup,
@@ -15,13 +24,31 @@ func RegisterHandlers(
 	transactionService transaction.Service,
 	logger log.Logger,
 	transactionHandler routing.Handler,
+	readOnlyTransactionHandler routing.Handler,
 ) {
 	res := resource{depositService, transactionService, logger}
 
 	r.Post("/deposits/balance", res.getBalance)
 	r.Post("/deposits/update", transactionHandler, res.updateBalance)
 	r.Post("/deposits/transfer", transactionHandler, res.transfer)
+	r.Post("/deposits/transfers/batch", transactionHandler, res.batch)
 	r.Post("/deposits/history", res.history)
+	r.Post("/deposits/analytics", res.analytics)
+	r.Post("/deposits/statement", readOnlyTransactionHandler, res.statement)
+	r.Post("/deposits/reserve", transactionHandler, res.reserve)
+	r.Post("/reservations/<id>/capture", transactionHandler, res.capture)
+	r.Post("/reservations/<id>/release", transactionHandler, res.release)
+	r.Get("/transactions/<id>", res.getTransaction)
+	r.Post("/transactions/batch", res.getTransactions)
+	r.Get("/transactions/<id>/status-history", res.statusHistory)
+	r.Post("/transactions/<id>/complete", transactionHandler, res.complete)
+	r.Post("/transactions/<id>/fail", transactionHandler, res.fail)
+	r.Post("/transactions/<id>/reverse", transactionHandler, res.reverse)
+
+	// administration
+	r.Post("/admin/deposits/credit-limit", transactionHandler, res.setCreditLimit)
+	r.Post("/admin/deposits/status", transactionHandler, res.setStatus)
+	r.Post("/admin/deposits/spending-limits", transactionHandler, res.setSpendingLimits)
 }
 
 type resource struct {
@@ -50,12 +77,11 @@ func (r resource) updateBalance(c *routing.Context) error {
 		r.logger.With(c.Request.Context()).Info(err)
 		return errors.BadRequest("")
 	}
-
-	err := r.depositService.Update(c.Request.Context(), input)
-	if err != nil {
-		return err
+	if input.IdempotencyKey == "" {
+		input.IdempotencyKey = c.Request.Header.Get(idempotencyKeyHeader)
 	}
-	tx, err := r.transactionService.CreateUpdateTransaction(c.Request.Context(), input)
+
+	tx, err := r.depositService.Update(c.Request.Context(), input)
 	if err != nil {
 		return err
 	}
@@ -68,16 +94,29 @@ func (r resource) transfer(c *routing.Context) error {
 		r.logger.With(c.Request.Context()).Info(err)
 		return errors.BadRequest("")
 	}
+	if input.IdempotencyKey == "" {
+		input.IdempotencyKey = c.Request.Header.Get(idempotencyKeyHeader)
+	}
 
-	err := r.depositService.Transfer(c.Request.Context(), input)
+	tx, err := r.depositService.Transfer(c.Request.Context(), input)
 	if err != nil {
 		return err
 	}
-	tx, err := r.transactionService.CreateTransferTransaction(c.Request.Context(), input)
+	return c.Write(tx)
+}
+
+func (r resource) batch(c *routing.Context) error {
+	var input requests.BatchRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	transactions, err := r.depositService.Batch(c.Request.Context(), input)
 	if err != nil {
 		return err
 	}
-	return c.Write(tx)
+	return c.Write(transactions)
 }
 
 func (r resource) history(c *routing.Context) error {
@@ -87,9 +126,249 @@ func (r resource) history(c *routing.Context) error {
 		return errors.BadRequest("")
 	}
 
-	transactions, err := r.transactionService.GetHistory(c.Request.Context(), input)
+	transactions, err := r.depositService.GetHistory(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(transactions)
+}
+
+func (r resource) analytics(c *routing.Context) error {
+	var input requests.AnalyticsRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	analytics, err := r.transactionService.GetAnalytics(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(analytics)
+}
+
+func (r resource) reserve(c *routing.Context) error {
+	var input requests.ReserveRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	res, err := r.depositService.Reserve(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(res)
+}
+
+func (r resource) capture(c *routing.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+	// empty body means capturing all the remaining reserved money
+	var input requests.CaptureRequest
+	if err := c.Read(&input); err != nil && err != io.EOF {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	tx, err := r.depositService.Capture(c.Request.Context(), id, input)
+	if err != nil {
+		return err
+	}
+	return c.Write(tx)
+}
+
+func (r resource) release(c *routing.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+
+	res, err := r.depositService.Release(c.Request.Context(), id)
+	if err != nil {
+		return err
+	}
+	return c.Write(res)
+}
+
+func (r resource) getTransaction(c *routing.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+
+	input := requests.GetTransactionsRequest{Ids: []int64{id}, OwnerId: c.Query("owner_id")}
+	transactions, err := r.transactionService.GetMany(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(transactions[0])
+}
+
+func (r resource) getTransactions(c *routing.Context) error {
+	var input requests.GetTransactionsRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	transactions, err := r.transactionService.GetMany(c.Request.Context(), input)
 	if err != nil {
 		return err
 	}
 	return c.Write(transactions)
+}
+
+func (r resource) reverse(c *routing.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+	// empty body means reversing all the remaining amount of the transaction
+	var input requests.ReverseRequest
+	if err := c.Read(&input); err != nil && err != io.EOF {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	tx, err := r.depositService.Reverse(c.Request.Context(), id, input)
+	if err != nil {
+		return err
+	}
+	return c.Write(tx)
+}
+
+func (r resource) statusHistory(c *routing.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+
+	// the transactions of other users are reported as missing
+	if ownerId := c.Query("owner_id"); ownerId != "" {
+		input := requests.GetTransactionsRequest{Ids: []int64{id}, OwnerId: ownerId}
+		if _, err = r.transactionService.GetMany(c.Request.Context(), input); err != nil {
+			return err
+		}
+	}
+
+	changes, err := r.transactionService.StatusHistory(c.Request.Context(), id)
+	if err != nil {
+		return err
+	}
+	return c.Write(changes)
+}
+
+func (r resource) complete(c *routing.Context) error {
+	return r.changeStatus(c, r.depositService.Complete)
+}
+
+func (r resource) fail(c *routing.Context) error {
+	return r.changeStatus(c, r.depositService.Fail)
+}
+
+// changeStatus reads ChangeTransactionStatusRequest for the transaction with the id from the URL and applies
+// the change. Empty body is allowed, since the reason is optional.
+func (r resource) changeStatus(
+	c *routing.Context,
+	change func(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (transaction.Transaction, error),
+) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+	var input requests.ChangeTransactionStatusRequest
+	if err := c.Read(&input); err != nil && err != io.EOF {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	tx, err := change(c.Request.Context(), id, input)
+	if err != nil {
+		return err
+	}
+	return c.Write(tx)
+}
+
+func (r resource) setCreditLimit(c *routing.Context) error {
+	var input requests.SetCreditLimitRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	dep, err := r.depositService.SetCreditLimit(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(dep)
+}
+
+func (r resource) setStatus(c *routing.Context) error {
+	var input requests.SetStatusRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	dep, err := r.depositService.SetStatus(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(dep)
+}
+
+func (r resource) setSpendingLimits(c *routing.Context) error {
+	var input requests.SetSpendingLimitsRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	dep, err := r.depositService.SetSpendingLimits(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(dep)
+}
+
+func (r resource) statement(c *routing.Context) error {
+	var input requests.StatementRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if input.Format == "" {
+		input.Format = statement.FormatOf(c.Request.Header.Get("Accept"))
+	}
+	if input.Format == "" {
+		input.Format = statement.FormatCSV
+	}
+
+	w := &statementWriter{res: c.Response, contentType: statement.ContentType(input.Format)}
+	err := r.depositService.Statement(c.Request.Context(), input, w)
+	if err != nil && w.written {
+		// the statement is partially sent, so the error can't be reported to the client anymore
+		r.logger.With(c.Request.Context()).Errorf("failed writing statement: %v", err)
+		return nil
+	}
+	return err
+}
+
+// statementWriter sets the Content-Type of a statement right before its first byte is written,
+// so that errors occurred before that are still sent as JSON.
+type statementWriter struct {
+	res         http.ResponseWriter
+	contentType string
+	written     bool
+}
+
+func (w *statementWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.res.Header().Set("Content-Type", w.contentType)
+		w.written = true
+	}
+	return w.res.Write(p)
 }
\ No newline at end of file
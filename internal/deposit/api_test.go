@@ -2,12 +2,19 @@ package deposit
 
 import (
 	"context"
+	"database/sql"
 	"net/http"
 	"testing"
+	"time"
 
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	"github.com/google/uuid"
 	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/idempotency"
+	"users-balance-microservice/internal/ledger"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/quote"
+	"users-balance-microservice/internal/reservation"
 	"users-balance-microservice/internal/test"
 	"users-balance-microservice/internal/transaction"
 	"users-balance-microservice/pkg/log"
@@ -19,23 +26,39 @@ const badRequestResponse = `{"status":400,"message":"Your request is in a bad fo
 func TestAPI(t *testing.T) {
 	logger, _ := log.NewForTest()
 	router := test.MockRouter(logger)
-	depositRepo := &mockDepositRepository{
-		items: []entity.Deposit{
-			{uuid.MustParse("615f3e76-37d3-11ec-8d3d-0242ac130003"), 1000},
-		},
+	deposits := []entity.Deposit{
+		{OwnerId: uuid.MustParse("615f3e76-37d3-11ec-8d3d-0242ac130003"), Currency: "RUB", Balance: 1000},
 	}
+	depositRepo := &mockDepositRepository{items: deposits}
 	transactionRepo := mockTransactionRepository{
 		items: []entity.Transaction{},
 	}
+	transactionService := transaction.NewService(&transactionRepo, money.RoundHalfEven, logger)
+	ledgerService := ledger.NewService(newMockLedgerRepository(deposits...), logger)
+	reservationService := reservation.NewService(&mockReservationRepository{}, time.Hour, logger)
+	idempotencyService := idempotency.NewService(&mockIdempotencyKeyRepository{}, time.Hour, logger)
 	exchangeService := mockExchangeRatesService{}
 	transactionHandler := func(c *routing.Context) error { return c.Next() }
 
 	RegisterHandlers(
 		router.Group(""),
-		NewService(depositRepo, exchangeService, logger),
-		transaction.NewService(&transactionRepo, logger),
+		NewService(
+			depositRepo,
+			transactionService,
+			ledgerService,
+			reservationService,
+			idempotencyService,
+			exchangeService,
+			quote.NewService(&mockQuoteRepository{}, exchangeService, time.Hour, money.RoundHalfEven, logger),
+			maxBatchSize,
+			entity.SpendingLimits{},
+			money.RoundHalfEven,
+			logger,
+		),
+		transactionService,
 		logger,
 		transactionHandler,
+		transactionHandler,
 	)
 
 	tests := []test.APITestCase{
@@ -45,7 +68,23 @@ func TestAPI(t *testing.T) {
 			"/deposits/balance",
 			`{"owner_id": "615f3e76-37d3-11ec-8d3d-0242ac130003"}`,
 			http.StatusOK,
-			`1000`,
+			`{"total":{"amount":"10.00","currency":"RUB"},"available":{"amount":"10.00","currency":"RUB"},"deposits":[{"currency":"RUB","total":{"amount":"10.00","currency":"RUB"},"available":{"amount":"10.00","currency":"RUB"}}]}`,
+		},
+		{
+			"get balance success in several currencies",
+			"POST",
+			"/deposits/balance",
+			`{"owner_id": "615f3e76-37d3-11ec-8d3d-0242ac130003","currencies":["USD"]}`,
+			http.StatusOK,
+			`{"total":{"amount":"10.00","currency":"RUB"},"available":{"amount":"10.00","currency":"RUB"},"deposits":[{"currency":"RUB","total":{"amount":"10.00","currency":"RUB"},"available":{"amount":"10.00","currency":"RUB"}}],"converted":{"USD":{"total":{"amount":"1.00","currency":"USD"},"available":{"amount":"1.00","currency":"USD"},"rate":0.1,"rate_timestamp":"2021-11-10T12:00:00Z"}}}`,
+		},
+		{
+			"get balance failure invalid currencies",
+			"POST",
+			"/deposits/balance",
+			`{"owner_id": "615f3e76-37d3-11ec-8d3d-0242ac130003","currencies":["US"]}`,
+			http.StatusBadRequest,
+			`*"field":"currencies"*`,
 		},
 		{
 			"get balance success non-existing Deposit",
@@ -53,7 +92,7 @@ func TestAPI(t *testing.T) {
 			"/deposits/balance",
 			`{"owner_id": "8c5593a0-37d3-11ec-8d3d-0242ac130003"}`,
 			http.StatusOK,
-			`0`,
+			`{"total":{"amount":"0.00","currency":"RUB"},"available":{"amount":"0.00","currency":"RUB"}}`,
 		},
 		{
 			"get balance failure invalid owner_id",
@@ -95,6 +134,22 @@ func TestAPI(t *testing.T) {
 			http.StatusOK,
 			"",
 		},
+		{
+			"update balance success with metadata and tags",
+			"POST",
+			"/deposits/update",
+			`{"owner_id":"9b3a4c5d-37d3-11ec-8d3d-0242ac130009","amount":100,"metadata":{"order_id":"42"},"tags":["promo"]}`,
+			http.StatusOK,
+			`*"metadata":{"order_id":"42"},"tags":["promo"]*`,
+		},
+		{
+			"update balance failure invalid metadata",
+			"POST",
+			"/deposits/update",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","amount":100,"metadata":{"":"42"}}`,
+			http.StatusBadRequest,
+			`*"field":"metadata"*`,
+		},
 		{
 			"update balance failure not enough funds",
 			"POST",
@@ -143,13 +198,125 @@ func TestAPI(t *testing.T) {
 			http.StatusForbidden,
 			"",
 		},
+		{
+			"transfer successful with idempotency key",
+			"POST",
+			"/deposits/transfer",
+			`{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"11111111-37d3-11ec-8d3d-0242ac130003","amount":100,"idempotency_key":"transfer-1"}`,
+			http.StatusOK,
+			"",
+		},
+		{
+			"transfer replay with idempotency key",
+			"POST",
+			"/deposits/transfer",
+			`{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"11111111-37d3-11ec-8d3d-0242ac130003","amount":100,"idempotency_key":"transfer-1"}`,
+			http.StatusOK,
+			"",
+		},
+		{
+			"transfer failure idempotency key reused with different payload",
+			"POST",
+			"/deposits/transfer",
+			`{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"11111111-37d3-11ec-8d3d-0242ac130003","amount":200,"idempotency_key":"transfer-1"}`,
+			http.StatusConflict,
+			"",
+		},
+		{
+			"reverse success partial",
+			"POST",
+			"/transactions/1/reverse",
+			`{"amount":100}`,
+			http.StatusOK,
+			`*"reversal_of":1*`,
+		},
+		{
+			"reverse failure amount exceeds remaining",
+			"POST",
+			"/transactions/1/reverse",
+			`{"amount":1000}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"reverse failure not found",
+			"POST",
+			"/transactions/1000/reverse",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"get transaction success",
+			"GET",
+			"/transactions/1",
+			"",
+			http.StatusOK,
+			`*"id":1,*`,
+		},
+		{
+			"get transaction success with owner",
+			"GET",
+			"/transactions/1?owner_id=615f3e76-37d3-11ec-8d3d-0242ac130003",
+			"",
+			http.StatusOK,
+			`*"id":1,*`,
+		},
+		{
+			"get transaction failure owner is not a party",
+			"GET",
+			"/transactions/1?owner_id=11112222-3333-4444-5555-666677778888",
+			"",
+			http.StatusNotFound,
+			`{"status":404,"message":"Transaction 1 is not found."}`,
+		},
+		{
+			"get transaction failure invalid owner_id",
+			"GET",
+			"/transactions/1?owner_id=123-456-789",
+			"",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"get transaction failure not found",
+			"GET",
+			"/transactions/1000",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"get transactions success",
+			"POST",
+			"/transactions/batch",
+			`{"ids":[2,1],"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003"}`,
+			http.StatusOK,
+			`*"id":2,*`,
+		},
+		{
+			"get transactions failure not found",
+			"POST",
+			"/transactions/batch",
+			`{"ids":[1,999,1000]}`,
+			http.StatusNotFound,
+			`{"status":404,"message":"Transactions 999, 1000 are not found."}`,
+		},
+		{
+			"get transactions failure no ids",
+			"POST",
+			"/transactions/batch",
+			`{"ids":[]}`,
+			http.StatusBadRequest,
+			"",
+		},
 		{
 			"getHistory success",
 			"POST",
 			"/deposits/history",
 			`{"owner_id":"11112222-3333-4444-5555-666677778888"}`,
 			http.StatusOK,
-			"",
+			`{"transactions":[],"has_more":false}`,
 		},
 		{
 			"getHistory fail invalid owner_id",
@@ -159,6 +326,46 @@ func TestAPI(t *testing.T) {
 			http.StatusBadRequest,
 			"",
 		},
+		{
+			"getHistory success with filters",
+			"POST",
+			"/deposits/history",
+			`{"owner_id":"11112222-3333-4444-5555-666677778888","date_from":"2021-11-01T00:00:00Z","types":["top_up"],"min_amount":100}`,
+			http.StatusOK,
+			"",
+		},
+		{
+			"getHistory success converted",
+			"POST",
+			"/deposits/history",
+			`{"owner_id":"11112222-3333-4444-5555-666677778888","convert_to":"USD"}`,
+			http.StatusOK,
+			`{"transactions":[],"has_more":false,"converted_currency":"USD"}`,
+		},
+		{
+			"getHistory fail invalid convert_to",
+			"POST",
+			"/deposits/history",
+			`{"owner_id":"11112222-3333-4444-5555-666677778888","convert_to":"XX"}`,
+			http.StatusBadRequest,
+			`*"field":"convert_to"*`,
+		},
+		{
+			"getHistory fail invalid cursor",
+			"POST",
+			"/deposits/history",
+			`{"owner_id":"11112222-3333-4444-5555-666677778888","cursor":"not a cursor"}`,
+			http.StatusBadRequest,
+			`{"status":400,"message":"Invalid cursor."}`,
+		},
+		{
+			"getHistory fail invalid filter",
+			"POST",
+			"/deposits/history",
+			`{"owner_id":"11112222-3333-4444-5555-666677778888","types":["refund"]}`,
+			http.StatusBadRequest,
+			`*"field":"types"*`,
+		},
 		{
 			"getHistory fail invalid request",
 			"POST",
@@ -167,6 +374,382 @@ func TestAPI(t *testing.T) {
 			http.StatusBadRequest,
 			"",
 		},
+		{
+			"analytics success",
+			"POST",
+			"/deposits/analytics",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","date_from":"2021-11-01","date_to":"2021-11-30","interval":"month","group_by":"counterparty"}`,
+			http.StatusOK,
+			`{"currency":"RUB","interval":"month","group_by":"counterparty","buckets":[]}`,
+		},
+		{
+			"analytics failure unknown interval",
+			"POST",
+			"/deposits/analytics",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","date_from":"2021-11-01","date_to":"2021-11-30","interval":"year"}`,
+			http.StatusBadRequest,
+			`*"field":"interval"*`,
+		},
+		{
+			"statement success CSV by default",
+			"POST",
+			"/deposits/statement",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","date_from":"2021-11-01","date_to":"2021-11-30"}`,
+			http.StatusOK,
+			"*2021-11-01T00:00:00Z,,opening_balance,,,RUB,10.00,*",
+		},
+		{
+			"statement success OFX",
+			"POST",
+			"/deposits/statement",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","date_from":"2021-11-01","date_to":"2021-11-30","format":"ofx"}`,
+			http.StatusOK,
+			"*<BALAMT>10.00</BALAMT>*",
+		},
+		{
+			"statement fail invalid format",
+			"POST",
+			"/deposits/statement",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","date_from":"2021-11-01","date_to":"2021-11-30","format":"pdf"}`,
+			http.StatusBadRequest,
+			`*"field":"format"*`,
+		},
+		{
+			"statement fail invalid request",
+			"POST",
+			"/deposits/statement",
+			`{owner_id: 123-456-789}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"reserve success",
+			"POST",
+			"/deposits/reserve",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","amount":300,"description":"order #1"}`,
+			http.StatusOK,
+			`*"status":"active"*`,
+		},
+		{
+			"reserve failure insufficient funds",
+			"POST",
+			"/deposits/reserve",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","amount":100000}`,
+			http.StatusForbidden,
+			"",
+		},
+		{
+			"reserve failure invalid request",
+			"POST",
+			"/deposits/reserve",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","amount":-300}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"get balance success with reserved funds",
+			"POST",
+			"/deposits/balance",
+			`{"owner_id": "615f3e76-37d3-11ec-8d3d-0242ac130003"}`,
+			http.StatusOK,
+			`{"total":{"amount":"7.00","currency":"RUB"},"available":{"amount":"4.00","currency":"RUB"},"deposits":[{"currency":"RUB","total":{"amount":"7.00","currency":"RUB"},"available":{"amount":"4.00","currency":"RUB"}}]}`,
+		},
+		{
+			"capture success partial",
+			"POST",
+			"/reservations/1/capture",
+			`{"amount":100}`,
+			http.StatusOK,
+			`*"amount":100*`,
+		},
+		{
+			"capture failure amount exceeds reserved",
+			"POST",
+			"/reservations/1/capture",
+			`{"amount":1000}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"capture failure not found",
+			"POST",
+			"/reservations/100/capture",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"release success",
+			"POST",
+			"/reservations/1/release",
+			"",
+			http.StatusOK,
+			`*"status":"released"*`,
+		},
+		{
+			"release failure already released",
+			"POST",
+			"/reservations/1/release",
+			"",
+			http.StatusConflict,
+			"",
+		},
+		{
+			"capture failure invalid id",
+			"POST",
+			"/reservations/abc/capture",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"transfer success cross-currency",
+			"POST",
+			"/deposits/transfer",
+			`{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"22222222-37d3-11ec-8d3d-0242ac130003","amount":100,"recipient_currency":"USD"}`,
+			http.StatusOK,
+			`*"recipient_amount":10,"exchange_rate":0.1*`,
+		},
+		{
+			"transfer failure invalid currency",
+			"POST",
+			"/deposits/transfer",
+			`{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"22222222-37d3-11ec-8d3d-0242ac130003","amount":100,"currency":"RUBLES"}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"transfer failure unknown quote",
+			"POST",
+			"/deposits/transfer",
+			`{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"22222222-37d3-11ec-8d3d-0242ac130003","amount":100,"recipient_currency":"USD","quote_id":"9b3a4c5d-37d3-11ec-8d3d-0242ac130011"}`,
+			http.StatusNotFound,
+			`{"status":404,"message":"Quote not found."}`,
+		},
+		{
+			"transfer failure invalid quote id",
+			"POST",
+			"/deposits/transfer",
+			`{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"22222222-37d3-11ec-8d3d-0242ac130003","amount":100,"recipient_currency":"USD","quote_id":"quote-1"}`,
+			http.StatusBadRequest,
+			`*"field":"quote_id"*`,
+		},
+		{
+			"batch success",
+			"POST",
+			"/deposits/transfers/batch",
+			`{"operations":[{"update":{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","amount":100}},{"transfer":{"sender_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","recipient_id":"33333333-37d3-11ec-8d3d-0242ac130003","amount":50}}]}`,
+			http.StatusOK,
+			`*"recipient_id":"33333333-37d3-11ec-8d3d-0242ac130003"*`,
+		},
+		{
+			"batch failure insufficient funds",
+			"POST",
+			"/deposits/transfers/batch",
+			`{"operations":[{"transfer":{"sender_id":"33333333-37d3-11ec-8d3d-0242ac130003","recipient_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","amount":100000}}]}`,
+			http.StatusForbidden,
+			`*"details":[{"index":0,"status":403,"message":"Insufficient funds to perform operation."}]*`,
+		},
+		{
+			"batch failure invalid operation",
+			"POST",
+			"/deposits/transfers/batch",
+			`{"operations":[{"update":{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","amount":100}},{}]}`,
+			http.StatusBadRequest,
+			`*"index":1*`,
+		},
+		{
+			"batch failure empty",
+			"POST",
+			"/deposits/transfers/batch",
+			`{"operations":[]}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"set credit limit success",
+			"POST",
+			"/admin/deposits/credit-limit",
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","credit_limit":1000}`,
+			http.StatusOK,
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","currency":"RUB","balance":50,"credit_limit":1000,"status":"active"}`,
+		},
+		{
+			"set credit limit failure negative limit",
+			"POST",
+			"/admin/deposits/credit-limit",
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","credit_limit":-1000}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"get balance success with credit limit",
+			"POST",
+			"/deposits/balance",
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003"}`,
+			http.StatusOK,
+			`{"total":{"amount":"0.50","currency":"RUB"},"available":{"amount":"10.50","currency":"RUB"},"deposits":[{"currency":"RUB","total":{"amount":"0.50","currency":"RUB"},"available":{"amount":"10.50","currency":"RUB"},"credit_limit":{"amount":"10.00","currency":"RUB"}}]}`,
+		},
+		{
+			"get balance success in deposit's currency",
+			"POST",
+			"/deposits/balance",
+			`{"owner_id":"22222222-37d3-11ec-8d3d-0242ac130003","currency":"USD"}`,
+			http.StatusOK,
+			`{"total":{"amount":"0.10","currency":"USD"},"available":{"amount":"0.10","currency":"USD"},"deposits":[{"currency":"USD","total":{"amount":"0.10","currency":"USD"},"available":{"amount":"0.10","currency":"USD"}}]}`,
+		},
+		{
+			"set status success",
+			"POST",
+			"/admin/deposits/status",
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","status":"frozen_debit","changed_by":"support","reason":"fraud investigation"}`,
+			http.StatusOK,
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","currency":"RUB","balance":50,"credit_limit":1000,"status":"frozen_debit"}`,
+		},
+		{
+			"update balance failure frozen deposit",
+			"POST",
+			"/deposits/update",
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","amount":-10}`,
+			http.StatusForbidden,
+			`{"status":403,"message":"The RUB deposit of user 33333333-37d3-11ec-8d3d-0242ac130003 is frozen_debit.","details":{"reason":"account_blocked"}}`,
+		},
+		{
+			"set status failure closing non-zero balance",
+			"POST",
+			"/admin/deposits/status",
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","status":"closed","changed_by":"support","reason":"user request"}`,
+			http.StatusConflict,
+			`{"status":409,"message":"Deposit with a non-zero balance can't be closed."}`,
+		},
+		{
+			"set spending limits success",
+			"POST",
+			"/admin/deposits/spending-limits",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","daily_amount_limit":100000,"daily_count_limit":20}`,
+			http.StatusOK,
+			`*"daily_amount_limit":100000,"daily_count_limit":20*`,
+		},
+		{
+			"set spending limits failure negative limit",
+			"POST",
+			"/admin/deposits/spending-limits",
+			`{"owner_id":"615f3e76-37d3-11ec-8d3d-0242ac130003","monthly_count_limit":-1}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"set status failure missing reason",
+			"POST",
+			"/admin/deposits/status",
+			`{"owner_id":"33333333-37d3-11ec-8d3d-0242ac130003","status":"active","changed_by":"support"}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"update balance success pending top-up",
+			"POST",
+			"/deposits/update",
+			`{"owner_id":"9b3a4c5d-37d3-11ec-8d3d-0242ac130010","amount":700,"pending":true}`,
+			http.StatusOK,
+			`*"status":"pending"*`,
+		},
+		{
+			"complete success",
+			"POST",
+			"/transactions/13/complete",
+			`{"reason":"confirmed by the bank"}`,
+			http.StatusOK,
+			`*"status":"completed"}*`,
+		},
+		{
+			"complete failure not pending",
+			"POST",
+			"/transactions/13/complete",
+			"",
+			http.StatusConflict,
+			"",
+		},
+		{
+			"update balance success pending withdrawal",
+			"POST",
+			"/deposits/update",
+			`{"owner_id":"9b3a4c5d-37d3-11ec-8d3d-0242ac130010","amount":-300,"pending":true}`,
+			http.StatusOK,
+			`*"status":"pending"}*`,
+		},
+		{
+			"get balance success with pending",
+			"POST",
+			"/deposits/balance",
+			`{"owner_id":"9b3a4c5d-37d3-11ec-8d3d-0242ac130010"}`,
+			http.StatusOK,
+			`{"total":{"amount":"7.00","currency":"RUB"},"available":{"amount":"4.00","currency":"RUB"},"deposits":[{"currency":"RUB","total":{"amount":"7.00","currency":"RUB"},"available":{"amount":"4.00","currency":"RUB"},"pending":{"amount":"3.00","currency":"RUB"}}]}`,
+		},
+		{
+			"fail success",
+			"POST",
+			"/transactions/14/fail",
+			`{"reason":"declined"}`,
+			http.StatusOK,
+			`*"status":"failed"*`,
+		},
+		{
+			"fail failure invalid request",
+			"POST",
+			"/transactions/14/fail",
+			`{"reason":`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"fail failure not found",
+			"POST",
+			"/transactions/1000/fail",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"complete failure invalid id",
+			"POST",
+			"/transactions/abc/complete",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"status history success",
+			"GET",
+			"/transactions/14/status-history",
+			"",
+			http.StatusOK,
+			`*"previous_status":"pending","status":"failed","reason":"declined"*`,
+		},
+		{
+			"status history success with owner",
+			"GET",
+			"/transactions/14/status-history?owner_id=9b3a4c5d-37d3-11ec-8d3d-0242ac130010",
+			"",
+			http.StatusOK,
+			`*"status":"failed"*`,
+		},
+		{
+			"status history failure owner is not a party",
+			"GET",
+			"/transactions/14/status-history?owner_id=615f3e76-37d3-11ec-8d3d-0242ac130003",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"status history failure not found",
+			"GET",
+			"/transactions/1000/status-history",
+			"",
+			http.StatusNotFound,
+			"",
+		},
 	}
 
 	for _, tc := range tests {
@@ -177,6 +760,29 @@ func TestAPI(t *testing.T) {
 type mockTransactionRepository struct {
 	items          []entity.Transaction
 	lastInsertedId int64
+	statusChanges  []entity.TransactionStatusChange
+}
+
+func (m *mockTransactionRepository) Get(ctx context.Context, id int64) (entity.Transaction, error) {
+	for _, tx := range m.items {
+		if tx.Id == id {
+			return tx, nil
+		}
+	}
+	return entity.Transaction{}, sql.ErrNoRows
+}
+
+func (m *mockTransactionRepository) GetMany(ctx context.Context, ids []int64) ([]entity.Transaction, error) {
+	var result []entity.Transaction
+	for _, tx := range m.items {
+		for _, id := range ids {
+			if tx.Id == id {
+				result = append(result, tx)
+				break
+			}
+		}
+	}
+	return result, nil
 }
 
 func (m *mockTransactionRepository) Create(ctx context.Context, tx *entity.Transaction) error {
@@ -184,14 +790,51 @@ func (m *mockTransactionRepository) Create(ctx context.Context, tx *entity.Trans
 		return databaseError
 	}
 
-	tx.Id = m.lastInsertedId
+	if tx.Status == "" {
+		tx.Status = entity.TransactionCompleted
+	}
+	if tx.CreatedAt.IsZero() {
+		tx.CreatedAt = tx.TransactionDate
+	}
+
+	// ids are auto-incremented starting from 1, like bigserial does
 	m.lastInsertedId++
+	tx.Id = m.lastInsertedId
 	m.items = append(m.items, *tx)
 	return nil
 }
 
-// Offset, limit and order are ignored for simplicity
-func (m *mockTransactionRepository) GetForUser(ctx context.Context, ownerId uuid.UUID, orderBy, orderDirection string, offset, limit int) ([]entity.Transaction, error) {
+func (m *mockTransactionRepository) Each(ctx context.Context, f func(tx entity.Transaction) error) error {
+	for _, tx := range m.items {
+		if err := f(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Currencies are listed in the order of their first transactions for simplicity.
+func (m *mockTransactionRepository) Outgoing(ctx context.Context, ownerId uuid.UUID, since time.Time) ([]transaction.OutgoingTotal, error) {
+	var result []transaction.OutgoingTotal
+	for _, tx := range m.items {
+		if tx.SenderId != ownerId || tx.RecipientId == ownerId || tx.ReversalOf != 0 || tx.Status == entity.TransactionFailed || tx.CreatedAt.Before(since) {
+			continue
+		}
+		i := 0
+		for i < len(result) && result[i].Currency != tx.Currency {
+			i++
+		}
+		if i == len(result) {
+			result = append(result, transaction.OutgoingTotal{Currency: tx.Currency})
+		}
+		result[i].Amount += tx.Amount
+		result[i].Count++
+	}
+	return result, nil
+}
+
+// Filter, offset, limit and order are ignored for simplicity
+func (m *mockTransactionRepository) GetForUser(ctx context.Context, ownerId uuid.UUID, filter transaction.HistoryFilter, orderBy, orderDirection string, after *transaction.Cursor, offset, limit int) ([]entity.Transaction, error) {
 	var result []entity.Transaction
 
 	for _, tx := range m.items {
@@ -203,6 +846,101 @@ func (m *mockTransactionRepository) GetForUser(ctx context.Context, ownerId uuid
 	return result, nil
 }
 
+// Analytics sums up the transactions of the user by day, regardless of interval and grouping.
+func (m *mockTransactionRepository) Analytics(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, interval, groupBy string) ([]transaction.AnalyticsBucket, error) {
+	// simulate database error
+	if ownerId.String() == "11111111-1111-1111-1111-111111111111" {
+		return nil, databaseError
+	}
+
+	var result []transaction.AnalyticsBucket
+	for _, tx := range m.items {
+		if tx.TransactionDate.Before(from) || !tx.TransactionDate.Before(to) {
+			continue
+		}
+		creditCurrency, amount := tx.Credited()
+		incoming := tx.RecipientId == ownerId && creditCurrency == currency
+		outgoing := tx.SenderId == ownerId && tx.Currency == currency
+		if !incoming && !outgoing {
+			continue
+		}
+
+		day := tx.TransactionDate.Truncate(24 * time.Hour)
+		if len(result) == 0 || !result[len(result)-1].PeriodStart.Equal(day) {
+			result = append(result, transaction.AnalyticsBucket{PeriodStart: day})
+		}
+		bucket := &result[len(result)-1]
+		if incoming {
+			bucket.IncomingAmount += amount
+			bucket.IncomingCount++
+		}
+		if outgoing {
+			bucket.OutgoingAmount += tx.Amount
+			bucket.OutgoingCount++
+		}
+	}
+	return result, nil
+}
+
+func (m *mockTransactionRepository) EachForUser(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, f func(tx entity.Transaction) error) error {
+	for _, tx := range m.items {
+		if !tx.Settled() {
+			continue
+		}
+		creditCurrency, _ := tx.Credited()
+		if !(tx.SenderId == ownerId && tx.Currency == currency || tx.RecipientId == ownerId && creditCurrency == currency) {
+			continue
+		}
+		if tx.TransactionDate.Before(from) || !tx.TransactionDate.Before(to) {
+			continue
+		}
+		if err := f(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockTransactionRepository) Update(ctx context.Context, tx entity.Transaction) error {
+	for i, item := range m.items {
+		if item.Id == tx.Id {
+			m.items[i] = tx
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
 func (m *mockTransactionRepository) Count(ctx context.Context) (int64, error) {
 	return int64(len(m.items)), nil
+}
+
+func (m *mockTransactionRepository) Lock(ctx context.Context, id int64) (entity.Transaction, error) {
+	return m.Get(ctx, id)
+}
+
+func (m *mockTransactionRepository) CreateStatusChange(ctx context.Context, change *entity.TransactionStatusChange) error {
+	change.Id = int64(len(m.statusChanges) + 1)
+	m.statusChanges = append(m.statusChanges, *change)
+	return nil
+}
+
+func (m *mockTransactionRepository) StatusChanges(ctx context.Context, id int64) ([]entity.TransactionStatusChange, error) {
+	var result []entity.TransactionStatusChange
+	for _, change := range m.statusChanges {
+		if change.TransactionId == id {
+			result = append(result, change)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockTransactionRepository) Pending(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error) {
+	var amount int64
+	for _, tx := range m.items {
+		if tx.SenderId == ownerId && tx.Currency == currency && tx.Status == entity.TransactionPending {
+			amount += tx.Amount
+		}
+	}
+	return amount, nil
 }
\ No newline at end of file
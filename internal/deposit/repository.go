@@ -3,6 +3,7 @@ package deposit
 import (
 	"context"
 
+	dbx "github.com/go-ozzo/ozzo-dbx"
 	"github.com/google/uuid"
 	"users-balance-microservice/internal/entity"
 	"users-balance-microservice/pkg/dbcontext"
@@ -11,12 +12,23 @@ import (
 
 // Repository encapsulates the logic to access deposits from the database.
 type Repository interface {
-	// Get returns the Deposit with the specified owner's UUID.
-	Get(ctx context.Context, ownerId uuid.UUID) (entity.Deposit, error)
+	// Get returns the Deposit with the specified owner's UUID in the specified currency.
+	Get(ctx context.Context, ownerId uuid.UUID, currency string) (entity.Deposit, error)
+	// List returns all Deposits of the owner with the specified UUID.
+	List(ctx context.Context, ownerId uuid.UUID) ([]entity.Deposit, error)
+	// Lock returns the Deposit with the specified owner's UUID in the specified currency and locks it until the end
+	// of the DB transaction. If the Deposit does not exist yet, it is created with zero balance.
+	Lock(ctx context.Context, ownerId uuid.UUID, currency string) (entity.Deposit, error)
+	// LockOwner locks all the Deposits of the owner with the specified UUID until the end of the DB transaction
+	// against concurrent calls of LockOwner for the same owner. The rows of the Deposits are not locked.
+	LockOwner(ctx context.Context, ownerId uuid.UUID) error
 	// Create saves a new Deposit in the storage.
 	Create(ctx context.Context, deposit entity.Deposit) error
 	// Update updates the changes to the given Deposit to db.
 	Update(ctx context.Context, deposit entity.Deposit) error
+	// CreateStatusChange saves a new DepositStatusChange in the storage.
+	// DepositStatusChange c is assigned an id from database in case of success.
+	CreateStatusChange(ctx context.Context, c *entity.DepositStatusChange) error
 	// Count returns the number of Deposit records in the database.
 	Count(ctx context.Context) (int64, error)
 }
@@ -32,14 +44,58 @@ func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
 	return repository{db, logger}
 }
 
-// Get reads the Deposit with the specified OwnerId from the database.
-// If Deposit with specified OwnerId does not exist, it is created with balance=0.
-func (r repository) Get(ctx context.Context, ownerId uuid.UUID) (entity.Deposit, error) {
+// Get reads the Deposit with the specified OwnerId and Currency from the database.
+func (r repository) Get(ctx context.Context, ownerId uuid.UUID, currency string) (entity.Deposit, error) {
 	var deposit entity.Deposit
-	err := r.db.With(ctx).Select().Model(ownerId, &deposit)
+	err := r.db.With(ctx).Select().
+		Where(dbx.HashExp{"owner_id": ownerId, "currency": currency}).
+		One(&deposit)
 	return deposit, err
 }
 
+// List reads all Deposits with the specified OwnerId from the database ordered by currency.
+func (r repository) List(ctx context.Context, ownerId uuid.UUID) ([]entity.Deposit, error) {
+	var deposits []entity.Deposit
+	err := r.db.With(ctx).Select().
+		Where(dbx.HashExp{"owner_id": ownerId}).
+		OrderBy("currency").
+		All(&deposits)
+	return deposits, err
+}
+
+// Lock reads the Deposit with the specified OwnerId and Currency from the database and locks its row with
+// SELECT ... FOR UPDATE, so that concurrent DB transactions modifying the same Deposit are serialized.
+// A missing Deposit is inserted first; concurrent inserts of the same Deposit don't conflict on the primary key.
+func (r repository) Lock(ctx context.Context, ownerId uuid.UUID, currency string) (entity.Deposit, error) {
+	var deposit entity.Deposit
+	params := dbx.Params{"owner_id": ownerId, "currency": currency}
+
+	_, err := r.db.With(ctx).
+		NewQuery("INSERT INTO deposit (owner_id, currency, balance) VALUES ({:owner_id}, {:currency}, 0) " +
+			"ON CONFLICT (owner_id, currency) DO NOTHING").
+		Bind(params).
+		Execute()
+	if err != nil {
+		return deposit, err
+	}
+
+	err = r.db.With(ctx).
+		NewQuery("SELECT * FROM deposit WHERE owner_id = {:owner_id} AND currency = {:currency} FOR UPDATE").
+		Bind(params).
+		One(&deposit)
+	return deposit, err
+}
+
+// LockOwner takes a transaction-level advisory lock keyed by the hash of the owner's UUID. Different owners may share
+// a key, which only serializes their operations needlessly.
+func (r repository) LockOwner(ctx context.Context, ownerId uuid.UUID) error {
+	_, err := r.db.With(ctx).
+		NewQuery("SELECT pg_advisory_xact_lock(hashtext({:owner_id}))").
+		Bind(dbx.Params{"owner_id": ownerId.String()}).
+		Execute()
+	return err
+}
+
 // Create saves a new Deposit record in the database.
 func (r repository) Create(ctx context.Context, deposit entity.Deposit) error {
 	return r.db.With(ctx).Model(&deposit).Insert()
@@ -50,6 +106,12 @@ func (r repository) Update(ctx context.Context, deposit entity.Deposit) error {
 	return r.db.With(ctx).Model(&deposit).Update()
 }
 
+// CreateStatusChange saves a new DepositStatusChange record in the database.
+// DepositStatusChange is assigned an auto-incremented id from database.
+func (r repository) CreateStatusChange(ctx context.Context, c *entity.DepositStatusChange) error {
+	return r.db.With(ctx).Model(c).Insert()
+}
+
 // Count returns the number of Deposit records in the database.
 func (r repository) Count(ctx context.Context) (int64, error) {
 	var count int64
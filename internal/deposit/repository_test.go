@@ -3,6 +3,7 @@ package deposit
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -14,13 +15,13 @@ import (
 func TestRepository(t *testing.T) {
 	logger, _ := log.NewForTest()
 	db := test.DB(t)
-	test.ResetTables(t, db, "deposit")
+	test.ResetTables(t, db, "deposit", "deposit_status_change")
 	repo := NewRepository(db, logger)
 
 	ctx := context.Background()
 
 	ownerId := uuid.New()
-	dep := entity.Deposit{OwnerId: ownerId, Balance: 1000}
+	dep := entity.Deposit{OwnerId: ownerId, Currency: "RUB", Balance: 1000, Status: entity.DepositActive}
 
 	// initial count
 	count, err := repo.Count(ctx)
@@ -34,7 +35,7 @@ func TestRepository(t *testing.T) {
 	}
 
 	// get balance
-	dep, err = repo.Get(ctx, ownerId)
+	dep, err = repo.Get(ctx, ownerId, "RUB")
 	if assert.NoError(t, err) {
 		assert.EqualValues(t, 1000, dep.Balance)
 	}
@@ -43,16 +44,74 @@ func TestRepository(t *testing.T) {
 	dep.Balance -= 600
 	err = repo.Update(ctx, dep)
 	if assert.NoError(t, err) {
-		dep, _ = repo.Get(ctx, ownerId)
+		dep, _ = repo.Get(ctx, ownerId, "RUB")
 		assert.EqualValues(t, 400, dep.Balance)
 	}
 
+	// lock existing deposit
+	dep, err = repo.Lock(ctx, ownerId, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 400, dep.Balance)
+	}
+
+	// lock non-existing deposit -> it is created with zero balance
+	newId := uuid.New()
+	dep2, err := repo.Lock(ctx, newId, "RUB")
+	if assert.NoError(t, err) {
+		assert.Equal(t, newId, dep2.OwnerId)
+		assert.Zero(t, dep2.Balance)
+		assert.Equal(t, entity.DepositActive, dep2.Status)
+		count2, _ := repo.Count(ctx)
+		assert.EqualValues(t, 2, count2-count)
+	}
+
+	// the same owner may have a deposit in another currency
+	dep2, err = repo.Lock(ctx, ownerId, "USD")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "USD", dep2.Currency)
+		assert.Zero(t, dep2.Balance)
+	}
+	deps, err := repo.List(ctx, ownerId)
+	if assert.NoError(t, err) && assert.Len(t, deps, 2) {
+		assert.Equal(t, "RUB", deps[0].Currency)
+		assert.Equal(t, "USD", deps[1].Currency)
+	}
+
 	// push an update with negative balance -> get an error, update rejected
 	dep.Balance -= 20000
 	err = repo.Update(ctx, dep)
 	if assert.Error(t, err) {
-		dep, _ = repo.Get(ctx, ownerId)
+		dep, _ = repo.Get(ctx, ownerId, "RUB")
 		assert.EqualValues(t, 400, dep.Balance)
 	}
 
+	// negative balance is allowed within the credit limit
+	dep.CreditLimit = 1000
+	dep.Balance = -1000
+	err = repo.Update(ctx, dep)
+	if assert.NoError(t, err) {
+		dep, _ = repo.Get(ctx, ownerId, "RUB")
+		assert.EqualValues(t, -1000, dep.Balance)
+		assert.EqualValues(t, 1000, dep.CreditLimit)
+	}
+
+	// fail closing a deposit with a non-zero balance
+	dep.Status = entity.DepositClosed
+	err = repo.Update(ctx, dep)
+	assert.Error(t, err)
+
+	// record a status change
+	change := entity.DepositStatusChange{
+		OwnerId:        ownerId,
+		Currency:       "RUB",
+		PreviousStatus: entity.DepositActive,
+		Status:         entity.DepositFrozenAll,
+		ChangedBy:      "support",
+		Reason:         "fraud investigation",
+		ChangedAt:      time.Now().UTC(),
+	}
+	err = repo.CreateStatusChange(ctx, &change)
+	if assert.NoError(t, err) {
+		assert.NotZero(t, change.Id)
+	}
 }
\ No newline at end of file
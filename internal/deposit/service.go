@@ -2,21 +2,45 @@ package deposit
 
 import (
 	"context"
-	"database/sql"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 	"users-balance-microservice/internal/entity"
 	"users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/idempotency"
+	"users-balance-microservice/internal/ledger"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/quote"
 	"users-balance-microservice/internal/rates"
 	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/internal/reservation"
+	"users-balance-microservice/internal/statement"
+	"users-balance-microservice/internal/transaction"
 	"users-balance-microservice/pkg/log"
 )
 
 // Service encapsulates usecase logic for deposits.
 type Service interface {
-	GetBalance(ctx context.Context, req requests.GetBalanceRequest) (float32, error)
-	Update(ctx context.Context, req requests.UpdateBalanceRequest) error
-	Transfer(ctx context.Context, req requests.TransferRequest) error
+	GetBalance(ctx context.Context, req requests.GetBalanceRequest) (Balance, error)
+	Update(ctx context.Context, req requests.UpdateBalanceRequest) (transaction.Transaction, error)
+	Transfer(ctx context.Context, req requests.TransferRequest) (transaction.Transaction, error)
+	Batch(ctx context.Context, req requests.BatchRequest) ([]transaction.Transaction, error)
+	Reserve(ctx context.Context, req requests.ReserveRequest) (reservation.Reservation, error)
+	Capture(ctx context.Context, id int64, req requests.CaptureRequest) (transaction.Transaction, error)
+	Release(ctx context.Context, id int64) (reservation.Reservation, error)
+	SetCreditLimit(ctx context.Context, req requests.SetCreditLimitRequest) (Deposit, error)
+	SetStatus(ctx context.Context, req requests.SetStatusRequest) (Deposit, error)
+	SetSpendingLimits(ctx context.Context, req requests.SetSpendingLimitsRequest) (Deposit, error)
+	Reverse(ctx context.Context, id int64, req requests.ReverseRequest) (transaction.Transaction, error)
+	Complete(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (transaction.Transaction, error)
+	Fail(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (transaction.Transaction, error)
+	Statement(ctx context.Context, req requests.StatementRequest, w io.Writer) error
+	GetHistory(ctx context.Context, req requests.GetHistoryRequest) (transaction.History, error)
 	Count(ctx context.Context) (int64, error)
 }
 
@@ -25,99 +49,1025 @@ type Deposit struct {
 	entity.Deposit
 }
 
-// Transaction represents the data about a transaction.
-type Transaction struct {
-	entity.Transaction
+// Balance represents the balance of all deposits of a user converted into a single currency.
+type Balance struct {
+	// Total is all the money on the deposits, including reserved.
+	Total money.Money `json:"total"`
+	// Available is the money which can be withdrawn or transferred, i.e. Total plus credit limits minus reserved.
+	Available money.Money `json:"available"`
+	// Deposits is the balance of each deposit of the user in its own currency.
+	Deposits []DepositBalance `json:"deposits,omitempty"`
+	// Converted is the balance converted into each of the additionally requested currencies.
+	Converted map[string]ConvertedBalance `json:"converted,omitempty"`
+}
+
+// ConvertedBalance represents the balance of all deposits of a user converted into one of the requested currencies.
+type ConvertedBalance struct {
+	Total     money.Money `json:"total"`
+	Available money.Money `json:"available"`
+	// Rate is the exchange rate of the currency used for conversion: units of it per one unit of
+	// entity.DefaultCurrency.
+	Rate float32 `json:"rate"`
+	// RateTimestamp is the time the Rate was fetched at.
+	RateTimestamp time.Time `json:"rate_timestamp"`
+}
+
+// DepositBalance represents the balance of a single deposit in its own currency.
+type DepositBalance struct {
+	Currency  string      `json:"currency"`
+	Total     money.Money `json:"total"`
+	Available money.Money `json:"available"`
+	// CreditLimit is nil if the deposit has no credit limit.
+	CreditLimit *money.Money `json:"credit_limit,omitempty"`
+	// Pending is the money held by pending withdrawals and outgoing transfers. Nil if there is none.
+	Pending *money.Money `json:"pending,omitempty"`
+}
+
+// account identifies a single Deposit: the owner's money in one currency.
+type account struct {
+	ownerId  uuid.UUID
+	currency string
 }
 
 type service struct {
-	repo            Repository
-	exchangeService rates.ExchangeRatesService
-	logger          log.Logger
+	repo               Repository
+	transactionService transaction.Service
+	ledgerService      ledger.Service
+	reservationService reservation.Service
+	idempotencyService idempotency.Service
+	exchangeService    rates.ExchangeRatesService
+	quoteService       quote.Service
+	maxBatchSize       int
+	spendingLimits     entity.SpendingLimits
+	rounding           money.RoundingMode
+	logger             log.Logger
 }
 
 // NewService creates a new Deposit depositService.
-func NewService(depositRepo Repository, exchangeService rates.ExchangeRatesService, logger log.Logger) Service {
-	return service{depositRepo, exchangeService, logger}
+// Batch requests can't contain more than maxBatchSize operations.
+// spendingLimits apply to every Deposit unless overridden by the Deposit's own limits.
+// Balances converted into another currency are rounded to its minor units with rounding.
+func NewService(
+	depositRepo Repository,
+	transactionService transaction.Service,
+	ledgerService ledger.Service,
+	reservationService reservation.Service,
+	idempotencyService idempotency.Service,
+	exchangeService rates.ExchangeRatesService,
+	quoteService quote.Service,
+	maxBatchSize int,
+	spendingLimits entity.SpendingLimits,
+	rounding money.RoundingMode,
+	logger log.Logger,
+) Service {
+	return service{
+		depositRepo,
+		transactionService,
+		ledgerService,
+		reservationService,
+		idempotencyService,
+		exchangeService,
+		quoteService,
+		maxBatchSize,
+		spendingLimits,
+		rounding,
+		logger,
+	}
 }
 
-func (s service) modifyBalance(ctx context.Context, ownerId uuid.UUID, amount int64) error {
-	dep, err := s.repo.Get(ctx, ownerId)
+// lock locks the owners and the Deposits of the given accounts until the end of the DB transaction, creating missing
+// Deposits. Every owner is locked right before its Deposits. Owners are always locked in the same order, and so are
+// the Deposits of an owner, so that concurrent operations on the same owners (e.g. transfers A->B and B->A, or
+// batches touching A and B in different orders) can't deadlock. The lock of an owner serializes the operations
+// on all its Deposits, e.g. so that they can't exceed the spending limits together.
+// Operations which take more locks afterwards must have taken them all here.
+func (s service) lock(ctx context.Context, accounts ...account) error {
+	sorted := make([]account, 0, len(accounts))
+	for _, a := range accounts {
+		if a.ownerId != uuid.Nil {
+			sorted = append(sorted, a)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ownerId != sorted[j].ownerId {
+			return sorted[i].ownerId.String() < sorted[j].ownerId.String()
+		}
+		return sorted[i].currency < sorted[j].currency
+	})
 
-	// If deposit is not in DB yet, create it.
-	if err == sql.ErrNoRows {
-		dep = entity.Deposit{OwnerId: ownerId}
-		if err = s.repo.Create(ctx, dep); err != nil {
+	for i, a := range sorted {
+		if i == 0 || sorted[i-1].ownerId != a.ownerId {
+			if err := s.repo.LockOwner(ctx, a.ownerId); err != nil {
+				return err
+			}
+		}
+		if _, err := s.repo.Lock(ctx, a.ownerId, a.currency); err != nil {
 			return err
 		}
-	} else if err != nil {
+	}
+	return nil
+}
+
+// blocked returns the error for an operation which is not allowed by the status of the Deposit.
+func blocked(dep entity.Deposit) error {
+	return errors.Blocked(fmt.Sprintf("The %s deposit of user %s is %s.", dep.Currency, dep.OwnerId, dep.Status))
+}
+
+// modifyBalance adds amount to the balance of the Deposit in the given currency, creating the Deposit if it does
+// not exist yet. The Deposit stays locked until the end of the DB transaction.
+func (s service) modifyBalance(ctx context.Context, ownerId uuid.UUID, currency string, amount int64) error {
+	dep, err := s.repo.Lock(ctx, ownerId, currency)
+	if err != nil {
 		return err
 	}
+	if amount < 0 && !dep.CanDebit() || amount > 0 && !dep.CanCredit() {
+		return blocked(dep)
+	}
 
 	dep.Balance += amount
-	if dep.Balance < 0 {
+	if dep.Balance+dep.CreditLimit < 0 {
 		return errors.Forbidden("Insufficient funds to perform operation.")
 	}
 
+	// Withdrawals and transfers can't use money held by reservations and pending transactions.
+	if amount < 0 {
+		held, err := s.held(ctx, ownerId, currency)
+		if err != nil {
+			return err
+		}
+		if dep.Balance+dep.CreditLimit < held {
+			return errors.Forbidden("Insufficient funds to perform operation, some of them are reserved.")
+		}
+	}
+
 	return s.repo.Update(ctx, dep)
 }
 
-// GetBalance returns the balance of the Deposit whose owner whose OwnerId is equal to GetBalanceRequest.OwnerId.
-func (s service) GetBalance(ctx context.Context, req requests.GetBalanceRequest) (float32, error) {
-	if err := req.Validate(); err != nil {
+// held returns the money held on the Deposit of the owner in the given currency by reservations
+// and pending transactions.
+func (s service) held(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error) {
+	reserved, err := s.reservationService.Held(ctx, ownerId, currency)
+	if err != nil {
 		return 0, err
 	}
+	pending, err := s.transactionService.Pending(ctx, ownerId, currency)
+	if err != nil {
+		return 0, err
+	}
+	return reserved + pending, nil
+}
+
+// hold checks that amount can be held on the Deposit of the owner in the given currency, i.e. that the Deposit
+// can be debited and has enough available money. The Deposit stays locked until the end of the DB transaction.
+func (s service) hold(ctx context.Context, ownerId uuid.UUID, currency string, amount int64) error {
+	dep, err := s.repo.Lock(ctx, ownerId, currency)
+	if err != nil {
+		return err
+	}
+	if !dep.CanDebit() {
+		return blocked(dep)
+	}
+	held, err := s.held(ctx, ownerId, currency)
+	if err != nil {
+		return err
+	}
+	if dep.Balance+dep.CreditLimit-held < amount {
+		return errors.Forbidden("Insufficient funds to perform operation.")
+	}
+	return nil
+}
 
-	deposit, err := s.repo.Get(ctx, uuid.MustParse(req.OwnerId))
-	if err == sql.ErrNoRows {
-		return 0, nil
-	} else if err != nil {
+// checkSpendingLimits returns an error if taking amount from the Deposit of the owner in the given currency would
+// exceed one of its daily or monthly spending limits. The limits are per user: the money taken from all the Deposits
+// of the owner is converted into the currency at the current rates and counted against them. Money held by active
+// reservations has been approved to be spent already, so it is counted too, and capturing it is not checked again.
+// The owner must be locked by the caller with lock, so that concurrent operations on any of its Deposits can't
+// exceed the limits together.
+func (s service) checkSpendingLimits(ctx context.Context, ownerId uuid.UUID, currency string, amount int64) error {
+	dep, err := s.repo.Get(ctx, ownerId, currency)
+	if err != nil {
+		return err
+	}
+	defaults, err := s.defaultSpendingLimits(ctx, currency)
+	if err != nil {
+		return err
+	}
+	limits := defaults.Override(dep.SpendingLimits)
+
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	windows := []struct {
+		name        string
+		since       time.Time
+		resetsAt    time.Time
+		amountLimit int64
+		countLimit  int64
+	}{
+		{"daily", day, day.AddDate(0, 0, 1), limits.DailyAmountLimit, limits.DailyCountLimit},
+		{"monthly", month, month.AddDate(0, 1, 0), limits.MonthlyAmountLimit, limits.MonthlyCountLimit},
+	}
+
+	for _, w := range windows {
+		if w.amountLimit == 0 && w.countLimit == 0 {
+			continue
+		}
+		totals, err := s.transactionService.Outgoing(ctx, ownerId, w.since)
+		if err != nil {
+			return err
+		}
+		held, err := s.reservationService.HeldTotals(ctx, ownerId)
+		if err != nil {
+			return err
+		}
+		for _, h := range held {
+			totals = append(totals, transaction.OutgoingTotal{Currency: h.Currency, Amount: h.Amount, Count: h.Count})
+		}
+		spent, count, err := s.outgoingIn(ctx, totals, currency)
+		if err != nil {
+			return err
+		}
+		if w.amountLimit > 0 && spent+amount > w.amountLimit {
+			return errors.LimitExceeded(fmt.Sprintf(
+				"The %s limit of %d %s of outgoing money is exceeded, it resets at %s.",
+				w.name, w.amountLimit, currency, w.resetsAt.Format(time.RFC3339),
+			), w.name+"_amount", w.resetsAt)
+		}
+		if w.countLimit > 0 && count+1 > w.countLimit {
+			return errors.LimitExceeded(fmt.Sprintf(
+				"The %s limit of %d outgoing operations is exceeded, it resets at %s.",
+				w.name, w.countLimit, w.resetsAt.Format(time.RFC3339),
+			), w.name+"_count", w.resetsAt)
+		}
+	}
+	return nil
+}
+
+// defaultSpendingLimits returns the default spending limits, whose amounts are set in entity.DefaultCurrency,
+// with the amounts converted into the currency at the current rate. A limit is never rounded down to zero,
+// which would lift it.
+func (s service) defaultSpendingLimits(ctx context.Context, currency string) (entity.SpendingLimits, error) {
+	limits := s.spendingLimits
+	if currency == entity.DefaultCurrency || (limits.DailyAmountLimit == 0 && limits.MonthlyAmountLimit == 0) {
+		return limits, nil
+	}
+
+	published, err := s.exchangeRates(ctx, []string{entity.DefaultCurrency, currency})
+	if err != nil {
+		return entity.SpendingLimits{}, err
+	}
+	rate, ok := rates.CrossRate(published, entity.DefaultCurrency, currency)
+	if !ok {
+		return entity.SpendingLimits{}, errors.InternalServerError("Requested currency is not available at the moment.")
+	}
+	for _, limit := range []*int64{&limits.DailyAmountLimit, &limits.MonthlyAmountLimit} {
+		if *limit == 0 {
+			continue
+		}
+		if *limit = s.rounding.Round(money.Convert(*limit, entity.DefaultCurrency, currency, rate)); *limit == 0 {
+			*limit = 1
+		}
+	}
+	return limits, nil
+}
+
+// outgoingIn returns the total amount of the outgoing money converted into the currency at the current rates
+// and the total number of the outgoing operations. The amounts are summed up exactly and rounded only once.
+func (s service) outgoingIn(ctx context.Context, totals []transaction.OutgoingTotal, currency string) (int64, int64, error) {
+	codes := []string{currency}
+	for _, t := range totals {
+		if t.Currency != currency {
+			codes = append(codes, t.Currency)
+		}
+	}
+	var published map[string]entity.Rate
+	if len(codes) > 1 {
+		var err error
+		if published, err = s.exchangeRates(ctx, codes); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	spent := new(big.Rat)
+	var count int64
+	for _, t := range totals {
+		rate, ok := rates.CrossRate(published, t.Currency, currency)
+		if !ok {
+			return 0, 0, errors.InternalServerError("Requested currency is not available at the moment.")
+		}
+		spent.Add(spent, money.Convert(t.Amount, t.Currency, currency, rate))
+		count += t.Count
+	}
+	return s.rounding.Round(spent), count, nil
+}
+
+// apply subtracts the amount of the Transaction from sender's Deposit and adds the credited amount to recipient's one.
+func (s service) apply(ctx context.Context, tx entity.Transaction) error {
+	if tx.SenderId != uuid.Nil {
+		if err := s.modifyBalance(ctx, tx.SenderId, tx.Currency, -tx.Amount); err != nil {
+			return err
+		}
+	}
+	if tx.RecipientId != uuid.Nil {
+		currency, amount := tx.Credited()
+		if err := s.modifyBalance(ctx, tx.RecipientId, currency, amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post records the postings of the Transaction in the ledger and verifies that the balances of its parties
+// match the ones derived from the ledger, so that deposits and the transaction log never drift apart.
+// The balances of the parties after the Transaction are saved in it.
+func (s service) post(ctx context.Context, tx *entity.Transaction) error {
+	if err := s.ledgerService.Record(ctx, *tx); err != nil {
+		return err
+	}
+
+	if tx.SenderId != uuid.Nil {
+		balance, err := s.verify(ctx, tx.SenderId, tx.Currency)
+		if err != nil {
+			return err
+		}
+		tx.SenderBalanceAfter = &balance
+	}
+	if tx.RecipientId != uuid.Nil {
+		creditCurrency, _ := tx.Credited()
+		balance, err := s.verify(ctx, tx.RecipientId, creditCurrency)
+		if err != nil {
+			return err
+		}
+		tx.RecipientBalanceAfter = &balance
+	}
+	return s.transactionService.RecordBalances(ctx, *tx)
+}
+
+// verify checks that the balance of the Deposit matches the one derived from the ledger and returns it.
+func (s service) verify(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error) {
+	dep, err := s.repo.Get(ctx, ownerId, currency)
+	if err != nil {
+		return 0, err
+	}
+	return dep.Balance, s.ledgerService.Verify(ctx, ownerId, currency, dep.Balance)
+}
+
+// exchangeRate returns the number of units of currency to per one unit of currency from.
+func (s service) exchangeRate(ctx context.Context, from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+
+	published, err := s.exchangeRates(ctx, []string{from, to})
+	if err != nil {
 		return 0, err
 	}
-	balance := float32(deposit.Balance)
+	rate, ok := rates.CrossRate(published, from, to)
+	if !ok {
+		return 0, errors.InternalServerError("Requested currency is not available at the moment.")
+	}
+	result, _ := rate.Float64()
+	return result, nil
+}
+
+// transferRate returns the rate to convert the money of the transfer at: the one locked by the referenced quote,
+// which can't be used again afterwards, or the current exchange rate if there is no quote.
+func (s service) transferRate(ctx context.Context, req requests.TransferRequest) (float64, error) {
+	if req.QuoteId == "" {
+		return s.exchangeRate(ctx, req.Currency, req.RecipientCurrency)
+	}
+
+	q, err := s.quoteService.Use(ctx, req.QuoteId, req.Currency, req.RecipientCurrency, req.Amount)
+	if err != nil {
+		return 0, err
+	}
+	return q.Rate, nil
+}
+
+// exchangeRates returns the rates of all the given currencies, resolved with a single lookup.
+func (s service) exchangeRates(ctx context.Context, codes []string) (map[string]entity.Rate, error) {
+	rates, err := s.exchangeService.GetRates(ctx, codes)
+	if err != nil {
+		return nil, errors.InternalServerError("Requested currency is not available at the moment.")
+	}
+	return rates, nil
+}
+
+// exchangeRateAt returns the rate to convert money from one currency into another as of the given time.
+func (s service) exchangeRateAt(ctx context.Context, from, to string, at time.Time) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+
+	fromRate, err := s.exchangeService.GetAt(ctx, from, at)
+	if err != nil {
+		return nil, err
+	}
+	toRate, err := s.exchangeService.GetAt(ctx, to, at)
+	if err != nil {
+		return nil, err
+	}
+	rate, ok := rates.CrossRate(map[string]entity.Rate{from: {Rate: fromRate}, to: {Rate: toRate}}, from, to)
+	if !ok {
+		return nil, fmt.Errorf("invalid rates %v of %s and %v of %s", fromRate, from, toRate, to)
+	}
+	return rate, nil
+}
+
+// idempotent runs the operation f unless a request with the same idempotency key has already been processed.
+// For a replayed request the originally created Transaction is returned. An empty key disables deduplication.
+func (s service) idempotent(
+	ctx context.Context,
+	key string,
+	req interface{},
+	f func() (transaction.Transaction, error),
+) (transaction.Transaction, error) {
+	if key == "" {
+		return f()
+	}
 
-	if req.Currency != "" {
-		rate, err := s.exchangeService.Get(req.Currency)
+	txId, replay, err := s.idempotencyService.Begin(ctx, key, req)
+	if err != nil {
+		return transaction.Transaction{}, err
+	}
+	if replay {
+		return s.transactionService.Get(ctx, txId)
+	}
+
+	tx, err := f()
+	if err != nil {
+		return transaction.Transaction{}, err
+	}
+	if err = s.idempotencyService.Complete(ctx, key, tx.Id); err != nil {
+		return transaction.Transaction{}, err
+	}
+	return tx, nil
+}
+
+// GetBalance returns the total and available balance of all Deposits whose OwnerId is equal to
+// GetBalanceRequest.OwnerId, converted into GetBalanceRequest.Currency (entity.DefaultCurrency if not specified)
+// and each of GetBalanceRequest.Currencies. All the rates are resolved at once, so the conversions are consistent.
+func (s service) GetBalance(ctx context.Context, req requests.GetBalanceRequest) (Balance, error) {
+	if err := req.Validate(); err != nil {
+		return Balance{}, err
+	}
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
+	ownerUUID := uuid.MustParse(req.OwnerId)
+	deposits, err := s.repo.List(ctx, ownerUUID)
+	if err != nil {
+		return Balance{}, err
+	}
+
+	balances := make([]DepositBalance, 0, len(deposits))
+	currencies := append([]string{req.Currency}, req.Currencies...)
+	converting := len(req.Currencies) > 0
+	for _, dep := range deposits {
+		reserved, err := s.reservationService.Held(ctx, ownerUUID, dep.Currency)
+		if err != nil {
+			return Balance{}, err
+		}
+		pending, err := s.transactionService.Pending(ctx, ownerUUID, dep.Currency)
 		if err != nil {
-			return 0, errors.InternalServerError("Requested currency is not available at the moment.")
+			return Balance{}, err
+		}
+		held := reserved + pending
+
+		b := DepositBalance{
+			Currency:  dep.Currency,
+			Total:     money.Money{Value: dep.Balance, Currency: dep.Currency},
+			Available: money.Money{Value: dep.Balance + dep.CreditLimit - held, Currency: dep.Currency},
+		}
+		if dep.CreditLimit != 0 {
+			b.CreditLimit = &money.Money{Value: dep.CreditLimit, Currency: dep.Currency}
+		}
+		if pending != 0 {
+			b.Pending = &money.Money{Value: pending, Currency: dep.Currency}
 		}
-		return balance * rate, nil
+		balances = append(balances, b)
+		currencies = append(currencies, dep.Currency)
+		converting = converting || dep.Currency != req.Currency
 	}
 
+	var published map[string]entity.Rate
+	if converting {
+		if published, err = s.exchangeRates(ctx, currencies); err != nil {
+			return Balance{}, err
+		}
+	}
+
+	balance := Balance{Deposits: balances}
+	if balance.Total, balance.Available, err = s.convertBalance(balances, published, req.Currency); err != nil {
+		return Balance{}, err
+	}
+	for _, code := range req.Currencies {
+		converted := ConvertedBalance{Rate: published[code].Rate, RateTimestamp: published[code].FetchedAt}
+		if converted.Total, converted.Available, err = s.convertBalance(balances, published, code); err != nil {
+			return Balance{}, err
+		}
+		if balance.Converted == nil {
+			balance.Converted = make(map[string]ConvertedBalance, len(req.Currencies))
+		}
+		balance.Converted[code] = converted
+	}
 	return balance, nil
 }
 
+// convertBalance returns the total and available balance of the deposits converted into the currency at the rates.
+// The converted amounts are summed up exactly and rounded to the minor units of the currency only once.
+func (s service) convertBalance(balances []DepositBalance, published map[string]entity.Rate, currency string) (money.Money, money.Money, error) {
+	total, available := new(big.Rat), new(big.Rat)
+	for _, b := range balances {
+		rate, ok := rates.CrossRate(published, b.Currency, currency)
+		if !ok {
+			return money.Money{}, money.Money{}, errors.InternalServerError("Requested currency is not available at the moment.")
+		}
+		total.Add(total, money.Convert(b.Total.Value, b.Currency, currency, rate))
+		available.Add(available, money.Convert(b.Available.Value, b.Currency, currency, rate))
+	}
+	return money.Money{Value: s.rounding.Round(total), Currency: currency},
+		money.Money{Value: s.rounding.Round(available), Currency: currency}, nil
+}
+
 // Update changes the balance of Deposit according to UpdateBalanceRequest.
 // It returns the Transaction which reflects the corresponding balance change in case of success.
-func (s service) Update(ctx context.Context, req requests.UpdateBalanceRequest) error {
+func (s service) Update(ctx context.Context, req requests.UpdateBalanceRequest) (transaction.Transaction, error) {
 	if err := req.Validate(); err != nil {
-		return err
+		return transaction.Transaction{}, err
+	}
+
+	return s.idempotent(ctx, req.IdempotencyKey, req, func() (transaction.Transaction, error) {
+		return s.update(ctx, req, false)
+	})
+}
+
+// update changes the balance of Deposit according to the already validated UpdateBalanceRequest.
+// A pending withdrawal only holds the money, the balance is changed once the Transaction is completed.
+// A withdrawal is checked against the spending limits unless it has been approved before, e.g. by a Reservation.
+func (s service) update(ctx context.Context, req requests.UpdateBalanceRequest, approved bool) (transaction.Transaction, error) {
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
 	}
 
 	ownerUUID := uuid.MustParse(req.OwnerId)
-	if err := s.modifyBalance(ctx, ownerUUID, req.Amount); err != nil {
-		return err
+	if req.Amount < 0 {
+		if err := s.lock(ctx, account{ownerUUID, req.Currency}); err != nil {
+			return transaction.Transaction{}, err
+		}
+		if !approved {
+			if err := s.checkSpendingLimits(ctx, ownerUUID, req.Currency, -req.Amount); err != nil {
+				return transaction.Transaction{}, err
+			}
+		}
+	}
+	switch {
+	case req.Pending && req.Amount < 0:
+		if err := s.hold(ctx, ownerUUID, req.Currency, -req.Amount); err != nil {
+			return transaction.Transaction{}, err
+		}
+	case !req.Pending:
+		if err := s.modifyBalance(ctx, ownerUUID, req.Currency, req.Amount); err != nil {
+			return transaction.Transaction{}, err
+		}
 	}
 
-	return nil
+	tx, err := s.transactionService.CreateUpdateTransaction(ctx, req)
+	if err != nil {
+		return transaction.Transaction{}, err
+	}
+	if req.Pending {
+		return tx, nil
+	}
+	if err = s.post(ctx, &tx.Transaction); err != nil {
+		return transaction.Transaction{}, err
+	}
+
+	return tx, nil
 }
 
 // Transfer sends money from one user to another according to TransferRequest.
 // It returns a Transaction which reflects the corresponding money transfer in case of success.
-func (s service) Transfer(ctx context.Context, req requests.TransferRequest) error {
+func (s service) Transfer(ctx context.Context, req requests.TransferRequest) (transaction.Transaction, error) {
 	if err := req.Validate(); err != nil {
-		return err
+		return transaction.Transaction{}, err
+	}
+
+	return s.idempotent(ctx, req.IdempotencyKey, req, func() (transaction.Transaction, error) {
+		return s.transfer(ctx, req)
+	})
+}
+
+// transfer sends money from one user to another according to the already validated TransferRequest.
+// Money sent in a currency other than the recipient's one is converted at the current exchange rate, or at the rate
+// locked by the referenced quote.
+// A pending transfer only holds sender's money, it is moved once the Transaction is completed.
+func (s service) transfer(ctx context.Context, req requests.TransferRequest) (transaction.Transaction, error) {
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+	if req.RecipientCurrency == "" {
+		req.RecipientCurrency = req.Currency
+	}
+	rate, err := s.transferRate(ctx, req)
+	if err != nil {
+		return transaction.Transaction{}, err
 	}
 
 	senderUUID, recipientUUID := uuid.MustParse(req.SenderId), uuid.MustParse(req.RecipientId)
-	if err := s.modifyBalance(ctx, senderUUID, -req.Amount); err != nil {
+	if err = s.lock(ctx, account{senderUUID, req.Currency}, account{recipientUUID, req.RecipientCurrency}); err != nil {
+		return transaction.Transaction{}, err
+	}
+	// exchanging money between own deposits is not spending it
+	if senderUUID != recipientUUID {
+		if err = s.checkSpendingLimits(ctx, senderUUID, req.Currency, req.Amount); err != nil {
+			return transaction.Transaction{}, err
+		}
+	}
+	if req.Pending {
+		if err = s.hold(ctx, senderUUID, req.Currency, req.Amount); err != nil {
+			return transaction.Transaction{}, err
+		}
+	}
+
+	tx, err := s.transactionService.CreateTransferTransaction(ctx, req, rate)
+	if err != nil {
+		return transaction.Transaction{}, err
+	}
+	if req.Pending {
+		return tx, nil
+	}
+	if err = s.apply(ctx, tx.Transaction); err != nil {
+		return transaction.Transaction{}, err
+	}
+	if err = s.post(ctx, &tx.Transaction); err != nil {
+		return transaction.Transaction{}, err
+	}
+
+	return tx, nil
+}
+
+// Batch applies the transfers and balance updates of BatchRequest in the given order. All operations are validated
+// before any of them is applied; if any operation fails, an error listing the failed operations is returned and none
+// of them takes effect, provided that the call is wrapped in a DB transaction.
+// It returns the created Transactions in the order of operations in case of success.
+func (s service) Batch(ctx context.Context, req requests.BatchRequest) ([]transaction.Transaction, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if len(req.Operations) > s.maxBatchSize {
+		return nil, errors.BadRequest(fmt.Sprintf("Batch can't contain more than %d operations.", s.maxBatchSize))
+	}
+
+	var failed []errors.BatchItemError
+	for i, op := range req.Operations {
+		if err := op.Validate(); err != nil {
+			failed = append(failed, errors.BatchItem(i, err))
+		}
+	}
+	if len(failed) > 0 {
+		return nil, errors.BatchFailed(failed)
+	}
+
+	// lock all the owners and Deposits of the batch at once, so that concurrent batches can't deadlock
+	var accounts []account
+	for _, op := range req.Operations {
+		if op.Transfer != nil {
+			currency, recipientCurrency := op.Transfer.Currency, op.Transfer.RecipientCurrency
+			if currency == "" {
+				currency = entity.DefaultCurrency
+			}
+			if recipientCurrency == "" {
+				recipientCurrency = currency
+			}
+			accounts = append(accounts,
+				account{uuid.MustParse(op.Transfer.SenderId), currency},
+				account{uuid.MustParse(op.Transfer.RecipientId), recipientCurrency},
+			)
+		} else {
+			currency := op.Update.Currency
+			if currency == "" {
+				currency = entity.DefaultCurrency
+			}
+			accounts = append(accounts, account{uuid.MustParse(op.Update.OwnerId), currency})
+		}
+	}
+	if err := s.lock(ctx, accounts...); err != nil {
+		return nil, err
+	}
+
+	txs := make([]transaction.Transaction, 0, len(req.Operations))
+	for i, op := range req.Operations {
+		var tx transaction.Transaction
+		var err error
+		if op.Transfer != nil {
+			tx, err = s.Transfer(ctx, *op.Transfer)
+		} else {
+			tx, err = s.Update(ctx, *op.Update)
+		}
+		if err != nil {
+			item := errors.BatchItem(i, err)
+			if item.Status == http.StatusInternalServerError {
+				return nil, err
+			}
+			return nil, errors.BatchFailed([]errors.BatchItemError{item})
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
+// Reserve holds money on the Deposit according to ReserveRequest.
+// Held money can't be withdrawn or transferred until the Reservation is released or expires.
+// The spending limits are checked when money is reserved, not when it is captured.
+func (s service) Reserve(ctx context.Context, req requests.ReserveRequest) (reservation.Reservation, error) {
+	if err := req.Validate(); err != nil {
+		return reservation.Reservation{}, err
+	}
+
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
+	ownerUUID := uuid.MustParse(req.OwnerId)
+	if err := s.lock(ctx, account{ownerUUID, req.Currency}); err != nil {
+		return reservation.Reservation{}, err
+	}
+	if err := s.checkSpendingLimits(ctx, ownerUUID, req.Currency, req.Amount); err != nil {
+		return reservation.Reservation{}, err
+	}
+	if err := s.hold(ctx, ownerUUID, req.Currency, req.Amount); err != nil {
+		return reservation.Reservation{}, err
+	}
+	return s.reservationService.Create(ctx, req)
+}
+
+// Capture withdraws money held by the Reservation with the given id according to CaptureRequest.
+// The Reservation is locked until the end of the DB transaction, so concurrent captures can't withdraw more than
+// reserved. It returns the Transaction which reflects the corresponding withdrawal in case of success.
+func (s service) Capture(ctx context.Context, id int64, req requests.CaptureRequest) (transaction.Transaction, error) {
+	if err := req.Validate(); err != nil {
+		return transaction.Transaction{}, err
+	}
+
+	res, err := s.reservationService.Lock(ctx, id)
+	if err != nil {
+		return transaction.Transaction{}, err
+	}
+	amount := req.Amount
+	if amount == 0 {
+		amount = res.Remaining()
+	}
+	if res, err = s.reservationService.Capture(ctx, id, amount); err != nil {
+		return transaction.Transaction{}, err
+	}
+
+	return s.update(ctx, requests.UpdateBalanceRequest{
+		OwnerId:     res.OwnerId.String(),
+		Amount:      -amount,
+		Currency:    res.Currency,
+		Description: res.Description,
+	}, true)
+}
+
+// Release returns the remaining money held by the Reservation with the given id to the available balance.
+func (s service) Release(ctx context.Context, id int64) (reservation.Reservation, error) {
+	return s.reservationService.Release(ctx, id)
+}
+
+// Reverse returns (part of) the money of the Transaction with the given id from its recipient to its sender
+// according to ReverseRequest. The recipient must have enough funds to be debited.
+// The original Transaction is locked before the Deposits, as in Complete; transfers never lock Transactions, so
+// the locks can't be taken in opposite orders.
+// It returns the compensating Transaction in case of success.
+func (s service) Reverse(ctx context.Context, id int64, req requests.ReverseRequest) (transaction.Transaction, error) {
+	tx, err := s.transactionService.CreateReversalTransaction(ctx, id, req)
+	if err != nil {
+		return transaction.Transaction{}, err
+	}
+	creditCurrency, _ := tx.Credited()
+	if err = s.lock(ctx, account{tx.SenderId, tx.Currency}, account{tx.RecipientId, creditCurrency}); err != nil {
+		return transaction.Transaction{}, err
+	}
+	if err = s.apply(ctx, tx.Transaction); err != nil {
+		return transaction.Transaction{}, err
+	}
+	if err = s.post(ctx, &tx.Transaction); err != nil {
+		return transaction.Transaction{}, err
+	}
+
+	return tx, nil
+}
+
+// Complete completes the pending Transaction with the given id according to ChangeTransactionStatusRequest:
+// its held money is moved from the sender to the recipient. The Transaction stays pending if it can't be applied,
+// e.g. when a deposit of a party has been frozen meanwhile.
+// It returns the completed Transaction in case of success.
+func (s service) Complete(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (transaction.Transaction, error) {
+	tx, err := s.transactionService.Complete(ctx, id, req)
+	if err != nil {
+		return transaction.Transaction{}, err
+	}
+	creditCurrency, _ := tx.Credited()
+	if err = s.lock(ctx, account{tx.SenderId, tx.Currency}, account{tx.RecipientId, creditCurrency}); err != nil {
+		return transaction.Transaction{}, err
+	}
+	if err = s.apply(ctx, tx.Transaction); err != nil {
+		return transaction.Transaction{}, err
+	}
+	if err = s.post(ctx, &tx.Transaction); err != nil {
+		return transaction.Transaction{}, err
+	}
+
+	return tx, nil
+}
+
+// Fail fails the pending Transaction with the given id according to ChangeTransactionStatusRequest,
+// so that its held money becomes available again. No balances are changed.
+func (s service) Fail(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (transaction.Transaction, error) {
+	return s.transactionService.Fail(ctx, id, req)
+}
+
+// SetCreditLimit changes the credit limit of the Deposit according to SetCreditLimitRequest, creating the Deposit
+// if it does not exist yet. The limit can't be lowered below the money the owner already owes.
+func (s service) SetCreditLimit(ctx context.Context, req requests.SetCreditLimitRequest) (Deposit, error) {
+	if err := req.Validate(); err != nil {
+		return Deposit{}, err
+	}
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
+	dep, err := s.repo.Lock(ctx, uuid.MustParse(req.OwnerId), req.Currency)
+	if err != nil {
+		return Deposit{}, err
+	}
+	if dep.Balance+req.CreditLimit < 0 {
+		return Deposit{}, errors.Conflict("Credit limit can't be lower than the current debt.")
+	}
+
+	dep.CreditLimit = req.CreditLimit
+	if err = s.repo.Update(ctx, dep); err != nil {
+		return Deposit{}, err
+	}
+	return Deposit{dep}, nil
+}
+
+// SetSpendingLimits overrides the default spending limits of the Deposit according to SetSpendingLimitsRequest,
+// creating the Deposit if it does not exist yet.
+func (s service) SetSpendingLimits(ctx context.Context, req requests.SetSpendingLimitsRequest) (Deposit, error) {
+	if err := req.Validate(); err != nil {
+		return Deposit{}, err
+	}
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
+	dep, err := s.repo.Lock(ctx, uuid.MustParse(req.OwnerId), req.Currency)
+	if err != nil {
+		return Deposit{}, err
+	}
+	dep.SpendingLimits = entity.SpendingLimits{
+		DailyAmountLimit:   req.DailyAmountLimit,
+		DailyCountLimit:    req.DailyCountLimit,
+		MonthlyAmountLimit: req.MonthlyAmountLimit,
+		MonthlyCountLimit:  req.MonthlyCountLimit,
+	}
+	if err = s.repo.Update(ctx, dep); err != nil {
+		return Deposit{}, err
+	}
+	return Deposit{dep}, nil
+}
+
+// SetStatus changes the status of the Deposit according to SetStatusRequest, creating the Deposit if it does
+// not exist yet. Only a Deposit with zero balance and no reserved money can be closed.
+// Every change is recorded in the audit log along with who made it and why.
+func (s service) SetStatus(ctx context.Context, req requests.SetStatusRequest) (Deposit, error) {
+	if err := req.Validate(); err != nil {
+		return Deposit{}, err
+	}
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
+	ownerUUID := uuid.MustParse(req.OwnerId)
+	dep, err := s.repo.Lock(ctx, ownerUUID, req.Currency)
+	if err != nil {
+		return Deposit{}, err
+	}
+	if req.Status == entity.DepositClosed && dep.Status != entity.DepositClosed {
+		if dep.Balance != 0 {
+			return Deposit{}, errors.Conflict("Deposit with a non-zero balance can't be closed.")
+		}
+		held, err := s.held(ctx, ownerUUID, req.Currency)
+		if err != nil {
+			return Deposit{}, err
+		}
+		if held > 0 {
+			return Deposit{}, errors.Conflict("Deposit with reserved money can't be closed.")
+		}
+	}
+
+	change := entity.DepositStatusChange{
+		OwnerId:        dep.OwnerId,
+		Currency:       dep.Currency,
+		PreviousStatus: dep.Status,
+		Status:         req.Status,
+		ChangedBy:      req.ChangedBy,
+		Reason:         req.Reason,
+		ChangedAt:      time.Now().UTC(),
+	}
+	dep.Status = req.Status
+	if err = s.repo.Update(ctx, dep); err != nil {
+		return Deposit{}, err
+	}
+	if err = s.repo.CreateStatusChange(ctx, &change); err != nil {
+		return Deposit{}, err
+	}
+
+	s.logger.With(ctx).Infof("status of the %s deposit of user %s changed from %s to %s by %s: %s",
+		change.Currency, change.OwnerId, change.PreviousStatus, change.Status, change.ChangedBy, change.Reason)
+	return Deposit{dep}, nil
+}
+
+// GetHistory returns a page of the transaction history of a user. If GetHistoryRequest.ConvertTo is specified,
+// user's side of each transaction is converted into that currency at the rates as of its transaction date;
+// the converted amount is left empty for the transactions made when the rates are unknown.
+func (s service) GetHistory(ctx context.Context, req requests.GetHistoryRequest) (transaction.History, error) {
+	history, err := s.transactionService.GetHistory(ctx, req)
+	if err != nil || req.ConvertTo == "" {
+		return history, err
+	}
+
+	ownerUUID := uuid.MustParse(req.OwnerId)
+	history.ConvertedCurrency = req.ConvertTo
+	for i := range history.Transactions {
+		item := &history.Transactions[i]
+		currency, amount := item.Currency, item.Amount
+		if item.RecipientId == ownerUUID {
+			currency, amount = item.Credited()
+		}
+
+		rate, err := s.exchangeRateAt(ctx, currency, req.ConvertTo, item.TransactionDate)
+		if err != nil {
+			s.logger.With(ctx).Infof("failed to convert transaction %d into %s: %v", item.Id, req.ConvertTo, err)
+			continue
+		}
+		converted := s.rounding.Round(money.Convert(amount, currency, req.ConvertTo, rate))
+		item.ConvertedAmount = &converted
+	}
+	return history, nil
+}
+
+// Statement writes the statement of user's Deposit in StatementRequest.Currency (entity.DefaultCurrency
+// if not specified) for the requested period to w in StatementRequest.Format (CSV if not specified).
+// The opening and closing balances are derived from the ledger, while the transactions are streamed one by one.
+// Nothing is written if the request is invalid or the balances can't be computed.
+func (s service) Statement(ctx context.Context, req requests.StatementRequest, w io.Writer) error {
+	if err := req.Validate(); err != nil {
 		return err
 	}
-	if err := s.modifyBalance(ctx, recipientUUID, req.Amount); err != nil {
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+	if req.Format == "" {
+		req.Format = statement.FormatCSV
+	}
+	enc, err := statement.NewEncoder(req.Format, w)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	ownerUUID := uuid.MustParse(req.OwnerId)
+	st := statement.Statement{OwnerId: ownerUUID, Currency: req.Currency, CreatedAt: time.Now().UTC()}
+	st.From, _ = time.Parse(requests.DateLayout, req.DateFrom)
+	st.To, _ = time.Parse(requests.DateLayout, req.DateTo)
+	if st.OpeningBalance, err = s.ledgerService.BalanceBefore(ctx, ownerUUID, req.Currency, st.From); err != nil {
+		return err
+	}
+	if st.ClosingBalance, err = s.ledgerService.BalanceBefore(ctx, ownerUUID, req.Currency, st.End()); err != nil {
+		return err
+	}
+
+	if err = enc.Begin(st); err != nil {
+		return err
+	}
+	balance := st.OpeningBalance
+	err = s.transactionService.EachForUser(ctx, ownerUUID, req.Currency, st.From, st.End(), func(tx entity.Transaction) error {
+		entry := statement.NewEntry(tx, ownerUUID, req.Currency)
+		balance += entry.Amount
+		entry.BalanceAfter = balance
+		return enc.Encode(entry)
+	})
+	if err != nil {
+		return err
+	}
+	if balance != st.ClosingBalance {
+		s.logger.With(ctx).Errorf("statement of %s deposit of user %s: transactions sum up to %d, but the closing balance is %d",
+			req.Currency, ownerUUID, balance, st.ClosingBalance)
+	}
+	return enc.End()
 }
 
 // Count returns a number of Deposits in the database.
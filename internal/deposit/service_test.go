@@ -1,15 +1,29 @@
 package deposit
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/csv"
 	"errors"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"users-balance-microservice/internal/entity"
+	apperrors "users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/idempotency"
+	"users-balance-microservice/internal/ledger"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/quote"
+	"users-balance-microservice/internal/rates"
 	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/internal/reservation"
+	"users-balance-microservice/internal/test"
+	"users-balance-microservice/internal/transaction"
 	"users-balance-microservice/pkg/log"
 )
 
@@ -17,18 +31,19 @@ var (
 	databaseError   = errors.New("database error")
 	logger, _       = log.NewForTest()
 	exchangeService = mockExchangeRatesService{}
+	ratesFetchedAt  = time.Date(2021, 11, 10, 12, 0, 0, 0, time.UTC)
+	maxBatchSize    = 10
 	ctx             = context.Background()
 )
 
 func TestService_GetBalance(t *testing.T) {
 	id1, id2 := uuid.New(), uuid.New()
-	s := NewService(
-		&mockDepositRepository{
-			items: []entity.Deposit{
-				{id1, 1000},
-			},
-		}, exchangeService, logger,
-	)
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	s := newTestService(testService{
+		deposits: deposits,
+	})
 
 	// initial count
 	count, err := s.Count(ctx)
@@ -39,19 +54,19 @@ func TestService_GetBalance(t *testing.T) {
 	// get existing deposit's balance in RUB
 	balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
 	if assert.NoError(t, err) {
-		assert.EqualValues(t, 1000, balance)
+		assert.EqualValues(t, 1000, balance.Total.Value)
 	}
 
 	// get existing deposit's balance in USD (fake exchange rate RUB/USD=0.1 is used)
 	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String(), Currency: "USD"})
 	if assert.NoError(t, err) {
-		assert.EqualValues(t, 100, balance)
+		assert.EqualValues(t, 100, balance.Total.Value)
 	}
 
 	// get non-existing deposit's balance - 0 is returned regardless of currency, new deposit is not created.
 	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String(), Currency: "EUR"})
 	if assert.NoError(t, err) {
-		assert.EqualValues(t, 0, balance)
+		assert.EqualValues(t, 0, balance.Total.Value)
 	}
 
 	// get
@@ -59,13 +74,12 @@ func TestService_GetBalance(t *testing.T) {
 
 func TestService_Update(t *testing.T) {
 	id1, id2 := uuid.New(), uuid.New()
-	s := NewService(
-		&mockDepositRepository{
-			items: []entity.Deposit{
-				{id1, 1000},
-			},
-		}, exchangeService, logger,
-	)
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	s := newTestService(testService{
+		deposits: deposits,
+	})
 
 	// initial count
 	count, err := s.Count(ctx)
@@ -74,16 +88,16 @@ func TestService_Update(t *testing.T) {
 	}
 
 	// update balance top-up success
-	err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 500, Description: "visa top-up"})
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 500, Description: "visa top-up"})
 	if assert.NoError(t, err) {
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1500, balance)
+			assert.EqualValues(t, 1500, balance.Total.Value)
 		}
 	}
 
 	// update balance withdrawal success
-	err = s.Update(ctx, requests.UpdateBalanceRequest{
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{
 		OwnerId:     id1.String(),
 		Amount:      -500,
 		Description: "monthly subscription",
@@ -91,12 +105,12 @@ func TestService_Update(t *testing.T) {
 	if assert.NoError(t, err) {
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1000, balance)
+			assert.EqualValues(t, 1000, balance.Total.Value)
 		}
 	}
 
 	// update balance top-up non-existing deposit -> new deposit is created
-	err = s.Update(ctx, requests.UpdateBalanceRequest{
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{
 		OwnerId:     id2.String(),
 		Amount:      2000,
 		Description: "mastercard top-up",
@@ -109,12 +123,12 @@ func TestService_Update(t *testing.T) {
 
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 2000, balance)
+			assert.EqualValues(t, 2000, balance.Total.Value)
 		}
 	}
 
 	// update balance withdrawal insufficient balance -> failure
-	err = s.Update(ctx, requests.UpdateBalanceRequest{
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{
 		OwnerId:     id1.String(),
 		Amount:      -250000,
 		Description: "hack3r attack",
@@ -122,13 +136,13 @@ func TestService_Update(t *testing.T) {
 	if assert.Error(t, err) {
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1000, balance)
+			assert.EqualValues(t, 1000, balance.Total.Value)
 		}
 	}
 
 	// update balance invalid owner_id -> failure
 	count, _ = s.Count(ctx)
-	err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: "123-456-789", Amount: 2000})
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: "123-456-789", Amount: 2000})
 	if assert.Error(t, err) {
 		count2, _ := s.Count(ctx)
 		assert.EqualValues(t, 0, count2-count)
@@ -137,36 +151,40 @@ func TestService_Update(t *testing.T) {
 
 func TestService_Transfer(t *testing.T) {
 	id1, id2, id3 := uuid.New(), uuid.New(), uuid.New()
-	s := NewService(
-		&mockDepositRepository{
-			items: []entity.Deposit{
-				{id1, 1000},
-				{id2, 2000},
-			},
-		}, exchangeService, logger,
-	)
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+		{OwnerId: id2, Currency: "RUB", Balance: 2000},
+	}
+	s := newTestService(testService{
+		deposits: deposits,
+	})
 
 	// transfer success
-	err := s.Transfer(ctx, requests.TransferRequest{
+	tx, err := s.Transfer(ctx, requests.TransferRequest{
 		SenderId:    id2.String(),
 		RecipientId: id1.String(),
 		Amount:      300,
 		Description: "thanks for dinner!",
 	})
 	if assert.NoError(t, err) {
+		if assert.NotNil(t, tx.SenderBalanceAfter) && assert.NotNil(t, tx.RecipientBalanceAfter) {
+			assert.EqualValues(t, 1700, *tx.SenderBalanceAfter)
+			assert.EqualValues(t, 1300, *tx.RecipientBalanceAfter)
+		}
+
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1300, balance)
+			assert.EqualValues(t, 1300, balance.Total.Value)
 		}
 
 		balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1700, balance)
+			assert.EqualValues(t, 1700, balance.Total.Value)
 		}
 	}
 
 	// transfer from existing to non-existing deposit success
-	err = s.Transfer(ctx, requests.TransferRequest{
+	_, err = s.Transfer(ctx, requests.TransferRequest{
 		SenderId:    id2.String(),
 		RecipientId: id3.String(),
 		Amount:      700,
@@ -175,17 +193,17 @@ func TestService_Transfer(t *testing.T) {
 	if assert.NoError(t, err) {
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1000, balance)
+			assert.EqualValues(t, 1000, balance.Total.Value)
 		}
 
 		balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id3.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 700, balance)
+			assert.EqualValues(t, 700, balance.Total.Value)
 		}
 	}
 
 	// transfer insufficient funds failure
-	err = s.Transfer(ctx, requests.TransferRequest{
+	_, err = s.Transfer(ctx, requests.TransferRequest{
 		SenderId:    id2.String(),
 		RecipientId: id1.String(),
 		Amount:      300000,
@@ -194,17 +212,17 @@ func TestService_Transfer(t *testing.T) {
 	if assert.Error(t, err) {
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1300, balance)
+			assert.EqualValues(t, 1300, balance.Total.Value)
 		}
 
 		balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1000, balance)
+			assert.EqualValues(t, 1000, balance.Total.Value)
 		}
 	}
 
 	// transfer negative amount failure
-	err = s.Transfer(ctx, requests.TransferRequest{
+	_, err = s.Transfer(ctx, requests.TransferRequest{
 		SenderId:    id2.String(),
 		RecipientId: id1.String(),
 		Amount:      -300,
@@ -213,63 +231,1793 @@ func TestService_Transfer(t *testing.T) {
 	if assert.Error(t, err) {
 		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1300, balance)
+			assert.EqualValues(t, 1300, balance.Total.Value)
 		}
 
 		balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String()})
 		if assert.NoError(t, err) {
-			assert.EqualValues(t, 1000, balance)
+			assert.EqualValues(t, 1000, balance.Total.Value)
 		}
 	}
 }
 
-type mockDepositRepository struct {
-	items []entity.Deposit
+func TestService_Batch(t *testing.T) {
+	id1, id2, id3 := uuid.New(), uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	transactionRepo := &mockTransactionRepository{}
+	s := newTestService(testService{
+		deposits:        deposits,
+		transactionRepo: transactionRepo,
+	})
+	balanceOf := func(id uuid.UUID) int64 {
+		balance, _ := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id.String()})
+		return balance.Total.Value
+	}
+
+	// success: operations are applied in order
+	txs, err := s.Batch(ctx, requests.BatchRequest{Operations: []requests.BatchOperation{
+		{Update: &requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 500}},
+		{Transfer: &requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 1200}},
+		{Transfer: &requests.TransferRequest{SenderId: id1.String(), RecipientId: id3.String(), Amount: 300}},
+	}})
+	if assert.NoError(t, err) && assert.Len(t, txs, 3) {
+		assert.Equal(t, id1, txs[0].RecipientId)
+		assert.Equal(t, id2, txs[1].RecipientId)
+		assert.Equal(t, id3, txs[2].RecipientId)
+		assert.EqualValues(t, 0, balanceOf(id1))
+		assert.EqualValues(t, 1200, balanceOf(id2))
+		assert.EqualValues(t, 300, balanceOf(id3))
+	}
+	count, _ := transactionRepo.Count(ctx)
+
+	// invalid operations are reported all at once, nothing is applied
+	_, err = s.Batch(ctx, requests.BatchRequest{Operations: []requests.BatchOperation{
+		{Transfer: &requests.TransferRequest{SenderId: id2.String(), RecipientId: id3.String(), Amount: -100}},
+		{Transfer: &requests.TransferRequest{SenderId: id2.String(), RecipientId: id3.String(), Amount: 100}},
+		{},
+	}})
+	if assert.Error(t, err) {
+		errResponse, ok := err.(apperrors.ErrorResponse)
+		if assert.True(t, ok) && assert.IsType(t, []apperrors.BatchItemError{}, errResponse.Details) {
+			assert.Equal(t, http.StatusBadRequest, errResponse.Status)
+			items := errResponse.Details.([]apperrors.BatchItemError)
+			if assert.Len(t, items, 2) {
+				assert.Equal(t, 0, items[0].Index)
+				assert.Equal(t, 2, items[1].Index)
+			}
+		}
+		count2, _ := transactionRepo.Count(ctx)
+		assert.Equal(t, count, count2)
+	}
+
+	// failed operation is reported with its index
+	_, err = s.Batch(ctx, requests.BatchRequest{Operations: []requests.BatchOperation{
+		{Transfer: &requests.TransferRequest{SenderId: id2.String(), RecipientId: id3.String(), Amount: 100}},
+		{Transfer: &requests.TransferRequest{SenderId: id2.String(), RecipientId: id3.String(), Amount: 5000}},
+	}})
+	if assert.Error(t, err) {
+		errResponse, ok := err.(apperrors.ErrorResponse)
+		if assert.True(t, ok) {
+			assert.Equal(t, http.StatusForbidden, errResponse.Status)
+			assert.Equal(t, []apperrors.BatchItemError{{Index: 1, ErrorResponse: apperrors.Forbidden("Insufficient funds to perform operation.")}}, errResponse.Details)
+		}
+	}
+
+	// fail empty batch
+	_, err = s.Batch(ctx, requests.BatchRequest{})
+	assert.Error(t, err)
+
+	// fail too many operations
+	operations := make([]requests.BatchOperation, maxBatchSize+1)
+	for i := range operations {
+		operations[i].Update = &requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 1}
+	}
+	_, err = s.Batch(ctx, requests.BatchRequest{Operations: operations})
+	assert.Error(t, err)
 }
 
-func (m *mockDepositRepository) Get(ctx context.Context, ownerId uuid.UUID) (entity.Deposit, error) {
-	for _, item := range m.items {
-		if item.OwnerId == ownerId {
-			return item, nil
+func TestService_BatchLocks(t *testing.T) {
+	id1, id2 := uuid.MustParse("00000000-0000-0000-0000-0000000000a1"), uuid.MustParse("00000000-0000-0000-0000-0000000000a2")
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+		{OwnerId: id1, Currency: "USD", Balance: 1000},
+		{OwnerId: id2, Currency: "RUB", Balance: 1000},
+	}
+	repo := &mockDepositRepository{items: deposits}
+	s := newTestService(testService{deposits: deposits, repo: repo})
+
+	// owners and their Deposits are locked up front in the same order, whatever the order of operations
+	_, err := s.Batch(ctx, requests.BatchRequest{Operations: []requests.BatchOperation{
+		{Transfer: &requests.TransferRequest{SenderId: id2.String(), RecipientId: id1.String(), Amount: 100, RecipientCurrency: "USD"}},
+		{Transfer: &requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 100}},
+	}})
+	if assert.NoError(t, err) && assert.GreaterOrEqual(t, len(repo.locks), 5) {
+		assert.Equal(t, []string{
+			id1.String(), id1.String() + "/RUB", id1.String() + "/USD",
+			id2.String(), id2.String() + "/RUB",
+		}, repo.locks[:5])
+	}
+}
+
+func TestService_Ledger(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	ledgerService := ledger.NewService(newMockLedgerRepository(deposits...), logger)
+	s := newTestService(testService{
+		deposits:      deposits,
+		ledgerService: ledgerService,
+	})
+
+	// every operation produces balanced postings, balances stay equal to the ledger ones
+	_, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -200})
+	assert.NoError(t, err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 300})
+	assert.NoError(t, err)
+
+	for _, id := range []uuid.UUID{id1, id2} {
+		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id.String()})
+		if assert.NoError(t, err) {
+			ledgerBalance, err := ledgerService.Balance(ctx, id, "RUB")
+			if assert.NoError(t, err) {
+				assert.EqualValues(t, ledgerBalance, balance.Total.Value)
+			}
 		}
 	}
-	return entity.Deposit{}, sql.ErrNoRows
+	balance, err := ledgerService.Balance(ctx, entity.ExternalWithdrawalAccount, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 200, balance)
+	}
+
+	// deposit balance which is not backed by postings -> failure
+	s = newTestService(testService{
+		repo: &mockDepositRepository{items: []entity.Deposit{{OwnerId: id1, Currency: "RUB", Balance: 1000}}},
+	})
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 100})
+	assert.Error(t, err)
 }
 
-func (m *mockDepositRepository) Create(ctx context.Context, deposit entity.Deposit) error {
-	if deposit.Balance < 0 {
-		return databaseError
+func TestService_Reservation(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
 	}
-	m.items = append(m.items, deposit)
-	return nil
+	s := newTestService(testService{
+		deposits: deposits,
+	})
+
+	// reserve success -> money is held, but still belongs to the deposit
+	res, err := s.Reserve(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 600, Description: "order #1"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.ReservationActive, res.Status)
+		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 1000, balance.Total.Value)
+			assert.EqualValues(t, 400, balance.Available.Value)
+		}
+	}
+
+	// reserve more than available -> failure
+	_, err = s.Reserve(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 500})
+	assert.Error(t, err)
+
+	// withdrawal and transfer can't use held money
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -500})
+	assert.Error(t, err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 500})
+	assert.Error(t, err)
+
+	// partial capture -> money is withdrawn, the rest is still held
+	tx, err := s.Capture(ctx, res.Id, requests.CaptureRequest{Amount: 200})
+	if assert.NoError(t, err) {
+		assert.Equal(t, id1, tx.SenderId)
+		assert.EqualValues(t, 200, tx.Amount)
+		assert.Equal(t, "order #1", tx.Description)
+		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 800, balance.Total.Value)
+			assert.EqualValues(t, 400, balance.Available.Value)
+		}
+	}
+
+	// capture more than remaining -> failure
+	_, err = s.Capture(ctx, res.Id, requests.CaptureRequest{Amount: 500})
+	assert.Error(t, err)
+
+	// release -> the rest becomes available
+	res, err = s.Release(ctx, res.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.ReservationReleased, res.Status)
+		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 800, balance.Total.Value)
+			assert.EqualValues(t, 800, balance.Available.Value)
+		}
+	}
+
+	// capture released reservation -> failure
+	_, err = s.Capture(ctx, res.Id, requests.CaptureRequest{})
+	assert.Error(t, err)
+
+	// full capture
+	res, err = s.Reserve(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 300})
+	if assert.NoError(t, err) {
+		tx, err = s.Capture(ctx, res.Id, requests.CaptureRequest{})
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 300, tx.Amount)
+		}
+	}
+
+	// reservations of a non-existing deposit -> failure
+	_, err = s.Reserve(ctx, requests.ReserveRequest{OwnerId: id2.String(), Amount: 100})
+	assert.Error(t, err)
 }
 
-func (m *mockDepositRepository) Update(ctx context.Context, deposit entity.Deposit) error {
-	if deposit.Balance < 0 {
-		return databaseError
+func TestService_Idempotency(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
 	}
-	// simulate database error
-	if deposit.OwnerId.String() == "11111111-1111-1111-1111-111111111111" {
-		return databaseError
+	s := newTestService(testService{
+		deposits: deposits,
+	})
+
+	req := requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 300, IdempotencyKey: "key-1"}
+	tx, err := s.Transfer(ctx, req)
+	assert.NoError(t, err)
+
+	// replay returns the original transaction, money is moved once
+	replayed, err := s.Transfer(ctx, req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tx, replayed)
+		balance, _ := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+		assert.EqualValues(t, 700, balance.Total.Value)
 	}
 
-	for i, item := range m.items {
-		if item.OwnerId == deposit.OwnerId {
-			m.items[i] = deposit
-			return nil
+	// same key with a different payload -> conflict
+	req.Amount = 500
+	_, err = s.Transfer(ctx, req)
+	assert.Error(t, err)
+
+	// update with its own key
+	update := requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100, IdempotencyKey: "key-2"}
+	tx, err = s.Update(ctx, update)
+	assert.NoError(t, err)
+	replayed, err = s.Update(ctx, update)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tx, replayed)
+		balance, _ := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+		assert.EqualValues(t, 600, balance.Total.Value)
+	}
+
+	// no key -> no deduplication
+	update.IdempotencyKey = ""
+	_, _ = s.Update(ctx, update)
+	_, _ = s.Update(ctx, update)
+	balance, _ := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+	assert.EqualValues(t, 400, balance.Total.Value)
+}
+
+func TestService_Reverse(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	s := newTestService(testService{
+		deposits: deposits,
+	})
+	balanceOf := func(id uuid.UUID) int64 {
+		balance, _ := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id.String()})
+		return balance.Total.Value
+	}
+
+	transfer, err := s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 600})
+	assert.NoError(t, err)
+
+	// partial refund of a transfer
+	tx, err := s.Reverse(ctx, transfer.Id, requests.ReverseRequest{Amount: 200})
+	if assert.NoError(t, err) {
+		assert.Equal(t, transfer.Id, tx.ReversalOf)
+		assert.EqualValues(t, 600, balanceOf(id1))
+		assert.EqualValues(t, 400, balanceOf(id2))
+	}
+
+	// recipient spent the money -> insufficient funds
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id2.String(), Amount: -300})
+	assert.NoError(t, err)
+	_, err = s.Reverse(ctx, transfer.Id, requests.ReverseRequest{})
+	if assert.Error(t, err) {
+		assert.EqualValues(t, 100, balanceOf(id2))
+	}
+
+	// reversal of a top-up
+	topUp, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 500})
+	assert.NoError(t, err)
+	_, err = s.Reverse(ctx, topUp.Id, requests.ReverseRequest{})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 600, balanceOf(id1))
+	}
+
+	// reversal of a withdrawal
+	withdrawal, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100})
+	assert.NoError(t, err)
+	_, err = s.Reverse(ctx, withdrawal.Id, requests.ReverseRequest{})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 600, balanceOf(id1))
+	}
+
+	// non-existing transaction
+	_, err = s.Reverse(ctx, 100, requests.ReverseRequest{})
+	assert.Error(t, err)
+}
+
+func TestService_PendingTransactions(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	s := newTestService(testService{
+		deposits: deposits,
+	})
+	balanceOf := func(id uuid.UUID) DepositBalance {
+		balance, _ := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id.String()})
+		if len(balance.Deposits) == 0 {
+			return DepositBalance{}
 		}
+		return balance.Deposits[0]
 	}
 
-	return m.Create(ctx, deposit)
+	// pending withdrawal -> money is held, the balance is not changed
+	withdrawal, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -400, Pending: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionPending, withdrawal.Status)
+		balance := balanceOf(id1)
+		assert.EqualValues(t, 1000, balance.Total.Value)
+		assert.EqualValues(t, 600, balance.Available.Value)
+		assert.Equal(t, &money.Money{Value: 400, Currency: "RUB"}, balance.Pending)
+	}
+
+	// pending transfer -> sender's money is held, the recipient gets nothing yet
+	transfer, err := s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 500, Pending: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionPending, transfer.Status)
+		assert.EqualValues(t, 100, balanceOf(id1).Available.Value)
+		assert.EqualValues(t, 0, balanceOf(id2).Total.Value)
+	}
+
+	// held money can't be spent
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -200})
+	assert.Error(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -200, Pending: true})
+	assert.Error(t, err)
+
+	// pending transactions can't be reversed
+	_, err = s.Reverse(ctx, transfer.Id, requests.ReverseRequest{})
+	assert.Error(t, err)
+
+	// complete -> money is moved
+	tx, err := s.Complete(ctx, transfer.Id, requests.ChangeTransactionStatusRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionCompleted, tx.Status)
+		assert.EqualValues(t, 500, balanceOf(id1).Total.Value)
+		assert.EqualValues(t, 100, balanceOf(id1).Available.Value)
+		assert.EqualValues(t, 500, balanceOf(id2).Total.Value)
+	}
+
+	// fail -> held money becomes available again
+	tx, err = s.Fail(ctx, withdrawal.Id, requests.ChangeTransactionStatusRequest{Reason: "declined"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionFailed, tx.Status)
+		balance := balanceOf(id1)
+		assert.EqualValues(t, 500, balance.Total.Value)
+		assert.EqualValues(t, 500, balance.Available.Value)
+		assert.Nil(t, balance.Pending)
+	}
+
+	// finished transactions can't be completed or failed again
+	_, err = s.Complete(ctx, withdrawal.Id, requests.ChangeTransactionStatusRequest{})
+	assert.Error(t, err)
+	_, err = s.Fail(ctx, transfer.Id, requests.ChangeTransactionStatusRequest{})
+	assert.Error(t, err)
+
+	// pending top-up -> the money arrives once it is completed
+	topUp, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id2.String(), Amount: 300, Pending: true})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500, balanceOf(id2).Total.Value)
+		_, err = s.Complete(ctx, topUp.Id, requests.ChangeTransactionStatusRequest{})
+		assert.NoError(t, err)
+		assert.EqualValues(t, 800, balanceOf(id2).Total.Value)
+	}
+
+	// non-existing transaction
+	_, err = s.Complete(ctx, 100, requests.ChangeTransactionStatusRequest{})
+	assert.Error(t, err)
 }
 
-func (m *mockDepositRepository) Count(ctx context.Context) (int64, error) {
-	return int64(len(m.items)), nil
+func TestService_CreditLimit(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	s := newTestService(testService{
+		deposits: deposits,
+	})
+
+	// set the limit
+	dep, err := s.SetCreditLimit(ctx, requests.SetCreditLimitRequest{OwnerId: id1.String(), CreditLimit: 500})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500, dep.CreditLimit)
+		assert.EqualValues(t, 1000, dep.Balance)
+	}
+	balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, balance.Total.Value)
+		assert.EqualValues(t, 1500, balance.Available.Value)
+	}
+
+	// withdrawal and transfer may use the credit
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -1200})
+	assert.NoError(t, err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 300})
+	assert.NoError(t, err)
+	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, -500, balance.Total.Value)
+		assert.EqualValues(t, 0, balance.Available.Value)
+	}
+
+	// but not beyond it
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -1})
+	assert.Error(t, err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 1})
+	assert.Error(t, err)
+
+	// fail lowering the limit below the current debt
+	_, err = s.SetCreditLimit(ctx, requests.SetCreditLimitRequest{OwnerId: id1.String(), CreditLimit: 100})
+	assert.Error(t, err)
+
+	// recipients without a limit still can't go negative
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id2.String(), Amount: -301})
+	assert.Error(t, err)
+
+	// fail invalid request
+	_, err = s.SetCreditLimit(ctx, requests.SetCreditLimitRequest{OwnerId: id1.String(), CreditLimit: -100})
+	assert.Error(t, err)
 }
 
-// Fake exchange rates service provides exchange ratio=0.1 regardless of currency code.
-type mockExchangeRatesService struct{}
+func TestService_SpendingLimits(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 10000},
+	}
+	s := newTestService(testService{
+		deposits:       deposits,
+		spendingLimits: entity.SpendingLimits{DailyAmountLimit: 1000, DailyCountLimit: 3},
+	})
+	assertLimitExceeded := func(err error, msg string) {
+		if assert.Error(t, err) {
+			assert.Equal(t, http.StatusForbidden, err.(apperrors.ErrorResponse).Status)
+			assert.Contains(t, err.Error(), msg)
+		}
+	}
 
-func (s mockExchangeRatesService) Get(code string) (float32, error) {
-	return 0.1, nil
+	// exchanges between own deposits are not limited and not counted
+	_, err := s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id1.String(), Amount: 2000, RecipientCurrency: "USD"})
+	assert.NoError(t, err)
+
+	// withdrawals and transfers up to the limit
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -600})
+	assert.NoError(t, err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 400})
+	assert.NoError(t, err)
+
+	// fail exceeding the daily amount
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -1})
+	assertLimitExceeded(err, "The daily limit of 1000 RUB of outgoing money is exceeded")
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 1})
+	assertLimitExceeded(err, "The daily limit of 1000 RUB of outgoing money is exceeded")
+
+	// top-ups are not limited
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 5000})
+	assert.NoError(t, err)
+
+	// the limits of other users are independent
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id2.String(), Amount: -400})
+	assert.NoError(t, err)
+
+	// override the daily amount, the default daily count still applies
+	dep, err := s.SetSpendingLimits(ctx, requests.SetSpendingLimitsRequest{OwnerId: id1.String(), DailyAmountLimit: 5000})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 5000, dep.DailyAmountLimit)
+	}
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100})
+	assertLimitExceeded(err, "The daily limit of 3 outgoing operations is exceeded")
+
+	// fail invalid request
+	_, err = s.SetSpendingLimits(ctx, requests.SetSpendingLimitsRequest{OwnerId: id1.String(), DailyCountLimit: -1})
+	assert.Error(t, err)
+}
+
+func TestService_SpendingLimitsReservations(t *testing.T) {
+	id1 := uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 10000},
+	}
+	s := newTestService(testService{
+		deposits:       deposits,
+		spendingLimits: entity.SpendingLimits{DailyAmountLimit: 1000, DailyCountLimit: 3},
+	})
+
+	// the limits are checked when money is reserved
+	res, err := s.Reserve(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 800})
+	assert.NoError(t, err)
+	_, err = s.Reserve(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 300})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The daily limit of 1000 RUB of outgoing money is exceeded")
+	}
+
+	// reserved money is counted as spent
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -300})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The daily limit of 1000 RUB of outgoing money is exceeded")
+	}
+
+	// capture is approved by the reservation even if the limit has been lowered meanwhile
+	_, err = s.SetSpendingLimits(ctx, requests.SetSpendingLimitsRequest{OwnerId: id1.String(), DailyAmountLimit: 500})
+	assert.NoError(t, err)
+	_, err = s.Capture(ctx, res.Id, requests.CaptureRequest{Amount: 300})
+	assert.NoError(t, err)
+	_, err = s.Capture(ctx, res.Id, requests.CaptureRequest{})
+	assert.NoError(t, err)
+
+	// captured money is counted once
+	_, err = s.SetSpendingLimits(ctx, requests.SetSpendingLimitsRequest{OwnerId: id1.String(), DailyAmountLimit: 1000, DailyCountLimit: 4})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -200})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -1})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The daily limit of 1000 RUB of outgoing money is exceeded")
+	}
+}
+
+func TestService_SpendingLimitsPerUser(t *testing.T) {
+	id1 := uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 100000},
+		{OwnerId: id1, Currency: "USD", Balance: 10000},
+	}
+	// a withdrawal made yesterday and completed today is counted as of yesterday
+	now := time.Now().UTC()
+	transactionRepo := &mockTransactionRepository{items: []entity.Transaction{
+		{Id: 1, SenderId: id1, Amount: 50000, Currency: "RUB", Status: entity.TransactionCompleted, TransactionDate: now, CreatedAt: now.AddDate(0, 0, -1)},
+	}, lastInsertedId: 1}
+	s := newTestService(testService{
+		deposits:        deposits,
+		transactionRepo: transactionRepo,
+		spendingLimits:  entity.SpendingLimits{DailyAmountLimit: 10000, DailyCountLimit: 4},
+	})
+
+	// the money taken from all the deposits of the user is counted (fake exchange rate RUB/USD=0.1 is used)
+	_, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -500, Currency: "USD"})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -4000})
+	assert.NoError(t, err)
+
+	// the default limit of 100.00 RUB is 10.00 USD for the USD deposit, 9.00 USD are already spent
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -101, Currency: "USD"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The daily limit of 1000 USD of outgoing money is exceeded")
+	}
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100, Currency: "USD"})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -1})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The daily limit of 10000 RUB of outgoing money is exceeded")
+	}
+
+	// operations on all the deposits are counted
+	_, err = s.SetSpendingLimits(ctx, requests.SetSpendingLimitsRequest{OwnerId: id1.String(), DailyAmountLimit: 100000})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -1})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -1})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The daily limit of 4 outgoing operations is exceeded")
+	}
+}
+
+func TestService_Status(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000, Status: entity.DepositActive},
+		{OwnerId: id2, Currency: "RUB", Balance: 1000, Status: entity.DepositActive},
+	}
+	repo := &mockDepositRepository{items: deposits}
+	s := newTestService(testService{
+		deposits: deposits,
+		repo:     repo,
+	})
+	setStatus := func(id uuid.UUID, status string) error {
+		_, err := s.SetStatus(ctx, requests.SetStatusRequest{
+			OwnerId:   id.String(),
+			Status:    status,
+			ChangedBy: "support",
+			Reason:    "investigation #1",
+		})
+		return err
+	}
+	assertBlocked := func(err error) {
+		if assert.Error(t, err) {
+			assert.Equal(t, apperrors.Blocked(err.Error()), err)
+		}
+	}
+
+	// frozen for debits: can receive, but can't send
+	assert.NoError(t, setStatus(id1, entity.DepositFrozenDebit))
+	_, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 100})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100})
+	assertBlocked(err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 100})
+	assertBlocked(err)
+	_, err = s.Reserve(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 100})
+	assertBlocked(err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id2.String(), RecipientId: id1.String(), Amount: 100})
+	assert.NoError(t, err)
+
+	// frozen completely: can neither receive nor send
+	assert.NoError(t, setStatus(id1, entity.DepositFrozenAll))
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 100})
+	assertBlocked(err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100})
+	assertBlocked(err)
+
+	// active again
+	assert.NoError(t, setStatus(id1, entity.DepositActive))
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 1200})
+	assert.NoError(t, err)
+
+	// fail closing a deposit with a non-zero balance
+	err = setStatus(id2, entity.DepositClosed)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusConflict, err.(apperrors.ErrorResponse).Status)
+	}
+
+	// close the emptied deposit
+	assert.NoError(t, setStatus(id1, entity.DepositClosed))
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 100})
+	assertBlocked(err)
+	_, err = s.Transfer(ctx, requests.TransferRequest{SenderId: id2.String(), RecipientId: id1.String(), Amount: 100})
+	assertBlocked(err)
+
+	// every change is recorded
+	if assert.Len(t, repo.statusChanges, 4) {
+		assert.Equal(t, entity.DepositStatusChange{
+			Id:             4,
+			OwnerId:        id1,
+			Currency:       "RUB",
+			PreviousStatus: entity.DepositActive,
+			Status:         entity.DepositClosed,
+			ChangedBy:      "support",
+			Reason:         "investigation #1",
+			ChangedAt:      repo.statusChanges[3].ChangedAt,
+		}, repo.statusChanges[3])
+	}
+
+	// fail invalid request
+	assert.Error(t, setStatus(id1, "frozen"))
+}
+
+func TestService_MultiCurrency(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+		{OwnerId: id1, Currency: "USD", Balance: 50},
+	}
+	ledgerService := ledger.NewService(newMockLedgerRepository(deposits...), logger)
+	depositRepo := &mockDepositRepository{items: deposits}
+	s := newTestService(testService{
+		repo:          depositRepo,
+		ledgerService: ledgerService,
+	})
+	balanceOf := func(id uuid.UUID, currency string) int64 {
+		dep, _ := depositRepo.Get(ctx, id, currency)
+		return dep.Balance
+	}
+
+	// deposits in different currencies are independent
+	_, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -20, Currency: "USD"})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 30, balanceOf(id1, "USD"))
+		assert.EqualValues(t, 1000, balanceOf(id1, "RUB"))
+	}
+
+	// total balance is converted into the requested currency, each deposit is reported in its own one
+	balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1300, balance.Total.Value)
+		assert.Equal(t, []DepositBalance{
+			{Currency: "RUB", Total: money.Money{Value: 1000, Currency: "RUB"}, Available: money.Money{Value: 1000, Currency: "RUB"}},
+			{Currency: "USD", Total: money.Money{Value: 30, Currency: "USD"}, Available: money.Money{Value: 30, Currency: "USD"}},
+		}, balance.Deposits)
+	}
+
+	// no money in a currency the owner has no deposit in
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100, Currency: "EUR"})
+	assert.Error(t, err)
+
+	// cross-currency transfer (fake exchange rate RUB/USD=0.1 is used)
+	tx, err := s.Transfer(ctx, requests.TransferRequest{
+		SenderId:          id1.String(),
+		RecipientId:       id2.String(),
+		Amount:            500,
+		RecipientCurrency: "USD",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "RUB", tx.Currency)
+		assert.Equal(t, "USD", tx.RecipientCurrency)
+		assert.EqualValues(t, 50, tx.RecipientAmount)
+		assert.InDelta(t, 0.1, tx.ExchangeRate, 1e-6)
+		assert.EqualValues(t, 500, balanceOf(id1, "RUB"))
+		assert.EqualValues(t, 50, balanceOf(id2, "USD"))
+	}
+
+	// conversion between own deposits
+	_, err = s.Transfer(ctx, requests.TransferRequest{
+		SenderId:          id1.String(),
+		RecipientId:       id1.String(),
+		Amount:            10,
+		Currency:          "USD",
+		RecipientCurrency: "RUB",
+	})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 20, balanceOf(id1, "USD"))
+		assert.EqualValues(t, 600, balanceOf(id1, "RUB"))
+	}
+
+	// cross-currency transfer is reversed at the original rate
+	_, err = s.Reverse(ctx, tx.Id, requests.ReverseRequest{Amount: 100})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 700, balanceOf(id1, "RUB"))
+		assert.EqualValues(t, 40, balanceOf(id2, "USD"))
+	}
+
+	// all balances match the ledger, conversions are balanced by the exchange account
+	for _, dep := range depositRepo.items {
+		assert.NoError(t, ledgerService.Verify(ctx, dep.OwnerId, dep.Currency, dep.Balance))
+	}
+	exchanged, err := ledgerService.Balance(ctx, entity.ExchangeAccount, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500-100-100, exchanged)
+	}
+}
+
+func TestService_Quote(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+	}
+	// a quote locked at a rate which differs from the current fake rate RUB/USD=0.1
+	locked := entity.Quote{
+		Id: uuid.New(), Currency: "RUB", Amount: 300, TargetCurrency: "USD", TargetAmount: 60, Rate: 0.2,
+		Status: entity.QuoteActive, CreatedAt: time.Now().UTC(), ExpiresAt: time.Now().UTC().Add(time.Minute),
+	}
+	expired := entity.Quote{
+		Id: uuid.New(), Currency: "RUB", Amount: 100, TargetCurrency: "USD", TargetAmount: 20, Rate: 0.2,
+		Status: entity.QuoteActive, CreatedAt: time.Now().UTC().Add(-time.Hour), ExpiresAt: time.Now().UTC().Add(-time.Minute),
+	}
+	depositRepo := &mockDepositRepository{items: deposits}
+	quoteService := quote.NewService(&mockQuoteRepository{items: []entity.Quote{locked, expired}}, exchangeService, time.Hour, money.RoundHalfEven, logger)
+	s := newTestService(testService{
+		deposits:     deposits,
+		repo:         depositRepo,
+		quoteService: quoteService,
+	})
+	balanceOf := func(id uuid.UUID, currency string) int64 {
+		dep, _ := depositRepo.Get(ctx, id, currency)
+		return dep.Balance
+	}
+	transfer := func(amount int64, quoteId uuid.UUID) requests.TransferRequest {
+		return requests.TransferRequest{
+			SenderId:          id1.String(),
+			RecipientId:       id2.String(),
+			Amount:            amount,
+			RecipientCurrency: "USD",
+			QuoteId:           quoteId.String(),
+		}
+	}
+
+	// fail transfer doesn't match the quote
+	_, err := s.Transfer(ctx, transfer(200, locked.Id))
+	assert.Error(t, err)
+
+	// success transfer is converted at the locked rate
+	tx, err := s.Transfer(ctx, transfer(300, locked.Id))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 60, tx.RecipientAmount)
+		assert.Equal(t, 0.2, tx.ExchangeRate)
+		assert.EqualValues(t, 700, balanceOf(id1, "RUB"))
+		assert.EqualValues(t, 60, balanceOf(id2, "USD"))
+	}
+
+	// fail quote has already been used
+	_, err = s.Transfer(ctx, transfer(300, locked.Id))
+	assert.Error(t, err)
+
+	// fail quote has expired
+	_, err = s.Transfer(ctx, transfer(100, expired.Id))
+	assert.Error(t, err)
+
+	// fail unknown quote
+	_, err = s.Transfer(ctx, transfer(100, uuid.New()))
+	assert.Error(t, err)
+	assert.EqualValues(t, 700, balanceOf(id1, "RUB"))
+
+	// success quote made at the current rate credits the quoted amount
+	q, err := quoteService.Create(ctx, requests.QuoteRequest{Amount: 255, TargetCurrency: "USD"})
+	if assert.NoError(t, err) {
+		tx, err = s.Transfer(ctx, transfer(255, q.Id))
+		if assert.NoError(t, err) {
+			assert.Equal(t, q.TargetAmount, tx.RecipientAmount)
+			assert.Equal(t, q.Rate, tx.ExchangeRate)
+		}
+	}
+}
+
+func TestService_GetHistory(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	date := func(year int) time.Time { return time.Date(year, 6, 1, 0, 0, 0, 0, time.UTC) }
+	transactionRepo := &mockTransactionRepository{items: []entity.Transaction{
+		{Id: 1, RecipientId: id1, Amount: 1000, Currency: "RUB", TransactionDate: date(2021)},
+		{Id: 2, SenderId: id1, RecipientId: id2, Amount: 500, Currency: "RUB", RecipientAmount: 50, RecipientCurrency: "USD", TransactionDate: date(2020)},
+		{Id: 3, SenderId: id2, RecipientId: id1, Amount: 10, Currency: "USD", TransactionDate: date(2021)},
+		{Id: 4, RecipientId: id1, Amount: 300, Currency: "RUB", TransactionDate: date(2019)},
+	}}
+	s := newTestService(testService{
+		transactionRepo: transactionRepo,
+	})
+	converted := func(history transaction.History) []interface{} {
+		var result []interface{}
+		for _, item := range history.Transactions {
+			if item.ConvertedAmount == nil {
+				result = append(result, nil)
+			} else {
+				result = append(result, *item.ConvertedAmount)
+			}
+		}
+		return result
+	}
+
+	// nothing is converted unless requested
+	history, err := s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String()})
+	if assert.NoError(t, err) {
+		assert.Empty(t, history.ConvertedCurrency)
+		assert.Equal(t, []interface{}{nil, nil, nil, nil}, converted(history))
+	}
+
+	// owner's side of each transaction is converted at the rates as of its date, unknown rates are skipped
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), ConvertTo: "USD"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "USD", history.ConvertedCurrency)
+		assert.Equal(t, []interface{}{int64(100), int64(100), int64(10), nil}, converted(history))
+	}
+
+	// minor units of the currencies are respected and halves are rounded to even: 10.00 and 5.00 RUB
+	// at 0.1 JPY per RUB, 0.10 USD at 1 JPY per USD
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), ConvertTo: "JPY"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{int64(1), int64(0), int64(0), nil}, converted(history))
+	}
+
+	// the recipient side is converted from the credited currency
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id2.String(), ConvertTo: "RUB"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{int64(250), int64(100)}, converted(history))
+	}
+
+	// fail invalid currency
+	_, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), ConvertTo: "usd"})
+	assert.Error(t, err)
+}
+
+func TestService_BalancePrecision(t *testing.T) {
+	id1, id2, id3, id4 := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1600000001},
+		{OwnerId: id2, Currency: "RUB", Balance: 5},
+		{OwnerId: id2, Currency: "EUR", Balance: 1},
+		{OwnerId: id3, Currency: "JPY", Balance: 100},
+		{OwnerId: id4, Currency: "RUB", Balance: 25},
+	}
+	newService := func(rounding money.RoundingMode) Service {
+		return newTestService(testService{
+			deposits: deposits,
+			rounding: rounding,
+		})
+	}
+	s := newService(money.RoundHalfEven)
+
+	// large balances are exact
+	balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, money.Money{Value: 1600000001, Currency: "RUB"}, balance.Total)
+		assert.Equal(t, "16000000.01", balance.Total.String())
+	}
+	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String(), Currency: "USD"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1600000.00", balance.Total.String())
+	}
+
+	// minor units of the currencies are respected (fake exchange rate RUB/JPY=0.1 is used)
+	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id3.String()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1000.00", balance.Total.String())
+	}
+	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String(), Currency: "JPY"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1600000", balance.Total.String())
+	}
+
+	// converted amounts are summed up before rounding: 0.5 + 1 USD cents
+	// halves are rounded according to the mode: 2.5 USD cents
+	for rounding, expected := range map[money.RoundingMode][2]int64{
+		money.RoundHalfEven: {2, 2},
+		money.RoundHalfUp:   {2, 3},
+		money.RoundDown:     {1, 2},
+	} {
+		s := newService(rounding)
+		balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String(), Currency: "USD"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected[0], balance.Total.Value, rounding)
+		}
+		balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id4.String(), Currency: "USD"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected[1], balance.Total.Value, rounding)
+		}
+	}
+}
+
+func TestService_BalanceCurrencies(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+		{OwnerId: id1, Currency: "USD", Balance: 50, CreditLimit: 100},
+	}
+	exchangeService := &countingExchangeRatesService{}
+	s := newTestService(testService{
+		deposits:        deposits,
+		exchangeService: exchangeService,
+	})
+
+	// the balance is converted into each currency, all rates are resolved at once
+	// (fake exchange rates RUB/USD=RUB/EUR=0.1 are used)
+	balance, err := s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String(), Currencies: []string{"RUB", "USD", "EUR"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, exchangeService.calls)
+		assert.Equal(t, money.Money{Value: 1500, Currency: "RUB"}, balance.Total)
+		assert.Equal(t, map[string]ConvertedBalance{
+			"RUB": {
+				Total:         money.Money{Value: 1500, Currency: "RUB"},
+				Available:     money.Money{Value: 2500, Currency: "RUB"},
+				Rate:          1,
+				RateTimestamp: ratesFetchedAt,
+			},
+			"USD": {
+				Total:         money.Money{Value: 150, Currency: "USD"},
+				Available:     money.Money{Value: 250, Currency: "USD"},
+				Rate:          0.1,
+				RateTimestamp: ratesFetchedAt,
+			},
+			"EUR": {
+				Total:         money.Money{Value: 150, Currency: "EUR"},
+				Available:     money.Money{Value: 250, Currency: "EUR"},
+				Rate:          0.1,
+				RateTimestamp: ratesFetchedAt,
+			},
+		}, balance.Converted)
+	}
+
+	// nothing is converted unless requested
+	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String()})
+	if assert.NoError(t, err) {
+		assert.Nil(t, balance.Converted)
+	}
+
+	// the rates are not looked up if there is nothing to convert
+	exchangeService.calls = 0
+	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String()})
+	if assert.NoError(t, err) {
+		assert.Zero(t, exchangeService.calls)
+		assert.Equal(t, money.Money{Value: 0, Currency: "RUB"}, balance.Total)
+	}
+
+	// the balance of a user without deposits is converted too
+	balance, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id2.String(), Currencies: []string{"USD"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, money.Money{Value: 0, Currency: "USD"}, balance.Converted["USD"].Total)
+	}
+
+	// fail invalid currencies
+	_, err = s.GetBalance(ctx, requests.GetBalanceRequest{OwnerId: id1.String(), Currencies: []string{"usd"}})
+	assert.Error(t, err)
+}
+
+func TestService_Statement(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+		{OwnerId: id2, Currency: "RUB", Balance: 2000},
+	}
+	s := newTestService(testService{
+		deposits: deposits,
+	})
+
+	_, err := s.Transfer(ctx, requests.TransferRequest{SenderId: id2.String(), RecipientId: id1.String(), Amount: 300})
+	assert.NoError(t, err)
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100, Description: "coffee"})
+	assert.NoError(t, err)
+
+	today := time.Now().UTC().Format(requests.DateLayout)
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format(requests.DateLayout)
+
+	// success CSV with balances and entries
+	var buf bytes.Buffer
+	err = s.Statement(ctx, requests.StatementRequest{OwnerId: id1.String(), DateFrom: yesterday, DateTo: today}, &buf)
+	if assert.NoError(t, err) {
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if assert.NoError(t, err) && assert.Len(t, rows, 5) {
+			assert.Equal(t, []string{"opening_balance", "", "", "RUB", "10.00"}, rows[1][2:7])
+			assert.Equal(t, []string{"incoming_transfer", id2.String(), "3.00", "RUB", "13.00"}, rows[2][2:7])
+			assert.Equal(t, []string{"withdrawal", "", "-1.00", "RUB", "12.00", "coffee"}, rows[3][2:])
+			assert.Equal(t, []string{"closing_balance", "", "", "RUB", "12.00"}, rows[4][2:7])
+		}
+	}
+
+	// success period before the transactions
+	buf.Reset()
+	err = s.Statement(ctx, requests.StatementRequest{OwnerId: id2.String(), DateFrom: yesterday, DateTo: yesterday}, &buf)
+	if assert.NoError(t, err) {
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if assert.NoError(t, err) && assert.Len(t, rows, 3) {
+			assert.Equal(t, "20.00", rows[1][6])
+			assert.Equal(t, "20.00", rows[2][6])
+		}
+	}
+
+	// success camt.053
+	buf.Reset()
+	err = s.Statement(ctx, requests.StatementRequest{OwnerId: id2.String(), DateFrom: today, DateTo: today, Format: "camt053"}, &buf)
+	if assert.NoError(t, err) {
+		assert.Contains(t, buf.String(), "<Cd>CLBD</Cd>")
+		assert.Contains(t, buf.String(), `<Amt Ccy="RUB">17.00</Amt>`)
+	}
+
+	// fail invalid request, nothing is written
+	buf.Reset()
+	err = s.Statement(ctx, requests.StatementRequest{OwnerId: id1.String(), DateFrom: today, DateTo: yesterday}, &buf)
+	if assert.Error(t, err) {
+		assert.Zero(t, buf.Len())
+	}
+}
+
+func TestService_ExchangeBetweenOwnDeposits(t *testing.T) {
+	id := uuid.New()
+	deposits := []entity.Deposit{
+		{OwnerId: id, Currency: "RUB", Balance: 1000},
+		{OwnerId: id, Currency: "USD", Balance: 100},
+	}
+	depositRepo := &mockDepositRepository{items: deposits}
+	s := newTestService(testService{
+		deposits: deposits,
+		repo:     depositRepo,
+	})
+	balanceOf := func(currency string) int64 {
+		dep, _ := depositRepo.Get(ctx, id, currency)
+		return dep.Balance
+	}
+
+	// fail transfer to itself in the same currency
+	_, err := s.Transfer(ctx, requests.TransferRequest{SenderId: id.String(), RecipientId: id.String(), Amount: 10})
+	if assert.Error(t, err) {
+		assert.EqualValues(t, 1000, balanceOf("RUB"))
+	}
+
+	// success exchange (fake exchange rate USD/RUB=10 is used), each side has its own balance
+	tx, err := s.Transfer(ctx, requests.TransferRequest{
+		SenderId:          id.String(),
+		RecipientId:       id.String(),
+		Amount:            10,
+		Currency:          "USD",
+		RecipientCurrency: "RUB",
+	})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 90, balanceOf("USD"))
+		assert.EqualValues(t, 1100, balanceOf("RUB"))
+		if assert.NotNil(t, tx.BalanceAfter(id, "USD")) && assert.NotNil(t, tx.BalanceAfter(id, "RUB")) {
+			assert.EqualValues(t, 90, *tx.BalanceAfter(id, "USD"))
+			assert.EqualValues(t, 1100, *tx.BalanceAfter(id, "RUB"))
+		}
+		assert.Nil(t, tx.BalanceAfter(id, "EUR"))
+	}
+
+	// statement of each deposit shows its own side of the exchange
+	today := time.Now().UTC().Format(requests.DateLayout)
+	var buf bytes.Buffer
+	err = s.Statement(ctx, requests.StatementRequest{OwnerId: id.String(), Currency: "USD", DateFrom: today, DateTo: today}, &buf)
+	if assert.NoError(t, err) {
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if assert.NoError(t, err) && assert.Len(t, rows, 4) {
+			assert.Equal(t, []string{"outgoing_transfer", id.String(), "-0.10", "USD", "0.90"}, rows[2][2:7])
+			assert.Equal(t, []string{"closing_balance", "", "", "USD", "0.90"}, rows[3][2:7])
+		}
+	}
+	buf.Reset()
+	err = s.Statement(ctx, requests.StatementRequest{OwnerId: id.String(), Currency: "RUB", DateFrom: today, DateTo: today}, &buf)
+	if assert.NoError(t, err) {
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if assert.NoError(t, err) && assert.Len(t, rows, 4) {
+			assert.Equal(t, []string{"incoming_transfer", id.String(), "1.00", "RUB", "11.00"}, rows[2][2:7])
+			assert.Equal(t, []string{"closing_balance", "", "", "RUB", "11.00"}, rows[3][2:7])
+		}
+	}
+}
+
+func TestService_ConcurrentTransfers(t *testing.T) {
+	db := test.DB(t)
+	test.ResetTables(t, db, "deposit", "transaction", "posting", "reservation", "idempotency_key")
+	repo := NewRepository(db, logger)
+	ledgerService := ledger.NewService(ledger.NewRepository(db, logger), logger)
+	s := newTestService(testService{
+		repo:               repo,
+		transactionRepo:    transaction.NewRepository(db, logger),
+		ledgerService:      ledgerService,
+		reservationService: reservation.NewService(reservation.NewRepository(db, logger), time.Hour, logger),
+		idempotencyService: idempotency.NewService(idempotency.NewRepository(db, logger), time.Hour, logger),
+	})
+
+	const (
+		accounts       = 10
+		initialBalance = 1000
+		transfers      = 500
+		workers        = 20
+	)
+
+	ids := make([]uuid.UUID, accounts)
+	for i := range ids {
+		ids[i] = uuid.New()
+		_, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: ids[i].String(), Amount: initialBalance})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	// a deposit which is created concurrently by many transfers at once
+	newId := uuid.New()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	errs := make(chan error, transfers)
+	for i := 0; i < transfers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// transfers go in both directions between the same pairs of deposits
+			sender, recipient := ids[i%accounts], ids[(i/accounts+i+1)%accounts]
+			if i%2 == 1 {
+				sender, recipient = recipient, sender
+			}
+			if i%10 == 0 {
+				recipient = newId
+			}
+			if sender == recipient {
+				return
+			}
+
+			errs <- db.Transactional(ctx, func(ctx context.Context) error {
+				_, err := s.Transfer(ctx, requests.TransferRequest{
+					SenderId:    sender.String(),
+					RecipientId: recipient.String(),
+					Amount:      int64(i%300 + 1),
+				})
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	// the only acceptable failure is insufficient funds
+	for err := range errs {
+		if err != nil {
+			httpErr, ok := err.(interface{ StatusCode() int })
+			if assert.True(t, ok, err.Error()) {
+				assert.Equal(t, http.StatusForbidden, httpErr.StatusCode(), err.Error())
+			}
+		}
+	}
+
+	// money is conserved, no balance is negative and all balances match the ledger
+	var total int64
+	for _, id := range append(ids, newId) {
+		dep, err := repo.Get(ctx, id, entity.DefaultCurrency)
+		if assert.NoError(t, err) {
+			assert.GreaterOrEqual(t, dep.Balance, int64(0))
+			assert.NoError(t, ledgerService.Verify(ctx, id, dep.Currency, dep.Balance))
+			total += dep.Balance
+		}
+	}
+	assert.EqualValues(t, accounts*initialBalance, total)
+}
+
+func TestService_ConcurrentCaptures(t *testing.T) {
+	db := test.DB(t)
+	test.ResetTables(t, db, "deposit", "transaction", "posting", "reservation", "idempotency_key")
+	repo := NewRepository(db, logger)
+	ledgerService := ledger.NewService(ledger.NewRepository(db, logger), logger)
+	reservationService := reservation.NewService(reservation.NewRepository(db, logger), time.Hour, logger)
+	s := newTestService(testService{
+		repo:               repo,
+		transactionRepo:    transaction.NewRepository(db, logger),
+		ledgerService:      ledgerService,
+		reservationService: reservationService,
+		idempotencyService: idempotency.NewService(idempotency.NewRepository(db, logger), time.Hour, logger),
+	})
+
+	const (
+		initialBalance = 1000
+		reserved       = 500
+		captures       = 20
+	)
+
+	id := uuid.New()
+	_, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: id.String(), Amount: initialBalance})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	res, err := s.Reserve(ctx, requests.ReserveRequest{OwnerId: id.String(), Amount: reserved})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// every capture tries to take the whole reservation, and a release races with them
+	var wg sync.WaitGroup
+	errs := make(chan error, captures+1)
+	for i := 0; i <= captures; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.Transactional(ctx, func(ctx context.Context) error {
+				if i == captures {
+					_, err := s.Release(ctx, res.Id)
+					return err
+				}
+				_, err := s.Capture(ctx, res.Id, requests.CaptureRequest{Amount: reserved})
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	// exactly one operation succeeds, the others find the reservation captured or released
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		httpErr, ok := err.(interface{ StatusCode() int })
+		if assert.True(t, ok, err.Error()) {
+			assert.Equal(t, http.StatusConflict, httpErr.StatusCode(), err.Error())
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+
+	// the deposit is charged at most the reserved amount
+	dep, err := repo.Get(ctx, id, entity.DefaultCurrency)
+	if assert.NoError(t, err) {
+		assert.GreaterOrEqual(t, dep.Balance, int64(initialBalance-reserved))
+		assert.NoError(t, ledgerService.Verify(ctx, id, dep.Currency, dep.Balance))
+	}
+	res, err = reservationService.Get(ctx, res.Id)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, entity.ReservationActive, res.Status)
+	}
+}
+
+func TestService_ConcurrentReversals(t *testing.T) {
+	db := test.DB(t)
+	test.ResetTables(t, db, "deposit", "transaction", "posting", "reservation", "idempotency_key")
+	repo := NewRepository(db, logger)
+	ledgerService := ledger.NewService(ledger.NewRepository(db, logger), logger)
+	transactionRepo := transaction.NewRepository(db, logger)
+	s := newTestService(testService{
+		repo:               repo,
+		transactionRepo:    transactionRepo,
+		ledgerService:      ledgerService,
+		reservationService: reservation.NewService(reservation.NewRepository(db, logger), time.Hour, logger),
+		idempotencyService: idempotency.NewService(idempotency.NewRepository(db, logger), time.Hour, logger),
+	})
+
+	const (
+		initialBalance = 1000
+		transferred    = 500
+		reversals      = 20
+		reversed       = 100
+	)
+
+	sender, recipient := uuid.New(), uuid.New()
+	_, err := s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: sender.String(), Amount: initialBalance})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// the recipient has more money than transferred, so only the remaining amount limits the reversals
+	_, err = s.Update(ctx, requests.UpdateBalanceRequest{OwnerId: recipient.String(), Amount: initialBalance})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tx, err := s.Transfer(ctx, requests.TransferRequest{SenderId: sender.String(), RecipientId: recipient.String(), Amount: transferred})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, reversals)
+	for i := 0; i < reversals; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.Transactional(ctx, func(ctx context.Context) error {
+				_, err := s.Reverse(ctx, tx.Id, requests.ReverseRequest{Amount: reversed})
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// the remaining amount is reversed exactly once, the other reversals are rejected
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		httpErr, ok := err.(interface{ StatusCode() int })
+		if assert.True(t, ok, err.Error()) {
+			assert.Contains(t, []int{http.StatusBadRequest, http.StatusConflict}, httpErr.StatusCode(), err.Error())
+		}
+	}
+	assert.Equal(t, transferred/reversed, succeeded)
+
+	original, err := transactionRepo.Get(ctx, tx.Id)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, transferred, original.ReversedAmount)
+		assert.Equal(t, entity.TransactionReversed, original.Status)
+	}
+	for _, id := range []uuid.UUID{sender, recipient} {
+		dep, err := repo.Get(ctx, id, entity.DefaultCurrency)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, initialBalance, dep.Balance)
+			assert.NoError(t, ledgerService.Verify(ctx, id, dep.Currency, dep.Balance))
+		}
+	}
+}
+
+// testService lists the dependencies of a deposit service under test. The ones which are not set
+// are replaced with in-memory mocks, deposits seed both the deposit repository and the ledger.
+type testService struct {
+	deposits           []entity.Deposit
+	repo               Repository
+	transactionRepo    transaction.Repository
+	ledgerService      ledger.Service
+	reservationService reservation.Service
+	idempotencyService idempotency.Service
+	exchangeService    rates.ExchangeRatesService
+	quoteService       quote.Service
+	spendingLimits     entity.SpendingLimits
+	rounding           money.RoundingMode
+}
+
+func newTestService(deps testService) Service {
+	if deps.rounding == "" {
+		deps.rounding = money.RoundHalfEven
+	}
+	if deps.repo == nil {
+		deps.repo = &mockDepositRepository{items: deps.deposits}
+	}
+	if deps.transactionRepo == nil {
+		deps.transactionRepo = &mockTransactionRepository{}
+	}
+	if deps.ledgerService == nil {
+		deps.ledgerService = ledger.NewService(newMockLedgerRepository(deps.deposits...), logger)
+	}
+	if deps.reservationService == nil {
+		deps.reservationService = reservation.NewService(&mockReservationRepository{}, time.Hour, logger)
+	}
+	if deps.idempotencyService == nil {
+		deps.idempotencyService = idempotency.NewService(&mockIdempotencyKeyRepository{}, time.Hour, logger)
+	}
+	if deps.exchangeService == nil {
+		deps.exchangeService = exchangeService
+	}
+	if deps.quoteService == nil {
+		deps.quoteService = quote.NewService(&mockQuoteRepository{}, deps.exchangeService, time.Hour, deps.rounding, logger)
+	}
+	return NewService(
+		deps.repo,
+		transaction.NewService(deps.transactionRepo, deps.rounding, logger),
+		deps.ledgerService,
+		deps.reservationService,
+		deps.idempotencyService,
+		deps.exchangeService,
+		deps.quoteService,
+		maxBatchSize,
+		deps.spendingLimits,
+		deps.rounding,
+		logger,
+	)
+}
+
+type mockDepositRepository struct {
+	items         []entity.Deposit
+	statusChanges []entity.DepositStatusChange
+	// locks lists the owners and the Deposits in the order they were locked in
+	locks []string
+}
+
+func (m *mockDepositRepository) Get(ctx context.Context, ownerId uuid.UUID, currency string) (entity.Deposit, error) {
+	for _, item := range m.items {
+		if item.OwnerId == ownerId && item.Currency == currency {
+			return item, nil
+		}
+	}
+	return entity.Deposit{}, sql.ErrNoRows
+}
+
+func (m *mockDepositRepository) List(ctx context.Context, ownerId uuid.UUID) ([]entity.Deposit, error) {
+	var deposits []entity.Deposit
+	for _, item := range m.items {
+		if item.OwnerId == ownerId {
+			deposits = append(deposits, item)
+		}
+	}
+	return deposits, nil
+}
+
+func (m *mockDepositRepository) Lock(ctx context.Context, ownerId uuid.UUID, currency string) (entity.Deposit, error) {
+	m.locks = append(m.locks, ownerId.String()+"/"+currency)
+	dep, err := m.Get(ctx, ownerId, currency)
+	if err == sql.ErrNoRows {
+		dep = entity.Deposit{OwnerId: ownerId, Currency: currency, Status: entity.DepositActive}
+		err = m.Create(ctx, dep)
+	}
+	return dep, err
+}
+
+func (m *mockDepositRepository) LockOwner(ctx context.Context, ownerId uuid.UUID) error {
+	m.locks = append(m.locks, ownerId.String())
+	return nil
+}
+
+func (m *mockDepositRepository) Create(ctx context.Context, deposit entity.Deposit) error {
+	if deposit.Balance+deposit.CreditLimit < 0 {
+		return databaseError
+	}
+	m.items = append(m.items, deposit)
+	return nil
+}
+
+func (m *mockDepositRepository) Update(ctx context.Context, deposit entity.Deposit) error {
+	if deposit.Balance+deposit.CreditLimit < 0 {
+		return databaseError
+	}
+	// simulate database error
+	if deposit.OwnerId.String() == "11111111-1111-1111-1111-111111111111" {
+		return databaseError
+	}
+
+	for i, item := range m.items {
+		if item.OwnerId == deposit.OwnerId && item.Currency == deposit.Currency {
+			m.items[i] = deposit
+			return nil
+		}
+	}
+
+	return m.Create(ctx, deposit)
+}
+
+func (m *mockDepositRepository) CreateStatusChange(ctx context.Context, c *entity.DepositStatusChange) error {
+	c.Id = int64(len(m.statusChanges) + 1)
+	m.statusChanges = append(m.statusChanges, *c)
+	return nil
+}
+
+func (m *mockDepositRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
+
+type mockLedgerRepository struct {
+	items          []entity.Posting
+	lastInsertedId int64
+}
+
+// newMockLedgerRepository creates a ledger repository holding opening top-up postings for the given deposits,
+// so that their balances match the ledger.
+func newMockLedgerRepository(deposits ...entity.Deposit) *mockLedgerRepository {
+	m := &mockLedgerRepository{}
+	for _, dep := range deposits {
+		for _, p := range ledger.Postings(entity.Transaction{RecipientId: dep.OwnerId, Amount: dep.Balance, Currency: dep.Currency}) {
+			if p.AccountId == dep.OwnerId {
+				p.BalanceAfter = dep.Balance
+			}
+			_ = m.Create(ctx, &p)
+		}
+	}
+	return m
+}
+
+func (m *mockLedgerRepository) Create(ctx context.Context, p *entity.Posting) error {
+	p.Id = m.lastInsertedId
+	m.lastInsertedId++
+	m.items = append(m.items, *p)
+	return nil
+}
+
+func (m *mockLedgerRepository) Balance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error) {
+	var balance int64
+	for _, p := range m.items {
+		if p.AccountId == accountId && p.Currency == currency {
+			balance += p.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (m *mockLedgerRepository) LastBalance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error) {
+	var balance int64
+	for _, p := range m.items {
+		if p.AccountId == accountId && p.Currency == currency {
+			balance = p.BalanceAfter
+		}
+	}
+	return balance, nil
+}
+
+func (m *mockLedgerRepository) BalanceBefore(ctx context.Context, accountId uuid.UUID, currency string, before time.Time) (int64, error) {
+	var balance int64
+	for _, p := range m.items {
+		if p.AccountId == accountId && p.Currency == currency && p.PostingDate.Before(before) {
+			balance += p.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (m *mockLedgerRepository) Unposted(ctx context.Context, afterId int64, limit int) ([]entity.Transaction, error) {
+	return nil, nil
+}
+
+func (m *mockLedgerRepository) Mismatches(ctx context.Context) ([]ledger.Mismatch, error) {
+	return nil, nil
+}
+
+func (m *mockLedgerRepository) LockDeposits(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockLedgerRepository) CreateOpeningBalances(ctx context.Context, date time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockLedgerRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
+
+type mockReservationRepository struct {
+	items          []entity.Reservation
+	lastInsertedId int64
+}
+
+func (m *mockReservationRepository) Get(ctx context.Context, id int64) (entity.Reservation, error) {
+	for _, item := range m.items {
+		if item.Id == id {
+			return item, nil
+		}
+	}
+	return entity.Reservation{}, sql.ErrNoRows
+}
+
+func (m *mockReservationRepository) Lock(ctx context.Context, id int64) (entity.Reservation, error) {
+	return m.Get(ctx, id)
+}
+
+func (m *mockReservationRepository) Create(ctx context.Context, res *entity.Reservation) error {
+	m.lastInsertedId++
+	res.Id = m.lastInsertedId
+	m.items = append(m.items, *res)
+	return nil
+}
+
+func (m *mockReservationRepository) Update(ctx context.Context, res entity.Reservation) error {
+	for i, item := range m.items {
+		if item.Id == res.Id {
+			m.items[i] = res
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockReservationRepository) Held(ctx context.Context, ownerId uuid.UUID, currency string, now time.Time) (int64, error) {
+	var held int64
+	for _, item := range m.items {
+		if item.OwnerId == ownerId && item.Currency == currency && item.Status == entity.ReservationActive && item.ExpiresAt.After(now) {
+			held += item.Remaining()
+		}
+	}
+	return held, nil
+}
+
+func (m *mockReservationRepository) HeldTotals(ctx context.Context, ownerId uuid.UUID, now time.Time) ([]reservation.HeldTotal, error) {
+	var totals []reservation.HeldTotal
+	for _, item := range m.items {
+		if item.OwnerId != ownerId || item.Status != entity.ReservationActive || !item.ExpiresAt.After(now) {
+			continue
+		}
+		i := 0
+		for i < len(totals) && totals[i].Currency != item.Currency {
+			i++
+		}
+		if i == len(totals) {
+			totals = append(totals, reservation.HeldTotal{Currency: item.Currency})
+		}
+		totals[i].Amount += item.Remaining()
+		if item.CapturedAmount == 0 {
+			totals[i].Count++
+		}
+	}
+	return totals, nil
+}
+
+func (m *mockReservationRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
+
+type mockIdempotencyKeyRepository struct {
+	items []entity.IdempotencyKey
+}
+
+func (m *mockIdempotencyKeyRepository) Get(ctx context.Context, key string) (entity.IdempotencyKey, error) {
+	for _, item := range m.items {
+		if item.Key == key {
+			return item, nil
+		}
+	}
+	return entity.IdempotencyKey{}, sql.ErrNoRows
+}
+
+func (m *mockIdempotencyKeyRepository) Create(ctx context.Context, key entity.IdempotencyKey) (bool, error) {
+	if _, err := m.Get(ctx, key.Key); err == nil {
+		return false, nil
+	}
+	m.items = append(m.items, key)
+	return true, nil
+}
+
+func (m *mockIdempotencyKeyRepository) Update(ctx context.Context, key entity.IdempotencyKey) error {
+	for i, item := range m.items {
+		if item.Key == key.Key {
+			m.items[i] = key
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockIdempotencyKeyRepository) Delete(ctx context.Context, key string) error {
+	for i, item := range m.items {
+		if item.Key == key {
+			m.items = append(m.items[:i], m.items[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *mockIdempotencyKeyRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
+
+type mockQuoteRepository struct {
+	items []entity.Quote
+}
+
+func (m *mockQuoteRepository) Create(ctx context.Context, quote entity.Quote) error {
+	m.items = append(m.items, quote)
+	return nil
+}
+
+func (m *mockQuoteRepository) Lock(ctx context.Context, id uuid.UUID) (entity.Quote, error) {
+	for _, item := range m.items {
+		if item.Id == id {
+			return item, nil
+		}
+	}
+	return entity.Quote{}, sql.ErrNoRows
+}
+
+func (m *mockQuoteRepository) Update(ctx context.Context, quote entity.Quote) error {
+	for i, item := range m.items {
+		if item.Id == quote.Id {
+			m.items[i] = quote
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockQuoteRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
+
+// Fake exchange rates service provides exchange ratio RUB/CURRENCY=0.1 for any currency code other than RUB.
+type mockExchangeRatesService struct{}
+
+func (s mockExchangeRatesService) Get(ctx context.Context, code string) (float32, error) {
+	if code == entity.DefaultCurrency {
+		return 1, nil
+	}
+	return 0.1, nil
+}
+
+// GetAt returns the same rates as Get since the beginning of 2021, USD was twice cheaper before, and the rates
+// are unknown before 2020.
+func (s mockExchangeRatesService) GetAt(ctx context.Context, code string, at time.Time) (float32, error) {
+	if at.Year() < 2020 {
+		return 0, errors.New("currency is not present in either cache or provider response")
+	}
+	rate, err := s.Get(ctx, code)
+	if code == "USD" && at.Year() < 2021 {
+		rate *= 2
+	}
+	return rate, err
+}
+
+func (s mockExchangeRatesService) GetRates(ctx context.Context, codes []string) (map[string]entity.Rate, error) {
+	rates := make(map[string]entity.Rate, len(codes))
+	for _, code := range codes {
+		rate, err := s.Get(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		rates[code] = entity.Rate{Currency: code, Rate: rate, FetchedAt: ratesFetchedAt}
+	}
+	return rates, nil
+}
+
+func (s mockExchangeRatesService) KeepFresh(ctx context.Context, ahead time.Duration) {}
+
+// countingExchangeRatesService counts the lookups of rates.
+type countingExchangeRatesService struct {
+	mockExchangeRatesService
+	calls int
+}
+
+func (s *countingExchangeRatesService) Get(ctx context.Context, code string) (float32, error) {
+	s.calls++
+	return s.mockExchangeRatesService.Get(ctx, code)
+}
+
+func (s *countingExchangeRatesService) GetRates(ctx context.Context, codes []string) (map[string]entity.Rate, error) {
+	s.calls++
+	return s.mockExchangeRatesService.GetRates(ctx, codes)
 }
\ No newline at end of file
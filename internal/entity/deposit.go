@@ -2,10 +2,48 @@ package entity
 
 import "github.com/google/uuid"
 
-// Deposit represents a user's account in the database.
+// DefaultCurrency is the ISO 4217 code of the currency used when a request does not specify one.
+const DefaultCurrency = "RUB"
+
+// Deposit statuses.
+const (
+	// DepositActive is the status of a Deposit which can be both debited and credited.
+	DepositActive = "active"
+	// DepositFrozenDebit is the status of a Deposit which can be credited, but can't be debited.
+	DepositFrozenDebit = "frozen_debit"
+	// DepositFrozenAll is the status of a Deposit which can be neither debited nor credited.
+	DepositFrozenAll = "frozen_all"
+	// DepositClosed is the status of a Deposit which has been closed by its owner. It can be neither debited
+	// nor credited and must have zero balance.
+	DepositClosed = "closed"
+)
+
+// Deposit represents a user's account in a single currency in the database.
+//
+// A user may hold several Deposits, one per currency.
 type Deposit struct {
-	// OwnerId is a UUID of the user which this Deposit belongs to. Serves as primary key in the database.
+	// OwnerId is a UUID of the user which this Deposit belongs to. Part of the primary key in the database.
 	OwnerId uuid.UUID `json:"owner_id" db:"pk"`
-	// Balance is an amount of money which is available to this user. Non-negative.
+	// Currency is the ISO 4217 code of the currency of this Deposit. Part of the primary key in the database.
+	Currency string `json:"currency" db:"pk"`
+	// Balance is an amount of money which is available to this user. May be negative down to -CreditLimit.
 	Balance int64 `json:"balance"`
+	// CreditLimit is an amount of money this user is allowed to owe, i.e. how far Balance may go below zero.
+	// Non-negative, zero by default.
+	CreditLimit int64 `json:"credit_limit"`
+	// Status is one of the Deposit statuses, which defines the operations allowed on this Deposit.
+	// DepositActive by default.
+	Status string `json:"status"`
+	// SpendingLimits override the default spending limits of this Deposit. Zero limits mean the default ones apply.
+	SpendingLimits
+}
+
+// CanDebit tells whether money can be taken from this Deposit.
+func (d Deposit) CanDebit() bool {
+	return d.Status != DepositFrozenDebit && d.Status != DepositFrozenAll && d.Status != DepositClosed
+}
+
+// CanCredit tells whether money can be added to this Deposit.
+func (d Deposit) CanCredit() bool {
+	return d.Status != DepositFrozenAll && d.Status != DepositClosed
 }
\ No newline at end of file
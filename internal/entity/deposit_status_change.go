@@ -0,0 +1,27 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DepositStatusChange represents a record of the audit log of Deposit status changes.
+type DepositStatusChange struct {
+	// Database id of this DepositStatusChange.
+	Id int64 `json:"id,omitempty" db:"pk"`
+	// UUID of the owner of the Deposit whose status was changed.
+	OwnerId uuid.UUID `json:"owner_id"`
+	// The ISO 4217 code of the currency of the Deposit whose status was changed.
+	Currency string `json:"currency"`
+	// The status of the Deposit before the change.
+	PreviousStatus string `json:"previous_status"`
+	// The status of the Deposit after the change.
+	Status string `json:"status"`
+	// Identifier of the employee or system which changed the status.
+	ChangedBy string `json:"changed_by"`
+	// The reason the status was changed for, e.g. the number of a fraud investigation.
+	Reason string `json:"reason"`
+	// The date and time when the status was changed.
+	ChangedAt time.Time `json:"changed_at"`
+}
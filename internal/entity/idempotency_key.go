@@ -0,0 +1,20 @@
+package entity
+
+import "time"
+
+// IdempotencyKey represents a client-provided key which makes retries of a money operation safe.
+//
+// The first request with a given Key creates a Transaction, subsequent requests with the same Key and payload
+// receive the originally created Transaction instead of performing the operation again.
+type IdempotencyKey struct {
+	// The key provided by the client. Serves as primary key in the database.
+	Key string `json:"key" db:"pk"`
+	// The hash of the request payload the key was first used with.
+	RequestHash string `json:"request_hash"`
+	// Database id of the Transaction created by the request. Zero while the request is being processed.
+	TransactionId int64 `json:"transaction_id"`
+	// The date and time when the key was first used.
+	CreatedAt time.Time `json:"created_at"`
+	// The date and time after which the key may be reused for another request.
+	ExpiresAt time.Time `json:"expires_at"`
+}
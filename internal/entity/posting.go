@@ -0,0 +1,44 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ExternalTopUpAccount is a system account which serves as a source of money for deposit top-ups.
+	ExternalTopUpAccount = uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	// ExternalWithdrawalAccount is a system account which serves as a destination of money for deposit withdrawals.
+	ExternalWithdrawalAccount = uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	// ExchangeAccount is a system account through which money is converted between currencies.
+	ExchangeAccount = uuid.MustParse("00000000-0000-0000-0000-000000000003")
+)
+
+// Posting represents a single leg of a double-entry Transaction.
+//
+// Every Transaction produces a debit Posting (negative Amount) against the account money is taken from and a credit
+// Posting (positive Amount) against the account money is added to, so postings of each Transaction sum up to zero.
+// A cross-currency Transaction is routed through ExchangeAccount, so that its postings sum up to zero in each currency.
+type Posting struct {
+	// Database id of this Posting.
+	Id int64 `json:"id,omitempty" db:"pk"`
+	// Database id of the Transaction this Posting belongs to.
+	TransactionId int64 `json:"transaction_id"`
+	// UUID of the account affected by this Posting. Either a Deposit owner or one of the system accounts.
+	AccountId uuid.UUID `json:"account_id"`
+	// A signed amount of Currency added to (positive) or subtracted from (negative) the account. Non-zero.
+	Amount int64 `json:"amount"`
+	// The ISO 4217 code of the currency of Amount.
+	Currency string `json:"currency"`
+	// The date and time when this Posting was made.
+	PostingDate time.Time `json:"posting_date"`
+	// The balance of the account in Currency after this Posting, i.e. the sum of its postings up to this one.
+	// Only kept for deposits: postings of the system accounts are not serialized, so it is zero for them.
+	BalanceAfter int64 `json:"balance_after"`
+}
+
+// SystemAccount tells whether the account with the given id is one of the system accounts.
+func SystemAccount(id uuid.UUID) bool {
+	return id == ExternalTopUpAccount || id == ExternalWithdrawalAccount || id == ExchangeAccount
+}
@@ -0,0 +1,43 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Quote statuses.
+const (
+	// QuoteActive means that the Quote can still be used by a transfer.
+	QuoteActive = "active"
+	// QuoteUsed means that a transfer has already been converted at the Quote's rate.
+	QuoteUsed = "used"
+	// QuoteExpired means that the Quote was not used before ExpiresAt.
+	QuoteExpired = "expired"
+)
+
+// Quote represents an exchange rate locked for a single conversion of Amount of Currency into TargetCurrency.
+//
+// A transfer which references the Quote is converted at exactly its Rate, so the recipient gets TargetAmount
+// regardless of how the current exchange rates have changed since the Quote was made. A Quote can be used only once
+// and only before ExpiresAt.
+type Quote struct {
+	// Random id of this Quote, which clients reference it by.
+	Id uuid.UUID `json:"id" db:"pk"`
+	// The ISO 4217 code of the currency converted from.
+	Currency string `json:"currency"`
+	// An amount of Currency to be converted. Positive.
+	Amount int64 `json:"amount"`
+	// The ISO 4217 code of the currency converted into.
+	TargetCurrency string `json:"target_currency"`
+	// An amount of TargetCurrency which Amount is converted into at Rate.
+	TargetAmount int64 `json:"target_amount"`
+	// The locked exchange rate: units of TargetCurrency per unit of Currency.
+	Rate float64 `json:"rate"`
+	// One of the Quote statuses.
+	Status string `json:"status"`
+	// The date and time when this Quote was made.
+	CreatedAt time.Time `json:"created_at"`
+	// The date and time after which this Quote can't be used.
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,17 @@
+package entity
+
+import (
+	"time"
+)
+
+// Rate represents an exchange rate of a currency as it was fetched at some moment.
+type Rate struct {
+	// Database id of this Rate.
+	Id int64 `json:"-" db:"pk"`
+	// The ISO 4217 code of the currency.
+	Currency string `json:"currency"`
+	// Units of Currency per one unit of DefaultCurrency.
+	Rate float32 `json:"rate"`
+	// The date and time when the rate was fetched, in UTC.
+	FetchedAt time.Time `json:"fetched_at"`
+}
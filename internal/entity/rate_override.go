@@ -0,0 +1,34 @@
+package entity
+
+import (
+	"time"
+)
+
+// RateOverride represents an exchange rate of a currency pinned manually for a while, e.g. when the provider
+// publishes a wrong rate. It is served instead of the fetched Rate from SetAt until ExpiresAt. Overrides are kept
+// after they end, so that the rates as of past dates are known.
+type RateOverride struct {
+	// Database id of this RateOverride.
+	Id int64 `json:"-" db:"pk"`
+	// The ISO 4217 code of the currency.
+	Currency string `json:"currency"`
+	// Units of Currency per one unit of DefaultCurrency.
+	Rate float32 `json:"rate"`
+	// Identifier of the employee or system which pinned the rate.
+	SetBy string `json:"set_by"`
+	// The reason the rate was pinned for.
+	Reason string `json:"reason"`
+	// The date and time when the rate was pinned, in UTC.
+	SetAt time.Time `json:"set_at"`
+	// The date and time after which the fetched Rate is served again, in UTC. It is moved to the moment the
+	// override was removed or replaced at, if that happened earlier.
+	ExpiresAt time.Time `json:"expires_at"`
+	// Identifier of the employee or system which removed or replaced the override before it expired.
+	// Empty if the override was not ended early.
+	RemovedBy string `json:"removed_by,omitempty"`
+}
+
+// ActiveAt tells whether this RateOverride is served at the given time.
+func (o RateOverride) ActiveAt(at time.Time) bool {
+	return !at.Before(o.SetAt) && at.Before(o.ExpiresAt)
+}
@@ -0,0 +1,48 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reservation statuses.
+const (
+	// ReservationActive means that the remaining reserved money is held on the Deposit.
+	ReservationActive = "active"
+	// ReservationCaptured means that the whole reserved amount has been withdrawn from the Deposit.
+	ReservationCaptured = "captured"
+	// ReservationReleased means that the remaining reserved money has been returned to the available balance.
+	ReservationReleased = "released"
+	// ReservationExpired means that the Reservation was not captured nor released before ExpiresAt.
+	ReservationExpired = "expired"
+)
+
+// Reservation represents money held on a user's Deposit until it is either captured or released.
+//
+// Held money still belongs to the Deposit's balance, but it can't be withdrawn or transferred by other operations.
+type Reservation struct {
+	// Database id of this Reservation.
+	Id int64 `json:"id" db:"pk"`
+	// UUID of the Deposit the money is held on.
+	OwnerId uuid.UUID `json:"owner_id"`
+	// The ISO 4217 code of the currency of the Deposit the money is held on.
+	Currency string `json:"currency"`
+	// An amount of Currency held on the Deposit. Positive.
+	Amount int64 `json:"amount"`
+	// An amount of Currency which has already been captured. Never exceeds Amount.
+	CapturedAmount int64 `json:"captured_amount"`
+	// The description of this Reservation. Optional.
+	Description string `json:"description"`
+	// One of the Reservation statuses.
+	Status string `json:"status"`
+	// The date and time when this Reservation was made.
+	CreatedAt time.Time `json:"created_at"`
+	// The date and time after which this Reservation is considered expired.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Remaining returns an amount of Currency which is still held by this Reservation.
+func (r Reservation) Remaining() int64 {
+	return r.Amount - r.CapturedAmount
+}
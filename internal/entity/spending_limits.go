@@ -0,0 +1,32 @@
+package entity
+
+// SpendingLimits represents the limits of money which can be taken from all the Deposits of a user by withdrawals
+// and outgoing transfers within a calendar day and a calendar month (in UTC). The limits of a Deposit apply to
+// the operations taking money from it, their amounts are in the currency of the Deposit. Zero means no limit.
+type SpendingLimits struct {
+	// The maximum amount of money taken from the Deposit during a day.
+	DailyAmountLimit int64 `json:"daily_amount_limit,omitempty"`
+	// The maximum number of withdrawals and outgoing transfers during a day.
+	DailyCountLimit int64 `json:"daily_count_limit,omitempty"`
+	// The maximum amount of money taken from the Deposit during a month.
+	MonthlyAmountLimit int64 `json:"monthly_amount_limit,omitempty"`
+	// The maximum number of withdrawals and outgoing transfers during a month.
+	MonthlyCountLimit int64 `json:"monthly_count_limit,omitempty"`
+}
+
+// Override returns these limits with the ones which are set (non-zero) in other replacing the corresponding ones.
+func (l SpendingLimits) Override(other SpendingLimits) SpendingLimits {
+	if other.DailyAmountLimit != 0 {
+		l.DailyAmountLimit = other.DailyAmountLimit
+	}
+	if other.DailyCountLimit != 0 {
+		l.DailyCountLimit = other.DailyCountLimit
+	}
+	if other.MonthlyAmountLimit != 0 {
+		l.MonthlyAmountLimit = other.MonthlyAmountLimit
+	}
+	if other.MonthlyCountLimit != 0 {
+		l.MonthlyCountLimit = other.MonthlyCountLimit
+	}
+	return l
+}
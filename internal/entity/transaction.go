@@ -1,11 +1,39 @@
 package entity
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Types of transactions from the point of view of one of their parties.
+const (
+	// TransactionTopUp is a Transaction which adds money to the party's Deposit from outside of the system.
+	TransactionTopUp = "top_up"
+	// TransactionWithdrawal is a Transaction which takes money from the party's Deposit out of the system.
+	TransactionWithdrawal = "withdrawal"
+	// TransactionIncomingTransfer is a Transaction which moves money from another user to the party.
+	TransactionIncomingTransfer = "incoming_transfer"
+	// TransactionOutgoingTransfer is a Transaction which moves money from the party to another user.
+	TransactionOutgoingTransfer = "outgoing_transfer"
+)
+
+// Transaction statuses.
+const (
+	// TransactionPending means that the Transaction awaits an external confirmation. Sender's money is held,
+	// but balances are not changed yet.
+	TransactionPending = "pending"
+	// TransactionCompleted means that the money has been moved between the deposits.
+	TransactionCompleted = "completed"
+	// TransactionFailed means that the pending Transaction has not been confirmed and the held money is released.
+	TransactionFailed = "failed"
+	// TransactionReversed means that the completed Transaction has been fully returned by reversals.
+	TransactionReversed = "reversed"
+)
+
 // Transaction represents a single change in user's Deposit.
 //
 // SenderId and RecipientId are "positional". The transaction Amount (which is positive) is always subtracted from
@@ -14,6 +42,17 @@ import (
 // If a transaction is missing a RecipientId, it is considered a deposit withdrawal.
 // If a transaction is missing a SenderId, it is considered a deposit top-up.
 // Otherwise, a transaction is considered a money transfer between two users within the system.
+//
+// Amount is expressed in Currency. A transfer between Deposits in different currencies credits the recipient with
+// RecipientAmount in RecipientCurrency, converted from Amount at ExchangeRate.
+//
+// A Transaction is created either completed or pending. A pending Transaction changes no balances until it is
+// completed, while its Amount is held on sender's Deposit; TransactionDate is the date of completion then.
+//
+// Metadata and Tags are arbitrary data attached by clients, e.g. ids of orders and campaigns. They are stored as JSON.
+//
+// A transaction with non-zero ReversalOf is a reversal: it compensates (part of) the referenced transaction by moving
+// money back from its recipient to its sender.
 type Transaction struct {
 	// Database id of this Transaction.
 	Id int64 `json:"id,omitempty" db:"pk"`
@@ -21,10 +60,151 @@ type Transaction struct {
 	SenderId uuid.UUID `json:"sender_id,omitempty"`
 	// UUID of recipient's Deposit. Optional.
 	RecipientId uuid.UUID `json:"recipient_id,omitempty"`
-	// An amount of rubles subtracted from sender's deposit and added to recipient's deposit. Positive.
+	// An amount of money subtracted from sender's deposit and added to recipient's deposit. Positive.
 	Amount int64 `json:"amount"`
+	// The ISO 4217 code of the currency of Amount.
+	Currency string `json:"currency"`
+	// The ISO 4217 code of the currency of recipient's deposit if it differs from Currency. Empty otherwise.
+	RecipientCurrency string `json:"recipient_currency,omitempty"`
+	// An amount of RecipientCurrency added to recipient's deposit. Zero if RecipientCurrency is empty.
+	RecipientAmount int64 `json:"recipient_amount,omitempty"`
+	// The applied exchange rate: units of RecipientCurrency per unit of Currency. Zero if RecipientCurrency is empty.
+	ExchangeRate float64 `json:"exchange_rate,omitempty"`
 	// The description of this Transaction. Optional.
 	Description string `json:"description"`
-	// The date and time when this Transaction was made.
+	// The date and time when this Transaction was made, or the date of its completion if it was pending.
 	TransactionDate time.Time `json:"transaction_date,omitempty"`
+	// The date and time when this Transaction was created. Unlike TransactionDate, it never changes.
+	CreatedAt time.Time `json:"-"`
+	// One of the Transaction statuses.
+	Status string `json:"status"`
+	// Arbitrary key-value pairs attached to this Transaction. Optional.
+	Metadata Metadata `json:"metadata,omitempty"`
+	// Labels attached to this Transaction. Optional.
+	Tags Tags `json:"tags,omitempty"`
+	// Database id of the Transaction reversed by this Transaction. Zero if this Transaction is not a reversal.
+	ReversalOf int64 `json:"reversal_of,omitempty"`
+	// An amount of Currency which has been returned by reversals of this Transaction. Never exceeds Amount.
+	ReversedAmount int64 `json:"reversed_amount,omitempty"`
+	// The balance of sender's deposit in Currency right after this Transaction. Nil if unknown or there is no sender.
+	SenderBalanceAfter *int64 `json:"-"`
+	// The balance of recipient's deposit in the credited currency right after this Transaction.
+	// Nil if unknown or there is no recipient.
+	RecipientBalanceAfter *int64 `json:"-"`
+}
+
+// Credited returns the currency and the amount of money added to recipient's deposit by this Transaction.
+func (t Transaction) Credited() (string, int64) {
+	if t.RecipientCurrency == "" {
+		return t.Currency, t.Amount
+	}
+	return t.RecipientCurrency, t.RecipientAmount
+}
+
+// Sent tells whether the money of this Transaction is taken from the deposit of the party with the given id
+// in the given currency. A party exchanging money between its own deposits is both the sender and the recipient,
+// so the side of the party is told by the currency of its deposit.
+func (t Transaction) Sent(ownerId uuid.UUID, currency string) bool {
+	return t.SenderId == ownerId && t.Currency == currency
+}
+
+// BalanceAfter returns the balance of the deposit of the party with the given id in the given currency
+// right after this Transaction, so that one party can't see the balance of the other one. Nil if unknown.
+func (t Transaction) BalanceAfter(ownerId uuid.UUID, currency string) *int64 {
+	if t.Sent(ownerId, currency) {
+		return t.SenderBalanceAfter
+	}
+	if credited, _ := t.Credited(); t.RecipientId == ownerId && credited == currency {
+		return t.RecipientBalanceAfter
+	}
+	return nil
+}
+
+// Type returns the type of this Transaction from the point of view of the deposit of the party with the given id
+// in the given currency: one of TransactionTopUp, TransactionWithdrawal, TransactionIncomingTransfer and
+// TransactionOutgoingTransfer.
+func (t Transaction) Type(ownerId uuid.UUID, currency string) string {
+	switch {
+	case t.SenderId == uuid.Nil:
+		return TransactionTopUp
+	case t.RecipientId == uuid.Nil:
+		return TransactionWithdrawal
+	case t.Sent(ownerId, currency):
+		return TransactionOutgoingTransfer
+	default:
+		return TransactionIncomingTransfer
+	}
+}
+
+// Settled tells whether the money of this Transaction has been moved between the deposits,
+// i.e. whether it is completed or reversed.
+func (t Transaction) Settled() bool {
+	return t.Status == TransactionCompleted || t.Status == TransactionReversed
+}
+
+// Remaining returns an amount of Currency of this Transaction which can still be reversed.
+func (t Transaction) Remaining() int64 {
+	return t.Amount - t.ReversedAmount
+}
+
+// Metadata represents arbitrary key-value pairs attached to a Transaction. It is stored as a JSON object.
+type Metadata map[string]string
+
+// Value implements driver.Valuer. Nil Metadata is stored as an empty object.
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(m)
+	return string(data), err
+}
+
+// Scan implements sql.Scanner. Empty Metadata is read as nil.
+func (m *Metadata) Scan(src interface{}) error {
+	*m = nil
+	if err := scanJSON(src, m); err != nil {
+		return err
+	}
+	if len(*m) == 0 {
+		*m = nil
+	}
+	return nil
+}
+
+// Tags represents a list of labels attached to a Transaction. It is stored as a JSON array.
+type Tags []string
+
+// Value implements driver.Valuer. Nil Tags are stored as an empty array.
+func (t Tags) Value() (driver.Value, error) {
+	if t == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(t)
+	return string(data), err
+}
+
+// Scan implements sql.Scanner. Empty Tags are read as nil.
+func (t *Tags) Scan(src interface{}) error {
+	*t = nil
+	if err := scanJSON(src, t); err != nil {
+		return err
+	}
+	if len(*t) == 0 {
+		*t = nil
+	}
+	return nil
+}
+
+// scanJSON decodes a JSON column value into v. NULL leaves v untouched.
+func scanJSON(src interface{}, v interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(data, v)
+	case string:
+		return json.Unmarshal([]byte(data), v)
+	default:
+		return fmt.Errorf("entity: cannot scan %T as JSON", src)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,21 @@
+package entity
+
+import (
+	"time"
+)
+
+// TransactionStatusChange represents a record of the status history of a Transaction.
+type TransactionStatusChange struct {
+	// Database id of this TransactionStatusChange.
+	Id int64 `json:"id,omitempty" db:"pk"`
+	// Database id of the Transaction whose status was changed.
+	TransactionId int64 `json:"transaction_id"`
+	// The status of the Transaction before the change. Empty when the Transaction was created.
+	PreviousStatus string `json:"previous_status,omitempty"`
+	// The status of the Transaction after the change.
+	Status string `json:"status"`
+	// The reason the status was changed for, e.g. the response of a card processor. Optional.
+	Reason string `json:"reason,omitempty"`
+	// The date and time when the status was changed.
+	ChangedAt time.Time `json:"changed_at"`
+}
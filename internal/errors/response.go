@@ -3,6 +3,7 @@ package errors
 import (
 	"net/http"
 	"sort"
+	"time"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 )
@@ -46,6 +47,39 @@ func Forbidden(msg string) ErrorResponse {
 	}
 }
 
+// Blocked creates a new error response representing an operation which is forbidden because the account
+// is frozen or closed (HTTP 403)
+func Blocked(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The account is blocked."
+	}
+	return ErrorResponse{
+		Status:  http.StatusForbidden,
+		Message: msg,
+		Details: blockedDetails{Reason: "account_blocked"},
+	}
+}
+
+type blockedDetails struct {
+	Reason string `json:"reason"`
+}
+
+// LimitExceeded creates a new error response representing an operation which is forbidden because it exceeds
+// a spending limit of the account (HTTP 403). The limit is named so that clients can tell which one was hit.
+func LimitExceeded(msg, limit string, resetsAt time.Time) ErrorResponse {
+	return ErrorResponse{
+		Status:  http.StatusForbidden,
+		Message: msg,
+		Details: limitExceededDetails{Reason: "limit_exceeded", Limit: limit, ResetsAt: resetsAt},
+	}
+}
+
+type limitExceededDetails struct {
+	Reason   string    `json:"reason"`
+	Limit    string    `json:"limit"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
 // NotFound creates a new error response representing a resource-not-found error (HTTP 404)
 func NotFound(msg string) ErrorResponse {
 	if msg == "" {
@@ -57,6 +91,17 @@ func NotFound(msg string) ErrorResponse {
 	}
 }
 
+// Conflict creates a new error response representing a conflict with the current state of a resource (HTTP 409)
+func Conflict(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The request conflicts with the current state of the resource."
+	}
+	return ErrorResponse{
+		Status:  http.StatusConflict,
+		Message: msg,
+	}
+}
+
 // BadRequest creates a new error response representing a bad request (HTTP 400)
 func BadRequest(msg string) ErrorResponse {
 	if msg == "" {
@@ -68,6 +113,28 @@ func BadRequest(msg string) ErrorResponse {
 	}
 }
 
+// BatchItemError represents an error of a single operation of a batch request.
+type BatchItemError struct {
+	// Index is the position of the failed operation in the batch, starting from 0.
+	Index int `json:"index"`
+	ErrorResponse
+}
+
+// BatchItem creates a new BatchItemError from the error of the batch operation with the given index.
+func BatchItem(index int, err error) BatchItemError {
+	return BatchItemError{Index: index, ErrorResponse: buildErrorResponse(err)}
+}
+
+// BatchFailed creates a new error response representing a batch request which has not been applied because some
+// of its operations failed. The response has the status of the first failed operation and lists all of them.
+func BatchFailed(items []BatchItemError) ErrorResponse {
+	return ErrorResponse{
+		Status:  items[0].Status,
+		Message: "The batch has not been applied because some of its operations failed.",
+		Details: items,
+	}
+}
+
 type invalidField struct {
 	Field string `json:"field"`
 	Error string `json:"error"`
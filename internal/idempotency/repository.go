@@ -0,0 +1,83 @@
+package idempotency
+
+import (
+	"context"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+// Repository encapsulates the logic to access idempotency keys from the database.
+type Repository interface {
+	// Get returns the IdempotencyKey with the specified key.
+	Get(ctx context.Context, key string) (entity.IdempotencyKey, error)
+	// Create saves a new IdempotencyKey in the storage unless the key is already there.
+	// It returns false if the key already exists.
+	Create(ctx context.Context, key entity.IdempotencyKey) (bool, error)
+	// Update updates the changes to the given IdempotencyKey to db.
+	Update(ctx context.Context, key entity.IdempotencyKey) error
+	// Delete removes the IdempotencyKey with the specified key from the storage.
+	Delete(ctx context.Context, key string) error
+	// Count returns the number of IdempotencyKey records in the database.
+	Count(ctx context.Context) (int64, error)
+}
+
+// repository persists IdempotencyKey in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new IdempotencyKey repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Get reads the IdempotencyKey with the specified key from the database.
+func (r repository) Get(ctx context.Context, key string) (entity.IdempotencyKey, error) {
+	var k entity.IdempotencyKey
+	err := r.db.With(ctx).Select().Model(key, &k)
+	return k, err
+}
+
+// Create saves a new IdempotencyKey record in the database.
+// If a concurrent transaction is inserting the same key, Create waits for it to finish and reports the key as existing.
+func (r repository) Create(ctx context.Context, key entity.IdempotencyKey) (bool, error) {
+	result, err := r.db.With(ctx).NewQuery(
+		"INSERT INTO idempotency_key (key, request_hash, transaction_id, created_at, expires_at) " +
+			"VALUES ({:key}, {:request_hash}, {:transaction_id}, {:created_at}, {:expires_at}) " +
+			"ON CONFLICT (key) DO NOTHING",
+	).Bind(dbx.Params{
+		"key":            key.Key,
+		"request_hash":   key.RequestHash,
+		"transaction_id": key.TransactionId,
+		"created_at":     key.CreatedAt,
+		"expires_at":     key.ExpiresAt,
+	}).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// Update saves the changes to the IdempotencyKey in the database.
+func (r repository) Update(ctx context.Context, key entity.IdempotencyKey) error {
+	return r.db.With(ctx).Model(&key).Update()
+}
+
+// Delete deletes the IdempotencyKey with the specified key from the database.
+func (r repository) Delete(ctx context.Context, key string) error {
+	_, err := r.db.With(ctx).Delete("idempotency_key", dbx.HashExp{"key": key}).Execute()
+	return err
+}
+
+// Count returns the number of IdempotencyKey records in the database.
+func (r repository) Count(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.db.With(ctx).Select("COUNT(*)").From("idempotency_key").Row(&count)
+	return count, err
+}
@@ -0,0 +1,55 @@
+package idempotency
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/test"
+	"users-balance-microservice/pkg/log"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "idempotency_key")
+	repo := NewRepository(db, logger)
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	// initial count
+	count, err := repo.Count(ctx)
+	assert.NoError(t, err)
+
+	// create
+	key := entity.IdempotencyKey{Key: "key-1", RequestHash: "hash", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	created, err := repo.Create(ctx, key)
+	if assert.NoError(t, err) {
+		assert.True(t, created)
+		count2, _ := repo.Count(ctx)
+		assert.EqualValues(t, 1, count2-count)
+	}
+
+	// create existing key -> not created
+	created, err = repo.Create(ctx, key)
+	if assert.NoError(t, err) {
+		assert.False(t, created)
+	}
+
+	// update and get
+	key.TransactionId = 42
+	assert.NoError(t, repo.Update(ctx, key))
+	key, err = repo.Get(ctx, "key-1")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 42, key.TransactionId)
+		assert.Equal(t, "hash", key.RequestHash)
+	}
+
+	// delete
+	assert.NoError(t, repo.Delete(ctx, "key-1"))
+	_, err = repo.Get(ctx, "key-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,99 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/errors"
+	"users-balance-microservice/pkg/log"
+)
+
+// Service encapsulates usecase logic for idempotency keys.
+//
+// Begin and Complete are expected to be called within the same DB transaction as the operation they guard,
+// so that the key is stored if and only if the operation succeeds.
+type Service interface {
+	// Begin claims the key for the given request payload.
+	// If the key has already been used with the same payload, the id of the created Transaction is returned with
+	// replay=true. If the key has been used with a different payload, a conflict error is returned.
+	Begin(ctx context.Context, key string, req interface{}) (transactionId int64, replay bool, err error)
+	// Complete links the claimed key with the Transaction created by the request.
+	Complete(ctx context.Context, key string, transactionId int64) error
+}
+
+type service struct {
+	repo      Repository
+	retention time.Duration
+	logger    log.Logger
+}
+
+// NewService creates a new idempotency service. Keys may be reused for other requests once retention has passed.
+func NewService(repo Repository, retention time.Duration, logger log.Logger) Service {
+	return service{repo, retention, logger}
+}
+
+// hash returns a hex-encoded SHA-256 hash of the JSON representation of req.
+func hash(req interface{}) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s service) Begin(ctx context.Context, key string, req interface{}) (int64, bool, error) {
+	requestHash, err := hash(req)
+	if err != nil {
+		return 0, false, err
+	}
+
+	now := time.Now().UTC()
+	k := entity.IdempotencyKey{
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.retention),
+	}
+	created, err := s.repo.Create(ctx, k)
+	if err != nil || created {
+		return 0, false, err
+	}
+
+	existing, err := s.repo.Get(ctx, key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// the key has outlived its retention period and can be claimed again
+	if !existing.ExpiresAt.After(now) {
+		if err = s.repo.Delete(ctx, key); err != nil {
+			return 0, false, err
+		}
+		if _, err = s.repo.Create(ctx, k); err != nil {
+			return 0, false, err
+		}
+		return 0, false, nil
+	}
+
+	if existing.RequestHash != requestHash {
+		return 0, false, errors.Conflict("Idempotency key has already been used with a different request.")
+	}
+	if existing.TransactionId == 0 {
+		return 0, false, errors.Conflict("A request with the same idempotency key is being processed.")
+	}
+	return existing.TransactionId, true, nil
+}
+
+func (s service) Complete(ctx context.Context, key string, transactionId int64) error {
+	k, err := s.repo.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	k.TransactionId = transactionId
+	return s.repo.Update(ctx, k)
+}
@@ -0,0 +1,124 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/log"
+)
+
+var (
+	databaseError = errors.New("database error")
+	logger, _     = log.NewForTest()
+	ctx           = context.Background()
+)
+
+type request struct {
+	Amount int64 `json:"amount"`
+}
+
+func TestService_Begin(t *testing.T) {
+	repo := &mockIdempotencyKeyRepository{}
+	s := NewService(repo, time.Hour, logger)
+
+	// new key is claimed
+	_, replay, err := s.Begin(ctx, "key-1", request{100})
+	if assert.NoError(t, err) {
+		assert.False(t, replay)
+	}
+
+	// key is claimed, but the request hasn't completed -> conflict
+	_, _, err = s.Begin(ctx, "key-1", request{100})
+	assert.Error(t, err)
+
+	// completed request is replayed
+	assert.NoError(t, s.Complete(ctx, "key-1", 42))
+	txId, replay, err := s.Begin(ctx, "key-1", request{100})
+	if assert.NoError(t, err) {
+		assert.True(t, replay)
+		assert.EqualValues(t, 42, txId)
+	}
+
+	// same key with a different payload -> conflict
+	_, _, err = s.Begin(ctx, "key-1", request{200})
+	assert.Error(t, err)
+
+	// database error
+	_, _, err = s.Begin(ctx, "broken", request{100})
+	assert.Equal(t, databaseError, err)
+
+	// complete non-existing key
+	assert.Error(t, s.Complete(ctx, "key-2", 42))
+}
+
+func TestService_BeginExpired(t *testing.T) {
+	repo := &mockIdempotencyKeyRepository{}
+	s := NewService(repo, time.Millisecond, logger)
+
+	_, _, err := s.Begin(ctx, "key-1", request{100})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Complete(ctx, "key-1", 42))
+	time.Sleep(5 * time.Millisecond)
+
+	// expired key can be used for another request
+	_, replay, err := s.Begin(ctx, "key-1", request{200})
+	if assert.NoError(t, err) {
+		assert.False(t, replay)
+		count, _ := repo.Count(ctx)
+		assert.EqualValues(t, 1, count)
+	}
+}
+
+type mockIdempotencyKeyRepository struct {
+	items []entity.IdempotencyKey
+}
+
+func (m *mockIdempotencyKeyRepository) Get(ctx context.Context, key string) (entity.IdempotencyKey, error) {
+	for _, item := range m.items {
+		if item.Key == key {
+			return item, nil
+		}
+	}
+	return entity.IdempotencyKey{}, sql.ErrNoRows
+}
+
+func (m *mockIdempotencyKeyRepository) Create(ctx context.Context, key entity.IdempotencyKey) (bool, error) {
+	// simulate database error
+	if key.Key == "broken" {
+		return false, databaseError
+	}
+	if _, err := m.Get(ctx, key.Key); err == nil {
+		return false, nil
+	}
+	m.items = append(m.items, key)
+	return true, nil
+}
+
+func (m *mockIdempotencyKeyRepository) Update(ctx context.Context, key entity.IdempotencyKey) error {
+	for i, item := range m.items {
+		if item.Key == key.Key {
+			m.items[i] = key
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockIdempotencyKeyRepository) Delete(ctx context.Context, key string) error {
+	for i, item := range m.items {
+		if item.Key == key {
+			m.items = append(m.items[:i], m.items[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *mockIdempotencyKeyRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
@@ -0,0 +1,179 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+// Repository encapsulates the logic to access postings from the database.
+type Repository interface {
+	// Create saves a new Posting in the storage.
+	// Posting p is assigned an id from database in case of success.
+	Create(ctx context.Context, p *entity.Posting) error
+	// Balance returns the sum of all postings in the given currency made against the account with the given id.
+	Balance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error)
+	// LastBalance returns the running balance in the given currency kept in the last posting made against
+	// the account with the given id.
+	LastBalance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error)
+	// BalanceBefore returns the sum of all postings in the given currency made against the account with the given id
+	// before the given time.
+	BalanceBefore(ctx context.Context, accountId uuid.UUID, currency string, before time.Time) (int64, error)
+	// Unposted returns at most limit settled transactions with ids greater than afterId which have no postings,
+	// in the order of their ids.
+	Unposted(ctx context.Context, afterId int64, limit int) ([]entity.Transaction, error)
+	// Mismatches returns the deposits whose balances differ from the sums of their postings.
+	Mismatches(ctx context.Context) ([]Mismatch, error)
+	// LockDeposits locks all the deposits against changes until the end of the DB transaction.
+	LockDeposits(ctx context.Context) error
+	// CreateOpeningBalances saves the postings which back the balances of the deposits not matching their postings.
+	// It returns the number of such deposits.
+	CreateOpeningBalances(ctx context.Context, date time.Time) (int64, error)
+	// Count returns the number of Posting records in the database.
+	Count(ctx context.Context) (int64, error)
+}
+
+// Mismatch represents a deposit whose balance differs from the sum of its postings.
+type Mismatch struct {
+	OwnerId  uuid.UUID `json:"owner_id"`
+	Currency string    `json:"currency"`
+	// Balance is the balance stored in the deposit.
+	Balance int64 `json:"balance"`
+	// LedgerBalance is the sum of the postings of the deposit.
+	LedgerBalance int64 `json:"ledger_balance"`
+}
+
+// mismatches selects the deposits whose balances differ from the sums of their postings,
+// along with the date of the first posting of each of them.
+const mismatches = `
+	SELECT d.owner_id, d.currency, d.balance, COALESCE(SUM(p.amount), 0) AS ledger_balance,
+		MIN(p.posting_date) AS first_posting_date
+	FROM deposit d LEFT JOIN posting p ON p.account_id = d.owner_id AND p.currency = d.currency
+	GROUP BY d.owner_id, d.currency, d.balance
+	HAVING d.balance <> COALESCE(SUM(p.amount), 0)`
+
+// repository persists Posting in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new Posting repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Create saves a new Posting record in the database.
+// Posting is assigned an auto-incremented id from database.
+func (r repository) Create(ctx context.Context, p *entity.Posting) error {
+	return r.db.With(ctx).Model(p).Insert()
+}
+
+// Balance returns the sum of all postings in the given currency made against the account with the given id.
+// If the account has no such postings, 0 is returned.
+func (r repository) Balance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error) {
+	var balance int64
+	err := r.db.With(ctx).Select("COALESCE(SUM(amount), 0)").
+		From("posting").
+		Where(dbx.HashExp{"account_id": accountId, "currency": currency}).
+		Row(&balance)
+	return balance, err
+}
+
+// LastBalance returns the running balance in the given currency kept in the last posting made against
+// the account with the given id. If the account has no such postings, 0 is returned.
+func (r repository) LastBalance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error) {
+	var balance int64
+	err := r.db.With(ctx).Select("balance_after").
+		From("posting").
+		Where(dbx.HashExp{"account_id": accountId, "currency": currency}).
+		OrderBy("id DESC").
+		Limit(1).
+		Row(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
+
+// BalanceBefore returns the sum of all postings in the given currency made against the account with the given id
+// strictly before the given time. If the account has no such postings, 0 is returned.
+func (r repository) BalanceBefore(ctx context.Context, accountId uuid.UUID, currency string, before time.Time) (int64, error) {
+	var balance int64
+	err := r.db.With(ctx).Select("COALESCE(SUM(amount), 0)").
+		From("posting").
+		Where(dbx.HashExp{"account_id": accountId, "currency": currency}).
+		AndWhere(dbx.NewExp("posting_date < {:before}", dbx.Params{"before": before})).
+		Row(&balance)
+	return balance, err
+}
+
+// Unposted returns at most limit settled transactions with ids greater than afterId which have no postings,
+// in the order of their ids.
+func (r repository) Unposted(ctx context.Context, afterId int64, limit int) ([]entity.Transaction, error) {
+	var txs []entity.Transaction
+	err := r.db.With(ctx).Select().
+		From("transaction").
+		Where(dbx.In("status", entity.TransactionCompleted, entity.TransactionReversed)).
+		AndWhere(dbx.NewExp("id > {:after}", dbx.Params{"after": afterId})).
+		AndWhere(dbx.NewExp("NOT EXISTS (SELECT 1 FROM posting p WHERE p.transaction_id = transaction.id)")).
+		OrderBy("id").
+		Limit(int64(limit)).
+		All(&txs)
+	return txs, err
+}
+
+// Mismatches returns the deposits whose balances differ from the sums of their postings,
+// in the order of their owners and currencies.
+func (r repository) Mismatches(ctx context.Context) ([]Mismatch, error) {
+	var items []Mismatch
+	err := r.db.With(ctx).
+		NewQuery("SELECT owner_id, currency, balance, ledger_balance FROM (" + mismatches + ") m ORDER BY owner_id, currency").
+		All(&items)
+	return items, err
+}
+
+// LockDeposits locks all the deposits against changes until the end of the DB transaction,
+// so the call is only meaningful within one.
+func (r repository) LockDeposits(ctx context.Context) error {
+	_, err := r.db.With(ctx).NewQuery("LOCK TABLE deposit IN SHARE MODE").Execute()
+	return err
+}
+
+// CreateOpeningBalances saves a pair of postings for each deposit whose balance differs from the sum of its postings:
+// the difference is credited to the deposit and debited from ExternalTopUpAccount, the running balance of the deposit
+// becomes equal to its balance. The postings are dated with
+// the first posting of the deposit, i.e. the date it was created on, or with the given date if it has no postings.
+// Once the balances are backed, the call saves nothing, so it is safe to repeat.
+func (r repository) CreateOpeningBalances(ctx context.Context, date time.Time) (int64, error) {
+	result, err := r.db.With(ctx).NewQuery(`
+		WITH opening AS (
+			SELECT owner_id, currency, balance, balance - ledger_balance AS amount,
+				COALESCE(first_posting_date, {:date}) AS posting_date
+			FROM (` + mismatches + `) m
+		)
+		INSERT INTO posting (transaction_id, account_id, amount, currency, posting_date, balance_after)
+		SELECT 0, owner_id, amount, currency, posting_date, balance FROM opening
+		UNION ALL
+		SELECT 0, {:source}, -amount, currency, posting_date, 0 FROM opening`).
+		Bind(dbx.Params{"date": date, "source": entity.ExternalTopUpAccount}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+	created, err := result.RowsAffected()
+	return created / 2, err
+}
+
+// Count returns the number of Posting records in the database.
+func (r repository) Count(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.db.With(ctx).Select("COUNT(*)").From("posting").Row(&count)
+	return count, err
+}
@@ -0,0 +1,160 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/test"
+	"users-balance-microservice/pkg/log"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "posting", "deposit", "transaction")
+	repo := NewRepository(db, logger)
+
+	ctx := context.Background()
+
+	id1, id2 := uuid.New(), uuid.New()
+
+	// initial count
+	count, err := repo.Count(ctx)
+	assert.NoError(t, err)
+
+	// create postings of a transfer
+	for _, p := range Postings(entity.Transaction{Id: 1, SenderId: id1, RecipientId: id2, Amount: 300, Currency: "RUB", TransactionDate: time.Now()}) {
+		err = repo.Create(ctx, &p)
+		if assert.NoError(t, err) {
+			assert.NotZero(t, p.Id)
+		}
+	}
+	count2, err := repo.Count(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2, count2-count)
+	}
+
+	// balances derived from postings
+	balance, err := repo.Balance(ctx, id1, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, -300, balance)
+	}
+	balance, err = repo.Balance(ctx, id2, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 300, balance)
+	}
+
+	// running balance is read from the last posting
+	err = repo.Create(ctx, &entity.Posting{TransactionId: 2, AccountId: id2, Amount: 50, Currency: "RUB", PostingDate: time.Now(), BalanceAfter: 350})
+	assert.NoError(t, err)
+	err = repo.Create(ctx, &entity.Posting{TransactionId: 2, AccountId: id1, Amount: -50, Currency: "RUB", PostingDate: time.Now()})
+	assert.NoError(t, err)
+	balance, err = repo.LastBalance(ctx, id2, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 350, balance)
+	}
+	balance, err = repo.LastBalance(ctx, id2, "USD")
+	if assert.NoError(t, err) {
+		assert.Zero(t, balance)
+	}
+	balance, err = repo.Balance(ctx, id2, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 350, balance)
+	}
+	balance, err = repo.Balance(ctx, id1, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, -350, balance)
+	}
+
+	// no postings in another currency
+	balance, err = repo.Balance(ctx, id1, "USD")
+	if assert.NoError(t, err) {
+		assert.Zero(t, balance)
+	}
+
+	// account without postings
+	balance, err = repo.Balance(ctx, uuid.New(), "RUB")
+	if assert.NoError(t, err) {
+		assert.Zero(t, balance)
+	}
+
+	// balance before the transfer and after it
+	balance, err = repo.BalanceBefore(ctx, id2, "RUB", time.Now().Add(-time.Hour))
+	if assert.NoError(t, err) {
+		assert.Zero(t, balance)
+	}
+	balance, err = repo.BalanceBefore(ctx, id2, "RUB", time.Now().Add(time.Hour))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 350, balance)
+	}
+
+	// settled transactions without postings
+	date := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	for _, status := range []string{entity.TransactionCompleted, entity.TransactionFailed, entity.TransactionCompleted} {
+		_, err = db.DB().Insert("transaction", dbx.Params{
+			"recipient_id": id1, "amount": 100, "currency": "RUB", "status": status, "transaction_date": date, "created_at": date,
+		}).Execute()
+		assert.NoError(t, err)
+	}
+	txs, err := repo.Unposted(ctx, 0, 10)
+	if assert.NoError(t, err) && assert.Len(t, txs, 2) {
+		assert.Less(t, txs[0].Id, txs[1].Id)
+		txs2, err := repo.Unposted(ctx, txs[0].Id, 10)
+		if assert.NoError(t, err) {
+			assert.Equal(t, txs[1:], txs2)
+		}
+		txs2, err = repo.Unposted(ctx, 0, 1)
+		if assert.NoError(t, err) {
+			assert.Equal(t, txs[:1], txs2)
+		}
+	}
+
+	// deposits which are not backed by postings get opening balances dated with their first postings, once
+	id3 := uuid.New()
+	_, err = db.DB().Insert("deposit", dbx.Params{"owner_id": id2, "currency": "RUB", "balance": 500}).Execute()
+	assert.NoError(t, err)
+	_, err = db.DB().Insert("deposit", dbx.Params{"owner_id": id3, "currency": "USD", "balance": 70}).Execute()
+	assert.NoError(t, err)
+	mismatches, err := repo.Mismatches(ctx)
+	if assert.NoError(t, err) {
+		assert.Len(t, mismatches, 2)
+	}
+	assert.NoError(t, repo.LockDeposits(ctx))
+	opened, err := repo.CreateOpeningBalances(ctx, time.Now())
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2, opened)
+	}
+	balance, err = repo.Balance(ctx, id2, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500, balance)
+	}
+	balance, err = repo.LastBalance(ctx, id2, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500, balance)
+	}
+	balance, err = repo.BalanceBefore(ctx, id2, "RUB", time.Now().Add(-time.Hour))
+	if assert.NoError(t, err) {
+		assert.Zero(t, balance)
+	}
+	balance, err = repo.Balance(ctx, id3, "USD")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 70, balance)
+	}
+	opened, err = repo.CreateOpeningBalances(ctx, time.Now())
+	if assert.NoError(t, err) {
+		assert.Zero(t, opened)
+	}
+	mismatches, err = repo.Mismatches(ctx)
+	if assert.NoError(t, err) {
+		assert.Empty(t, mismatches)
+	}
+
+	// zero amount -> db error
+	err = repo.Create(ctx, &entity.Posting{TransactionId: 2, AccountId: id1, Amount: 0, Currency: "RUB", PostingDate: time.Now()})
+	assert.Error(t, err)
+}
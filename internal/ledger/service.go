@@ -0,0 +1,176 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/log"
+)
+
+// Service encapsulates usecase logic for the double-entry ledger.
+type Service interface {
+	// Record writes balanced debit and credit postings reflecting the given Transaction.
+	// The deposits of the Transaction must be locked, so that their running balances are kept in order.
+	Record(ctx context.Context, tx entity.Transaction) error
+	// Balance returns the balance of the account with the given id in the given currency derived from its postings.
+	Balance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error)
+	// BalanceBefore returns the balance of the account with the given id in the given currency right before
+	// the given time derived from its postings.
+	BalanceBefore(ctx context.Context, accountId uuid.UUID, currency string, before time.Time) (int64, error)
+	// Verify checks that the given balance of the account in the given currency matches the running balance
+	// kept in its postings.
+	Verify(ctx context.Context, accountId uuid.UUID, currency string, balance int64) error
+	// Backfill writes the postings of the settled transactions which have none, e.g. the ones created before
+	// the ledger was introduced, and then opening postings for the deposits whose balances still differ
+	// from their postings. It returns the numbers of such transactions and deposits.
+	// It must be called within a DB transaction and does nothing if all the balances are backed.
+	Backfill(ctx context.Context) (posted int64, opened int64, err error)
+	// Mismatches returns the deposits whose balances differ from the sums of their postings.
+	Mismatches(ctx context.Context) ([]Mismatch, error)
+	// Count returns a number of all Postings in the database. Mainly used for testing purposes.
+	Count(ctx context.Context) (int64, error)
+}
+
+// backfillPageSize is the number of transactions read at once while backfilling the ledger.
+const backfillPageSize = 1000
+
+type service struct {
+	repo   Repository
+	logger log.Logger
+}
+
+// NewService creates a new ledger service.
+func NewService(repo Repository, logger log.Logger) Service {
+	return service{repo, logger}
+}
+
+// Postings returns the debit and credit legs of the given Transaction.
+// A missing SenderId is replaced with ExternalTopUpAccount, a missing RecipientId - with ExternalWithdrawalAccount.
+// A cross-currency Transaction has two more legs: ExchangeAccount is credited in Currency
+// and debited in RecipientCurrency.
+func Postings(tx entity.Transaction) []entity.Posting {
+	debit, credit := tx.SenderId, tx.RecipientId
+	if debit == uuid.Nil {
+		debit = entity.ExternalTopUpAccount
+	}
+	if credit == uuid.Nil {
+		credit = entity.ExternalWithdrawalAccount
+	}
+	creditCurrency, creditAmount := tx.Credited()
+
+	if creditCurrency == tx.Currency {
+		return []entity.Posting{
+			{TransactionId: tx.Id, AccountId: debit, Amount: -tx.Amount, Currency: tx.Currency, PostingDate: tx.TransactionDate},
+			{TransactionId: tx.Id, AccountId: credit, Amount: tx.Amount, Currency: tx.Currency, PostingDate: tx.TransactionDate},
+		}
+	}
+	return []entity.Posting{
+		{TransactionId: tx.Id, AccountId: debit, Amount: -tx.Amount, Currency: tx.Currency, PostingDate: tx.TransactionDate},
+		{TransactionId: tx.Id, AccountId: entity.ExchangeAccount, Amount: tx.Amount, Currency: tx.Currency, PostingDate: tx.TransactionDate},
+		{TransactionId: tx.Id, AccountId: entity.ExchangeAccount, Amount: -creditAmount, Currency: creditCurrency, PostingDate: tx.TransactionDate},
+		{TransactionId: tx.Id, AccountId: credit, Amount: creditAmount, Currency: creditCurrency, PostingDate: tx.TransactionDate},
+	}
+}
+
+func (s service) Record(ctx context.Context, tx entity.Transaction) error {
+	postings := Postings(tx)
+
+	// money can't be created nor destroyed in any currency
+	sums := make(map[string]int64)
+	for _, p := range postings {
+		if p.Amount == 0 {
+			return fmt.Errorf("ledger: transaction %d has a zero posting", tx.Id)
+		}
+		sums[p.Currency] += p.Amount
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("ledger: postings of transaction %d are not balanced in %s, sum is %d", tx.Id, currency, sum)
+		}
+	}
+
+	for i := range postings {
+		if p := &postings[i]; !entity.SystemAccount(p.AccountId) {
+			balance, err := s.repo.LastBalance(ctx, p.AccountId, p.Currency)
+			if err != nil {
+				return err
+			}
+			p.BalanceAfter = balance + p.Amount
+		}
+		if err := s.repo.Create(ctx, &postings[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s service) Balance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error) {
+	return s.repo.Balance(ctx, accountId, currency)
+}
+
+func (s service) BalanceBefore(ctx context.Context, accountId uuid.UUID, currency string, before time.Time) (int64, error) {
+	return s.repo.BalanceBefore(ctx, accountId, currency, before)
+}
+
+// Verify only reads the last posting of the account, so it doesn't slow down as the ledger grows.
+// The balances are checked against the sums of all the postings by Mismatches, which the reconciliation job runs.
+func (s service) Verify(ctx context.Context, accountId uuid.UUID, currency string, balance int64) error {
+	ledgerBalance, err := s.repo.LastBalance(ctx, accountId, currency)
+	if err != nil {
+		return err
+	}
+	if ledgerBalance != balance {
+		return fmt.Errorf("ledger: %s balance of account %s is %d, but its postings sum up to %d", currency, accountId, balance, ledgerBalance)
+	}
+	return nil
+}
+
+// Backfill locks the deposits, so that their balances don't change while the ledger is being completed.
+// Transactions are posted in the order of their ids and dated with their transaction dates. Every deposit whose
+// balance still differs from its postings is logged as an error before its opening postings are written,
+// so that the drift is not hidden.
+func (s service) Backfill(ctx context.Context) (int64, int64, error) {
+	if err := s.repo.LockDeposits(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	var posted, lastId int64
+	for {
+		txs, err := s.repo.Unposted(ctx, lastId, backfillPageSize)
+		if err != nil {
+			return posted, 0, err
+		}
+		for _, tx := range txs {
+			if err := s.Record(ctx, tx); err != nil {
+				return posted, 0, err
+			}
+			posted++
+			lastId = tx.Id
+		}
+		if len(txs) < backfillPageSize {
+			break
+		}
+	}
+
+	items, err := s.repo.Mismatches(ctx)
+	if err != nil {
+		return posted, 0, err
+	}
+	for _, m := range items {
+		s.logger.With(ctx).Errorf("ledger: %s balance of account %s is %d, but its postings sum up to %d, opening the difference",
+			m.Currency, m.OwnerId, m.Balance, m.LedgerBalance)
+	}
+	opened, err := s.repo.CreateOpeningBalances(ctx, time.Now().UTC())
+	return posted, opened, err
+}
+
+func (s service) Mismatches(ctx context.Context) ([]Mismatch, error) {
+	return s.repo.Mismatches(ctx)
+}
+
+func (s service) Count(ctx context.Context) (int64, error) {
+	return s.repo.Count(ctx)
+}
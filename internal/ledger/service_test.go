@@ -0,0 +1,340 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/log"
+)
+
+var (
+	databaseError = errors.New("database error")
+	logger, _     = log.NewForTest()
+	ctx           = context.Background()
+)
+
+func TestPostings(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+
+	// top-up is debited from the external top-up account
+	postings := Postings(entity.Transaction{Id: 1, RecipientId: id1, Amount: 500})
+	if assert.Len(t, postings, 2) {
+		assert.Equal(t, entity.ExternalTopUpAccount, postings[0].AccountId)
+		assert.EqualValues(t, -500, postings[0].Amount)
+		assert.Equal(t, id1, postings[1].AccountId)
+		assert.EqualValues(t, 500, postings[1].Amount)
+	}
+
+	// withdrawal is credited to the external withdrawal account
+	postings = Postings(entity.Transaction{Id: 2, SenderId: id1, Amount: 300})
+	if assert.Len(t, postings, 2) {
+		assert.Equal(t, id1, postings[0].AccountId)
+		assert.EqualValues(t, -300, postings[0].Amount)
+		assert.Equal(t, entity.ExternalWithdrawalAccount, postings[1].AccountId)
+		assert.EqualValues(t, 300, postings[1].Amount)
+	}
+
+	// transfer moves money between two deposits
+	postings = Postings(entity.Transaction{Id: 3, SenderId: id1, RecipientId: id2, Amount: 100})
+	if assert.Len(t, postings, 2) {
+		assert.Equal(t, id1, postings[0].AccountId)
+		assert.Equal(t, id2, postings[1].AccountId)
+		assert.EqualValues(t, 3, postings[0].TransactionId)
+		assert.EqualValues(t, 3, postings[1].TransactionId)
+	}
+
+	// cross-currency transfer is converted through the exchange account
+	postings = Postings(entity.Transaction{
+		Id: 4, SenderId: id1, RecipientId: id2, Amount: 100, Currency: "USD",
+		RecipientCurrency: "RUB", RecipientAmount: 7500, ExchangeRate: 75,
+	})
+	if assert.Len(t, postings, 4) {
+		assert.Equal(t, entity.Posting{TransactionId: 4, AccountId: id1, Amount: -100, Currency: "USD"}, postings[0])
+		assert.Equal(t, entity.Posting{TransactionId: 4, AccountId: entity.ExchangeAccount, Amount: 100, Currency: "USD"}, postings[1])
+		assert.Equal(t, entity.Posting{TransactionId: 4, AccountId: entity.ExchangeAccount, Amount: -7500, Currency: "RUB"}, postings[2])
+		assert.Equal(t, entity.Posting{TransactionId: 4, AccountId: id2, Amount: 7500, Currency: "RUB"}, postings[3])
+	}
+}
+
+func TestService_Record(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	repo := &mockPostingRepository{}
+	s := NewService(repo, logger)
+
+	// top-up, transfer and withdrawal
+	txs := []entity.Transaction{
+		{Id: 1, RecipientId: id1, Amount: 1000, Currency: "RUB", TransactionDate: time.Now()},
+		{Id: 2, SenderId: id1, RecipientId: id2, Amount: 300, Currency: "RUB", TransactionDate: time.Now()},
+		{Id: 3, SenderId: id2, Amount: 100, Currency: "RUB", TransactionDate: time.Now()},
+	}
+	for _, tx := range txs {
+		assert.NoError(t, s.Record(ctx, tx))
+	}
+
+	count, err := s.Count(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 6, count)
+	}
+
+	balance, err := s.Balance(ctx, id1, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 700, balance)
+	}
+	balance, err = s.Balance(ctx, id2, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 200, balance)
+	}
+	balance, err = s.Balance(ctx, entity.ExternalTopUpAccount, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, -1000, balance)
+	}
+	balance, err = s.Balance(ctx, entity.ExternalWithdrawalAccount, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 100, balance)
+	}
+
+	// running balances are kept for deposits only
+	var running []int64
+	for _, p := range repo.items {
+		running = append(running, p.BalanceAfter)
+	}
+	assert.Equal(t, []int64{0, 1000, 700, 300, 200, 0}, running)
+
+	// the ledger as a whole is always balanced
+	var sum int64
+	for _, p := range repo.items {
+		sum += p.Amount
+	}
+	assert.Zero(t, sum)
+
+	// zero amount -> failure, nothing is posted
+	err = s.Record(ctx, entity.Transaction{Id: 4, RecipientId: id1, Amount: 0})
+	if assert.Error(t, err) {
+		count2, _ := s.Count(ctx)
+		assert.EqualValues(t, count, count2)
+	}
+
+	// database error
+	err = s.Record(ctx, entity.Transaction{Id: 5, RecipientId: uuid.MustParse("11111111-1111-1111-1111-111111111111"), Amount: 10})
+	assert.Error(t, err)
+}
+
+func TestService_Verify(t *testing.T) {
+	id1 := uuid.New()
+	repo := &mockPostingRepository{}
+	s := NewService(repo, logger)
+
+	// account without postings has zero balance
+	assert.NoError(t, s.Verify(ctx, id1, "RUB", 0))
+
+	assert.NoError(t, s.Record(ctx, entity.Transaction{Id: 1, RecipientId: id1, Amount: 1000, Currency: "RUB"}))
+	assert.NoError(t, s.Verify(ctx, id1, "RUB", 1000))
+
+	// balances in different currencies are independent
+	assert.NoError(t, s.Verify(ctx, id1, "USD", 0))
+
+	// balance drifted apart from the ledger -> failure
+	assert.Error(t, s.Verify(ctx, id1, "RUB", 1500))
+
+	// the running balance is checked, not the sum of the postings
+	repo.items[len(repo.items)-1].BalanceAfter = 1500
+	assert.NoError(t, s.Verify(ctx, id1, "RUB", 1500))
+}
+
+func TestService_BalanceBefore(t *testing.T) {
+	id1 := uuid.New()
+	s := NewService(&mockPostingRepository{}, logger)
+
+	day1 := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	assert.NoError(t, s.Record(ctx, entity.Transaction{Id: 1, RecipientId: id1, Amount: 1000, Currency: "RUB", TransactionDate: day1}))
+	assert.NoError(t, s.Record(ctx, entity.Transaction{Id: 2, SenderId: id1, Amount: 300, Currency: "RUB", TransactionDate: day2}))
+
+	balance, err := s.BalanceBefore(ctx, id1, "RUB", day1)
+	if assert.NoError(t, err) {
+		assert.Zero(t, balance)
+	}
+	balance, err = s.BalanceBefore(ctx, id1, "RUB", day2)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, balance)
+	}
+	balance, err = s.BalanceBefore(ctx, id1, "RUB", day2.Add(time.Second))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 700, balance)
+	}
+}
+
+func TestService_Backfill(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	day1 := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	repo := &mockPostingRepository{
+		deposits: []entity.Deposit{
+			{OwnerId: id1, Currency: "RUB", Balance: 700},
+			{OwnerId: id1, Currency: "USD", Balance: 50},
+			{OwnerId: id2, Currency: "RUB", Balance: 450},
+		},
+		// transactions made before the ledger was introduced, except for the last one
+		transactions: []entity.Transaction{
+			{Id: 1, RecipientId: id1, Amount: 1000, Currency: "RUB", Status: entity.TransactionCompleted, TransactionDate: day1},
+			{Id: 2, SenderId: id1, RecipientId: id2, Amount: 300, Currency: "RUB", Status: entity.TransactionCompleted, TransactionDate: day2},
+			{Id: 3, SenderId: id1, Amount: 100, Currency: "RUB", Status: entity.TransactionFailed, TransactionDate: day2},
+			{Id: 4, RecipientId: id2, Amount: 100, Currency: "RUB", Status: entity.TransactionCompleted, TransactionDate: day2},
+		},
+	}
+	s := NewService(repo, logger)
+	assert.NoError(t, s.Record(ctx, repo.transactions[3]))
+
+	posted, opened, err := s.Backfill(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2, posted)
+		// id2 has drifted apart from its transactions, id1 has a USD balance without any
+		assert.EqualValues(t, 2, opened)
+	}
+	assert.NoError(t, s.Verify(ctx, id1, "RUB", 700))
+	assert.NoError(t, s.Verify(ctx, id1, "USD", 50))
+	assert.NoError(t, s.Verify(ctx, id2, "RUB", 450))
+
+	// postings are dated with the transactions, the opening one - with the first posting of the deposit
+	balance, err := s.BalanceBefore(ctx, id1, "RUB", day2)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, balance)
+	}
+	balance, err = s.BalanceBefore(ctx, id2, "RUB", day2.Add(time.Second))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 450, balance)
+	}
+
+	// repeated call records nothing
+	count, _ := s.Count(ctx)
+	posted, opened, err = s.Backfill(ctx)
+	if assert.NoError(t, err) {
+		assert.Zero(t, posted)
+		assert.Zero(t, opened)
+	}
+	count2, _ := s.Count(ctx)
+	assert.Equal(t, count, count2)
+}
+
+func TestService_Mismatches(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	repo := &mockPostingRepository{deposits: []entity.Deposit{
+		{OwnerId: id1, Currency: "RUB", Balance: 1000},
+		{OwnerId: id2, Currency: "RUB", Balance: 300},
+	}}
+	s := NewService(repo, logger)
+	assert.NoError(t, s.Record(ctx, entity.Transaction{Id: 1, RecipientId: id1, Amount: 1000, Currency: "RUB"}))
+
+	items, err := s.Mismatches(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Mismatch{{OwnerId: id2, Currency: "RUB", Balance: 300, LedgerBalance: 0}}, items)
+	}
+}
+
+type mockPostingRepository struct {
+	items          []entity.Posting
+	deposits       []entity.Deposit
+	transactions   []entity.Transaction
+	lastInsertedId int64
+}
+
+func (m *mockPostingRepository) Create(ctx context.Context, p *entity.Posting) error {
+	// simulate database error
+	if p.AccountId.String() == "11111111-1111-1111-1111-111111111111" {
+		return databaseError
+	}
+
+	m.lastInsertedId++
+	p.Id = m.lastInsertedId
+	m.items = append(m.items, *p)
+	return nil
+}
+
+func (m *mockPostingRepository) Balance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error) {
+	var balance int64
+	for _, p := range m.items {
+		if p.AccountId == accountId && p.Currency == currency {
+			balance += p.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (m *mockPostingRepository) LastBalance(ctx context.Context, accountId uuid.UUID, currency string) (int64, error) {
+	var balance int64
+	for _, p := range m.items {
+		if p.AccountId == accountId && p.Currency == currency {
+			balance = p.BalanceAfter
+		}
+	}
+	return balance, nil
+}
+
+func (m *mockPostingRepository) BalanceBefore(ctx context.Context, accountId uuid.UUID, currency string, before time.Time) (int64, error) {
+	var balance int64
+	for _, p := range m.items {
+		if p.AccountId == accountId && p.Currency == currency && p.PostingDate.Before(before) {
+			balance += p.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (m *mockPostingRepository) Unposted(ctx context.Context, afterId int64, limit int) ([]entity.Transaction, error) {
+	var txs []entity.Transaction
+	for _, tx := range m.transactions {
+		if !tx.Settled() || tx.Id <= afterId || len(txs) == limit {
+			continue
+		}
+		posted := false
+		for _, p := range m.items {
+			posted = posted || p.TransactionId == tx.Id
+		}
+		if !posted {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
+
+func (m *mockPostingRepository) Mismatches(ctx context.Context) ([]Mismatch, error) {
+	var items []Mismatch
+	for _, dep := range m.deposits {
+		balance, _ := m.Balance(ctx, dep.OwnerId, dep.Currency)
+		if balance != dep.Balance {
+			items = append(items, Mismatch{OwnerId: dep.OwnerId, Currency: dep.Currency, Balance: dep.Balance, LedgerBalance: balance})
+		}
+	}
+	return items, nil
+}
+
+func (m *mockPostingRepository) LockDeposits(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockPostingRepository) CreateOpeningBalances(ctx context.Context, date time.Time) (int64, error) {
+	items, _ := m.Mismatches(ctx)
+	for _, item := range items {
+		postingDate := date
+		for _, p := range m.items {
+			if p.AccountId == item.OwnerId && p.Currency == item.Currency && p.PostingDate.Before(postingDate) {
+				postingDate = p.PostingDate
+			}
+		}
+		amount := item.Balance - item.LedgerBalance
+		m.items = append(m.items,
+			entity.Posting{AccountId: item.OwnerId, Amount: amount, Currency: item.Currency, PostingDate: postingDate, BalanceAfter: item.Balance},
+			entity.Posting{AccountId: entity.ExternalTopUpAccount, Amount: -amount, Currency: item.Currency, PostingDate: postingDate},
+		)
+	}
+	return int64(len(items)), nil
+}
+
+func (m *mockPostingRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
@@ -0,0 +1,84 @@
+package money
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// defaultMinorUnits is the number of digits after the decimal point in amounts of most currencies.
+const defaultMinorUnits = 2
+
+// minorUnits holds the currencies which ISO 4217 defines a number of minor units other than defaultMinorUnits for.
+var minorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// MinorUnits returns the number of digits after the decimal point in amounts of the currency, as defined by ISO 4217.
+func MinorUnits(currency string) int {
+	if units, ok := minorUnits[currency]; ok {
+		return units
+	}
+	return defaultMinorUnits
+}
+
+// Money represents an exact amount of money: Value minor units (e.g. kopecks or cents) of Currency.
+type Money struct {
+	Value    int64
+	Currency string
+}
+
+// String formats the amount as a decimal number with MinorUnits(Currency) digits after the point, e.g. "-12.34".
+func (m Money) String() string {
+	units := MinorUnits(m.Currency)
+	digits := strconv.FormatInt(m.Value, 10)
+	sign := ""
+	if m.Value < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if units == 0 {
+		return sign + digits
+	}
+	if len(digits) <= units {
+		digits = strings.Repeat("0", units-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-units] + "." + digits[len(digits)-units:]
+}
+
+// MarshalJSON encodes Money as {"amount": "12.34", "currency": "USD"}. The amount is a string, so that clients
+// don't lose precision by parsing it as a binary floating point number.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.String(), m.Currency})
+}
+
+// Rate returns the exact value of an exchange rate which was published as a decimal number and stored as float32,
+// i.e. the shortest decimal number which rounds to rate. So 0.014 is 14/1000 rather than 0.014000000432133675.
+func Rate(rate float32) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(float64(rate), 'g', -1, 32))
+	return r
+}
+
+// Rate64 returns the exact value of an exchange rate stored as float64, i.e. the shortest decimal number
+// which rounds to rate, so that a conversion at a stored rate can be repeated exactly.
+func Rate64(rate float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(rate, 'g', -1, 64))
+	return r
+}
+
+// Convert returns the exact amount in minor units of the to currency which value minor units of the from currency
+// are worth at the rate (units of to per unit of from). The result is to be rounded with a RoundingMode.
+func Convert(value int64, from, to string, rate *big.Rat) *big.Rat {
+	result := new(big.Rat).Mul(big.NewRat(value, 1), rate)
+	return result.Mul(result, new(big.Rat).SetFrac(pow10(MinorUnits(to)), pow10(MinorUnits(from))))
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
@@ -0,0 +1,104 @@
+package money
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinorUnits(t *testing.T) {
+	assert.Equal(t, 2, MinorUnits("RUB"))
+	assert.Equal(t, 0, MinorUnits("JPY"))
+	assert.Equal(t, 3, MinorUnits("KWD"))
+	assert.Equal(t, 4, MinorUnits("CLF"))
+	assert.Equal(t, 2, MinorUnits("XYZ"))
+}
+
+func TestMoney_String(t *testing.T) {
+	tests := []struct {
+		money    Money
+		expected string
+	}{
+		{Money{1234, "USD"}, "12.34"},
+		{Money{-1234, "USD"}, "-12.34"},
+		{Money{5, "RUB"}, "0.05"},
+		{Money{-5, "RUB"}, "-0.05"},
+		{Money{0, "RUB"}, "0.00"},
+		{Money{1234, "JPY"}, "1234"},
+		{Money{1234, "KWD"}, "1.234"},
+		{Money{1600000001, "RUB"}, "16000000.01"},
+		{Money{-9223372036854775808, "RUB"}, "-92233720368547758.08"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, tc.money.String())
+	}
+}
+
+func TestMoney_MarshalJSON(t *testing.T) {
+	data, err := json.Marshal(Money{1234, "USD"})
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"amount":"12.34","currency":"USD"}`, string(data))
+	}
+}
+
+func TestRate(t *testing.T) {
+	assert.Equal(t, big.NewRat(14, 1000), Rate(0.014))
+	assert.Equal(t, big.NewRat(1, 1), Rate(1))
+	assert.Equal(t, big.NewRat(12195, 1000000), Rate(0.012195))
+	assert.Equal(t, big.NewRat(14, 1000000), Rate(0.000014))
+}
+
+func TestRate64(t *testing.T) {
+	assert.Equal(t, big.NewRat(14, 1000), Rate64(0.014))
+	assert.Equal(t, big.NewRat(1, 1), Rate64(1))
+	assert.Equal(t, big.NewRat(8571428571428571, 10000000000000000), Rate64(6.0/7))
+}
+
+func TestConvert(t *testing.T) {
+	// 1000.00 RUB at 0.014 USD per RUB
+	assert.Equal(t, big.NewRat(1400, 1), Convert(100000, "RUB", "USD", Rate(0.014)))
+	// 100 JPY at 0.5 RUB per JPY
+	assert.Equal(t, big.NewRat(5000, 1), Convert(100, "JPY", "RUB", Rate(0.5)))
+	// 1.00 RUB at 0.0125 USD per RUB
+	assert.Equal(t, big.NewRat(5, 4), Convert(100, "RUB", "USD", Rate(0.0125)))
+	// 1.234 KWD at 1 RUB per KWD
+	assert.Equal(t, big.NewRat(1234, 10), Convert(1234, "KWD", "RUB", Rate(1)))
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	for _, name := range []string{"half_even", "half_up", "down"} {
+		mode, err := ParseRoundingMode(name)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, name, mode)
+		}
+	}
+
+	_, err := ParseRoundingMode("up")
+	assert.Error(t, err)
+	_, err = ParseRoundingMode("")
+	assert.Error(t, err)
+}
+
+func TestRoundingMode_Round(t *testing.T) {
+	tests := []struct {
+		x                      *big.Rat
+		halfEven, halfUp, down int64
+	}{
+		{big.NewRat(5, 2), 2, 3, 2},
+		{big.NewRat(7, 2), 4, 4, 3},
+		{big.NewRat(-5, 2), -2, -3, -2},
+		{big.NewRat(-7, 2), -4, -4, -3},
+		{big.NewRat(13, 10), 1, 1, 1},
+		{big.NewRat(17, 10), 2, 2, 1},
+		{big.NewRat(-17, 10), -2, -2, -1},
+		{big.NewRat(1, 3), 0, 0, 0},
+		{big.NewRat(42, 1), 42, 42, 42},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.halfEven, RoundHalfEven.Round(tc.x), "half_even %v", tc.x)
+		assert.Equal(t, tc.halfUp, RoundHalfUp.Round(tc.x), "half_up %v", tc.x)
+		assert.Equal(t, tc.down, RoundDown.Round(tc.x), "down %v", tc.x)
+	}
+}
@@ -0,0 +1,45 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// RoundingMode is the way a converted amount is rounded to whole minor units.
+type RoundingMode string
+
+const (
+	// RoundHalfEven rounds to the nearest integer, and halves to the even one (banker's rounding).
+	RoundHalfEven RoundingMode = "half_even"
+	// RoundHalfUp rounds to the nearest integer, and halves away from zero.
+	RoundHalfUp RoundingMode = "half_up"
+	// RoundDown drops the fractional part, i.e. rounds towards zero.
+	RoundDown RoundingMode = "down"
+)
+
+// ParseRoundingMode returns the RoundingMode with the given name.
+func ParseRoundingMode(name string) (RoundingMode, error) {
+	switch mode := RoundingMode(name); mode {
+	case RoundHalfEven, RoundHalfUp, RoundDown:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown rounding mode %q, expected one of %s, %s and %s", name, RoundHalfEven, RoundHalfUp, RoundDown)
+}
+
+// Round rounds x to an integer according to the mode. An unknown mode rounds like RoundHalfEven.
+func (m RoundingMode) Round(x *big.Rat) int64 {
+	// the quotient is truncated towards zero, the remainder has the sign of x
+	q, r := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	if r.Sign() == 0 || m == RoundDown {
+		return q.Int64()
+	}
+
+	// compare the fractional part with a half
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(x.Denom())
+	if cmp > 0 || cmp == 0 && (m == RoundHalfUp || q.Bit(0) == 1) {
+		q.Add(q, big.NewInt(int64(r.Sign())))
+	}
+	return q.Int64()
+}
@@ -0,0 +1,26 @@
+package quote
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/test"
+)
+
+func TestAPI(t *testing.T) {
+	router := test.MockRouter(logger)
+	RegisterHandlers(router.Group(""), NewService(&mockQuoteRepository{}, mockExchangeRatesService{"USD": 0.014}, time.Minute, money.RoundHalfEven, logger), logger)
+
+	tests := []test.APITestCase{
+		{"create", "POST", "/rates/quote", `{"amount":100000,"target_currency":"USD"}`, http.StatusOK, `*"currency":"RUB","amount":100000,"target_currency":"USD","target_amount":1400,"rate":0.014,"status":"active"*`},
+		{"create same currency", "POST", "/rates/quote", `{"amount":100000,"currency":"USD","target_currency":"USD"}`, http.StatusBadRequest, `*"field":"target_currency"*`},
+		{"create too small amount", "POST", "/rates/quote", `{"amount":10,"target_currency":"USD"}`, http.StatusBadRequest, `*Amount is too small to be converted.*`},
+		{"create unavailable currency", "POST", "/rates/quote", `{"amount":100000,"target_currency":"GBP"}`, http.StatusInternalServerError, `*Requested currency is not available at the moment.*`},
+		{"create input error", "POST", "/rates/quote", `"amount":100000}`, http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
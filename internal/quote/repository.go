@@ -0,0 +1,88 @@
+package quote
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+// Repository encapsulates the logic to access quotes from the database.
+type Repository interface {
+	// Create saves a new Quote in the storage.
+	Create(ctx context.Context, quote entity.Quote) error
+	// Lock returns the Quote with the specified id and locks it until the end of the DB transaction,
+	// so that concurrent transfers can't use the same Quote.
+	Lock(ctx context.Context, id uuid.UUID) (entity.Quote, error)
+	// Update updates the changes to the given Quote to db.
+	Update(ctx context.Context, quote entity.Quote) error
+	// Count returns the number of Quote records in the database.
+	Count(ctx context.Context) (int64, error)
+}
+
+// Expirer marks the quotes which were not used in time as expired.
+type Expirer interface {
+	// Expire marks the active Quotes which expired not after the given time as expired and returns their number.
+	Expire(ctx context.Context, now time.Time) (int64, error)
+}
+
+// repository persists Quote in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new Quote repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// NewExpirer creates a new Expirer of the Quotes stored in the database.
+func NewExpirer(db *dbcontext.DB, logger log.Logger) Expirer {
+	return repository{db, logger}
+}
+
+// Create saves a new Quote record in the database.
+func (r repository) Create(ctx context.Context, quote entity.Quote) error {
+	return r.db.With(ctx).Model(&quote).Insert()
+}
+
+// Lock reads the Quote with the specified id from the database and locks it with SELECT ... FOR UPDATE.
+func (r repository) Lock(ctx context.Context, id uuid.UUID) (entity.Quote, error) {
+	var quote entity.Quote
+	err := r.db.With(ctx).
+		NewQuery("SELECT * FROM quote WHERE id = {:id} FOR UPDATE").
+		Bind(dbx.Params{"id": id}).
+		One(&quote)
+	return quote, err
+}
+
+// Update saves the changes to the Quote in the database.
+func (r repository) Update(ctx context.Context, quote entity.Quote) error {
+	return r.db.With(ctx).Model(&quote).Update()
+}
+
+// Expire sets the status of the active Quote records which expired not after now to entity.QuoteExpired.
+// The quotes locked by the transfers using them at the moment are skipped rather than waited for.
+func (r repository) Expire(ctx context.Context, now time.Time) (int64, error) {
+	res, err := r.db.With(ctx).
+		NewQuery("UPDATE quote SET status = {:expired} WHERE id IN " +
+			"(SELECT id FROM quote WHERE status = {:active} AND expires_at <= {:now} FOR UPDATE SKIP LOCKED)").
+		Bind(dbx.Params{"expired": entity.QuoteExpired, "active": entity.QuoteActive, "now": now.UTC()}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Count returns the number of Quote records in the database.
+func (r repository) Count(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.db.With(ctx).Select("COUNT(*)").From("quote").Row(&count)
+	return count, err
+}
@@ -0,0 +1,86 @@
+package quote
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/test"
+	"users-balance-microservice/pkg/log"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "quote")
+	repo := NewRepository(db, logger)
+
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// initial count
+	count, err := repo.Count(ctx)
+	assert.NoError(t, err)
+
+	// create
+	quote := entity.Quote{
+		Id:             uuid.New(),
+		Currency:       "RUB",
+		Amount:         100000,
+		TargetCurrency: "USD",
+		TargetAmount:   1400,
+		Rate:           0.014,
+		Status:         entity.QuoteActive,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(time.Minute),
+	}
+	err = repo.Create(ctx, quote)
+	if assert.NoError(t, err) {
+		count2, _ := repo.Count(ctx)
+		assert.EqualValues(t, 1, count2-count)
+	}
+
+	// lock
+	locked, err := repo.Lock(ctx, quote.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, quote.Id, locked.Id)
+		assert.EqualValues(t, 1400, locked.TargetAmount)
+		assert.Equal(t, 0.014, locked.Rate)
+		assert.True(t, quote.ExpiresAt.Equal(locked.ExpiresAt))
+	}
+
+	// update
+	quote.Status = entity.QuoteUsed
+	err = repo.Update(ctx, quote)
+	if assert.NoError(t, err) {
+		locked, _ = repo.Lock(ctx, quote.Id)
+		assert.Equal(t, entity.QuoteUsed, locked.Status)
+	}
+
+	// lock unknown
+	_, err = repo.Lock(ctx, uuid.New())
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// expire the active quotes which were not used in time
+	expired := quote
+	expired.Id, expired.Status, expired.ExpiresAt = uuid.New(), entity.QuoteActive, now.Add(-time.Second)
+	active := quote
+	active.Id, active.Status = uuid.New(), entity.QuoteActive
+	assert.NoError(t, repo.Create(ctx, expired))
+	assert.NoError(t, repo.Create(ctx, active))
+	n, err := NewExpirer(db, logger).Expire(ctx, now)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+		locked, _ = repo.Lock(ctx, expired.Id)
+		assert.Equal(t, entity.QuoteExpired, locked.Status)
+		locked, _ = repo.Lock(ctx, active.Id)
+		assert.Equal(t, entity.QuoteActive, locked.Status)
+		locked, _ = repo.Lock(ctx, quote.Id)
+		assert.Equal(t, entity.QuoteUsed, locked.Status)
+	}
+}
@@ -0,0 +1,154 @@
+package quote
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/rates"
+	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/pkg/log"
+)
+
+// Service encapsulates usecase logic for exchange rate quotes.
+// It only locks rates, transfers at the locked rates are made by the deposit service.
+type Service interface {
+	// Create locks the current exchange rate for the conversion described by QuoteRequest.
+	Create(ctx context.Context, req requests.QuoteRequest) (Quote, error)
+	// Use marks the Quote with the given id as used by a conversion of amount of currency into targetCurrency.
+	// It fails if the Quote has expired, has already been used or was made for another conversion.
+	// Use must be called within a DB transaction, so that the Quote stays unused if the conversion fails.
+	Use(ctx context.Context, id string, currency, targetCurrency string, amount int64) (Quote, error)
+	// Count returns a number of all Quotes in the database. Mainly used for testing purposes.
+	Count(ctx context.Context) (int64, error)
+}
+
+// Quote represents the data about an exchange rate quote.
+type Quote struct {
+	entity.Quote
+}
+
+type service struct {
+	repo            Repository
+	exchangeService rates.ExchangeRatesService
+	ttl             time.Duration
+	rounding        money.RoundingMode
+	logger          log.Logger
+}
+
+// NewService creates a new Quote service. Quotes can be used within ttl after they are made.
+// The quoted amounts are rounded the same way as the transfers are, i.e. with rounding.
+func NewService(repo Repository, exchangeService rates.ExchangeRatesService, ttl time.Duration, rounding money.RoundingMode, logger log.Logger) Service {
+	return service{repo, exchangeService, ttl, rounding, logger}
+}
+
+func (s service) Create(ctx context.Context, req requests.QuoteRequest) (Quote, error) {
+	if err := req.Validate(); err != nil {
+		return Quote{}, err
+	}
+
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
+	rate, err := s.exchangeRate(ctx, req.Currency, req.TargetCurrency)
+	if err != nil {
+		return Quote{}, err
+	}
+	// converted exactly the same way as transfers are, so that the transfer credits the quoted amount
+	targetAmount := s.rounding.Round(money.Convert(req.Amount, req.Currency, req.TargetCurrency, money.Rate64(rate)))
+	if targetAmount == 0 {
+		return Quote{}, errors.BadRequest("Amount is too small to be converted.")
+	}
+
+	now := time.Now().UTC()
+	quote := entity.Quote{
+		Id:             uuid.New(),
+		Currency:       req.Currency,
+		Amount:         req.Amount,
+		TargetCurrency: req.TargetCurrency,
+		TargetAmount:   targetAmount,
+		Rate:           rate,
+		Status:         entity.QuoteActive,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(s.ttl),
+	}
+	if err = s.repo.Create(ctx, quote); err != nil {
+		return Quote{}, err
+	}
+	return Quote{quote}, nil
+}
+
+// exchangeRate returns the number of units of currency to per one unit of currency from.
+func (s service) exchangeRate(ctx context.Context, from, to string) (float64, error) {
+	published, err := s.exchangeService.GetRates(ctx, []string{from, to})
+	if err != nil {
+		return 0, errors.InternalServerError("Requested currency is not available at the moment.")
+	}
+
+	rate, ok := rates.CrossRate(published, from, to)
+	if !ok {
+		return 0, errors.InternalServerError("Requested currency is not available at the moment.")
+	}
+	result, _ := rate.Float64()
+	return result, nil
+}
+
+func (s service) Use(ctx context.Context, id string, currency, targetCurrency string, amount int64) (Quote, error) {
+	quoteUUID, err := uuid.Parse(id)
+	if err != nil {
+		return Quote{}, errors.NotFound("Quote not found.")
+	}
+	quote, err := s.repo.Lock(ctx, quoteUUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Quote{}, errors.NotFound("Quote not found.")
+		}
+		return Quote{}, err
+	}
+
+	switch {
+	case quote.Status == entity.QuoteUsed:
+		return Quote{}, errors.Conflict("Quote has already been used.")
+	case quote.Status == entity.QuoteExpired || !quote.ExpiresAt.After(time.Now().UTC()):
+		return Quote{}, errors.Conflict("Quote has expired.")
+	case quote.Currency != currency || quote.TargetCurrency != targetCurrency || quote.Amount != amount:
+		return Quote{}, errors.BadRequest(fmt.Sprintf("Quote was made for converting %d %s into %s.",
+			quote.Amount, quote.Currency, quote.TargetCurrency))
+	}
+
+	quote.Status = entity.QuoteUsed
+	if err = s.repo.Update(ctx, quote); err != nil {
+		return Quote{}, err
+	}
+	return Quote{quote}, nil
+}
+
+func (s service) Count(ctx context.Context) (int64, error) {
+	return s.repo.Count(ctx)
+}
+
+// KeepExpired marks the quotes which were not used in time as expired every interval until ctx is done.
+// Expired quotes can't be used regardless of their status, so a failed run is only logged and retried next time.
+func KeepExpired(ctx context.Context, expirer Expirer, interval time.Duration, logger log.Logger) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := expirer.Expire(ctx, now.UTC()); err != nil {
+				logger.With(ctx).Error("failed to expire quotes: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package quote
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	apierrors "users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/pkg/log"
+)
+
+var (
+	databaseError = errors.New("database error")
+	logger, _     = log.NewForTest()
+	ctx           = context.Background()
+)
+
+func TestService_Create(t *testing.T) {
+	repo := &mockQuoteRepository{}
+	s := NewService(repo, mockExchangeRatesService{"USD": 0.014, "EUR": 0.012, "JPY": 1.5}, time.Minute, money.RoundHalfEven, logger)
+
+	// success
+	q, err := s.Create(ctx, requests.QuoteRequest{Amount: 100000, TargetCurrency: "USD"})
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, uuid.Nil, q.Id)
+		assert.Equal(t, entity.DefaultCurrency, q.Currency)
+		assert.EqualValues(t, 100000, q.Amount)
+		assert.Equal(t, "USD", q.TargetCurrency)
+		assert.EqualValues(t, 1400, q.TargetAmount)
+		assert.Equal(t, 0.014, q.Rate)
+		assert.Equal(t, entity.QuoteActive, q.Status)
+		assert.Equal(t, q.CreatedAt.Add(time.Minute), q.ExpiresAt)
+	}
+
+	// success cross rate, the target amount is rounded
+	q, err = s.Create(ctx, requests.QuoteRequest{Amount: 1001, Currency: "USD", TargetCurrency: "EUR"})
+	if assert.NoError(t, err) {
+		assert.InDelta(t, 0.012/0.014, q.Rate, 1e-12)
+		assert.EqualValues(t, 858, q.TargetAmount)
+	}
+
+	// success minor units of the currencies are respected: 10.00 RUB at 1.5 JPY per RUB
+	q, err = s.Create(ctx, requests.QuoteRequest{Amount: 1000, TargetCurrency: "JPY"})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 15, q.TargetAmount)
+	}
+
+	// fail same currency
+	_, err = s.Create(ctx, requests.QuoteRequest{Amount: 100, TargetCurrency: "RUB"})
+	assert.Error(t, err)
+
+	// fail amount is too small to be converted
+	_, err = s.Create(ctx, requests.QuoteRequest{Amount: 10, TargetCurrency: "USD"})
+	assert.Error(t, err)
+
+	// fail currency is not available
+	_, err = s.Create(ctx, requests.QuoteRequest{Amount: 100, TargetCurrency: "GBP"})
+	assert.Error(t, err)
+
+	// fail database error
+	repo.err = databaseError
+	_, err = s.Create(ctx, requests.QuoteRequest{Amount: 100000, TargetCurrency: "USD"})
+	assert.Equal(t, databaseError, err)
+
+	count, err := s.Count(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 3, count)
+	}
+}
+
+func TestService_Use(t *testing.T) {
+	expired := entity.Quote{
+		Id: uuid.New(), Currency: "RUB", Amount: 100, TargetCurrency: "USD", TargetAmount: 2, Rate: 0.014,
+		Status: entity.QuoteActive, CreatedAt: time.Now().UTC().Add(-time.Hour), ExpiresAt: time.Now().UTC().Add(-time.Minute),
+	}
+	repo := &mockQuoteRepository{items: []entity.Quote{expired}}
+	s := NewService(repo, mockExchangeRatesService{"USD": 0.014}, time.Minute, money.RoundHalfEven, logger)
+	q, err := s.Create(ctx, requests.QuoteRequest{Amount: 100000, TargetCurrency: "USD"})
+	assert.NoError(t, err)
+
+	statusOf := func(err error) int {
+		var res apierrors.ErrorResponse
+		if errors.As(err, &res) {
+			return res.StatusCode()
+		}
+		return 0
+	}
+
+	// fail conversion doesn't match the quote
+	_, err = s.Use(ctx, q.Id.String(), "RUB", "USD", 50000)
+	assert.Equal(t, http.StatusBadRequest, statusOf(err))
+	_, err = s.Use(ctx, q.Id.String(), "RUB", "EUR", 100000)
+	assert.Equal(t, http.StatusBadRequest, statusOf(err))
+
+	// success
+	used, err := s.Use(ctx, q.Id.String(), "RUB", "USD", 100000)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.QuoteUsed, used.Status)
+		assert.Equal(t, q.Rate, used.Rate)
+	}
+
+	// fail already used
+	_, err = s.Use(ctx, q.Id.String(), "RUB", "USD", 100000)
+	assert.Equal(t, http.StatusConflict, statusOf(err))
+
+	// fail expired
+	_, err = s.Use(ctx, expired.Id.String(), "RUB", "USD", 100)
+	assert.Equal(t, http.StatusConflict, statusOf(err))
+
+	// fail not found
+	_, err = s.Use(ctx, uuid.NewString(), "RUB", "USD", 100)
+	assert.Equal(t, http.StatusNotFound, statusOf(err))
+	_, err = s.Use(ctx, "quote-1", "RUB", "USD", 100)
+	assert.Equal(t, http.StatusNotFound, statusOf(err))
+}
+
+func TestKeepExpired(t *testing.T) {
+	expired := entity.Quote{Id: uuid.New(), Status: entity.QuoteActive, ExpiresAt: time.Now().UTC().Add(-time.Minute)}
+	active := entity.Quote{Id: uuid.New(), Status: entity.QuoteActive, ExpiresAt: time.Now().UTC().Add(time.Hour)}
+	repo := &mockQuoteRepository{items: []entity.Quote{expired, active}}
+
+	// the quotes which were not used in time are marked expired in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		KeepExpired(ctx, repo, time.Millisecond, logger)
+		close(done)
+	}()
+	<-time.After(50 * time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, entity.QuoteExpired, repo.items[0].Status)
+	assert.Equal(t, entity.QuoteActive, repo.items[1].Status)
+}
+
+type mockQuoteRepository struct {
+	items []entity.Quote
+	err   error
+}
+
+func (m *mockQuoteRepository) Create(ctx context.Context, quote entity.Quote) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.items = append(m.items, quote)
+	return nil
+}
+
+func (m *mockQuoteRepository) Lock(ctx context.Context, id uuid.UUID) (entity.Quote, error) {
+	for _, item := range m.items {
+		if item.Id == id {
+			return item, nil
+		}
+	}
+	return entity.Quote{}, sql.ErrNoRows
+}
+
+func (m *mockQuoteRepository) Update(ctx context.Context, quote entity.Quote) error {
+	for i, item := range m.items {
+		if item.Id == quote.Id {
+			m.items[i] = quote
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockQuoteRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
+
+func (m *mockQuoteRepository) Expire(ctx context.Context, now time.Time) (int64, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	var count int64
+	for i, item := range m.items {
+		if item.Status == entity.QuoteActive && !item.ExpiresAt.After(now) {
+			m.items[i].Status = entity.QuoteExpired
+			count++
+		}
+	}
+	return count, nil
+}
+
+// mockExchangeRatesService provides the given rates (units of currency per RUB), other currencies are unavailable.
+type mockExchangeRatesService map[string]float32
+
+func (s mockExchangeRatesService) Get(ctx context.Context, code string) (float32, error) {
+	if code == entity.DefaultCurrency {
+		return 1, nil
+	}
+	if rate, ok := s[code]; ok {
+		return rate, nil
+	}
+	return 0, errors.New("currency is not present in either cache or provider response")
+}
+
+func (s mockExchangeRatesService) GetAt(ctx context.Context, code string, at time.Time) (float32, error) {
+	return s.Get(ctx, code)
+}
+
+func (s mockExchangeRatesService) GetRates(ctx context.Context, codes []string) (map[string]entity.Rate, error) {
+	rates := make(map[string]entity.Rate, len(codes))
+	for _, code := range codes {
+		rate, err := s.Get(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		rates[code] = entity.Rate{Currency: code, Rate: rate}
+	}
+	return rates, nil
+}
+
+func (s mockExchangeRatesService) KeepFresh(ctx context.Context, ahead time.Duration) {}
@@ -0,0 +1,64 @@
+package rates
+
+import (
+	"github.com/go-ozzo/ozzo-routing/v2"
+	"users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/pkg/log"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers.
+func RegisterHandlers(r *routing.RouteGroup, service Service, logger log.Logger) {
+	res := resource{service, logger}
+
+	// administration
+	r.Get("/admin/rates", res.list)
+	r.Post("/admin/rates/refresh", res.refresh)
+	r.Post("/admin/rates/overrides", res.pin)
+	r.Post("/admin/rates/overrides/clear", res.unpin)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) list(c *routing.Context) error {
+	return c.Write(r.service.List(c.Request.Context()))
+}
+
+func (r resource) refresh(c *routing.Context) error {
+	rates, err := r.service.Refresh(c.Request.Context())
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch currency rates.")
+	}
+	return c.Write(rates)
+}
+
+func (r resource) pin(c *routing.Context) error {
+	var input requests.PinRateRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	override, err := r.service.Pin(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(override)
+}
+
+func (r resource) unpin(c *routing.Context) error {
+	var input requests.UnpinRatesRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	removed, err := r.service.Unpin(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.Write(removed)
+}
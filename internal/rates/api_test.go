@@ -0,0 +1,43 @@
+package rates
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"users-balance-microservice/internal/test"
+	"users-balance-microservice/pkg/log"
+)
+
+func TestAPI(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014, "EUR": 0.012}}
+	RegisterHandlers(router.Group(""), NewService(time.Hour, 0, time.Second, provider, &mockRepository{}, logger), logger)
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []test.APITestCase{
+		{"list empty", "GET", "/admin/rates", "", http.StatusOK, `[]`},
+		{"refresh", "POST", "/admin/rates/refresh", "", http.StatusOK, `*"currency":"USD","rate":0.014,"source":"mock"*`},
+		{"list fetched", "GET", "/admin/rates", "", http.StatusOK, `*"currency":"EUR","rate":0.012,"source":"mock"*`},
+		{"pin", "POST", "/admin/rates/overrides", `{"currency":"USD","rate":0.015,"expires_at":"` + expiresAt + `","changed_by":"admin","reason":"wrong rate"}`, http.StatusOK, `*"currency":"USD","rate":0.015,"set_by":"admin","reason":"wrong rate"*`},
+		{"list pinned", "GET", "/admin/rates", "", http.StatusOK, `*"currency":"USD","rate":0.015,"source":"override"*`},
+		{"pin default currency", "POST", "/admin/rates/overrides", `{"currency":"RUB","rate":1,"expires_at":"` + expiresAt + `","changed_by":"admin","reason":"wrong rate"}`, http.StatusBadRequest, `*"field":"currency"*`},
+		{"pin missing reason", "POST", "/admin/rates/overrides", `{"currency":"USD","rate":0.015,"expires_at":"` + expiresAt + `","changed_by":"admin"}`, http.StatusBadRequest, `*"field":"reason"*`},
+		{"pin input error", "POST", "/admin/rates/overrides", `"currency":"USD"}`, http.StatusBadRequest, ""},
+		{"clear", "POST", "/admin/rates/overrides/clear", `{"currency":"USD","changed_by":"admin"}`, http.StatusOK, `*"currency":"USD","rate":0.015*`},
+		{"clear nothing", "POST", "/admin/rates/overrides/clear", `{"changed_by":"admin"}`, http.StatusOK, `[]`},
+		{"clear missing changed by", "POST", "/admin/rates/overrides/clear", `{"currency":"USD"}`, http.StatusBadRequest, `*"field":"changed_by"*`},
+		{"clear input error", "POST", "/admin/rates/overrides/clear", `"currency":"USD"}`, http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+
+	provider.Fail(errors.New("provider is down"))
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "refresh provider error", Method: "POST", URL: "/admin/rates/refresh",
+		WantStatus: http.StatusInternalServerError, WantResponse: `*Failed to fetch currency rates.*`,
+	})
+}
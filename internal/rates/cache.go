@@ -1,43 +1,160 @@
 package rates
 
 import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/patrickmn/go-cache"
+	"users-balance-microservice/internal/entity"
 )
 
-// CacheService handles in-memory caching of exchange rates.
+// refreshRetryDelay is the time after which a failed background refresh is retried.
+const refreshRetryDelay = 10 * time.Second
+
+// CacheService handles in-memory caching of exchange rates. The rates are fresh for expiry after they are stored,
+// and older ones are served only as a fallback, as long as the store keeps them. The manually pinned rates are cached
+// for expiry as well, but never served after it.
 type CacheService struct {
-	store *cache.Cache
+	store  *cache.Cache
+	expiry time.Duration
+
+	mu                 sync.RWMutex
+	storedAt           time.Time
+	overrides          []entity.RateOverride
+	overridesLoadedAt  time.Time
+	overridesExpiredAt time.Time
+}
+
+// cachedRate is a rate together with the time it was stored at.
+type cachedRate struct {
+	rate     float32
+	storedAt time.Time
 }
 
-// NewCacheService creates a new handler for this service.
-func NewCacheService(store *cache.Cache) *CacheService {
-	return &CacheService{store}
+// NewCacheService creates a new handler for this service. The store must keep the rates at least for expiry.
+func NewCacheService(store *cache.Cache, expiry time.Duration) *CacheService {
+	return &CacheService{store: store, expiry: expiry}
 }
 
-// Get will return our in-memory stored currency/rates.
+// Get will return our in-memory stored currency/rates if they are fresh.
 func (s *CacheService) Get(code string) (float32, bool) {
 	if x, found := s.store.Get(code); found {
-		return x.(float32), found
+		cached := x.(cachedRate)
+		if time.Since(cached.storedAt) < s.expiry {
+			return cached.rate, true
+		}
 	}
 	return 0, false
 }
 
-// Store unpacks currencies and corresponding rates from ratesResponse and saves them to cache.
-func (s *CacheService) Store(rsp *ratesResponse) {
-	for code, rate := range rsp.Rates {
-		s.store.Set(code, rate, cache.DefaultExpiration)
+// GetRate returns the stored rate of a given currency regardless of its freshness, fetched at the time it was stored.
+func (s *CacheService) GetRate(code string) (entity.Rate, bool) {
+	if x, found := s.store.Get(code); found {
+		cached := x.(cachedRate)
+		return entity.Rate{Currency: code, Rate: cached.rate, FetchedAt: cached.storedAt.UTC()}, true
+	}
+	return entity.Rate{}, false
+}
+
+// Rates returns all the stored rates regardless of their freshness, ordered by currency.
+func (s *CacheService) Rates() []entity.Rate {
+	items := s.store.Items()
+	rates := make([]entity.Rate, 0, len(items))
+	for code, item := range items {
+		cached := item.Object.(cachedRate)
+		rates = append(rates, entity.Rate{Currency: code, Rate: cached.rate, FetchedAt: cached.storedAt.UTC()})
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Currency < rates[j].Currency })
+	return rates
+}
+
+// Store saves currencies and corresponding rates to cache.
+func (s *CacheService) Store(rates map[string]float32) {
+	now := time.Now()
+	for code, rate := range rates {
+		s.store.Set(code, cachedRate{rate, now}, cache.DefaultExpiration)
 	}
+
+	s.mu.Lock()
+	s.storedAt = now
+	s.mu.Unlock()
+}
+
+// Overrides returns the cached overrides served at the given time if they were loaded less than expiry ago.
+func (s *CacheService) Overrides(at time.Time) ([]entity.RateOverride, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.overridesLoadedAt.IsZero() || time.Since(s.overridesLoadedAt) >= s.expiry {
+		return nil, false
+	}
+	overrides := make([]entity.RateOverride, 0, len(s.overrides))
+	for _, o := range s.overrides {
+		if o.ActiveAt(at) {
+			overrides = append(overrides, o)
+		}
+	}
+	return overrides, true
+}
+
+// StoreOverrides saves the overrides loaded at the given time to cache, unless they were expired after that, since
+// the load could miss the change that expired them.
+func (s *CacheService) StoreOverrides(overrides []entity.RateOverride, loadedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if loadedAt.Before(s.overridesExpiredAt) {
+		return
+	}
+	s.overrides, s.overridesLoadedAt = overrides, loadedAt
+}
+
+// ExpireOverrides will expire the cached overrides, so that they are loaded again on the next request.
+func (s *CacheService) ExpireOverrides() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides, s.overridesLoadedAt = nil, time.Time{}
+	s.overridesExpiredAt = time.Now()
 }
 
 // IsExpired checks whether the rate stored is expired.
 func (s *CacheService) IsExpired(code string) bool {
-	if _, found := s.store.Get(code); found {
-		return false
-	}
-	return true
+	_, fresh := s.Get(code)
+	return !fresh
 }
 
 // Expire will expire the cache for a given currency code.
 func (s *CacheService) Expire(code string) {
 	s.store.Delete(code)
-}
\ No newline at end of file
+}
+
+// Refresh calls fetch ahead of the expiry of the last stored rates, so that they are replaced before any request
+// finds them expired. A failed fetch is retried after refreshRetryDelay. Refresh blocks until ctx is done.
+func (s *CacheService) Refresh(ctx context.Context, ahead time.Duration, fetch func(ctx context.Context) error) {
+	// refreshing more often than every half of expiry would only load the provider
+	if ahead > s.expiry/2 {
+		ahead = s.expiry / 2
+	}
+
+	var retryAt time.Time
+	for {
+		s.mu.RLock()
+		next := s.storedAt.Add(s.expiry - ahead)
+		s.mu.RUnlock()
+		if next.Before(retryAt) {
+			next = retryAt
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := fetch(ctx); err != nil {
+			retryAt = time.Now().Add(refreshRetryDelay)
+		}
+	}
+}
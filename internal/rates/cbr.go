@@ -0,0 +1,120 @@
+package rates
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const cbrURL = "https://www.cbr.ru/scripts/XML_daily.asp"
+
+type cbrProvider struct {
+	url    string
+	client *http.Client
+}
+
+// NewCBRProvider creates a Provider which fetches the daily rates published by the Central Bank of Russia
+// in its XML format at url (the official feed if empty).
+func NewCBRProvider(url string, client *http.Client) Provider {
+	if url == "" {
+		url = cbrURL
+	}
+	return cbrProvider{url: url, client: client}
+}
+
+// cbrResponse holds the daily rates of the Central Bank of Russia. Each Value is the price of Nominal units
+// of the currency in RUB, with a decimal comma.
+type cbrResponse struct {
+	Valutes []struct {
+		CharCode string `xml:"CharCode"`
+		Nominal  int    `xml:"Nominal"`
+		Value    string `xml:"Value"`
+	} `xml:"Valute"`
+}
+
+func (p cbrProvider) Name() string {
+	return ProviderCBR
+}
+
+func (p cbrProvider) Fetch(ctx context.Context) (map[string]float32, error) {
+	response, err := get(ctx, p.client, p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseCBR(response.Body)
+}
+
+// parseCBR reads the rates from the Central Bank of Russia XML and converts them to units of currency per RUB.
+func parseCBR(r io.Reader) (map[string]float32, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charsetReader
+
+	daily := cbrResponse{}
+	if err := decoder.Decode(&daily); err != nil {
+		return nil, err
+	}
+	if len(daily.Valutes) == 0 {
+		return nil, errors.New("CBR response contains no rates")
+	}
+
+	rates := make(map[string]float32, len(daily.Valutes))
+	for _, v := range daily.Valutes {
+		value, err := strconv.ParseFloat(strings.Replace(v.Value, ",", ".", 1), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CBR rate of %s: %w", v.CharCode, err)
+		}
+		if value <= 0 || v.Nominal <= 0 {
+			return nil, fmt.Errorf("invalid CBR rate of %s: %d for %s", v.CharCode, v.Nominal, v.Value)
+		}
+		rates[v.CharCode] = float32(float64(v.Nominal) / value)
+	}
+	return rates, nil
+}
+
+// charsetReader converts the windows-1251 encoding used by the CBR feed to UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	if !strings.EqualFold(charset, "windows-1251") {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+
+	// the feed is small, so it is simply converted in memory
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	for _, b := range data {
+		if b < 0x80 {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteRune(windows1251[b-0x80])
+		}
+	}
+	return &buf, nil
+}
+
+// windows1251 maps the upper half of windows-1251 to Unicode.
+var windows1251 = func() [128]rune {
+	table := [128]rune{
+		'Ђ', 'Ѓ', '‚', 'ѓ', '„', '…', '†', '‡', '€', '‰', 'Љ', '‹', 'Њ', 'Ќ', 'Ћ', 'Џ',
+		'ђ', '‘', '’', '“', '”', '•', '–', '—', utf8.RuneError, '™', 'љ', '›', 'њ', 'ќ', 'ћ', 'џ',
+		'\u00a0', 'Ў', 'ў', 'Ј', '¤', 'Ґ', '¦', '§', 'Ё', '©', 'Є', '«', '¬', '\u00ad', '®', 'Ї',
+		'°', '±', 'І', 'і', 'ґ', 'µ', '¶', '·', 'ё', '№', 'є', '»', 'ј', 'Ѕ', 'ѕ', 'ї',
+	}
+	// А-я are contiguous in both encodings
+	for i := 0x40; i < 0x80; i++ {
+		table[i] = 'А' + rune(i-0x40)
+	}
+	return table
+}()
@@ -0,0 +1,51 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const exchangeRateHostURL = "https://api.exchangerate.host/latest"
+
+type exchangeRateHostProvider struct {
+	url    string
+	client *http.Client
+}
+
+// NewExchangeRateHostProvider creates a Provider which fetches the latest rates from the exchangerate.host API
+// at url (the public API if empty).
+func NewExchangeRateHostProvider(url string, client *http.Client) Provider {
+	if url == "" {
+		url = exchangeRateHostURL
+	}
+	return exchangeRateHostProvider{url: url, client: client}
+}
+
+// ratesResponse holds an API response with a list of RUB\CURRENCY ratios for all currencies.
+type ratesResponse struct {
+	Rates map[string]float32 `json:"rates"`
+}
+
+func (p exchangeRateHostProvider) Name() string {
+	return ProviderExchangeRateHost
+}
+
+func (p exchangeRateHostProvider) Fetch(ctx context.Context) (map[string]float32, error) {
+	response, err := get(ctx, p.client, fmt.Sprintf("%s?base=%s", p.url, baseCurrency))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	latest := ratesResponse{}
+	if err = json.NewDecoder(response.Body).Decode(&latest); err != nil {
+		return nil, err
+	}
+	if len(latest.Rates) == 0 {
+		return nil, errors.New("exchangerate.host response contains no rates")
+	}
+	return latest.Rates, nil
+}
@@ -0,0 +1,55 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+type fileProvider struct {
+	path string
+}
+
+// NewFileProvider creates a Provider which reads fixed rates from the YAML or JSON file at path, e.g.
+//
+//	rates:
+//	  USD: 0.0137
+//	  EUR: 0.0118
+//
+// The file is read on each Fetch, so that edited rates are picked up once the cached ones expire.
+func NewFileProvider(path string) Provider {
+	return fileProvider{path: path}
+}
+
+// ratesFile holds the contents of the rates file. JSON is a subset of YAML, so both are parsed the same way.
+type ratesFile struct {
+	Rates map[string]float32 `yaml:"rates"`
+}
+
+func (p fileProvider) Name() string {
+	return ProviderFile
+}
+
+func (p fileProvider) Fetch(ctx context.Context) (map[string]float32, error) {
+	bytes, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := ratesFile{}
+	if err = yaml.Unmarshal(bytes, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Rates) == 0 {
+		return nil, errors.New("rates file contains no rates")
+	}
+	for code, rate := range file.Rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("invalid rate of %s in rates file: %v", code, rate)
+		}
+	}
+	return file.Rates, nil
+}
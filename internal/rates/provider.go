@@ -0,0 +1,58 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Names of the supported sources of exchange rates, see NewProvider.
+const (
+	ProviderExchangeRateHost = "exchangerate.host"
+	ProviderCBR              = "cbr"
+	ProviderFile             = "file"
+)
+
+// Provider fetches exchange rates from some source.
+type Provider interface {
+	// Fetch returns the exchange rates of all currencies known to the source, i.e. units of currency
+	// per one unit of baseCurrency(RUB), keyed by currency code.
+	Fetch(ctx context.Context) (map[string]float32, error)
+	// Name returns the name of the source.
+	Name() string
+}
+
+// NewProvider creates the Provider with the given name. For the providers fetching the rates over HTTP, url overrides
+// the default address of the source; path is the rates file of ProviderFile.
+func NewProvider(name, url, path string) (Provider, error) {
+	switch name {
+	case "", ProviderExchangeRateHost:
+		return NewExchangeRateHostProvider(url, http.DefaultClient), nil
+	case ProviderCBR:
+		return NewCBRProvider(url, http.DefaultClient), nil
+	case ProviderFile:
+		if path == "" {
+			return nil, fmt.Errorf("rates file is required for the %s provider", ProviderFile)
+		}
+		return NewFileProvider(path), nil
+	}
+	return nil, fmt.Errorf("unknown rates provider %q", name)
+}
+
+// get sends a GET request to url and fails unless the response is successful.
+// The caller must close the body of the returned response.
+func get(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected response status %q from %s", response.Status, url)
+	}
+	return response, nil
+}
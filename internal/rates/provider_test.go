@@ -0,0 +1,179 @@
+package rates
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+// serveFile starts a server which responds to all requests with the contents of the fixture file.
+func serveFile(t *testing.T, path string) *httptest.Server {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serveStatus starts a server which responds to all requests with the given status and body.
+func serveStatus(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewProvider(t *testing.T) {
+	p, err := NewProvider("", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, exchangeRateHostURL, p.(exchangeRateHostProvider).url)
+		assert.Equal(t, ProviderExchangeRateHost, p.Name())
+	}
+	p, err = NewProvider(ProviderCBR, "http://localhost/daily.xml", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "http://localhost/daily.xml", p.(cbrProvider).url)
+		assert.Equal(t, ProviderCBR, p.Name())
+	}
+	p, err = NewProvider(ProviderFile, "", "testdata/rates.yml")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "testdata/rates.yml", p.(fileProvider).path)
+		assert.Equal(t, ProviderFile, p.Name())
+	}
+
+	// fail file provider without file
+	_, err = NewProvider(ProviderFile, "", "")
+	assert.Error(t, err)
+
+	// fail unknown provider
+	_, err = NewProvider("ecb", "", "")
+	assert.Error(t, err)
+}
+
+func TestExchangeRateHostProvider_Fetch(t *testing.T) {
+	// success
+	var query string
+	body, _ := ioutil.ReadFile("testdata/exchangerate_host.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write(body)
+	}))
+	defer server.Close()
+	rates, err := NewExchangeRateHostProvider(server.URL, server.Client()).Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "base=RUB", query)
+		assert.Equal(t, map[string]float32{"EUR": 0.012195, "RUB": 1, "USD": 0.014085}, rates)
+	}
+
+	// fail error response
+	server = serveStatus(t, http.StatusInternalServerError, `{"rates":{"USD":0.014}}`)
+	_, err = NewExchangeRateHostProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail invalid response
+	server = serveStatus(t, http.StatusOK, `{"rates":`)
+	_, err = NewExchangeRateHostProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail no rates
+	server = serveStatus(t, http.StatusOK, `{"success":false}`)
+	_, err = NewExchangeRateHostProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+}
+
+func TestCBRProvider_Fetch(t *testing.T) {
+	// success windows-1251 feed, rates are per nominal
+	server := serveFile(t, "testdata/cbr_daily.xml")
+	rates, err := NewCBRProvider(server.URL, server.Client()).Fetch(ctx)
+	if assert.NoError(t, err) && assert.Len(t, rates, 4) {
+		assert.InDelta(t, 1/71.0, rates["USD"], 1e-7)
+		assert.InDelta(t, 1/82.0, rates["EUR"], 1e-7)
+		assert.InDelta(t, 10/111.11, rates["CNY"], 1e-7)
+		assert.InDelta(t, 1.6, rates["JPY"], 1e-7)
+	}
+
+	// success UTF-8 feed
+	server = serveStatus(t, http.StatusOK, `<?xml version="1.0" encoding="UTF-8"?>
+<ValCurs><Valute><CharCode>USD</CharCode><Nominal>1</Nominal><Name>Доллар США</Name><Value>80,00</Value></Valute></ValCurs>`)
+	rates, err = NewCBRProvider(server.URL, server.Client()).Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float32{"USD": 0.0125}, rates)
+	}
+
+	// fail error response
+	server = serveStatus(t, http.StatusNotFound, "")
+	_, err = NewCBRProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail invalid value
+	server = serveStatus(t, http.StatusOK, `<ValCurs><Valute><CharCode>USD</CharCode><Nominal>1</Nominal><Value>N/A</Value></Valute></ValCurs>`)
+	_, err = NewCBRProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail zero value
+	server = serveStatus(t, http.StatusOK, `<ValCurs><Valute><CharCode>USD</CharCode><Nominal>1</Nominal><Value>0,0</Value></Valute></ValCurs>`)
+	_, err = NewCBRProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail no rates
+	server = serveStatus(t, http.StatusOK, `<ValCurs></ValCurs>`)
+	_, err = NewCBRProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail unsupported charset
+	server = serveStatus(t, http.StatusOK, `<?xml version="1.0" encoding="koi8-r"?><ValCurs></ValCurs>`)
+	_, err = NewCBRProvider(server.URL, server.Client()).Fetch(ctx)
+	assert.Error(t, err)
+}
+
+func TestFileProvider_Fetch(t *testing.T) {
+	expected := map[string]float32{"USD": 0.014, "EUR": 0.012}
+
+	// success YAML and JSON
+	rates, err := NewFileProvider("testdata/rates.yml").Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, rates)
+	}
+	rates, err = NewFileProvider("testdata/rates.json").Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, rates)
+	}
+
+	// fail missing file
+	_, err = NewFileProvider("testdata/missing.yml").Fetch(ctx)
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// fail invalid file
+	_, err = NewFileProvider(write("invalid.yml", "rates: [")).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail no rates
+	_, err = NewFileProvider(write("empty.yml", "rates: {}")).Fetch(ctx)
+	assert.Error(t, err)
+
+	// fail non-positive rate
+	_, err = NewFileProvider(write("negative.yml", "rates:\n  USD: -0.014\n")).Fetch(ctx)
+	assert.Error(t, err)
+}
@@ -0,0 +1,143 @@
+package rates
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+// Repository encapsulates the logic to access the history of exchange rates and their overrides from the database.
+type Repository interface {
+	// Create saves the rates fetched at the same moment in the storage.
+	Create(ctx context.Context, rates []entity.Rate) error
+	// GetAt returns the latest Rate of the currency fetched not after the given time.
+	GetAt(ctx context.Context, currency string, at time.Time) (entity.Rate, error)
+	// CreateOverride saves the override in the storage, ending the override of its currency served at its SetAt.
+	// It returns the ended overrides.
+	CreateOverride(ctx context.Context, override *entity.RateOverride) ([]entity.RateOverride, error)
+	// RemoveOverrides ends the overrides of the currency, or of all currencies if it is empty, served at the given
+	// time, and returns them.
+	RemoveOverrides(ctx context.Context, currency string, at time.Time, removedBy string) ([]entity.RateOverride, error)
+	// GetOverrideAt returns the RateOverride of the currency served at the given time.
+	GetOverrideAt(ctx context.Context, currency string, at time.Time) (entity.RateOverride, error)
+	// OverridesAt returns the RateOverride of each currency served at the given time, ordered by currency.
+	OverridesAt(ctx context.Context, at time.Time) ([]entity.RateOverride, error)
+}
+
+// repository persists Rate in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new Rate repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Create saves the Rate records in the database in a single DB transaction, so that a rate set is never stored
+// partially.
+func (r repository) Create(ctx context.Context, rates []entity.Rate) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		for i := range rates {
+			if err := r.db.With(ctx).Model(&rates[i]).Insert(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetAt reads the latest Rate of the currency fetched not after at from the database.
+// sql.ErrNoRows is returned if there is no such rate.
+func (r repository) GetAt(ctx context.Context, currency string, at time.Time) (entity.Rate, error) {
+	var rate entity.Rate
+	err := r.db.With(ctx).Select().
+		Where(dbx.HashExp{"currency": currency}).
+		AndWhere(dbx.NewExp("fetched_at <= {:at}", dbx.Params{"at": at.UTC()})).
+		OrderBy("fetched_at DESC", "id DESC").
+		Limit(1).
+		One(&rate)
+	return rate, err
+}
+
+// CreateOverride ends the RateOverride of the currency served at the time the new one is set at and inserts the new
+// one in a single DB transaction. The id of the inserted record is set to override.
+func (r repository) CreateOverride(ctx context.Context, override *entity.RateOverride) ([]entity.RateOverride, error) {
+	var replaced []entity.RateOverride
+	err := r.db.Transactional(ctx, func(ctx context.Context) error {
+		var err error
+		if replaced, err = r.endOverrides(ctx, override.Currency, override.SetAt, override.SetBy); err != nil {
+			return err
+		}
+		return r.db.With(ctx).Model(override).Insert()
+	})
+	return replaced, err
+}
+
+// RemoveOverrides ends the RateOverride records of the currency (of all currencies if it is empty) served at the
+// given time in a single DB transaction.
+func (r repository) RemoveOverrides(ctx context.Context, currency string, at time.Time, removedBy string) ([]entity.RateOverride, error) {
+	var removed []entity.RateOverride
+	err := r.db.Transactional(ctx, func(ctx context.Context) error {
+		var err error
+		removed, err = r.endOverrides(ctx, currency, at, removedBy)
+		return err
+	})
+	return removed, err
+}
+
+// endOverrides locks the RateOverride records of the currency (of all currencies if it is empty) served at the given
+// time with SELECT ... FOR UPDATE and makes them expire at that time.
+func (r repository) endOverrides(ctx context.Context, currency string, at time.Time, removedBy string) ([]entity.RateOverride, error) {
+	query := "SELECT * FROM rate_override WHERE set_at <= {:at} AND expires_at > {:at}"
+	if currency != "" {
+		query += " AND currency = {:currency}"
+	}
+	query += " ORDER BY currency, set_at, id FOR UPDATE"
+
+	var overrides []entity.RateOverride
+	err := r.db.With(ctx).
+		NewQuery(query).
+		Bind(dbx.Params{"at": at.UTC(), "currency": currency}).
+		All(&overrides)
+	if err != nil {
+		return nil, err
+	}
+	for i := range overrides {
+		overrides[i].ExpiresAt = at.UTC()
+		overrides[i].RemovedBy = removedBy
+		if err := r.db.With(ctx).Model(&overrides[i]).Update("ExpiresAt", "RemovedBy"); err != nil {
+			return nil, err
+		}
+	}
+	return overrides, nil
+}
+
+// GetOverrideAt reads the latest RateOverride of the currency served at the given time from the database.
+// sql.ErrNoRows is returned if there is no such override.
+func (r repository) GetOverrideAt(ctx context.Context, currency string, at time.Time) (entity.RateOverride, error) {
+	var override entity.RateOverride
+	err := r.db.With(ctx).Select().
+		Where(dbx.HashExp{"currency": currency}).
+		AndWhere(dbx.NewExp("set_at <= {:at} AND expires_at > {:at}", dbx.Params{"at": at.UTC()})).
+		OrderBy("set_at DESC", "id DESC").
+		Limit(1).
+		One(&override)
+	return override, err
+}
+
+// OverridesAt reads the latest RateOverride of each currency served at the given time from the database.
+func (r repository) OverridesAt(ctx context.Context, at time.Time) ([]entity.RateOverride, error) {
+	var overrides []entity.RateOverride
+	err := r.db.With(ctx).
+		NewQuery("SELECT DISTINCT ON (currency) * FROM rate_override WHERE set_at <= {:at} AND expires_at > {:at} " +
+			"ORDER BY currency, set_at DESC, id DESC").
+		Bind(dbx.Params{"at": at.UTC()}).
+		All(&overrides)
+	return overrides, err
+}
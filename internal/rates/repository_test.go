@@ -0,0 +1,131 @@
+package rates
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/test"
+	"users-balance-microservice/pkg/log"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "rate", "rate_override")
+	repo := NewRepository(db, logger)
+
+	ctx := context.Background()
+
+	dayAgo := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+	hourAgo := dayAgo.Add(23 * time.Hour)
+
+	// create
+	err := repo.Create(ctx, []entity.Rate{
+		{Currency: "USD", Rate: 0.014, FetchedAt: dayAgo},
+		{Currency: "EUR", Rate: 0.012, FetchedAt: dayAgo},
+	})
+	assert.NoError(t, err)
+	err = repo.Create(ctx, []entity.Rate{
+		{Currency: "USD", Rate: 0.015, FetchedAt: hourAgo},
+	})
+	assert.NoError(t, err)
+
+	// get the rate as of the moment
+	rate, err := repo.GetAt(ctx, "USD", hourAgo.Add(-time.Minute))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.014, rate.Rate)
+		assert.True(t, dayAgo.Equal(rate.FetchedAt))
+	}
+	rate, err = repo.GetAt(ctx, "USD", time.Now())
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rate.Rate)
+	}
+	rate, err = repo.GetAt(ctx, "EUR", time.Now())
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.012, rate.Rate)
+	}
+
+	// no rate fetched before the moment
+	_, err = repo.GetAt(ctx, "USD", dayAgo.Add(-time.Minute))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// unknown currency
+	_, err = repo.GetAt(ctx, "XYZ", time.Now())
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// a rate set is saved entirely or not at all
+	err = repo.Create(ctx, []entity.Rate{
+		{Currency: "GBP", Rate: 0.01, FetchedAt: hourAgo},
+		{Currency: "JPY", Rate: -1, FetchedAt: hourAgo},
+	})
+	assert.Error(t, err)
+	_, err = repo.GetAt(ctx, "GBP", time.Now())
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// create overrides
+	now := time.Now().UTC().Truncate(time.Second)
+	usd := entity.RateOverride{Currency: "USD", Rate: 0.015, SetBy: "admin", Reason: "wrong rate", SetAt: hourAgo, ExpiresAt: now.Add(time.Hour)}
+	replaced, err := repo.CreateOverride(ctx, &usd)
+	if assert.NoError(t, err) {
+		assert.Empty(t, replaced)
+		assert.NotZero(t, usd.Id)
+	}
+	eur := entity.RateOverride{Currency: "EUR", Rate: 0.013, SetBy: "admin", Reason: "wrong rate", SetAt: hourAgo, ExpiresAt: now.Add(time.Hour)}
+	_, err = repo.CreateOverride(ctx, &eur)
+	assert.NoError(t, err)
+
+	// the override served at the moment
+	o, err := repo.GetOverrideAt(ctx, "USD", now)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, o.Rate)
+		assert.Equal(t, "admin", o.SetBy)
+	}
+	_, err = repo.GetOverrideAt(ctx, "USD", dayAgo)
+	assert.Equal(t, sql.ErrNoRows, err)
+	overrides, err := repo.OverridesAt(ctx, now)
+	if assert.NoError(t, err) && assert.Len(t, overrides, 2) {
+		assert.Equal(t, "EUR", overrides[0].Currency)
+		assert.Equal(t, "USD", overrides[1].Currency)
+	}
+
+	// replaced override ends at the time the new one is set at
+	replacement := entity.RateOverride{Currency: "USD", Rate: 0.016, SetBy: "support", Reason: "typo", SetAt: now, ExpiresAt: now.Add(time.Hour)}
+	replaced, err = repo.CreateOverride(ctx, &replacement)
+	if assert.NoError(t, err) && assert.Len(t, replaced, 1) {
+		assert.Equal(t, usd.Id, replaced[0].Id)
+		assert.True(t, now.Equal(replaced[0].ExpiresAt))
+		assert.Equal(t, "support", replaced[0].RemovedBy)
+	}
+	o, err = repo.GetOverrideAt(ctx, "USD", now.Add(-time.Minute))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, o.Rate)
+	}
+	o, err = repo.GetOverrideAt(ctx, "USD", now)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.016, o.Rate)
+	}
+
+	// removed overrides are kept for the past
+	later := now.Add(time.Minute)
+	removed, err := repo.RemoveOverrides(ctx, "", later, "admin")
+	if assert.NoError(t, err) && assert.Len(t, removed, 2) {
+		assert.Equal(t, "EUR", removed[0].Currency)
+		assert.Equal(t, replacement.Id, removed[1].Id)
+	}
+	overrides, err = repo.OverridesAt(ctx, later)
+	if assert.NoError(t, err) {
+		assert.Empty(t, overrides)
+	}
+	o, err = repo.GetOverrideAt(ctx, "EUR", now)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.013, o.Rate)
+	}
+	removed, err = repo.RemoveOverrides(ctx, "USD", later, "admin")
+	if assert.NoError(t, err) {
+		assert.Empty(t, removed)
+	}
+}
@@ -1,89 +1,445 @@
 package rates
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"net/http"
+	"math/big"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/money"
+	"users-balance-microservice/internal/requests"
 	"users-balance-microservice/pkg/log"
 )
 
-const (
-	baseCurrency = "RUB"
-	apiPath      = "https://api.exchangerate.host/latest"
-)
+const baseCurrency = "RUB"
+
+// SourceOverride is the source of the rates pinned manually.
+const SourceOverride = "override"
 
-var currencyUnavailableError = errors.New("currency is not present in either cache or API response")
+var currencyUnavailableError = errors.New("currency is not present in either cache or provider response")
 
 // ExchangeRatesService provides exchange rates for currencies.
 type ExchangeRatesService interface {
 	// Get returns the exchange ratio for specific currency code against baseCurrency(RUB).
-	Get(code string) (float32, error)
+	Get(ctx context.Context, code string) (float32, error)
+	// GetRates returns the rates of the given currencies against baseCurrency(RUB) with the time they were fetched at.
+	GetRates(ctx context.Context, codes []string) (map[string]entity.Rate, error)
+	// GetAt returns the exchange ratio for specific currency code against baseCurrency(RUB) as it was at the given time.
+	GetAt(ctx context.Context, code string, at time.Time) (float32, error)
+	// KeepFresh refreshes the cached rates in the background ahead of their expiry until ctx is done.
+	KeepFresh(ctx context.Context, ahead time.Duration)
+}
+
+// Service provides exchange rates and allows to inspect and correct them.
+type Service interface {
+	ExchangeRatesService
+	// List returns the cached rates with their source and age, including the manually pinned ones.
+	List(ctx context.Context) []CachedRate
+	// Refresh fetches the rates from the provider regardless of their expiry and returns the cached rates.
+	Refresh(ctx context.Context) ([]CachedRate, error)
+	// Pin serves a manually set rate of a currency instead of the fetched one until it expires.
+	Pin(ctx context.Context, req requests.PinRateRequest) (entity.RateOverride, error)
+	// Unpin removes the manually set rate of a currency, or of all currencies, and returns the removed ones.
+	Unpin(ctx context.Context, req requests.UnpinRatesRequest) ([]entity.RateOverride, error)
+}
+
+// CrossRate returns the number of units of currency to per one unit of currency from as an exact fraction
+// of their rates against baseCurrency(RUB). It returns false if any of the rates is missing.
+func CrossRate(rates map[string]entity.Rate, from, to string) (*big.Rat, bool) {
+	if from == to {
+		return big.NewRat(1, 1), true
+	}
+
+	fromRate, toRate := rates[from].Rate, rates[to].Rate
+	if fromRate <= 0 || toRate <= 0 {
+		return nil, false
+	}
+	return new(big.Rat).Quo(money.Rate(toRate), money.Rate(fromRate)), true
+}
+
+// CachedRate represents an exchange rate known to the service.
+type CachedRate struct {
+	Currency string  `json:"currency"`
+	Rate     float32 `json:"rate"`
+	// Source is the name of the provider the rate was fetched from, or SourceOverride if it was pinned manually.
+	Source string `json:"source"`
+	// FetchedAt is the time the rate was fetched or pinned at, in UTC.
+	FetchedAt time.Time `json:"fetched_at"`
+	// Age is the number of seconds passed since FetchedAt.
+	Age int64 `json:"age"`
+	// Expired tells whether the fetched rate is served only while the provider fails.
+	Expired bool `json:"expired,omitempty"`
+	// ExpiresAt is the time the pinned rate expires at. Nil for the fetched rates.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 type service struct {
-	cache  *CacheService
-	logger log.Logger
+	cache           *CacheService
+	flight          *flight
+	overridesFlight *flight
+	provider        Provider
+	repo            Repository
+	maxStale        time.Duration
+	timeout         time.Duration
+	logger          log.Logger
 }
 
-// NewService creates a new exchange rates service.
-func NewService(expiry time.Duration, logger log.Logger) ExchangeRatesService {
-	store := cache.New(expiry, 5*time.Minute)
-	cacheService := NewCacheService(store)
-	return service{cache: cacheService, logger: logger}
+// NewService creates a new exchange rates service which caches the rates fetched from provider for expiry.
+// If the provider fails, expired rates are still served for maxStale. A fetch is aborted after timeout.
+// Every fetched rate set is saved in repo to be able to tell the rates as of past dates.
+func NewService(expiry, maxStale, timeout time.Duration, provider Provider, repo Repository, logger log.Logger) Service {
+	store := cache.New(expiry+maxStale, 5*time.Minute)
+	cacheService := NewCacheService(store, expiry)
+	return service{
+		cache:           cacheService,
+		flight:          &flight{},
+		overridesFlight: &flight{},
+		provider:        provider,
+		repo:            repo,
+		maxStale:        maxStale,
+		timeout:         timeout,
+		logger:          logger,
+	}
 }
 
-// ratesResponse holds an API response with a list of RUB\CURRENCY ratios for all currencies.
-type ratesResponse struct {
-	Rates map[string]float32 `json:"rates"`
+// Get will fetch a single rate for a given currency either from the cache or the provider.
+func (s service) Get(ctx context.Context, code string) (float32, error) {
+	rates, err := s.GetRates(ctx, []string{code})
+	if err != nil {
+		return 0, err
+	}
+	return rates[code].Rate, nil
 }
 
-// Get will fetch a single rate for a given currency either from the cache or the API.
-func (s service) Get(code string) (float32, error) {
-	if code == baseCurrency {
-		return 1, nil
+// GetRates returns the rates of the given currencies pinned manually, or either from the cache or the provider.
+// The provider is called at most once, even if several rates are missing in the cache.
+func (s service) GetRates(ctx context.Context, codes []string) (map[string]entity.Rate, error) {
+	overrides, err := s.overrides(ctx)
+	if err != nil {
+		s.logger.With(ctx).Error("failed to read pinned currency rates: ", err)
+		return nil, err
+	}
+	pinned := make(map[string]entity.RateOverride, len(overrides))
+	for _, o := range overrides {
+		pinned[o.Currency] = o
 	}
 
 	// If we have cached results, use them.
-	if result, ok := s.cache.Get(code); ok {
-		return result, nil
+	rates := make(map[string]entity.Rate, len(codes))
+	var missing []string
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		if o, ok := pinned[code]; ok {
+			rates[code] = entity.Rate{Currency: code, Rate: o.Rate, FetchedAt: o.SetAt}
+		} else if rate, ok := s.fresh(code); ok {
+			rates[code] = rate
+		} else {
+			missing = append(missing, code)
+		}
+	}
+	if len(missing) == 0 {
+		return rates, nil
 	}
 
 	// No cached results, go and fetch them.
-	if err := s.fetch(); err != nil {
-		s.logger.Error("failed to fetch currency rates: ", err)
+	if err := s.fetch(ctx); err != nil {
+		for _, code := range missing {
+			rate, ok := s.stale(ctx, code)
+			if !ok {
+				s.logger.With(ctx).Error("failed to fetch currency rates: ", err)
+				return nil, err
+			}
+			s.logger.With(ctx).Infof("failed to fetch currency rates, serving the rate of %s fetched at %v: %v", code, rate.FetchedAt, err)
+			rates[code] = rate
+		}
+		return rates, nil
+	}
+
+	// Currencies should be in cache by now. If failed, then particular currency is unavailable in service right now.
+	for _, code := range missing {
+		rate, ok := s.fresh(code)
+		if !ok {
+			s.logger.With(ctx).Info(fmt.Sprintf("client requested rate for \"%s\", which was not found in provider response", code))
+			return nil, currencyUnavailableError
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
+
+// fresh returns the rate of a given currency if it is in the cache and not expired.
+func (s service) fresh(code string) (entity.Rate, bool) {
+	if code == baseCurrency {
+		return entity.Rate{Currency: code, Rate: 1, FetchedAt: time.Now().UTC()}, true
+	}
+	rate, ok := s.cache.GetRate(code)
+	if !ok || time.Since(rate.FetchedAt) >= s.cache.expiry {
+		return entity.Rate{}, false
+	}
+	return rate, true
+}
+
+// stale returns an outdated rate of a given currency, as long as it's not too old: better an outdated rate than none.
+func (s service) stale(ctx context.Context, code string) (entity.Rate, bool) {
+	maxAge := s.cache.expiry + s.maxStale
+	if rate, ok := s.cache.GetRate(code); ok && time.Since(rate.FetchedAt) < maxAge {
+		return rate, true
+	}
+	// The cache is empty after a restart, but the last fetched rates may still be in the database.
+	if rate, err := s.repo.GetAt(ctx, code, time.Now()); err == nil && time.Since(rate.FetchedAt) < maxAge {
+		return rate, true
+	}
+	return entity.Rate{}, false
+}
+
+// GetAt returns the rate of a given currency pinned manually at the time, or else the last one fetched not after at.
+// Only the rates fetched by this service are known, so currencyUnavailableError is returned for earlier dates.
+func (s service) GetAt(ctx context.Context, code string, at time.Time) (float32, error) {
+	if code == baseCurrency {
+		return 1, nil
+	}
+
+	o, err := s.repo.GetOverrideAt(ctx, code, at)
+	if err == nil {
+		return o.Rate, nil
+	}
+	if err != sql.ErrNoRows {
 		return 0, err
 	}
 
-	// Currency should be in cache by now. If failed, then particular currency is unavailable in service right now.
-	if result, ok := s.cache.Get(code); ok {
-		return result, nil
-	} else {
-		s.logger.Info(fmt.Sprintf("client requested rate for \"%s\", which was not found in API response", code))
-		return 0, currencyUnavailableError
+	rate, err := s.repo.GetAt(ctx, code, at)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, currencyUnavailableError
+		}
+		return 0, err
 	}
+	return rate.Rate, nil
 }
 
-// Fetch all RUB/CURRENCY rates from API.
-func (s service) fetch() error {
-	fullUrl := fmt.Sprintf("%s?base=%s", apiPath, baseCurrency)
-	response, err := http.Get(fullUrl)
+// List returns the manually pinned rates and the cached fetched ones, ordered by currency. If a currency has both,
+// the pinned rate goes first, since it is the one being served.
+func (s service) List(ctx context.Context) []CachedRate {
+	overrides, err := s.overrides(ctx)
 	if err != nil {
-		return err
+		s.logger.With(ctx).Error("failed to read pinned currency rates: ", err)
+	}
+	now := time.Now()
+	fetched := s.cache.Rates()
+	list := make([]CachedRate, 0, len(overrides)+len(fetched))
+	for _, o := range overrides {
+		expiresAt := o.ExpiresAt
+		list = append(list, CachedRate{
+			Currency:  o.Currency,
+			Rate:      o.Rate,
+			Source:    SourceOverride,
+			FetchedAt: o.SetAt,
+			Age:       int64(now.Sub(o.SetAt) / time.Second),
+			ExpiresAt: &expiresAt,
+		})
+	}
+	for _, rate := range fetched {
+		list = append(list, CachedRate{
+			Currency:  rate.Currency,
+			Rate:      rate.Rate,
+			Source:    s.provider.Name(),
+			FetchedAt: rate.FetchedAt,
+			Age:       int64(now.Sub(rate.FetchedAt) / time.Second),
+			Expired:   now.Sub(rate.FetchedAt) >= s.cache.expiry,
+		})
 	}
-	defer response.Body.Close()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Currency < list[j].Currency })
+	return list
+}
+
+// Refresh fetches the rates from the provider. If a fetch is already in progress, its result is awaited instead.
+func (s service) Refresh(ctx context.Context) ([]CachedRate, error) {
+	if err := s.fetch(ctx); err != nil {
+		s.logger.With(ctx).Error("failed to refresh currency rates on request: ", err)
+		return nil, err
+	}
+	s.logger.With(ctx).Infof("currency rates refreshed on request from %s", s.provider.Name())
+	return s.List(ctx), nil
+}
+
+// Pin serves the rate from the request instead of the fetched rate of the currency until the request's ExpiresAt.
+// The override is saved in the database, so that it is served by all instances of the service, survives restarts
+// and applies to the conversions as of the time it was served. Other instances serve it once their cached overrides
+// expire, that is within the rates expiry.
+func (s service) Pin(ctx context.Context, req requests.PinRateRequest) (entity.RateOverride, error) {
+	if err := req.Validate(); err != nil {
+		return entity.RateOverride{}, err
+	}
+
+	expiresAt, _ := time.Parse(time.RFC3339, req.ExpiresAt)
+	o := entity.RateOverride{
+		Currency:  req.Currency,
+		Rate:      req.Rate,
+		SetBy:     req.ChangedBy,
+		Reason:    req.Reason,
+		SetAt:     time.Now().UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+	replaced, err := s.repo.CreateOverride(ctx, &o)
+	if err != nil {
+		return entity.RateOverride{}, err
+	}
+	s.cache.ExpireOverrides()
+
+	for _, previous := range replaced {
+		s.logger.With(ctx).Infof("rate of %s pinned at %v until %v by %s, replacing %v pinned by %s: %s",
+			o.Currency, o.Rate, o.ExpiresAt, o.SetBy, previous.Rate, previous.SetBy, o.Reason)
+	}
+	if len(replaced) == 0 {
+		s.logger.With(ctx).Infof("rate of %s pinned at %v until %v by %s: %s", o.Currency, o.Rate, o.ExpiresAt, o.SetBy, o.Reason)
+	}
+	return o, nil
+}
 
-	latest := ratesResponse{}
-	err = json.NewDecoder(response.Body).Decode(&latest)
+// Unpin removes the manually set rate of the request's Currency, or all of them if Currency is empty.
+// The removed overrides are kept in the database, ending at the time they were removed.
+func (s service) Unpin(ctx context.Context, req requests.UnpinRatesRequest) ([]entity.RateOverride, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	removed, err := s.repo.RemoveOverrides(ctx, req.Currency, time.Now().UTC(), req.ChangedBy)
 	if err != nil {
+		return nil, err
+	}
+	s.cache.ExpireOverrides()
+	for _, o := range removed {
+		s.logger.With(ctx).Infof("pinned rate %v of %s removed by %s: %s", o.Rate, o.Currency, req.ChangedBy, req.Reason)
+	}
+	if removed == nil {
+		removed = []entity.RateOverride{}
+	}
+	return removed, nil
+}
+
+func (s service) KeepFresh(ctx context.Context, ahead time.Duration) {
+	if ahead <= 0 {
+		return
+	}
+	s.cache.Refresh(ctx, ahead, func(ctx context.Context) error {
+		err := s.fetch(ctx)
+		if err != nil {
+			s.logger.With(ctx).Error("failed to refresh currency rates: ", err)
+		}
 		return err
+	})
+}
+
+// overrides returns the pinned rates served now, either from the cache or the database. Pinned rates are shared by
+// all instances of the service, so they are cached only for the rates expiry. Concurrent calls share a single query.
+func (s service) overrides(ctx context.Context) ([]entity.RateOverride, error) {
+	if overrides, ok := s.cache.Overrides(time.Now().UTC()); ok {
+		return overrides, nil
+	}
+
+	err := s.overridesFlight.do(ctx, func() error {
+		loadCtx := context.Background()
+		if s.timeout > 0 {
+			var cancel context.CancelFunc
+			loadCtx, cancel = context.WithTimeout(loadCtx, s.timeout)
+			defer cancel()
+		}
+
+		loadedAt := time.Now()
+		overrides, err := s.repo.OverridesAt(loadCtx, loadedAt.UTC())
+		if err != nil {
+			return err
+		}
+		s.cache.StoreOverrides(overrides, loadedAt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Store our results.
-	s.cache.Store(&latest)
+	if overrides, ok := s.cache.Overrides(time.Now().UTC()); ok {
+		return overrides, nil
+	}
+	// The overrides were changed while being loaded, so the loaded ones were not cached.
+	return s.repo.OverridesAt(ctx, time.Now().UTC())
+}
+
+// Fetch all RUB/CURRENCY rates from the provider. Concurrent calls share a single request to the provider, which is
+// not canceled when some of the callers give up waiting for it.
+func (s service) fetch(ctx context.Context) error {
+	return s.flight.do(ctx, func() error {
+		fetchCtx := context.Background()
+		if s.timeout > 0 {
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithTimeout(fetchCtx, s.timeout)
+			defer cancel()
+		}
+
+		rates, err := s.provider.Fetch(fetchCtx)
+		if err != nil {
+			return err
+		}
+
+		// Store our results.
+		s.cache.Store(rates)
 
-	return nil
+		// Keep them for conversions as of past dates. The rates are usable without it, so only log the failure.
+		fetchedAt := time.Now().UTC()
+		records := make([]entity.Rate, 0, len(rates))
+		for code, rate := range rates {
+			records = append(records, entity.Rate{Currency: code, Rate: rate, FetchedAt: fetchedAt})
+		}
+		if err := s.repo.Create(fetchCtx, records); err != nil {
+			s.logger.Error("failed to save currency rates: ", err)
+		}
+
+		return nil
+	})
+}
+
+// flight collapses concurrent calls of a function into one: the callers arriving while the call is in progress
+// wait for its result instead of calling the function again.
+type flight struct {
+	mu   sync.Mutex
+	call *flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+// do calls fn unless it is already being called and waits for the result until ctx is done.
+func (f *flight) do(ctx context.Context, fn func() error) error {
+	f.mu.Lock()
+	c := f.call
+	if c == nil {
+		c = &flightCall{done: make(chan struct{})}
+		f.call = c
+		go func() {
+			c.err = fn()
+			f.mu.Lock()
+			f.call = nil
+			f.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
\ No newline at end of file
@@ -0,0 +1,652 @@
+package rates
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/pkg/log"
+)
+
+var logger, _ = log.NewForTest()
+
+func TestService_Get(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014, "EUR": 0.012}}
+	s := NewService(time.Hour, 0, time.Second, provider, &mockRepository{}, logger)
+
+	// success base currency is not fetched
+	rate, err := s.Get(ctx, "RUB")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, rate)
+		assert.Zero(t, provider.Calls())
+	}
+
+	// success fetched once, then cached
+	rate, err = s.Get(ctx, "USD")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.014, rate)
+	}
+	rate, err = s.Get(ctx, "EUR")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.012, rate)
+		assert.Equal(t, 1, provider.Calls())
+	}
+
+	// fail currency unknown to the provider
+	_, err = s.Get(ctx, "XYZ")
+	assert.Equal(t, currencyUnavailableError, err)
+
+	// fail provider error
+	s = NewService(time.Hour, time.Hour, time.Second, &mockProvider{err: errors.New("provider is down")}, &mockRepository{}, logger)
+	_, err = s.Get(ctx, "USD")
+	assert.Error(t, err)
+}
+
+func TestService_GetRates(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014, "EUR": 0.012}}
+	s := NewService(time.Hour, 0, time.Second, provider, &mockRepository{}, logger)
+	before := time.Now().UTC()
+
+	// success all rates are fetched at once
+	rates, err := s.GetRates(ctx, []string{"RUB", "USD", "EUR", "USD"})
+	if assert.NoError(t, err) && assert.Len(t, rates, 3) {
+		assert.Equal(t, 1, provider.Calls())
+		assert.EqualValues(t, 1, rates["RUB"].Rate)
+		assert.EqualValues(t, 0.014, rates["USD"].Rate)
+		assert.Equal(t, "EUR", rates["EUR"].Currency)
+		assert.EqualValues(t, 0.012, rates["EUR"].Rate)
+		assert.False(t, rates["USD"].FetchedAt.Before(before))
+		assert.Equal(t, rates["USD"].FetchedAt, rates["EUR"].FetchedAt)
+	}
+
+	// success cached rates keep the time they were fetched at
+	cached, err := s.GetRates(ctx, []string{"USD"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, provider.Calls())
+		assert.Equal(t, rates["USD"], cached["USD"])
+	}
+
+	// fail any currency unknown to the provider
+	_, err = s.GetRates(ctx, []string{"USD", "XYZ"})
+	assert.Equal(t, currencyUnavailableError, err)
+
+	// fail provider error
+	s = NewService(time.Hour, time.Hour, time.Second, &mockProvider{err: errors.New("provider is down")}, &mockRepository{}, logger)
+	_, err = s.GetRates(ctx, []string{"RUB", "USD"})
+	assert.Error(t, err)
+
+	// success base currency only
+	rates, err = s.GetRates(ctx, []string{"RUB"})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, rates["RUB"].Rate)
+	}
+}
+
+func TestService_GetConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014}, release: release}
+	s := NewService(time.Hour, 0, time.Second, provider, &mockRepository{}, logger)
+
+	// concurrent misses share a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rate, err := s.Get(ctx, "USD")
+			if assert.NoError(t, err) {
+				assert.EqualValues(t, 0.014, rate)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, provider.Calls())
+}
+
+func TestService_GetStale(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014}}
+	s := NewService(10*time.Millisecond, time.Hour, time.Second, provider, &mockRepository{}, logger)
+	_, err := s.Get(ctx, "USD")
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	// success expired rate is served while the provider is down
+	provider.Fail(errors.New("provider is down"))
+	rate, err := s.Get(ctx, "USD")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.014, rate)
+		assert.Equal(t, 2, provider.Calls())
+	}
+
+	// success fresh rate once the provider is back
+	provider.Fail(nil)
+	provider.rates = map[string]float32{"USD": 0.015}
+	rate, err = s.Get(ctx, "USD")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rate)
+	}
+
+	// fail stale rates are not served without the window
+	provider = &mockProvider{rates: map[string]float32{"USD": 0.014}}
+	s = NewService(10*time.Millisecond, 0, time.Second, provider, &mockRepository{}, logger)
+	_, err = s.Get(ctx, "USD")
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	provider.Fail(errors.New("provider is down"))
+	_, err = s.Get(ctx, "USD")
+	assert.Error(t, err)
+}
+
+func TestService_GetSaved(t *testing.T) {
+	// success saved rate is served after a restart while the provider is down
+	repo := &mockRepository{}
+	repo.Create(ctx, []entity.Rate{{Currency: "USD", Rate: 0.014, FetchedAt: time.Now().UTC().Add(-30 * time.Minute)}})
+	s := NewService(10*time.Minute, time.Hour, time.Second, &mockProvider{err: errors.New("provider is down")}, repo, logger)
+	rate, err := s.Get(ctx, "USD")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.014, rate)
+	}
+
+	// fail saved rate is too old
+	s = NewService(10*time.Minute, 0, time.Second, &mockProvider{err: errors.New("provider is down")}, repo, logger)
+	_, err = s.Get(ctx, "USD")
+	assert.Error(t, err)
+}
+
+func TestService_GetAt(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014, "EUR": 0.012}}
+	repo := &mockRepository{}
+	s := NewService(time.Hour, 0, time.Second, provider, repo, logger)
+	before := time.Now()
+
+	// success base currency
+	rate, err := s.GetAt(ctx, "RUB", before)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, rate)
+	}
+
+	// fetched rates are saved
+	_, err = s.Get(ctx, "USD")
+	assert.NoError(t, err)
+	if assert.Len(t, repo.rates, 2) {
+		assert.Equal(t, repo.rates[0].FetchedAt, repo.rates[1].FetchedAt)
+		assert.Equal(t, time.UTC, repo.rates[0].FetchedAt.Location())
+	}
+	repo.Create(ctx, []entity.Rate{{Currency: "USD", Rate: 0.015, FetchedAt: time.Now().UTC().Add(time.Hour)}})
+
+	// success rate as of the moment
+	rate, err = s.GetAt(ctx, "USD", time.Now())
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.014, rate)
+	}
+	rate, err = s.GetAt(ctx, "USD", time.Now().Add(2*time.Hour))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rate)
+	}
+
+	// fail no rate fetched before the moment
+	_, err = s.GetAt(ctx, "USD", before.Add(-time.Minute))
+	assert.Equal(t, currencyUnavailableError, err)
+
+	// fail repository error
+	repo.err = errors.New("database is down")
+	_, err = s.GetAt(ctx, "USD", time.Now())
+	assert.Equal(t, repo.err, err)
+
+	// success rates are served even if they could not be saved
+	s = NewService(time.Hour, 0, time.Second, provider, &mockRepository{createErr: errors.New("database is read-only")}, logger)
+	rate, err = s.Get(ctx, "EUR")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.012, rate)
+	}
+}
+
+func TestService_Pin(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014, "EUR": 0.012}}
+	s := NewService(time.Hour, 0, time.Second, provider, &mockRepository{}, logger)
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// success pinned rate is served instead of the fetched one
+	o, err := s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "USD", o.Currency)
+		assert.Equal(t, expiresAt, o.ExpiresAt.Format(time.RFC3339))
+	}
+	rate, err := s.Get(ctx, "USD")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rate)
+		assert.Zero(t, provider.Calls())
+	}
+	rates, err := s.GetRates(ctx, []string{"USD", "EUR"})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rates["USD"].Rate)
+		assert.Equal(t, o.SetAt, rates["USD"].FetchedAt)
+		assert.EqualValues(t, 0.012, rates["EUR"].Rate)
+	}
+
+	// success pinned rate is replaced
+	_, err = s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: 0.016, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "typo"})
+	assert.NoError(t, err)
+	rate, _ = s.Get(ctx, "USD")
+	assert.EqualValues(t, 0.016, rate)
+
+	// fail invalid request
+	_, err = s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: -1, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "typo"})
+	assert.Error(t, err)
+
+	// success pinned rate of a single currency is removed
+	_, err = s.Pin(ctx, requests.PinRateRequest{Currency: "EUR", Rate: 0.013, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"})
+	assert.NoError(t, err)
+	removed, err := s.Unpin(ctx, requests.UnpinRatesRequest{Currency: "USD", ChangedBy: "admin"})
+	if assert.NoError(t, err) && assert.Len(t, removed, 1) {
+		assert.EqualValues(t, 0.016, removed[0].Rate)
+	}
+	rate, _ = s.Get(ctx, "USD")
+	assert.EqualValues(t, 0.014, rate)
+	rate, _ = s.Get(ctx, "EUR")
+	assert.EqualValues(t, 0.013, rate)
+
+	// success nothing to remove
+	removed, err = s.Unpin(ctx, requests.UnpinRatesRequest{Currency: "USD", ChangedBy: "admin"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, removed)
+	}
+
+	// success all pinned rates are removed
+	removed, err = s.Unpin(ctx, requests.UnpinRatesRequest{ChangedBy: "admin", Reason: "provider fixed the rates"})
+	if assert.NoError(t, err) && assert.Len(t, removed, 1) {
+		assert.Equal(t, "EUR", removed[0].Currency)
+	}
+	rate, _ = s.Get(ctx, "EUR")
+	assert.EqualValues(t, 0.012, rate)
+
+	// fail invalid request
+	_, err = s.Unpin(ctx, requests.UnpinRatesRequest{Currency: "USD"})
+	assert.Error(t, err)
+
+	// expired pinned rate is not served
+	repo := &mockRepository{overrides: []entity.RateOverride{
+		{Currency: "USD", Rate: 0.015, SetAt: time.Now().UTC().Add(-time.Hour), ExpiresAt: time.Now().UTC().Add(-time.Minute)},
+	}}
+	s = NewService(time.Hour, 0, time.Second, provider, repo, logger)
+	rate, _ = s.Get(ctx, "USD")
+	assert.EqualValues(t, 0.014, rate)
+	removed, err = s.Unpin(ctx, requests.UnpinRatesRequest{ChangedBy: "admin"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, removed)
+	}
+}
+
+func TestService_PinPersisted(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014}}
+	repo := &mockRepository{}
+	s := NewService(time.Hour, 0, time.Second, provider, repo, logger)
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	o, err := s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	pinnedAt := time.Now().UTC()
+
+	// the pinned rate is saved with who set it, when and until when
+	if assert.Len(t, repo.overrides, 1) {
+		assert.Equal(t, "admin", repo.overrides[0].SetBy)
+		assert.Equal(t, "wrong rate", repo.overrides[0].Reason)
+		assert.Equal(t, o.SetAt, repo.overrides[0].SetAt)
+		assert.Equal(t, expiresAt, repo.overrides[0].ExpiresAt.Format(time.RFC3339))
+	}
+
+	// another instance of the service, or the same one after a restart, serves the pinned rate
+	other := NewService(time.Hour, 0, time.Second, provider, repo, logger)
+	rate, err := other.Get(ctx, "USD")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rate)
+	}
+	assert.Len(t, other.List(ctx), 1)
+
+	// the pinned rate applies to the conversions as of the time it was served
+	rate, err = other.GetAt(ctx, "USD", pinnedAt)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rate)
+	}
+
+	// replacing and removing the pinned rate keeps it for the past, ending it at the time it was replaced or removed
+	_, err = s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: 0.016, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "typo"})
+	assert.NoError(t, err)
+	removed, err := other.Unpin(ctx, requests.UnpinRatesRequest{Currency: "USD", ChangedBy: "support"})
+	if assert.NoError(t, err) && assert.Len(t, removed, 1) {
+		assert.EqualValues(t, 0.016, removed[0].Rate)
+		assert.Equal(t, "support", removed[0].RemovedBy)
+	}
+	if assert.Len(t, repo.overrides, 2) {
+		assert.Equal(t, "admin", repo.overrides[0].RemovedBy)
+		assert.Equal(t, repo.overrides[1].SetAt, repo.overrides[0].ExpiresAt)
+	}
+	rate, _ = s.Get(ctx, "USD")
+	assert.EqualValues(t, 0.014, rate)
+	rate, err = s.GetAt(ctx, "USD", pinnedAt)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0.015, rate)
+	}
+
+	// fail repository error
+	repo.err = errors.New("database is down")
+	_, err = NewService(time.Hour, 0, time.Second, provider, repo, logger).Get(ctx, "USD")
+	assert.Equal(t, repo.err, err)
+	_, err = s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"})
+	assert.Equal(t, repo.err, err)
+	_, err = s.Unpin(ctx, requests.UnpinRatesRequest{ChangedBy: "admin"})
+	assert.Equal(t, repo.err, err)
+}
+
+func TestService_PinCached(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014}}
+	repo := &mockRepository{}
+	s := NewService(50*time.Millisecond, 0, time.Second, provider, repo, logger)
+	other := NewService(50*time.Millisecond, 0, time.Second, provider, repo, logger)
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// the pinned rates are read from the database once per expiry
+	for i := 0; i < 3; i++ {
+		rate, err := other.Get(ctx, "USD")
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 0.014, rate)
+		}
+	}
+	assert.Equal(t, 1, repo.OverridesCalls())
+
+	// the instance pinning the rate serves it right away
+	_, err := s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"})
+	assert.NoError(t, err)
+	rate, _ := s.Get(ctx, "USD")
+	assert.EqualValues(t, 0.015, rate)
+
+	// other instances serve it once their cache expires
+	rate, _ = other.Get(ctx, "USD")
+	assert.EqualValues(t, 0.014, rate)
+	time.Sleep(50 * time.Millisecond)
+	rate, _ = other.Get(ctx, "USD")
+	assert.EqualValues(t, 0.015, rate)
+
+	// the instance removing the rate stops serving it right away
+	_, err = s.Unpin(ctx, requests.UnpinRatesRequest{ChangedBy: "admin"})
+	assert.NoError(t, err)
+	rate, _ = s.Get(ctx, "USD")
+	assert.EqualValues(t, 0.014, rate)
+}
+
+func TestService_List(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014, "EUR": 0.012}}
+	s := NewService(time.Hour, 0, time.Second, provider, &mockRepository{}, logger)
+
+	// nothing is cached yet
+	assert.Empty(t, s.List(ctx))
+
+	// success refresh fetches the rates
+	list, err := s.Refresh(ctx)
+	if assert.NoError(t, err) && assert.Len(t, list, 2) {
+		assert.Equal(t, 1, provider.Calls())
+		assert.Equal(t, "EUR", list[0].Currency)
+		assert.Equal(t, "USD", list[1].Currency)
+		assert.Equal(t, "mock", list[1].Source)
+		assert.EqualValues(t, 0.014, list[1].Rate)
+		assert.False(t, list[1].Expired)
+		assert.Nil(t, list[1].ExpiresAt)
+	}
+
+	// success refresh ignores the expiry
+	_, err = s.Refresh(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, provider.Calls())
+
+	// pinned rate goes before the fetched one
+	_, err = s.Pin(ctx, requests.PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: time.Now().Add(time.Hour).Format(time.RFC3339), ChangedBy: "admin", Reason: "wrong rate"})
+	assert.NoError(t, err)
+	list = s.List(ctx)
+	if assert.Len(t, list, 3) {
+		assert.Equal(t, SourceOverride, list[1].Source)
+		assert.EqualValues(t, 0.015, list[1].Rate)
+		assert.NotNil(t, list[1].ExpiresAt)
+		assert.Equal(t, "mock", list[2].Source)
+	}
+
+	// fail provider error
+	provider.Fail(errors.New("provider is down"))
+	_, err = s.Refresh(ctx)
+	assert.Error(t, err)
+
+	// expired rates are marked
+	s = NewService(10*time.Millisecond, time.Hour, time.Second, &mockProvider{rates: map[string]float32{"USD": 0.014}}, &mockRepository{}, logger)
+	_, err = s.Refresh(ctx)
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	list = s.List(ctx)
+	if assert.Len(t, list, 1) {
+		assert.True(t, list[0].Expired)
+	}
+}
+
+func TestCrossRate(t *testing.T) {
+	published := map[string]entity.Rate{
+		"RUB": {Currency: "RUB", Rate: 1},
+		"USD": {Currency: "USD", Rate: 0.014},
+		"EUR": {Currency: "EUR", Rate: 0.012},
+	}
+
+	// the rate is an exact fraction of the published decimal rates
+	rate, ok := CrossRate(published, "USD", "EUR")
+	if assert.True(t, ok) {
+		assert.Equal(t, big.NewRat(6, 7), rate)
+	}
+	rate, ok = CrossRate(published, "RUB", "USD")
+	if assert.True(t, ok) {
+		assert.Equal(t, big.NewRat(7, 500), rate)
+	}
+	rate, ok = CrossRate(published, "JPY", "JPY")
+	if assert.True(t, ok) {
+		assert.Equal(t, big.NewRat(1, 1), rate)
+	}
+
+	// missing rate
+	_, ok = CrossRate(published, "USD", "JPY")
+	assert.False(t, ok)
+}
+
+func TestService_GetTimeout(t *testing.T) {
+	// fail provider does not respond in time
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014}, release: make(chan struct{})}
+	s := NewService(time.Hour, 0, 10*time.Millisecond, provider, &mockRepository{}, logger)
+	_, err := s.Get(ctx, "USD")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// fail caller gives up waiting
+	s = NewService(time.Hour, 0, time.Second, provider, &mockRepository{}, logger)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.Get(canceled, "USD")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestService_KeepFresh(t *testing.T) {
+	provider := &mockProvider{rates: map[string]float32{"USD": 0.014}}
+	s := NewService(40*time.Millisecond, 0, time.Second, provider, &mockRepository{}, logger)
+	refreshCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.KeepFresh(refreshCtx, 20*time.Millisecond)
+		close(done)
+	}()
+
+	// rates are fetched right away and then ahead of each expiry
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	assert.GreaterOrEqual(t, provider.Calls(), 3)
+
+	// refresh is disabled by zero
+	s.KeepFresh(ctx, 0)
+}
+
+type mockProvider struct {
+	mu      sync.Mutex
+	rates   map[string]float32
+	err     error
+	calls   int
+	release chan struct{}
+}
+
+// Fetch returns the rates or the error after release is closed, if it is set.
+func (p *mockProvider) Fetch(ctx context.Context) (map[string]float32, error) {
+	p.mu.Lock()
+	p.calls++
+	p.mu.Unlock()
+
+	if p.release != nil {
+		select {
+		case <-p.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rates, p.err
+}
+
+func (p *mockProvider) Name() string {
+	return "mock"
+}
+
+func (p *mockProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func (p *mockProvider) Fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+type mockRepository struct {
+	mu        sync.Mutex
+	rates     []entity.Rate
+	overrides []entity.RateOverride
+	err       error
+	createErr error
+	// the number of OverridesAt calls
+	overridesCalls int
+}
+
+func (r *mockRepository) Create(ctx context.Context, rates []entity.Rate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.createErr != nil {
+		return r.createErr
+	}
+	r.rates = append(r.rates, rates...)
+	return nil
+}
+
+func (r *mockRepository) GetAt(ctx context.Context, currency string, at time.Time) (entity.Rate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return entity.Rate{}, r.err
+	}
+	var found *entity.Rate
+	for i, rate := range r.rates {
+		if rate.Currency == currency && !rate.FetchedAt.After(at) && (found == nil || !rate.FetchedAt.Before(found.FetchedAt)) {
+			found = &r.rates[i]
+		}
+	}
+	if found == nil {
+		return entity.Rate{}, sql.ErrNoRows
+	}
+	return *found, nil
+}
+
+func (r *mockRepository) CreateOverride(ctx context.Context, override *entity.RateOverride) ([]entity.RateOverride, error) {
+	replaced, err := r.RemoveOverrides(ctx, override.Currency, override.SetAt, override.SetBy)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	override.Id = int64(len(r.overrides) + 1)
+	r.overrides = append(r.overrides, *override)
+	return replaced, nil
+}
+
+func (r *mockRepository) RemoveOverrides(ctx context.Context, currency string, at time.Time, removedBy string) ([]entity.RateOverride, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	var removed []entity.RateOverride
+	for i, o := range r.overrides {
+		if (currency == "" || o.Currency == currency) && o.ActiveAt(at) {
+			r.overrides[i].ExpiresAt, r.overrides[i].RemovedBy = at, removedBy
+			removed = append(removed, r.overrides[i])
+		}
+	}
+	sort.SliceStable(removed, func(i, j int) bool { return removed[i].Currency < removed[j].Currency })
+	return removed, nil
+}
+
+func (r *mockRepository) GetOverrideAt(ctx context.Context, currency string, at time.Time) (entity.RateOverride, error) {
+	overrides, err := r.OverridesAt(ctx, at)
+	if err != nil {
+		return entity.RateOverride{}, err
+	}
+	for _, o := range overrides {
+		if o.Currency == currency {
+			return o, nil
+		}
+	}
+	return entity.RateOverride{}, sql.ErrNoRows
+}
+
+func (r *mockRepository) OverridesCalls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.overridesCalls
+}
+
+func (r *mockRepository) OverridesAt(ctx context.Context, at time.Time) ([]entity.RateOverride, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.overridesCalls++
+	if r.err != nil {
+		return nil, r.err
+	}
+	latest := make(map[string]entity.RateOverride)
+	for _, o := range r.overrides {
+		if o.ActiveAt(at) && !o.SetAt.Before(latest[o.Currency].SetAt) {
+			latest[o.Currency] = o
+		}
+	}
+	overrides := make([]entity.RateOverride, 0, len(latest))
+	for _, o := range latest {
+		overrides = append(overrides, o)
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Currency < overrides[j].Currency })
+	return overrides, nil
+}
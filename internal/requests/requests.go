@@ -1,11 +1,61 @@
 package requests
 
 import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"users-balance-microservice/internal/entity"
 )
 
-var notNilUuidRule = validation.NotIn("00000000-0000-0000-0000-000000000000").Error("value cannot be Nil UUID.")
+const (
+	// DateLayout is the layout of dates without time in requests.
+	DateLayout = "2006-01-02"
+	// MaxTransactionIds is the maximum number of transactions which can be requested at once.
+	MaxTransactionIds = 100
+	// MaxMetadataKeys is the maximum number of metadata key-value pairs of a transaction.
+	MaxMetadataKeys = 20
+	// MaxMetadataKeyLength and MaxMetadataValueLength limit the length of metadata keys and values in characters.
+	MaxMetadataKeyLength   = 40
+	MaxMetadataValueLength = 500
+	// MaxTags is the maximum number of tags of a transaction.
+	MaxTags = 10
+	// MaxTagLength limits the length of tags in characters.
+	MaxTagLength = 50
+	// MaxBalanceCurrencies is the maximum number of currencies a balance can be converted into at once.
+	MaxBalanceCurrencies = 10
+	// MaxRateOverrideDuration is the maximum time an exchange rate can be overridden for.
+	MaxRateOverrideDuration = 30 * 24 * time.Hour
+)
+
+var (
+	notNilUuidRule       = validation.NotIn("00000000-0000-0000-0000-000000000000").Error("value cannot be Nil UUID.")
+	notSystemAccountRule = validation.NotIn(entity.ExternalTopUpAccount.String(), entity.ExternalWithdrawalAccount.String(), entity.ExchangeAccount.String()).Error("value cannot be a system account UUID.")
+)
+
+// metadataRules validate the size of transaction metadata: the number of pairs and the length of keys and values.
+var metadataRules = []validation.Rule{
+	validation.Length(0, MaxMetadataKeys),
+	validation.By(func(value interface{}) error {
+		m, _ := value.(map[string]string)
+		for key := range m {
+			if n := utf8.RuneCountInString(key); n == 0 || n > MaxMetadataKeyLength {
+				return validation.NewError("validation_metadata_key_length",
+					fmt.Sprintf("keys must be between 1 and %d characters long", MaxMetadataKeyLength))
+			}
+		}
+		return nil
+	}),
+	validation.Each(validation.Length(0, MaxMetadataValueLength)),
+}
+
+// tagsRules validate the number and the length of transaction tags.
+var tagsRules = []validation.Rule{
+	validation.Length(0, MaxTags),
+	validation.Each(validation.Required, validation.Length(1, MaxTagLength)),
+}
 
 // Request represents a JSON data of an API request.
 type Request interface {
@@ -14,9 +64,11 @@ type Request interface {
 }
 
 // GetBalanceRequest represents a request to get balance of specific user.
+// The balance can be additionally converted into each of Currencies.
 type GetBalanceRequest struct {
-	OwnerId  string `json:"owner_id"`
-	Currency string `json:"currency,omitempty"`
+	OwnerId    string   `json:"owner_id"`
+	Currency   string   `json:"currency,omitempty"`
+	Currencies []string `json:"currencies,omitempty"`
 }
 
 // Validate validates the GetBalanceRequest fields.
@@ -24,58 +76,444 @@ func (r GetBalanceRequest) Validate() error {
 	return validation.ValidateStruct(&r,
 		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule),
 		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.Currencies, validation.Length(0, MaxBalanceCurrencies), validation.Each(validation.Required, is.CurrencyCode)),
 	)
 }
 
 // UpdateBalanceRequest represents a request to update user's balance.
+// If Currency is not specified, the Deposit in entity.DefaultCurrency is updated.
+// Metadata and Tags are attached to the created transaction.
+// If Pending is true, the transaction is created pending and changes the balance only once it is completed.
 type UpdateBalanceRequest struct {
-	OwnerId     string `json:"owner_id"`
-	Amount      int64  `json:"amount"`
-	Description string `json:"description,omitempty"`
+	OwnerId        string            `json:"owner_id"`
+	Amount         int64             `json:"amount"`
+	Currency       string            `json:"currency,omitempty"`
+	Description    string            `json:"description,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+	Pending        bool              `json:"pending,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
 }
 
 func (r UpdateBalanceRequest) Validate() error {
 	return validation.ValidateStruct(&r,
-		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule),
+		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule),
 		validation.Field(&r.Amount, validation.Required),
+		validation.Field(&r.Currency, is.CurrencyCode),
 		validation.Field(&r.Description, validation.Length(0, 100)),
+		validation.Field(&r.Metadata, metadataRules...),
+		validation.Field(&r.Tags, tagsRules...),
+		validation.Field(&r.IdempotencyKey, validation.Length(0, 255)),
 	)
 }
 
 // TransferRequest represents a request to transfer money from one user to another.
+// Amount is taken from sender's Deposit in Currency (entity.DefaultCurrency if not specified) and credited to
+// recipient's Deposit in RecipientCurrency (Currency if not specified), converted at the current exchange rate, or at
+// the rate locked by the quote with QuoteId.
+// Metadata and Tags are attached to the created transaction.
+// If Pending is true, the transaction is created pending and moves the money only once it is completed.
 type TransferRequest struct {
-	SenderId    string `json:"sender_id"`
-	RecipientId string `json:"recipient_id"`
-	Amount      int64  `json:"amount"`
-	Description string `json:"description"`
+	SenderId          string            `json:"sender_id"`
+	RecipientId       string            `json:"recipient_id"`
+	Amount            int64             `json:"amount"`
+	Currency          string            `json:"currency,omitempty"`
+	RecipientCurrency string            `json:"recipient_currency,omitempty"`
+	Description       string            `json:"description"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
+	Pending           bool              `json:"pending,omitempty"`
+	IdempotencyKey    string            `json:"idempotency_key,omitempty"`
+	QuoteId           string            `json:"quote_id,omitempty"`
 }
 
 // Validate validates the TransferRequest fields.
+// The sender can be the recipient only to exchange money between its own deposits in different currencies.
 func (r TransferRequest) Validate() error {
+	currency, recipientCurrency := r.Currency, r.RecipientCurrency
+	if currency == "" {
+		currency = entity.DefaultCurrency
+	}
+	if recipientCurrency == "" {
+		recipientCurrency = currency
+	}
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.SenderId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule),
+		validation.Field(&r.RecipientId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule,
+			validation.When(currency == recipientCurrency,
+				validation.NotIn(r.SenderId).Error("must differ from the sender_id unless the currencies differ"),
+			),
+		),
+		validation.Field(&r.Amount, validation.Required, validation.Min(0).Exclusive()),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.RecipientCurrency, is.CurrencyCode),
+		validation.Field(&r.Description, validation.Length(0, 100)),
+		validation.Field(&r.Metadata, metadataRules...),
+		validation.Field(&r.Tags, tagsRules...),
+		validation.Field(&r.IdempotencyKey, validation.Length(0, 255)),
+		validation.Field(&r.QuoteId, is.UUID),
+	)
+}
+
+// BatchOperation represents a single operation of a batch: either a transfer or a balance update.
+type BatchOperation struct {
+	Transfer *TransferRequest      `json:"transfer,omitempty"`
+	Update   *UpdateBalanceRequest `json:"update,omitempty"`
+}
+
+// Validate validates the BatchOperation. Exactly one of its fields must be specified.
+func (o BatchOperation) Validate() error {
+	switch {
+	case o.Transfer != nil && o.Update != nil:
+		return validation.Errors{
+			"update": validation.NewError("validation_batch_operation_ambiguous", "must be blank if transfer is specified"),
+		}
+	case o.Transfer != nil:
+		return o.Transfer.Validate()
+	case o.Update != nil:
+		return o.Update.Validate()
+	default:
+		return validation.Errors{
+			"transfer": validation.NewError("validation_batch_operation_empty", "either transfer or update is required"),
+		}
+	}
+}
+
+// BatchRequest represents a request to apply several transfers and balance updates atomically, in the given order.
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// Validate validates the BatchRequest fields. Its operations are validated separately with BatchOperation.Validate,
+// so that errors can be reported for each of them.
+func (r BatchRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		// Skip prevents the operations from being validated as part of the slice
+		validation.Field(&r.Operations, validation.Required, validation.Skip),
+	)
+}
+
+// ReserveRequest represents a request to hold money on user's deposit.
+// If Currency is not specified, the money is held on the Deposit in entity.DefaultCurrency.
+type ReserveRequest struct {
+	OwnerId     string `json:"owner_id"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Validate validates the ReserveRequest fields.
+func (r ReserveRequest) Validate() error {
 	return validation.ValidateStruct(&r,
-		validation.Field(&r.SenderId, validation.Required, is.UUID, notNilUuidRule),
-		validation.Field(&r.RecipientId, validation.Required, is.UUID, notNilUuidRule),
+		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule),
 		validation.Field(&r.Amount, validation.Required, validation.Min(0).Exclusive()),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.Description, validation.Length(0, 100)),
+	)
+}
+
+// SetCreditLimitRequest represents a request to change the credit limit of user's deposit.
+// If Currency is not specified, the Deposit in entity.DefaultCurrency is changed.
+type SetCreditLimitRequest struct {
+	OwnerId     string `json:"owner_id"`
+	Currency    string `json:"currency,omitempty"`
+	CreditLimit int64  `json:"credit_limit"`
+}
+
+// Validate validates the SetCreditLimitRequest fields.
+func (r SetCreditLimitRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.CreditLimit, validation.Min(0)),
+	)
+}
+
+// SetSpendingLimitsRequest represents a request to override the default spending limits of user's deposit.
+// Zero limits mean the default ones apply. If Currency is not specified, the Deposit in entity.DefaultCurrency
+// is changed.
+type SetSpendingLimitsRequest struct {
+	OwnerId            string `json:"owner_id"`
+	Currency           string `json:"currency,omitempty"`
+	DailyAmountLimit   int64  `json:"daily_amount_limit"`
+	DailyCountLimit    int64  `json:"daily_count_limit"`
+	MonthlyAmountLimit int64  `json:"monthly_amount_limit"`
+	MonthlyCountLimit  int64  `json:"monthly_count_limit"`
+}
+
+// Validate validates the SetSpendingLimitsRequest fields.
+func (r SetSpendingLimitsRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.DailyAmountLimit, validation.Min(0)),
+		validation.Field(&r.DailyCountLimit, validation.Min(0)),
+		validation.Field(&r.MonthlyAmountLimit, validation.Min(0)),
+		validation.Field(&r.MonthlyCountLimit, validation.Min(0)),
+	)
+}
+
+// SetStatusRequest represents a request to change the status of user's deposit, e.g. to freeze it during
+// a fraud investigation. If Currency is not specified, the Deposit in entity.DefaultCurrency is changed.
+type SetStatusRequest struct {
+	OwnerId   string `json:"owner_id"`
+	Currency  string `json:"currency,omitempty"`
+	Status    string `json:"status"`
+	ChangedBy string `json:"changed_by"`
+	Reason    string `json:"reason"`
+}
+
+// Validate validates the SetStatusRequest fields.
+func (r SetStatusRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.Status, validation.Required, validation.In(
+			entity.DepositActive, entity.DepositFrozenDebit, entity.DepositFrozenAll, entity.DepositClosed,
+		)),
+		validation.Field(&r.ChangedBy, validation.Required, validation.Length(0, 100)),
+		validation.Field(&r.Reason, validation.Required, validation.Length(0, 255)),
+	)
+}
+
+// CaptureRequest represents a request to withdraw money held by a reservation.
+// If Amount is not specified, all the remaining reserved money is captured.
+type CaptureRequest struct {
+	Amount int64 `json:"amount,omitempty"`
+}
+
+// Validate validates the CaptureRequest fields.
+func (r CaptureRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Amount, validation.Min(0)),
+	)
+}
+
+// ReverseRequest represents a request to reverse (refund) an existing transaction.
+// If Amount is not specified, all the remaining amount of the transaction is reversed.
+type ReverseRequest struct {
+	Amount      int64  `json:"amount,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Validate validates the ReverseRequest fields.
+func (r ReverseRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Amount, validation.Min(0)),
 		validation.Field(&r.Description, validation.Length(0, 100)),
 	)
 }
 
+// ChangeTransactionStatusRequest represents a request to complete or fail a pending transaction.
+type ChangeTransactionStatusRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Validate validates the ChangeTransactionStatusRequest fields.
+func (r ChangeTransactionStatusRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Reason, validation.Length(0, 255)),
+	)
+}
+
+// GetTransactionsRequest represents a request to get transactions by their ids.
+// If OwnerId is specified, the user with this id must be a party to each of the transactions.
+type GetTransactionsRequest struct {
+	Ids     []int64 `json:"ids"`
+	OwnerId string  `json:"owner_id,omitempty"`
+}
+
+// Validate validates the GetTransactionsRequest fields.
+func (r GetTransactionsRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Ids, validation.Required, validation.Length(1, MaxTransactionIds), validation.Each(validation.Required, validation.Min(int64(1)))),
+		validation.Field(&r.OwnerId, is.UUID, notNilUuidRule),
+	)
+}
+
 // GetHistoryRequest represents a request to get a list of all user's transactions: top-ups, withdrawals and transfers.
+// The transactions can be filtered by date (RFC 3339, both ends inclusive), type, counterparty of transfers,
+// amount (both ends inclusive), status, a substring of description, tags (all of them must be attached to a transaction)
+// and metadata (all of the key-value pairs must be present in transaction's metadata).
+// Pages can be requested either by Offset or by Cursor returned with the previous page.
+// If ConvertTo is specified, the amount of each transaction is also converted into that currency at the exchange rate
+// as of the transaction date.
 type GetHistoryRequest struct {
-	OwnerId        string `json:"owner_id"`
-	Offset         int    `json:"offset,omitempty"`
-	Limit          int    `json:"limit,omitempty"`
-	OrderBy        string `json:"order_by,omitempty"`
-	OrderDirection string `json:"order_direction,omitempty"`
+	OwnerId        string            `json:"owner_id"`
+	Cursor         string            `json:"cursor,omitempty"`
+	Offset         int               `json:"offset,omitempty"`
+	Limit          int               `json:"limit,omitempty"`
+	OrderBy        string            `json:"order_by,omitempty"`
+	OrderDirection string            `json:"order_direction,omitempty"`
+	DateFrom       string            `json:"date_from,omitempty"`
+	DateTo         string            `json:"date_to,omitempty"`
+	Types          []string          `json:"types,omitempty"`
+	Statuses       []string          `json:"statuses,omitempty"`
+	CounterpartyId string            `json:"counterparty_id,omitempty"`
+	MinAmount      int64             `json:"min_amount,omitempty"`
+	MaxAmount      int64             `json:"max_amount,omitempty"`
+	Description    string            `json:"description,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	ConvertTo      string            `json:"convert_to,omitempty"`
 }
 
 // Validate validates the GetHistoryRequest.
 func (r GetHistoryRequest) Validate() error {
+	// the end of the period can't precede its start
+	dateToRule := validation.Date(time.RFC3339)
+	if from, err := time.Parse(time.RFC3339, r.DateFrom); err == nil {
+		dateToRule = dateToRule.Min(from)
+	}
+
 	return validation.ValidateStruct(&r,
 		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule),
-		validation.Field(&r.Offset, validation.Min(0)),
+		validation.Field(&r.Cursor, validation.Length(0, 512)),
+		validation.Field(&r.Offset, validation.Min(0), validation.When(r.Cursor != "",
+			validation.Empty.Error("must be blank if cursor is specified"),
+		)),
 		validation.Field(&r.Limit, validation.Min(1)),
 		validation.Field(&r.OrderBy, validation.In("transaction_date", "amount")),
 		validation.Field(&r.OrderDirection, validation.In("ASC", "DESC")),
+		validation.Field(&r.DateFrom, validation.Date(time.RFC3339)),
+		validation.Field(&r.DateTo, dateToRule),
+		validation.Field(&r.Types, validation.Each(validation.In(
+			entity.TransactionTopUp, entity.TransactionWithdrawal,
+			entity.TransactionIncomingTransfer, entity.TransactionOutgoingTransfer,
+		))),
+		validation.Field(&r.Statuses, validation.Each(validation.In(
+			entity.TransactionPending, entity.TransactionCompleted, entity.TransactionFailed, entity.TransactionReversed,
+		))),
+		validation.Field(&r.CounterpartyId, is.UUID, notNilUuidRule),
+		validation.Field(&r.MinAmount, validation.Min(0)),
+		validation.Field(&r.MaxAmount, validation.Min(0), validation.Min(r.MinAmount)),
+		validation.Field(&r.Description, validation.Length(0, 100)),
+		validation.Field(&r.Tags, tagsRules...),
+		validation.Field(&r.Metadata, metadataRules...),
+		validation.Field(&r.ConvertTo, is.CurrencyCode),
+	)
+}
+
+// StatementRequest represents a request to get a statement of user's deposit for a period of whole days in UTC,
+// from DateFrom to DateTo inclusive. If Currency is not specified, the statement of the Deposit in
+// entity.DefaultCurrency is returned. Format is one of csv, ofx and camt053, csv by default.
+type StatementRequest struct {
+	OwnerId  string `json:"owner_id"`
+	Currency string `json:"currency,omitempty"`
+	DateFrom string `json:"date_from"`
+	DateTo   string `json:"date_to"`
+	Format   string `json:"format,omitempty"`
+}
+
+// Validate validates the StatementRequest fields.
+func (r StatementRequest) Validate() error {
+	// the end of the period can't precede its start
+	dateToRule := validation.Date(DateLayout)
+	if from, err := time.Parse(DateLayout, r.DateFrom); err == nil {
+		dateToRule = dateToRule.Min(from)
+	}
+
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule, notSystemAccountRule),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.DateFrom, validation.Required, validation.Date(DateLayout)),
+		validation.Field(&r.DateTo, validation.Required, dateToRule),
+		validation.Field(&r.Format, validation.In("csv", "ofx", "camt053")),
 	)
-}
\ No newline at end of file
+}
+
+// AnalyticsRequest represents a request to get the totals of money received and sent by a user for a period of whole
+// days in UTC, from DateFrom to DateTo inclusive, bucketed by Interval (day, week or month) and optionally split by
+// GroupBy (counterparty or tag). If Currency is not specified, the Deposit in entity.DefaultCurrency is analyzed.
+type AnalyticsRequest struct {
+	OwnerId  string `json:"owner_id"`
+	Currency string `json:"currency,omitempty"`
+	DateFrom string `json:"date_from"`
+	DateTo   string `json:"date_to"`
+	Interval string `json:"interval"`
+	GroupBy  string `json:"group_by,omitempty"`
+}
+
+// Validate validates the AnalyticsRequest fields.
+func (r AnalyticsRequest) Validate() error {
+	// the end of the period can't precede its start
+	dateToRule := validation.Date(DateLayout)
+	if from, err := time.Parse(DateLayout, r.DateFrom); err == nil {
+		dateToRule = dateToRule.Min(from)
+	}
+
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.OwnerId, validation.Required, is.UUID, notNilUuidRule),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.DateFrom, validation.Required, validation.Date(DateLayout)),
+		validation.Field(&r.DateTo, validation.Required, dateToRule),
+		validation.Field(&r.Interval, validation.Required, validation.In("day", "week", "month")),
+		validation.Field(&r.GroupBy, validation.In("counterparty", "tag")),
+	)
+}
+
+// PinRateRequest represents a request to serve a manually set exchange rate of a currency (units of it per one unit
+// of entity.DefaultCurrency) instead of the fetched one until ExpiresAt (RFC 3339).
+type PinRateRequest struct {
+	Currency  string  `json:"currency"`
+	Rate      float32 `json:"rate"`
+	ExpiresAt string  `json:"expires_at"`
+	ChangedBy string  `json:"changed_by"`
+	Reason    string  `json:"reason"`
+}
+
+// Validate validates the PinRateRequest fields.
+func (r PinRateRequest) Validate() error {
+	now := time.Now()
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Currency, validation.Required, is.CurrencyCode,
+			validation.NotIn(entity.DefaultCurrency).Error("the rate of the default currency can't be changed"),
+		),
+		validation.Field(&r.Rate, validation.Required, validation.Min(float32(0)).Exclusive()),
+		validation.Field(&r.ExpiresAt, validation.Required,
+			validation.Date(time.RFC3339).Min(now).Max(now.Add(MaxRateOverrideDuration)),
+		),
+		validation.Field(&r.ChangedBy, validation.Required, validation.Length(0, 100)),
+		validation.Field(&r.Reason, validation.Required, validation.Length(0, 255)),
+	)
+}
+
+// UnpinRatesRequest represents a request to remove the manually set exchange rate of Currency, or of all currencies
+// if it is not specified.
+type UnpinRatesRequest struct {
+	Currency  string `json:"currency,omitempty"`
+	ChangedBy string `json:"changed_by"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Validate validates the UnpinRatesRequest fields.
+func (r UnpinRatesRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.ChangedBy, validation.Required, validation.Length(0, 100)),
+		validation.Field(&r.Reason, validation.Length(0, 255)),
+	)
+}
+
+// QuoteRequest represents a request to lock the exchange rate for converting Amount of Currency into TargetCurrency.
+// If Currency is not specified, entity.DefaultCurrency is converted.
+type QuoteRequest struct {
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency,omitempty"`
+	TargetCurrency string `json:"target_currency"`
+}
+
+// Validate validates the QuoteRequest fields.
+func (r QuoteRequest) Validate() error {
+	currency := r.Currency
+	if currency == "" {
+		currency = entity.DefaultCurrency
+	}
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Amount, validation.Required, validation.Min(0).Exclusive()),
+		validation.Field(&r.Currency, is.CurrencyCode),
+		validation.Field(&r.TargetCurrency, validation.Required, is.CurrencyCode,
+			validation.NotIn(currency).Error("must differ from the currency"),
+		),
+	)
+}
@@ -1,11 +1,14 @@
 package requests
 
 import (
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
 )
 
 var nilUuidString = "00000000-0000-0000-0000-000000000000"
@@ -25,6 +28,15 @@ func testValidation(t *testing.T, tests []validationTestcase) {
 	}
 }
 
+// tooManyMetadataKeys returns metadata with one pair more than allowed.
+func tooManyMetadataKeys() map[string]string {
+	m := make(map[string]string, MaxMetadataKeys+1)
+	for i := 0; i <= MaxMetadataKeys; i++ {
+		m[fmt.Sprint("key", i)] = "value"
+	}
+	return m
+}
+
 func TestGetBalanceRequest_Validate(t *testing.T) {
 	id1 := uuid.NewString()
 	testValidation(t, []validationTestcase{
@@ -34,35 +46,181 @@ func TestGetBalanceRequest_Validate(t *testing.T) {
 		{"fail invalid OwnerId", GetBalanceRequest{OwnerId: "12712912"}, true},
 		{"fail nil OwnerId", GetBalanceRequest{OwnerId: nilUuidString}, true},
 		{"fail invalid currency", GetBalanceRequest{OwnerId: id1, Currency: "EURUSDPLT"}, true},
+		{"success with currencies", GetBalanceRequest{OwnerId: id1, Currency: "EUR", Currencies: []string{"RUB", "USD", "EUR"}}, false},
+		{"fail invalid currencies", GetBalanceRequest{OwnerId: id1, Currencies: []string{"USD", "dollar"}}, true},
+		{"fail empty currency in currencies", GetBalanceRequest{OwnerId: id1, Currencies: []string{""}}, true},
+		{"fail too many currencies", GetBalanceRequest{OwnerId: id1, Currencies: strings.Split("AUD,CAD,CHF,CNY,EUR,GBP,JPY,KZT,RUB,TRY,USD", ",")}, true},
 	})
 }
 
 func TestUpdateBalanceRequest_Validate(t *testing.T) {
 	id1 := uuid.NewString()
 	testValidation(t, []validationTestcase{
-		{"success positive amount", UpdateBalanceRequest{id1, 500, "visa"}, false},
-		{"success negative amount", UpdateBalanceRequest{id1, -500, "mastercard"}, false},
-		{"success no description", UpdateBalanceRequest{id1, 500, ""}, false},
-		{"fail zero amount", UpdateBalanceRequest{id1, 0, ""}, true},
-		{"fail invalid OwnerId", UpdateBalanceRequest{"i'm invalid", 500, ""}, true},
-		{"fail nil OwnerId", UpdateBalanceRequest{nilUuidString, 500, ""}, true},
-		{"fail too long description", UpdateBalanceRequest{id1, 500, strings.Repeat("test", 100)}, true},
+		{"success positive amount", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Description: "visa"}, false},
+		{"success negative amount", UpdateBalanceRequest{OwnerId: id1, Amount: -500, Description: "mastercard"}, false},
+		{"success no description", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Description: ""}, false},
+		{"fail zero amount", UpdateBalanceRequest{OwnerId: id1, Amount: 0, Description: ""}, true},
+		{"fail invalid OwnerId", UpdateBalanceRequest{OwnerId: "i'm invalid", Amount: 500, Description: ""}, true},
+		{"fail nil OwnerId", UpdateBalanceRequest{OwnerId: nilUuidString, Amount: 500, Description: ""}, true},
+		{"fail system account OwnerId", UpdateBalanceRequest{OwnerId: entity.ExternalTopUpAccount.String(), Amount: 500, Description: ""}, true},
+		{"fail too long description", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Description: strings.Repeat("test", 100)}, true},
+		{"success with idempotency key", UpdateBalanceRequest{OwnerId: id1, Amount: 500, IdempotencyKey: uuid.NewString()}, false},
+		{"fail too long idempotency key", UpdateBalanceRequest{OwnerId: id1, Amount: 500, IdempotencyKey: strings.Repeat("key", 100)}, true},
+		{"success with currency", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Currency: "USD"}, false},
+		{"fail invalid currency", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Currency: "DOLLARS"}, true},
+		{"success with metadata and tags", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Metadata: map[string]string{"order_id": "42"}, Tags: []string{"promo"}}, false},
+		{"fail empty metadata key", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Metadata: map[string]string{"": "42"}}, true},
+		{"fail too long metadata value", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Metadata: map[string]string{"order_id": strings.Repeat("test", 200)}}, true},
+		{"fail too many tags", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Tags: strings.Fields(strings.Repeat("tag ", MaxTags+1))}, true},
+		{"fail empty tag", UpdateBalanceRequest{OwnerId: id1, Amount: 500, Tags: []string{""}}, true},
+		{"success pending", UpdateBalanceRequest{OwnerId: id1, Amount: -500, Pending: true}, false},
 	})
 }
 
 func TestTransferRequest_Validate(t *testing.T) {
 	id1, id2 := uuid.NewString(), uuid.NewString()
 	testValidation(t, []validationTestcase{
-		{"success no description", TransferRequest{id1, id2, 500, ""}, false},
-		{"success with description", TransferRequest{id1, id2, 500, "thanks for dinner"}, false},
-		{"fail negative amount", TransferRequest{id1, id2, -500, ""}, true},
-		{"fail missing missing SenderId", TransferRequest{"", id2, 500, ""}, true},
-		{"fail missing missing RecipientId", TransferRequest{id1, "", 500, ""}, true},
-		{"fail SenderId invalid", TransferRequest{"124124-12412-12412", id2, 500, ""}, true},
-		{"fail RecipientId invalid", TransferRequest{id1, "982312-124-124-43", 500, ""}, true},
-		{"fail nil SenderId", TransferRequest{nilUuidString, id2, 500, ""}, true},
-		{"fail nil RecipientId", TransferRequest{id1, nilUuidString, 500, ""}, true},
-		{"fail description too long", TransferRequest{id1, id2, 500, strings.Repeat("test", 100)}, true},
+		{"success no description", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Description: ""}, false},
+		{"success with description", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Description: "thanks for dinner"}, false},
+		{"fail negative amount", TransferRequest{SenderId: id1, RecipientId: id2, Amount: -500, Description: ""}, true},
+		{"fail missing missing SenderId", TransferRequest{SenderId: "", RecipientId: id2, Amount: 500, Description: ""}, true},
+		{"fail missing missing RecipientId", TransferRequest{SenderId: id1, RecipientId: "", Amount: 500, Description: ""}, true},
+		{"fail SenderId invalid", TransferRequest{SenderId: "124124-12412-12412", RecipientId: id2, Amount: 500, Description: ""}, true},
+		{"fail RecipientId invalid", TransferRequest{SenderId: id1, RecipientId: "982312-124-124-43", Amount: 500, Description: ""}, true},
+		{"fail nil SenderId", TransferRequest{SenderId: nilUuidString, RecipientId: id2, Amount: 500, Description: ""}, true},
+		{"fail nil RecipientId", TransferRequest{SenderId: id1, RecipientId: nilUuidString, Amount: 500, Description: ""}, true},
+		{"fail system account SenderId", TransferRequest{SenderId: entity.ExternalTopUpAccount.String(), RecipientId: id2, Amount: 500, Description: ""}, true},
+		{"fail system account RecipientId", TransferRequest{SenderId: id1, RecipientId: entity.ExternalWithdrawalAccount.String(), Amount: 500, Description: ""}, true},
+		{"fail description too long", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Description: strings.Repeat("test", 100)}, true},
+		{"success with idempotency key", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, IdempotencyKey: uuid.NewString()}, false},
+		{"fail too long idempotency key", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, IdempotencyKey: strings.Repeat("key", 100)}, true},
+		{"success with quote", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, RecipientCurrency: "USD", QuoteId: uuid.NewString()}, false},
+		{"fail invalid quote id", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, RecipientCurrency: "USD", QuoteId: "quote-1"}, true},
+		{"success cross-currency", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Currency: "USD", RecipientCurrency: "EUR"}, false},
+		{"fail invalid currency", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Currency: "DOLLARS"}, true},
+		{"fail invalid recipient currency", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, RecipientCurrency: "EURO"}, true},
+		{"fail exchange account RecipientId", TransferRequest{SenderId: id1, RecipientId: entity.ExchangeAccount.String(), Amount: 500}, true},
+		{"success with metadata and tags", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Metadata: map[string]string{"invoice_id": "INV-1"}, Tags: []string{"rent"}}, false},
+		{"fail too many metadata keys", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Metadata: tooManyMetadataKeys()}, true},
+		{"fail too long metadata key", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Metadata: map[string]string{strings.Repeat("key", 20): "1"}}, true},
+		{"fail too long tag", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Tags: []string{strings.Repeat("tag", 20)}}, true},
+		{"success pending", TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500, Pending: true}, false},
+		{"fail transfer to itself", TransferRequest{SenderId: id1, RecipientId: id1, Amount: 500}, true},
+		{"fail transfer to itself in the same currency", TransferRequest{SenderId: id1, RecipientId: id1, Amount: 500, Currency: "USD", RecipientCurrency: "USD"}, true},
+		{"fail transfer to itself in the default currency", TransferRequest{SenderId: id1, RecipientId: id1, Amount: 500, RecipientCurrency: entity.DefaultCurrency}, true},
+		{"success exchange between own deposits", TransferRequest{SenderId: id1, RecipientId: id1, Amount: 500, Currency: "USD", RecipientCurrency: "RUB"}, false},
+	})
+}
+
+func TestBatchRequest_Validate(t *testing.T) {
+	id1, id2 := uuid.NewString(), uuid.NewString()
+	transfer := &TransferRequest{SenderId: id1, RecipientId: id2, Amount: 500}
+	update := &UpdateBalanceRequest{OwnerId: id1, Amount: 500}
+	testValidation(t, []validationTestcase{
+		{"success", BatchRequest{Operations: []BatchOperation{{Update: update}, {Transfer: transfer}}}, false},
+		{"fail no operations", BatchRequest{}, true},
+		{"success transfer operation", BatchOperation{Transfer: transfer}, false},
+		{"success update operation", BatchOperation{Update: update}, false},
+		{"fail empty operation", BatchOperation{}, true},
+		{"fail ambiguous operation", BatchOperation{Transfer: transfer, Update: update}, true},
+		{"fail invalid transfer", BatchOperation{Transfer: &TransferRequest{SenderId: id1, RecipientId: id2}}, true},
+		{"fail invalid update", BatchOperation{Update: &UpdateBalanceRequest{OwnerId: "12712912", Amount: 500}}, true},
+	})
+}
+
+func TestReserveRequest_Validate(t *testing.T) {
+	id1 := uuid.NewString()
+	testValidation(t, []validationTestcase{
+		{"success", ReserveRequest{OwnerId: id1, Amount: 500, Description: "order #1"}, false},
+		{"success no description", ReserveRequest{OwnerId: id1, Amount: 500}, false},
+		{"fail zero amount", ReserveRequest{OwnerId: id1}, true},
+		{"fail negative amount", ReserveRequest{OwnerId: id1, Amount: -500}, true},
+		{"fail invalid OwnerId", ReserveRequest{OwnerId: "12712912", Amount: 500}, true},
+		{"fail nil OwnerId", ReserveRequest{OwnerId: nilUuidString, Amount: 500}, true},
+		{"fail too long description", ReserveRequest{OwnerId: id1, Amount: 500, Description: strings.Repeat("test", 100)}, true},
+		{"success with currency", ReserveRequest{OwnerId: id1, Amount: 500, Currency: "EUR"}, false},
+		{"fail invalid currency", ReserveRequest{OwnerId: id1, Amount: 500, Currency: "EURO"}, true},
+	})
+}
+
+func TestSetCreditLimitRequest_Validate(t *testing.T) {
+	id1 := uuid.NewString()
+	testValidation(t, []validationTestcase{
+		{"success", SetCreditLimitRequest{OwnerId: id1, CreditLimit: 5000}, false},
+		{"success zero limit", SetCreditLimitRequest{OwnerId: id1}, false},
+		{"success with currency", SetCreditLimitRequest{OwnerId: id1, Currency: "USD", CreditLimit: 100}, false},
+		{"fail negative limit", SetCreditLimitRequest{OwnerId: id1, CreditLimit: -100}, true},
+		{"fail invalid OwnerId", SetCreditLimitRequest{OwnerId: "12712912", CreditLimit: 100}, true},
+		{"fail system account OwnerId", SetCreditLimitRequest{OwnerId: entity.ExternalWithdrawalAccount.String(), CreditLimit: 100}, true},
+		{"fail invalid currency", SetCreditLimitRequest{OwnerId: id1, Currency: "EURO"}, true},
+	})
+}
+
+func TestSetSpendingLimitsRequest_Validate(t *testing.T) {
+	id1 := uuid.NewString()
+	testValidation(t, []validationTestcase{
+		{"success", SetSpendingLimitsRequest{OwnerId: id1, DailyAmountLimit: 100000, DailyCountLimit: 20}, false},
+		{"success reset to defaults", SetSpendingLimitsRequest{OwnerId: id1}, false},
+		{"success with currency", SetSpendingLimitsRequest{OwnerId: id1, Currency: "USD", MonthlyAmountLimit: 1000, MonthlyCountLimit: 100}, false},
+		{"fail negative amount limit", SetSpendingLimitsRequest{OwnerId: id1, DailyAmountLimit: -1}, true},
+		{"fail negative count limit", SetSpendingLimitsRequest{OwnerId: id1, MonthlyCountLimit: -1}, true},
+		{"fail invalid OwnerId", SetSpendingLimitsRequest{OwnerId: "12712912"}, true},
+		{"fail invalid currency", SetSpendingLimitsRequest{OwnerId: id1, Currency: "EURO"}, true},
+	})
+}
+
+func TestSetStatusRequest_Validate(t *testing.T) {
+	id1 := uuid.NewString()
+	testValidation(t, []validationTestcase{
+		{"success", SetStatusRequest{OwnerId: id1, Status: "frozen_all", ChangedBy: "admin", Reason: "fraud"}, false},
+		{"success with currency", SetStatusRequest{OwnerId: id1, Currency: "USD", Status: "active", ChangedBy: "admin", Reason: "ok"}, false},
+		{"fail unknown status", SetStatusRequest{OwnerId: id1, Status: "frozen", ChangedBy: "admin", Reason: "fraud"}, true},
+		{"fail missing status", SetStatusRequest{OwnerId: id1, ChangedBy: "admin", Reason: "fraud"}, true},
+		{"fail missing changed_by", SetStatusRequest{OwnerId: id1, Status: "closed", Reason: "fraud"}, true},
+		{"fail missing reason", SetStatusRequest{OwnerId: id1, Status: "closed", ChangedBy: "admin"}, true},
+		{"fail too long reason", SetStatusRequest{OwnerId: id1, Status: "closed", ChangedBy: "admin", Reason: strings.Repeat("test", 100)}, true},
+		{"fail invalid OwnerId", SetStatusRequest{OwnerId: "12712912", Status: "closed", ChangedBy: "admin", Reason: "fraud"}, true},
+	})
+}
+
+func TestCaptureRequest_Validate(t *testing.T) {
+	testValidation(t, []validationTestcase{
+		{"success all remaining", CaptureRequest{}, false},
+		{"success partial", CaptureRequest{Amount: 500}, false},
+		{"fail negative amount", CaptureRequest{Amount: -500}, true},
+	})
+}
+
+func TestReverseRequest_Validate(t *testing.T) {
+	testValidation(t, []validationTestcase{
+		{"success all remaining", ReverseRequest{}, false},
+		{"success partial with description", ReverseRequest{Amount: 500, Description: "refund"}, false},
+		{"fail negative amount", ReverseRequest{Amount: -500}, true},
+		{"fail too long description", ReverseRequest{Description: strings.Repeat("test", 100)}, true},
+	})
+}
+
+func TestChangeTransactionStatusRequest_Validate(t *testing.T) {
+	testValidation(t, []validationTestcase{
+		{"success no reason", ChangeTransactionStatusRequest{}, false},
+		{"success with reason", ChangeTransactionStatusRequest{Reason: "confirmed by the bank"}, false},
+		{"fail too long reason", ChangeTransactionStatusRequest{Reason: strings.Repeat("test", 100)}, true},
+	})
+}
+
+func TestGetTransactionsRequest_Validate(t *testing.T) {
+	tooMany := make([]int64, MaxTransactionIds+1)
+	for i := range tooMany {
+		tooMany[i] = int64(i + 1)
+	}
+	testValidation(t, []validationTestcase{
+		{"success single id", GetTransactionsRequest{Ids: []int64{1}}, false},
+		{"success with OwnerId", GetTransactionsRequest{Ids: []int64{1, 2, 3}, OwnerId: uuid.NewString()}, false},
+		{"fail missing ids", GetTransactionsRequest{}, true},
+		{"fail non-positive id", GetTransactionsRequest{Ids: []int64{1, 0}}, true},
+		{"fail too many ids", GetTransactionsRequest{Ids: tooMany}, true},
+		{"fail invalid OwnerId", GetTransactionsRequest{Ids: []int64{1}, OwnerId: "128312-1241-12"}, true},
+		{"fail nil OwnerId", GetTransactionsRequest{Ids: []int64{1}, OwnerId: nilUuidString}, true},
 	})
 }
 
@@ -72,7 +230,7 @@ func TestGetHistoryRequest_Validate(t *testing.T) {
 		{"success only OwnerId", GetHistoryRequest{OwnerId: id1}, false},
 		{"success with ordering", GetHistoryRequest{OwnerId: id1, OrderBy: "amount", OrderDirection: "ASC"}, false},
 		{"success with limit&offset", GetHistoryRequest{OwnerId: id1, Offset: 10, Limit: 5}, false},
-		{"success all params", GetHistoryRequest{id1, 10, 5, "transaction_date", "DESC"}, false},
+		{"success all params", GetHistoryRequest{OwnerId: id1, Offset: 10, Limit: 5, OrderBy: "transaction_date", OrderDirection: "DESC"}, false},
 		{"fail missing OwnerId", GetHistoryRequest{OwnerId: ""}, true},
 		{"fail invalid OwnerId", GetHistoryRequest{OwnerId: "128312-1241-12"}, true},
 		{"fail nil OwnerId", GetHistoryRequest{OwnerId: nilUuidString}, true},
@@ -80,5 +238,100 @@ func TestGetHistoryRequest_Validate(t *testing.T) {
 		{"fail invalid OrderDirection", GetHistoryRequest{OwnerId: id1, OrderBy: "amount", OrderDirection: "MEDIAN"}, true},
 		{"fail negative offset", GetHistoryRequest{OwnerId: id1, Offset: -10}, true},
 		{"fail negative limit", GetHistoryRequest{OwnerId: id1, Limit: -5}, true},
+		{"success with date range", GetHistoryRequest{OwnerId: id1, DateFrom: "2021-11-01T00:00:00Z", DateTo: "2021-11-30T23:59:59+03:00"}, false},
+		{"success with types", GetHistoryRequest{OwnerId: id1, Types: []string{"top_up", "outgoing_transfer"}}, false},
+		{"success with counterparty", GetHistoryRequest{OwnerId: id1, CounterpartyId: uuid.NewString()}, false},
+		{"success with amount range", GetHistoryRequest{OwnerId: id1, MinAmount: 100, MaxAmount: 100}, false},
+		{"success with description", GetHistoryRequest{OwnerId: id1, Description: "50%_off"}, false},
+		{"fail invalid date", GetHistoryRequest{OwnerId: id1, DateFrom: "2021-11-01"}, true},
+		{"fail reversed date range", GetHistoryRequest{OwnerId: id1, DateFrom: "2021-11-02T00:00:00Z", DateTo: "2021-11-01T00:00:00Z"}, true},
+		{"fail unknown type", GetHistoryRequest{OwnerId: id1, Types: []string{"top_up", "refund"}}, true},
+		{"success with statuses", GetHistoryRequest{OwnerId: id1, Statuses: []string{"pending", "failed"}}, false},
+		{"fail unknown status", GetHistoryRequest{OwnerId: id1, Statuses: []string{"completed", "cancelled"}}, true},
+		{"fail invalid counterparty", GetHistoryRequest{OwnerId: id1, CounterpartyId: "128312-1241-12"}, true},
+		{"fail negative min amount", GetHistoryRequest{OwnerId: id1, MinAmount: -1}, true},
+		{"fail reversed amount range", GetHistoryRequest{OwnerId: id1, MinAmount: 200, MaxAmount: 100}, true},
+		{"fail too long description", GetHistoryRequest{OwnerId: id1, Description: strings.Repeat("test", 100)}, true},
+		{"success with cursor", GetHistoryRequest{OwnerId: id1, Cursor: "eyJvIjoiYW1vdW50In0", Limit: 5}, false},
+		{"fail cursor with offset", GetHistoryRequest{OwnerId: id1, Cursor: "eyJvIjoiYW1vdW50In0", Offset: 5}, true},
+		{"fail too long cursor", GetHistoryRequest{OwnerId: id1, Cursor: strings.Repeat("test", 200)}, true},
+		{"success with tags and metadata", GetHistoryRequest{OwnerId: id1, Tags: []string{"promo"}, Metadata: map[string]string{"campaign": "black-friday"}}, false},
+		{"fail empty tag", GetHistoryRequest{OwnerId: id1, Tags: []string{""}}, true},
+		{"fail empty metadata key", GetHistoryRequest{OwnerId: id1, Metadata: map[string]string{"": "black-friday"}}, true},
+		{"success with conversion", GetHistoryRequest{OwnerId: id1, ConvertTo: "USD"}, false},
+		{"fail invalid conversion currency", GetHistoryRequest{OwnerId: id1, ConvertTo: "DOLLAR"}, true},
+	})
+}
+
+func TestStatementRequest_Validate(t *testing.T) {
+	id1 := uuid.NewString()
+	testValidation(t, []validationTestcase{
+		{"success required params", StatementRequest{OwnerId: id1, DateFrom: "2021-11-01", DateTo: "2021-11-30"}, false},
+		{"success single day", StatementRequest{OwnerId: id1, DateFrom: "2021-11-01", DateTo: "2021-11-01"}, false},
+		{"success all params", StatementRequest{OwnerId: id1, Currency: "USD", DateFrom: "2021-11-01", DateTo: "2021-11-30", Format: "camt053"}, false},
+		{"fail missing OwnerId", StatementRequest{DateFrom: "2021-11-01", DateTo: "2021-11-30"}, true},
+		{"fail nil OwnerId", StatementRequest{OwnerId: nilUuidString, DateFrom: "2021-11-01", DateTo: "2021-11-30"}, true},
+		{"fail invalid currency", StatementRequest{OwnerId: id1, Currency: "RUR", DateFrom: "2021-11-01", DateTo: "2021-11-30"}, true},
+		{"fail missing dates", StatementRequest{OwnerId: id1}, true},
+		{"fail date with time", StatementRequest{OwnerId: id1, DateFrom: "2021-11-01T00:00:00Z", DateTo: "2021-11-30"}, true},
+		{"fail reversed date range", StatementRequest{OwnerId: id1, DateFrom: "2021-11-30", DateTo: "2021-11-01"}, true},
+		{"fail unknown format", StatementRequest{OwnerId: id1, DateFrom: "2021-11-01", DateTo: "2021-11-30", Format: "pdf"}, true},
+	})
+}
+
+func TestAnalyticsRequest_Validate(t *testing.T) {
+	id1 := uuid.NewString()
+	testValidation(t, []validationTestcase{
+		{"success required params", AnalyticsRequest{OwnerId: id1, DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "day"}, false},
+		{"success all params", AnalyticsRequest{OwnerId: id1, Currency: "USD", DateFrom: "2021-01-01", DateTo: "2021-12-31", Interval: "month", GroupBy: "tag"}, false},
+		{"fail missing OwnerId", AnalyticsRequest{DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "day"}, true},
+		{"fail invalid currency", AnalyticsRequest{OwnerId: id1, Currency: "RUR", DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "day"}, true},
+		{"fail missing dates", AnalyticsRequest{OwnerId: id1, Interval: "day"}, true},
+		{"fail reversed date range", AnalyticsRequest{OwnerId: id1, DateFrom: "2021-11-30", DateTo: "2021-11-01", Interval: "day"}, true},
+		{"fail missing interval", AnalyticsRequest{OwnerId: id1, DateFrom: "2021-11-01", DateTo: "2021-11-30"}, true},
+		{"fail unknown interval", AnalyticsRequest{OwnerId: id1, DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "year"}, true},
+		{"fail unknown grouping", AnalyticsRequest{OwnerId: id1, DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "day", GroupBy: "currency"}, true},
 	})
-}
\ No newline at end of file
+}
+
+func TestPinRateRequest_Validate(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	testValidation(t, []validationTestcase{
+		{"success", PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"}, false},
+		{"fail missing currency", PinRateRequest{Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail invalid currency", PinRateRequest{Currency: "RUR", Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail default currency", PinRateRequest{Currency: "RUB", Rate: 1, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail missing rate", PinRateRequest{Currency: "USD", ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail negative rate", PinRateRequest{Currency: "USD", Rate: -0.015, ExpiresAt: expiresAt, ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail missing expiry", PinRateRequest{Currency: "USD", Rate: 0.015, ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail invalid expiry", PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: "2021-11-01", ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail expiry in the past", PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: time.Now().Add(-time.Hour).Format(time.RFC3339), ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail too late expiry", PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: time.Now().Add(MaxRateOverrideDuration + time.Hour).Format(time.RFC3339), ChangedBy: "admin", Reason: "wrong rate"}, true},
+		{"fail missing changed by", PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: expiresAt, Reason: "wrong rate"}, true},
+		{"fail missing reason", PinRateRequest{Currency: "USD", Rate: 0.015, ExpiresAt: expiresAt, ChangedBy: "admin"}, true},
+	})
+}
+
+func TestUnpinRatesRequest_Validate(t *testing.T) {
+	testValidation(t, []validationTestcase{
+		{"success single currency", UnpinRatesRequest{Currency: "USD", ChangedBy: "admin"}, false},
+		{"success all currencies", UnpinRatesRequest{ChangedBy: "admin", Reason: "provider fixed the rates"}, false},
+		{"fail invalid currency", UnpinRatesRequest{Currency: "DOLLAR", ChangedBy: "admin"}, true},
+		{"fail missing changed by", UnpinRatesRequest{Currency: "USD"}, true},
+		{"fail too long reason", UnpinRatesRequest{ChangedBy: "admin", Reason: strings.Repeat("test", 100)}, true},
+	})
+}
+
+func TestQuoteRequest_Validate(t *testing.T) {
+	testValidation(t, []validationTestcase{
+		{"success", QuoteRequest{Amount: 100000, TargetCurrency: "USD"}, false},
+		{"success with currency", QuoteRequest{Amount: 100, Currency: "USD", TargetCurrency: "EUR"}, false},
+		{"fail missing amount", QuoteRequest{TargetCurrency: "USD"}, true},
+		{"fail negative amount", QuoteRequest{Amount: -100, TargetCurrency: "USD"}, true},
+		{"fail invalid currency", QuoteRequest{Amount: 100, Currency: "RUR", TargetCurrency: "USD"}, true},
+		{"fail missing target currency", QuoteRequest{Amount: 100}, true},
+		{"fail invalid target currency", QuoteRequest{Amount: 100, TargetCurrency: "DOLLAR"}, true},
+		{"fail same currency", QuoteRequest{Amount: 100, TargetCurrency: "RUB"}, true},
+		{"fail same explicit currency", QuoteRequest{Amount: 100, Currency: "USD", TargetCurrency: "USD"}, true},
+	})
+}
@@ -0,0 +1,115 @@
+package reservation
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/pkg/dbcontext"
+	"users-balance-microservice/pkg/log"
+)
+
+// Repository encapsulates the logic to access reservations from the database.
+type Repository interface {
+	// Get returns the Reservation with the specified id.
+	Get(ctx context.Context, id int64) (entity.Reservation, error)
+	// Lock returns the Reservation with the specified id and locks it until the end of the DB transaction,
+	// so that concurrent captures and releases of the same Reservation are applied one after another.
+	Lock(ctx context.Context, id int64) (entity.Reservation, error)
+	// Create saves a new Reservation in the storage.
+	// Reservation res is assigned an id from database in case of success.
+	Create(ctx context.Context, res *entity.Reservation) error
+	// Update updates the changes to the given Reservation to db.
+	Update(ctx context.Context, res entity.Reservation) error
+	// Held returns the sum of money held by active reservations of the given owner's Deposit in the given currency
+	// which expire after the given time.
+	Held(ctx context.Context, ownerId uuid.UUID, currency string, now time.Time) (int64, error)
+	// HeldTotals returns the money held by active reservations of all the given owner's Deposits which expire
+	// after the given time, in each currency.
+	HeldTotals(ctx context.Context, ownerId uuid.UUID, now time.Time) ([]HeldTotal, error)
+	// Count returns the number of Reservation records in the database.
+	Count(ctx context.Context) (int64, error)
+}
+
+// HeldTotal represents the money held by active reservations of a user in a single currency.
+type HeldTotal struct {
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+	// Count is the number of the reservations nothing has been captured from yet.
+	Count int64 `json:"count"`
+}
+
+// repository persists Reservation in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new Reservation repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Get reads the Reservation with the specified id from the database.
+func (r repository) Get(ctx context.Context, id int64) (entity.Reservation, error) {
+	var res entity.Reservation
+	err := r.db.With(ctx).Select().Model(id, &res)
+	return res, err
+}
+
+// Lock reads the Reservation with the specified id from the database and locks it with SELECT ... FOR UPDATE.
+func (r repository) Lock(ctx context.Context, id int64) (entity.Reservation, error) {
+	var res entity.Reservation
+	err := r.db.With(ctx).
+		NewQuery("SELECT * FROM reservation WHERE id = {:id} FOR UPDATE").
+		Bind(dbx.Params{"id": id}).
+		One(&res)
+	return res, err
+}
+
+// Create saves a new Reservation record in the database.
+// Reservation is assigned an auto-incremented id from database.
+func (r repository) Create(ctx context.Context, res *entity.Reservation) error {
+	return r.db.With(ctx).Model(res).Insert()
+}
+
+// Update saves the changes to the Reservation in the database.
+func (r repository) Update(ctx context.Context, res entity.Reservation) error {
+	return r.db.With(ctx).Model(&res).Update()
+}
+
+// Held returns the sum of money held by active reservations of the given owner's Deposit in the given currency
+// which expire after now. If the owner has no such reservations, 0 is returned.
+func (r repository) Held(ctx context.Context, ownerId uuid.UUID, currency string, now time.Time) (int64, error) {
+	var held int64
+	err := r.db.With(ctx).Select("COALESCE(SUM(amount - captured_amount), 0)").
+		From("reservation").
+		Where(dbx.HashExp{"owner_id": ownerId, "currency": currency, "status": entity.ReservationActive}).
+		AndWhere(dbx.NewExp("expires_at > {:now}", dbx.Params{"now": now})).
+		Row(&held)
+	return held, err
+}
+
+// HeldTotals returns the money held by active reservations of all the given owner's Deposits which expire after now,
+// in each currency in alphabetical order.
+func (r repository) HeldTotals(ctx context.Context, ownerId uuid.UUID, now time.Time) ([]HeldTotal, error) {
+	var totals []HeldTotal
+	err := r.db.With(ctx).
+		Select("currency", "SUM(amount - captured_amount) AS amount", "COUNT(*) FILTER (WHERE captured_amount = 0) AS count").
+		From("reservation").
+		Where(dbx.HashExp{"owner_id": ownerId, "status": entity.ReservationActive}).
+		AndWhere(dbx.NewExp("expires_at > {:now}", dbx.Params{"now": now})).
+		GroupBy("currency").
+		OrderBy("currency").
+		All(&totals)
+	return totals, err
+}
+
+// Count returns the number of Reservation records in the database.
+func (r repository) Count(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.db.With(ctx).Select("COUNT(*)").From("reservation").Row(&count)
+	return count, err
+}
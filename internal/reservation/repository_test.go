@@ -0,0 +1,99 @@
+package reservation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/test"
+	"users-balance-microservice/pkg/log"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "reservation")
+	repo := NewRepository(db, logger)
+
+	ctx := context.Background()
+
+	ownerId := uuid.New()
+	now := time.Now().UTC()
+
+	// initial count
+	count, err := repo.Count(ctx)
+	assert.NoError(t, err)
+
+	// create
+	res := entity.Reservation{
+		OwnerId:   ownerId,
+		Currency:  "RUB",
+		Amount:    500,
+		Status:    entity.ReservationActive,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	err = repo.Create(ctx, &res)
+	if assert.NoError(t, err) {
+		assert.NotZero(t, res.Id)
+		count2, _ := repo.Count(ctx)
+		assert.EqualValues(t, 1, count2-count)
+	}
+
+	// expired reservation doesn't hold money
+	expired := entity.Reservation{
+		OwnerId:   ownerId,
+		Currency:  "RUB",
+		Amount:    700,
+		Status:    entity.ReservationActive,
+		CreatedAt: now.Add(-time.Hour),
+		ExpiresAt: now.Add(-time.Minute),
+	}
+	assert.NoError(t, repo.Create(ctx, &expired))
+
+	held, err := repo.Held(ctx, ownerId, "RUB", now)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500, held)
+	}
+
+	// nothing is held in another currency
+	held, err = repo.Held(ctx, ownerId, "USD", now)
+	if assert.NoError(t, err) {
+		assert.Zero(t, held)
+	}
+	totals, err := repo.HeldTotals(ctx, ownerId, now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []HeldTotal{{Currency: "RUB", Amount: 500, Count: 1}}, totals)
+	}
+
+	// get and update
+	res, err = repo.Get(ctx, res.Id)
+	if assert.NoError(t, err) {
+		res.CapturedAmount = 200
+		assert.NoError(t, repo.Update(ctx, res))
+		held, _ = repo.Held(ctx, ownerId, "RUB", now)
+		assert.EqualValues(t, 300, held)
+		// partly captured reservation is not counted as an operation anymore
+		totals, _ = repo.HeldTotals(ctx, ownerId, now)
+		assert.Equal(t, []HeldTotal{{Currency: "RUB", Amount: 300, Count: 0}}, totals)
+	}
+
+	// lock
+	res, err = repo.Lock(ctx, res.Id)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 200, res.CapturedAmount)
+	}
+	_, err = repo.Lock(ctx, 0)
+	assert.Error(t, err)
+
+	// captured amount exceeding reserved -> db error
+	res.CapturedAmount = 1000
+	assert.Error(t, repo.Update(ctx, res))
+
+	// get non-existing
+	_, err = repo.Get(ctx, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,159 @@
+package reservation
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/pkg/log"
+)
+
+// Service encapsulates usecase logic for reservations.
+// It only keeps track of held money, actual withdrawals are made by the deposit service.
+type Service interface {
+	// Create creates an active Reservation based on ReserveRequest.
+	Create(ctx context.Context, req requests.ReserveRequest) (Reservation, error)
+	// Get returns the Reservation with the given id.
+	Get(ctx context.Context, id int64) (Reservation, error)
+	// Lock returns the Reservation with the given id and locks it until the end of the DB transaction.
+	Lock(ctx context.Context, id int64) (Reservation, error)
+	// Capture marks the given amount of the Reservation as captured. If amount is 0, all the remaining money is captured.
+	Capture(ctx context.Context, id int64, amount int64) (Reservation, error)
+	// Release returns the remaining money of the Reservation to the available balance.
+	Release(ctx context.Context, id int64) (Reservation, error)
+	// Held returns the sum of money held by active reservations of the given owner's Deposit in the given currency.
+	Held(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error)
+	// HeldTotals returns the money held by active reservations of all the given owner's Deposits in each currency.
+	HeldTotals(ctx context.Context, ownerId uuid.UUID) ([]HeldTotal, error)
+	// Count returns a number of all Reservations in the database. Mainly used for testing purposes.
+	Count(ctx context.Context) (int64, error)
+}
+
+// Reservation represents the data about a reservation.
+type Reservation struct {
+	entity.Reservation
+}
+
+type service struct {
+	repo   Repository
+	ttl    time.Duration
+	logger log.Logger
+}
+
+// NewService creates a new Reservation service. Reservations expire after ttl unless captured or released.
+func NewService(repo Repository, ttl time.Duration, logger log.Logger) Service {
+	return service{repo, ttl, logger}
+}
+
+func (s service) Create(ctx context.Context, req requests.ReserveRequest) (Reservation, error) {
+	if err := req.Validate(); err != nil {
+		return Reservation{}, err
+	}
+
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
+	now := time.Now().UTC()
+	res := entity.Reservation{
+		OwnerId:     uuid.MustParse(req.OwnerId),
+		Currency:    req.Currency,
+		Amount:      req.Amount,
+		Description: req.Description,
+		Status:      entity.ReservationActive,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.ttl),
+	}
+	if err := s.repo.Create(ctx, &res); err != nil {
+		return Reservation{}, err
+	}
+	return Reservation{res}, nil
+}
+
+// Get returns the Reservation with the given id.
+// An active Reservation whose expiration time has passed is marked as expired.
+func (s service) Get(ctx context.Context, id int64) (Reservation, error) {
+	res, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	return s.expire(ctx, res)
+}
+
+// Lock returns the Reservation with the given id and locks it until the end of the DB transaction.
+// Like Get, it marks an overdue active Reservation as expired.
+func (s service) Lock(ctx context.Context, id int64) (Reservation, error) {
+	res, err := s.repo.Lock(ctx, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	return s.expire(ctx, res)
+}
+
+// expire marks the Reservation as expired if it is active and its expiration time has passed.
+func (s service) expire(ctx context.Context, res entity.Reservation) (Reservation, error) {
+	if res.Status == entity.ReservationActive && !res.ExpiresAt.After(time.Now().UTC()) {
+		res.Status = entity.ReservationExpired
+		if err := s.repo.Update(ctx, res); err != nil {
+			return Reservation{}, err
+		}
+	}
+	return Reservation{res}, nil
+}
+
+func (s service) Capture(ctx context.Context, id int64, amount int64) (Reservation, error) {
+	res, err := s.Lock(ctx, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	if res.Status != entity.ReservationActive {
+		return Reservation{}, errors.Conflict("Reservation is " + res.Status + ".")
+	}
+
+	if amount == 0 {
+		amount = res.Remaining()
+	}
+	if amount < 0 || amount > res.Remaining() {
+		return Reservation{}, errors.BadRequest("Capture amount exceeds the remaining reserved amount.")
+	}
+
+	res.CapturedAmount += amount
+	if res.Remaining() == 0 {
+		res.Status = entity.ReservationCaptured
+	}
+	if err = s.repo.Update(ctx, res.Reservation); err != nil {
+		return Reservation{}, err
+	}
+	return res, nil
+}
+
+func (s service) Release(ctx context.Context, id int64) (Reservation, error) {
+	res, err := s.Lock(ctx, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	if res.Status != entity.ReservationActive {
+		return Reservation{}, errors.Conflict("Reservation is " + res.Status + ".")
+	}
+
+	res.Status = entity.ReservationReleased
+	if err = s.repo.Update(ctx, res.Reservation); err != nil {
+		return Reservation{}, err
+	}
+	return res, nil
+}
+
+func (s service) Held(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error) {
+	return s.repo.Held(ctx, ownerId, currency, time.Now().UTC())
+}
+
+func (s service) HeldTotals(ctx context.Context, ownerId uuid.UUID) ([]HeldTotal, error) {
+	return s.repo.HeldTotals(ctx, ownerId, time.Now().UTC())
+}
+
+func (s service) Count(ctx context.Context) (int64, error) {
+	return s.repo.Count(ctx)
+}
@@ -0,0 +1,224 @@
+package reservation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/requests"
+	"users-balance-microservice/pkg/log"
+)
+
+var (
+	databaseError = errors.New("database error")
+	logger, _     = log.NewForTest()
+	ctx           = context.Background()
+)
+
+func TestService_Create(t *testing.T) {
+	id1 := uuid.New()
+	s := NewService(&mockReservationRepository{}, time.Hour, logger)
+
+	// success
+	res, err := s.Create(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 500, Description: "order #1"})
+	if assert.NoError(t, err) {
+		assert.NotZero(t, res.Id)
+		assert.Equal(t, id1, res.OwnerId)
+		assert.EqualValues(t, 500, res.Amount)
+		assert.Equal(t, entity.DefaultCurrency, res.Currency)
+		assert.Equal(t, entity.ReservationActive, res.Status)
+		assert.WithinDuration(t, res.CreatedAt.Add(time.Hour), res.ExpiresAt, time.Second)
+
+		held, err := s.Held(ctx, id1, "RUB")
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 500, held)
+		}
+	}
+
+	// success in another currency, held separately
+	res, err = s.Create(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 20, Currency: "USD"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "USD", res.Currency)
+		held, _ := s.Held(ctx, id1, "USD")
+		assert.EqualValues(t, 20, held)
+		totals, err := s.HeldTotals(ctx, id1)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []HeldTotal{{Currency: "RUB", Amount: 500, Count: 1}, {Currency: "USD", Amount: 20, Count: 1}}, totals)
+		}
+	}
+
+	// fail invalid amount
+	_, err = s.Create(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: -500})
+	assert.Error(t, err)
+
+	// fail database error
+	_, err = s.Create(ctx, requests.ReserveRequest{OwnerId: "11111111-1111-1111-1111-111111111111", Amount: 500})
+	assert.Error(t, err)
+
+	count, err := s.Count(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2, count)
+	}
+}
+
+func TestService_Capture(t *testing.T) {
+	id1 := uuid.New()
+	s := NewService(&mockReservationRepository{}, time.Hour, logger)
+	res, _ := s.Create(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 500})
+
+	// partial capture
+	res, err := s.Capture(ctx, res.Id, 200)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 200, res.CapturedAmount)
+		assert.Equal(t, entity.ReservationActive, res.Status)
+		held, _ := s.Held(ctx, id1, "RUB")
+		assert.EqualValues(t, 300, held)
+	}
+
+	// fail capture more than remaining
+	_, err = s.Capture(ctx, res.Id, 400)
+	assert.Error(t, err)
+
+	// capture the rest
+	res, err = s.Capture(ctx, res.Id, 0)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500, res.CapturedAmount)
+		assert.Equal(t, entity.ReservationCaptured, res.Status)
+		held, _ := s.Held(ctx, id1, "RUB")
+		assert.Zero(t, held)
+	}
+
+	// fail captured reservation
+	_, err = s.Capture(ctx, res.Id, 0)
+	assert.Error(t, err)
+
+	// fail not found
+	_, err = s.Capture(ctx, 100, 0)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestService_Release(t *testing.T) {
+	id1 := uuid.New()
+	s := NewService(&mockReservationRepository{}, time.Hour, logger)
+	res, _ := s.Create(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 500})
+
+	// success
+	res, err := s.Release(ctx, res.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.ReservationReleased, res.Status)
+		held, _ := s.Held(ctx, id1, "RUB")
+		assert.Zero(t, held)
+	}
+
+	// fail already released
+	_, err = s.Release(ctx, res.Id)
+	assert.Error(t, err)
+}
+
+func TestService_Expiry(t *testing.T) {
+	id1 := uuid.New()
+	s := NewService(&mockReservationRepository{}, time.Millisecond, logger)
+	res, _ := s.Create(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 500})
+	res2, _ := s.Create(ctx, requests.ReserveRequest{OwnerId: id1.String(), Amount: 300})
+	time.Sleep(5 * time.Millisecond)
+
+	// expired reservation doesn't hold money
+	held, err := s.Held(ctx, id1, "RUB")
+	if assert.NoError(t, err) {
+		assert.Zero(t, held)
+	}
+
+	// and is marked as expired once accessed
+	res, err = s.Get(ctx, res.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.ReservationExpired, res.Status)
+	}
+	res2, err = s.Lock(ctx, res2.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.ReservationExpired, res2.Status)
+	}
+
+	// fail capture expired reservation
+	_, err = s.Capture(ctx, res.Id, 0)
+	assert.Error(t, err)
+}
+
+type mockReservationRepository struct {
+	items          []entity.Reservation
+	lastInsertedId int64
+}
+
+func (m *mockReservationRepository) Get(ctx context.Context, id int64) (entity.Reservation, error) {
+	for _, item := range m.items {
+		if item.Id == id {
+			return item, nil
+		}
+	}
+	return entity.Reservation{}, sql.ErrNoRows
+}
+
+func (m *mockReservationRepository) Lock(ctx context.Context, id int64) (entity.Reservation, error) {
+	return m.Get(ctx, id)
+}
+
+func (m *mockReservationRepository) Create(ctx context.Context, res *entity.Reservation) error {
+	// simulate database error
+	if res.OwnerId.String() == "11111111-1111-1111-1111-111111111111" {
+		return databaseError
+	}
+
+	m.lastInsertedId++
+	res.Id = m.lastInsertedId
+	m.items = append(m.items, *res)
+	return nil
+}
+
+func (m *mockReservationRepository) Update(ctx context.Context, res entity.Reservation) error {
+	for i, item := range m.items {
+		if item.Id == res.Id {
+			m.items[i] = res
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockReservationRepository) Held(ctx context.Context, ownerId uuid.UUID, currency string, now time.Time) (int64, error) {
+	var held int64
+	for _, item := range m.items {
+		if item.OwnerId == ownerId && item.Currency == currency && item.Status == entity.ReservationActive && item.ExpiresAt.After(now) {
+			held += item.Remaining()
+		}
+	}
+	return held, nil
+}
+
+func (m *mockReservationRepository) HeldTotals(ctx context.Context, ownerId uuid.UUID, now time.Time) ([]HeldTotal, error) {
+	var totals []HeldTotal
+	for _, item := range m.items {
+		if item.OwnerId != ownerId || item.Status != entity.ReservationActive || !item.ExpiresAt.After(now) {
+			continue
+		}
+		i := 0
+		for i < len(totals) && totals[i].Currency != item.Currency {
+			i++
+		}
+		if i == len(totals) {
+			totals = append(totals, HeldTotal{Currency: item.Currency})
+		}
+		totals[i].Amount += item.Remaining()
+		if item.CapturedAmount == 0 {
+			totals[i].Count++
+		}
+	}
+	return totals, nil
+}
+
+func (m *mockReservationRepository) Count(ctx context.Context) (int64, error) {
+	return int64(len(m.items)), nil
+}
@@ -0,0 +1,210 @@
+package statement
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	camt053Namespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+	camtDateLayout   = "2006-01-02"
+	camtCredit       = "CRDT"
+	camtDebit        = "DBIT"
+)
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtGroupHeader struct {
+	MsgId    string `xml:"MsgId"`
+	CreDtTm  string `xml:"CreDtTm"`
+	MsgPgntn struct {
+		PgNb      int  `xml:"PgNb"`
+		LastPgInd bool `xml:"LastPgInd"`
+	} `xml:"MsgPgntn"`
+}
+
+type camtAccount struct {
+	Id       string `xml:"Id>Othr>Id"`
+	Currency string `xml:"Ccy"`
+}
+
+type camtBalance struct {
+	Code      string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount    camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	Date      string     `xml:"Dt>Dt"`
+}
+
+type camtEntry struct {
+	NtryRef     int64       `xml:"NtryRef"`
+	Amount      camtAmount  `xml:"Amt"`
+	CdtDbtInd   string      `xml:"CdtDbtInd"`
+	RvslInd     bool        `xml:"RvslInd,omitempty"`
+	Sts         string      `xml:"Sts"`
+	BookgDt     string      `xml:"BookgDt>DtTm"`
+	ValDt       string      `xml:"ValDt>DtTm"`
+	AcctSvcrRef string      `xml:"AcctSvcrRef"`
+	BkTxCd      string      `xml:"BkTxCd>Prtry>Cd"`
+	Details     camtDetails `xml:"NtryDtls>TxDtls"`
+}
+
+type camtDetails struct {
+	RelatedParties *camtParties    `xml:"RltdPties"`
+	Remittance     *camtRemittance `xml:"RmtInf"`
+}
+
+type camtParties struct {
+	DebtorAccount   *camtAccountId `xml:"DbtrAcct"`
+	CreditorAccount *camtAccountId `xml:"CdtrAcct"`
+}
+
+type camtAccountId struct {
+	Id string `xml:"Id>Othr>Id"`
+}
+
+type camtRemittance struct {
+	Unstructured string `xml:"Ustrd"`
+}
+
+// camt053Encoder writes a Statement as an ISO 20022 BankToCustomerStatement (camt.053.001.02) message
+// with a single statement. Amounts are non-negative, their direction is given by the credit/debit indicator.
+type camt053Encoder struct {
+	w         io.Writer
+	enc       *xml.Encoder
+	statement Statement
+}
+
+func newCamt053Encoder(w io.Writer) *camt053Encoder {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &camt053Encoder{w: w, enc: enc}
+}
+
+func camtDateTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// camtSigned returns the absolute value of the amount and its credit/debit indicator.
+func camtSigned(amount int64) (int64, string) {
+	if amount < 0 {
+		return -amount, camtDebit
+	}
+	return amount, camtCredit
+}
+
+func (e *camt053Encoder) balance(code string, amount int64, date time.Time) camtBalance {
+	value, indicator := camtSigned(amount)
+	return camtBalance{
+		Code:      code,
+		Amount:    camtAmount{Currency: e.statement.Currency, Value: e.statement.Amount(value)},
+		CdtDbtInd: indicator,
+		Date:      date.Format(camtDateLayout),
+	}
+}
+
+func (e *camt053Encoder) Begin(s Statement) error {
+	e.statement = s
+	if _, err := io.WriteString(e.w, xml.Header); err != nil {
+		return err
+	}
+	document := xml.StartElement{
+		Name: xml.Name{Local: "Document"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: camt053Namespace}},
+	}
+	if err := e.enc.EncodeToken(document); err != nil {
+		return err
+	}
+	if err := e.start("BkToCstmrStmt"); err != nil {
+		return err
+	}
+
+	header := camtGroupHeader{
+		MsgId:   s.CreatedAt.UTC().Format("20060102T150405.000000000"),
+		CreDtTm: camtDateTime(s.CreatedAt),
+	}
+	header.MsgPgntn.PgNb = 1
+	header.MsgPgntn.LastPgInd = true
+	if err := e.element("GrpHdr", header); err != nil {
+		return err
+	}
+
+	if err := e.start("Stmt"); err != nil {
+		return err
+	}
+	id := fmt.Sprintf("%s-%s-%s", s.Currency, s.From.Format("20060102"), s.To.Format("20060102"))
+	if err := e.element("Id", id); err != nil {
+		return err
+	}
+	if err := e.element("CreDtTm", camtDateTime(s.CreatedAt)); err != nil {
+		return err
+	}
+	period := struct {
+		From string `xml:"FrDtTm"`
+		To   string `xml:"ToDtTm"`
+	}{camtDateTime(s.From), camtDateTime(s.End().Add(-time.Second))}
+	if err := e.element("FrToDt", period); err != nil {
+		return err
+	}
+	if err := e.element("Acct", camtAccount{Id: compactId(s.OwnerId), Currency: s.Currency}); err != nil {
+		return err
+	}
+	if err := e.element("Bal", e.balance("OPBD", s.OpeningBalance, s.From)); err != nil {
+		return err
+	}
+	return e.element("Bal", e.balance("CLBD", s.ClosingBalance, s.To))
+}
+
+func (e *camt053Encoder) Encode(entry Entry) error {
+	value, indicator := camtSigned(entry.Amount)
+	ntry := camtEntry{
+		NtryRef:     entry.Id,
+		Amount:      camtAmount{Currency: e.statement.Currency, Value: e.statement.Amount(value)},
+		CdtDbtInd:   indicator,
+		RvslInd:     entry.ReversalOf != 0,
+		Sts:         "BOOK",
+		BookgDt:     camtDateTime(entry.Date),
+		ValDt:       camtDateTime(entry.Date),
+		AcctSvcrRef: fmt.Sprint(entry.Id),
+		BkTxCd:      entry.Type,
+	}
+	if entry.CounterpartyId != uuid.Nil {
+		account := &camtAccountId{Id: compactId(entry.CounterpartyId)}
+		if indicator == camtCredit {
+			ntry.Details.RelatedParties = &camtParties{DebtorAccount: account}
+		} else {
+			ntry.Details.RelatedParties = &camtParties{CreditorAccount: account}
+		}
+	}
+	if entry.Description != "" {
+		ntry.Details.Remittance = &camtRemittance{Unstructured: entry.Description}
+	}
+	return e.element("Ntry", ntry)
+}
+
+func (e *camt053Encoder) End() error {
+	for _, name := range []string{"Stmt", "BkToCstmrStmt", "Document"} {
+		if err := e.end(name); err != nil {
+			return err
+		}
+	}
+	return e.enc.Flush()
+}
+
+func (e *camt053Encoder) start(name string) error {
+	return e.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+func (e *camt053Encoder) end(name string) error {
+	return e.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+}
+
+func (e *camt053Encoder) element(name string, v interface{}) error {
+	return e.enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+}
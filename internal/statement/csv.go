@@ -0,0 +1,68 @@
+package statement
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Types of the CSV rows holding the balances at the start and at the end of the period.
+const (
+	csvOpeningBalance = "opening_balance"
+	csvClosingBalance = "closing_balance"
+)
+
+var csvHeader = []string{"date", "id", "type", "counterparty_id", "amount", "currency", "balance", "description"}
+
+// csvEncoder writes a Statement as a CSV table with a header.
+// The first row holds the opening balance, the last one - the closing balance, entries are in between.
+type csvEncoder struct {
+	w         *csv.Writer
+	statement Statement
+}
+
+func newCSVEncoder(w io.Writer) *csvEncoder {
+	return &csvEncoder{w: csv.NewWriter(w)}
+}
+
+func (e *csvEncoder) Begin(s Statement) error {
+	e.statement = s
+	if err := e.w.Write(csvHeader); err != nil {
+		return err
+	}
+	return e.w.Write([]string{
+		s.From.Format(time.RFC3339), "", csvOpeningBalance, "", "", s.Currency, s.Amount(s.OpeningBalance), "",
+	})
+}
+
+func (e *csvEncoder) Encode(entry Entry) error {
+	counterparty := ""
+	if entry.CounterpartyId != uuid.Nil {
+		counterparty = entry.CounterpartyId.String()
+	}
+	return e.w.Write([]string{
+		entry.Date.UTC().Format(time.RFC3339),
+		strconv.FormatInt(entry.Id, 10),
+		entry.Type,
+		counterparty,
+		e.statement.Amount(entry.Amount),
+		e.statement.Currency,
+		e.statement.Amount(entry.BalanceAfter),
+		entry.Description,
+	})
+}
+
+func (e *csvEncoder) End() error {
+	s := e.statement
+	err := e.w.Write([]string{
+		s.End().Format(time.RFC3339), "", csvClosingBalance, "", "", s.Currency, s.Amount(s.ClosingBalance), "",
+	})
+	if err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
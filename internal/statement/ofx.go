@@ -0,0 +1,184 @@
+package statement
+
+import (
+	"encoding/xml"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+)
+
+const (
+	ofxHeader = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n" +
+		`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n"
+	ofxDateLayout = "20060102150405.000[0:GMT]"
+	// ofxBankId is a placeholder routing number, since deposits are not held by a bank.
+	ofxBankId = "000000000"
+)
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+var ofxStatusOk = ofxStatus{Code: 0, Severity: "INFO"}
+
+type ofxSignOn struct {
+	Status   ofxStatus `xml:"SONRS>STATUS"`
+	DTServer string    `xml:"SONRS>DTSERVER"`
+	Language string    `xml:"SONRS>LANGUAGE"`
+}
+
+type ofxAccount struct {
+	BankId   string `xml:"BANKID"`
+	AcctId   string `xml:"ACCTID"`
+	AcctType string `xml:"ACCTTYPE"`
+}
+
+type ofxTransaction struct {
+	TrnType  string `xml:"TRNTYPE"`
+	DTPosted string `xml:"DTPOSTED"`
+	TrnAmt   string `xml:"TRNAMT"`
+	FitId    int64  `xml:"FITID"`
+	Name     string `xml:"NAME,omitempty"`
+	Memo     string `xml:"MEMO,omitempty"`
+}
+
+type ofxBalance struct {
+	BalAmt string `xml:"BALAMT"`
+	DTAsOf string `xml:"DTASOF"`
+}
+
+type ofxNamedBalance struct {
+	Name    string `xml:"NAME"`
+	Desc    string `xml:"DESC"`
+	BalType string `xml:"BALTYPE"`
+	Value   string `xml:"VALUE"`
+	DTAsOf  string `xml:"DTASOF"`
+}
+
+// ofxEncoder writes a Statement as an OFX 2.2 bank statement response.
+// The closing balance is reported as the ledger balance, the opening one - in the list of additional balances.
+type ofxEncoder struct {
+	w         io.Writer
+	enc       *xml.Encoder
+	statement Statement
+}
+
+func newOFXEncoder(w io.Writer) *ofxEncoder {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &ofxEncoder{w: w, enc: enc}
+}
+
+func ofxDate(t time.Time) string {
+	return t.UTC().Format(ofxDateLayout)
+}
+
+func (e *ofxEncoder) Begin(s Statement) error {
+	e.statement = s
+	if _, err := io.WriteString(e.w, ofxHeader); err != nil {
+		return err
+	}
+
+	if err := e.start("OFX"); err != nil {
+		return err
+	}
+	signOn := ofxSignOn{Status: ofxStatusOk, DTServer: ofxDate(s.CreatedAt), Language: "RUS"}
+	if err := e.element("SIGNONMSGSRSV1", signOn); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"BANKMSGSRSV1", "STMTTRNRS"} {
+		if err := e.start(name); err != nil {
+			return err
+		}
+	}
+	if err := e.element("TRNUID", 0); err != nil {
+		return err
+	}
+	if err := e.element("STATUS", ofxStatusOk); err != nil {
+		return err
+	}
+	if err := e.start("STMTRS"); err != nil {
+		return err
+	}
+	if err := e.element("CURDEF", s.Currency); err != nil {
+		return err
+	}
+	account := ofxAccount{BankId: ofxBankId, AcctId: compactId(s.OwnerId), AcctType: "CHECKING"}
+	if err := e.element("BANKACCTFROM", account); err != nil {
+		return err
+	}
+
+	if err := e.start("BANKTRANLIST"); err != nil {
+		return err
+	}
+	if err := e.element("DTSTART", ofxDate(s.From)); err != nil {
+		return err
+	}
+	return e.element("DTEND", ofxDate(s.End()))
+}
+
+func (e *ofxEncoder) Encode(entry Entry) error {
+	tx := ofxTransaction{
+		DTPosted: ofxDate(entry.Date),
+		TrnAmt:   e.statement.Amount(entry.Amount),
+		FitId:    entry.Id,
+		Memo:     entry.Description,
+	}
+	switch entry.Type {
+	case entity.TransactionTopUp:
+		tx.TrnType = "DEP"
+	case entity.TransactionWithdrawal:
+		tx.TrnType = "DEBIT"
+	default:
+		tx.TrnType = "XFER"
+	}
+	if entry.CounterpartyId != uuid.Nil {
+		tx.Name = compactId(entry.CounterpartyId)
+	}
+	return e.element("STMTTRN", tx)
+}
+
+func (e *ofxEncoder) End() error {
+	s := e.statement
+	if err := e.end("BANKTRANLIST"); err != nil {
+		return err
+	}
+	if err := e.element("LEDGERBAL", ofxBalance{BalAmt: s.Amount(s.ClosingBalance), DTAsOf: ofxDate(s.End())}); err != nil {
+		return err
+	}
+	opening := ofxNamedBalance{
+		Name:    "OPENING",
+		Desc:    "Opening balance",
+		BalType: "DOLLAR",
+		Value:   s.Amount(s.OpeningBalance),
+		DTAsOf:  ofxDate(s.From),
+	}
+	if err := e.element("BALLIST", struct {
+		Bal ofxNamedBalance `xml:"BAL"`
+	}{opening}); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"STMTRS", "STMTTRNRS", "BANKMSGSRSV1", "OFX"} {
+		if err := e.end(name); err != nil {
+			return err
+		}
+	}
+	return e.enc.Flush()
+}
+
+func (e *ofxEncoder) start(name string) error {
+	return e.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+func (e *ofxEncoder) end(name string) error {
+	return e.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+}
+
+func (e *ofxEncoder) element(name string, v interface{}) error {
+	return e.enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+}
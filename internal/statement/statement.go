@@ -0,0 +1,145 @@
+// Package statement encodes statements of user's deposits in the formats imported by accounting software:
+// CSV, OFX and ISO 20022 camt.053.
+package statement
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/money"
+)
+
+// Supported formats of statements.
+const (
+	FormatCSV     = "csv"
+	FormatOFX     = "ofx"
+	FormatCamt053 = "camt053"
+)
+
+// Statement represents a statement of user's deposit in one currency for a period of whole days in UTC.
+type Statement struct {
+	OwnerId  uuid.UUID
+	Currency string
+	// From and To are the first and the last days of the period, both at midnight UTC.
+	From, To time.Time
+	// OpeningBalance is the balance at the start of From, ClosingBalance - at the end of To.
+	OpeningBalance, ClosingBalance int64
+	// The date and time when this Statement was created.
+	CreatedAt time.Time
+}
+
+// End returns the moment right after the period of the Statement.
+func (s Statement) End() time.Time {
+	return s.To.AddDate(0, 0, 1)
+}
+
+// Amount formats an amount in minor units of the Statement's Currency as a decimal number of major units,
+// e.g. -300 RUB as "-3.00", which is how all the supported formats expect amounts.
+func (s Statement) Amount(value int64) string {
+	return money.Money{Value: value, Currency: s.Currency}.String()
+}
+
+// Entry represents a Transaction as it is seen in the statement of one of its parties.
+type Entry struct {
+	// Database id of the Transaction.
+	Id   int64
+	Date time.Time
+	// Type is the type of the Transaction from the party's point of view, e.g. entity.TransactionTopUp.
+	Type string
+	// CounterpartyId is the UUID of the other party of a transfer. Nil for top-ups and withdrawals.
+	CounterpartyId uuid.UUID
+	// Amount added to (positive) or subtracted from (negative) the deposit.
+	Amount      int64
+	Description string
+	// ReversalOf is the id of the Transaction reversed by this one. Zero if it is not a reversal.
+	ReversalOf int64
+	// BalanceAfter is the balance of the deposit right after the Transaction.
+	BalanceAfter int64
+}
+
+// NewEntry returns the Transaction as it is seen by the deposit of the party with the given id in the given currency.
+// BalanceAfter is left zero.
+func NewEntry(tx entity.Transaction, ownerId uuid.UUID, currency string) Entry {
+	e := Entry{
+		Id:          tx.Id,
+		Date:        tx.TransactionDate,
+		Type:        tx.Type(ownerId, currency),
+		Description: tx.Description,
+		ReversalOf:  tx.ReversalOf,
+	}
+	if tx.Sent(ownerId, currency) {
+		e.CounterpartyId = tx.RecipientId
+		e.Amount = -tx.Amount
+	} else {
+		e.CounterpartyId = tx.SenderId
+		_, e.Amount = tx.Credited()
+	}
+	return e
+}
+
+// Encoder writes a Statement in some format. Entries are written one by one as soon as they are encoded,
+// so that a Statement of any size can be streamed.
+type Encoder interface {
+	// Begin writes the header of the Statement.
+	Begin(s Statement) error
+	// Encode writes an entry of the Statement. Entries must be encoded in the order of their dates.
+	Encode(e Entry) error
+	// End writes the rest of the Statement and flushes the output.
+	End() error
+}
+
+// NewEncoder returns an Encoder which writes statements in the given format to w.
+func NewEncoder(format string, w io.Writer) (Encoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVEncoder(w), nil
+	case FormatOFX:
+		return newOFXEncoder(w), nil
+	case FormatCamt053:
+		return newCamt053Encoder(w), nil
+	}
+	return nil, fmt.Errorf("statement: unsupported format %q", format)
+}
+
+// ContentType returns the media type of statements in the given format. Empty if the format is not supported.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatOFX:
+		return "application/x-ofx"
+	case FormatCamt053:
+		return "application/xml; charset=utf-8"
+	}
+	return ""
+}
+
+// FormatOf returns the first supported format listed in the value of Accept HTTP header.
+// Empty if none of the formats is acceptable.
+func FormatOf(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return FormatCSV
+		case "application/x-ofx", "application/ofx":
+			return FormatOFX
+		case "application/xml", "text/xml":
+			return FormatCamt053
+		}
+	}
+	return ""
+}
+
+// compactId returns the UUID without hyphens to fit into the short identifiers of OFX and ISO 20022.
+func compactId(id uuid.UUID) string {
+	return strings.ReplaceAll(id.String(), "-", "")
+}
@@ -0,0 +1,249 @@
+package statement
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"users-balance-microservice/internal/entity"
+)
+
+// update rewrites the golden files in testdata with the current output: go test ./internal/statement -update
+var update = flag.Bool("update", false, "update the golden files")
+
+var (
+	ownerId, counterpartyId = uuid.New(), uuid.New()
+	testStatement           = Statement{
+		OwnerId:        ownerId,
+		Currency:       "RUB",
+		From:           time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+		To:             time.Date(2021, 11, 30, 0, 0, 0, 0, time.UTC),
+		OpeningBalance: 100,
+		ClosingBalance: -50,
+		CreatedAt:      time.Date(2021, 12, 1, 10, 0, 0, 0, time.UTC),
+	}
+	testEntries = []Entry{
+		{
+			Id:             1,
+			Date:           time.Date(2021, 11, 10, 14, 23, 11, 0, time.UTC),
+			Type:           entity.TransactionOutgoingTransfer,
+			CounterpartyId: counterpartyId,
+			Amount:         -200,
+			Description:    "dinner & <drinks>",
+			BalanceAfter:   -100,
+		},
+		{
+			Id:           2,
+			Date:         time.Date(2021, 11, 11, 9, 0, 0, 0, time.UTC),
+			Type:         entity.TransactionTopUp,
+			Amount:       50,
+			BalanceAfter: -50,
+		},
+	}
+)
+
+// encode writes testStatement with testEntries in the given format.
+func encode(t *testing.T, format string) string {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(format, &buf)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	assert.NoError(t, enc.Begin(testStatement))
+	for _, e := range testEntries {
+		assert.NoError(t, enc.Encode(e))
+	}
+	assert.NoError(t, enc.End())
+	return buf.String()
+}
+
+func TestNewEntry(t *testing.T) {
+	tx := entity.Transaction{
+		Id:                7,
+		SenderId:          ownerId,
+		RecipientId:       counterpartyId,
+		Amount:            1000,
+		Currency:          "RUB",
+		RecipientCurrency: "USD",
+		RecipientAmount:   15,
+		Description:       "exchange",
+		TransactionDate:   time.Now(),
+	}
+
+	// sender's side
+	e := NewEntry(tx, ownerId, "RUB")
+	assert.Equal(t, Entry{
+		Id:             7,
+		Date:           tx.TransactionDate,
+		Type:           entity.TransactionOutgoingTransfer,
+		CounterpartyId: counterpartyId,
+		Amount:         -1000,
+		Description:    "exchange",
+	}, e)
+
+	// recipient's side is credited in its own currency
+	e = NewEntry(tx, counterpartyId, "USD")
+	assert.Equal(t, entity.TransactionIncomingTransfer, e.Type)
+	assert.Equal(t, ownerId, e.CounterpartyId)
+	assert.EqualValues(t, 15, e.Amount)
+
+	// top-up has no counterparty
+	e = NewEntry(entity.Transaction{RecipientId: ownerId, Amount: 500, Currency: "RUB"}, ownerId, "RUB")
+	assert.Equal(t, entity.TransactionTopUp, e.Type)
+	assert.Equal(t, uuid.Nil, e.CounterpartyId)
+	assert.EqualValues(t, 500, e.Amount)
+
+	// exchange between own deposits is seen from the side of the deposit in the given currency
+	tx.RecipientId = ownerId
+	e = NewEntry(tx, ownerId, "RUB")
+	assert.Equal(t, entity.TransactionOutgoingTransfer, e.Type)
+	assert.EqualValues(t, -1000, e.Amount)
+	e = NewEntry(tx, ownerId, "USD")
+	assert.Equal(t, entity.TransactionIncomingTransfer, e.Type)
+	assert.EqualValues(t, 15, e.Amount)
+}
+
+func TestFormatOf(t *testing.T) {
+	assert.Equal(t, FormatCSV, FormatOf("text/csv"))
+	assert.Equal(t, FormatOFX, FormatOf("application/json, application/x-ofx;q=0.9"))
+	assert.Equal(t, FormatCamt053, FormatOf("application/xml; charset=utf-8"))
+	assert.Empty(t, FormatOf("application/json"))
+	assert.Empty(t, FormatOf(""))
+}
+
+func TestNewEncoder(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatOFX, FormatCamt053} {
+		_, err := NewEncoder(format, &bytes.Buffer{})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, ContentType(format))
+	}
+
+	_, err := NewEncoder("pdf", &bytes.Buffer{})
+	assert.Error(t, err)
+	assert.Empty(t, ContentType("pdf"))
+}
+
+func TestCSVEncoder(t *testing.T) {
+	rows, err := csv.NewReader(strings.NewReader(encode(t, FormatCSV))).ReadAll()
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]string{
+			csvHeader,
+			{"2021-11-01T00:00:00Z", "", "opening_balance", "", "", "RUB", "1.00", ""},
+			{"2021-11-10T14:23:11Z", "1", "outgoing_transfer", counterpartyId.String(), "-2.00", "RUB", "-1.00", "dinner & <drinks>"},
+			{"2021-11-11T09:00:00Z", "2", "top_up", "", "0.50", "RUB", "-0.50", ""},
+			{"2021-12-01T00:00:00Z", "", "closing_balance", "", "", "RUB", "-0.50", ""},
+		}, rows)
+	}
+}
+
+func TestOFXEncoder(t *testing.T) {
+	out := encode(t, FormatOFX)
+	assert.True(t, strings.HasPrefix(out, ofxHeader))
+
+	var doc struct {
+		Statement struct {
+			Currency     string           `xml:"CURDEF"`
+			AccountId    string           `xml:"BANKACCTFROM>ACCTID"`
+			Transactions []ofxTransaction `xml:"BANKTRANLIST>STMTTRN"`
+			Ledger       ofxBalance       `xml:"LEDGERBAL"`
+			Opening      ofxNamedBalance  `xml:"BALLIST>BAL"`
+		} `xml:"BANKMSGSRSV1>STMTTRNRS>STMTRS"`
+	}
+	if assert.NoError(t, xml.Unmarshal([]byte(out), &doc)) {
+		assert.Equal(t, "RUB", doc.Statement.Currency)
+		assert.Equal(t, compactId(ownerId), doc.Statement.AccountId)
+		assert.Equal(t, []ofxTransaction{
+			{TrnType: "XFER", DTPosted: "20211110142311.000[0:GMT]", TrnAmt: "-2.00", FitId: 1, Name: compactId(counterpartyId), Memo: "dinner & <drinks>"},
+			{TrnType: "DEP", DTPosted: "20211111090000.000[0:GMT]", TrnAmt: "0.50", FitId: 2},
+		}, doc.Statement.Transactions)
+		assert.Equal(t, ofxBalance{BalAmt: "-0.50", DTAsOf: "20211201000000.000[0:GMT]"}, doc.Statement.Ledger)
+		assert.Equal(t, "1.00", doc.Statement.Opening.Value)
+	}
+}
+
+func TestCamt053Encoder(t *testing.T) {
+	out := encode(t, FormatCamt053)
+
+	var doc struct {
+		XMLName   xml.Name
+		Statement struct {
+			Id       string        `xml:"Id"`
+			Account  camtAccount   `xml:"Acct"`
+			Balances []camtBalance `xml:"Bal"`
+			Entries  []camtEntry   `xml:"Ntry"`
+		} `xml:"BkToCstmrStmt>Stmt"`
+	}
+	if assert.NoError(t, xml.Unmarshal([]byte(out), &doc)) {
+		assert.Equal(t, camt053Namespace, doc.XMLName.Space)
+		assert.Equal(t, "RUB-20211101-20211130", doc.Statement.Id)
+		assert.Equal(t, camtAccount{Id: compactId(ownerId), Currency: "RUB"}, doc.Statement.Account)
+		assert.Equal(t, []camtBalance{
+			{Code: "OPBD", Amount: camtAmount{Currency: "RUB", Value: "1.00"}, CdtDbtInd: camtCredit, Date: "2021-11-01"},
+			{Code: "CLBD", Amount: camtAmount{Currency: "RUB", Value: "0.50"}, CdtDbtInd: camtDebit, Date: "2021-11-30"},
+		}, doc.Statement.Balances)
+		if assert.Len(t, doc.Statement.Entries, 2) {
+			debit := doc.Statement.Entries[0]
+			assert.Equal(t, camtAmount{Currency: "RUB", Value: "2.00"}, debit.Amount)
+			assert.Equal(t, camtDebit, debit.CdtDbtInd)
+			assert.Equal(t, "2021-11-10T14:23:11Z", debit.BookgDt)
+			assert.Equal(t, entity.TransactionOutgoingTransfer, debit.BkTxCd)
+			assert.Equal(t, compactId(counterpartyId), debit.Details.RelatedParties.CreditorAccount.Id)
+			assert.Equal(t, "dinner & <drinks>", debit.Details.Remittance.Unstructured)
+
+			credit := doc.Statement.Entries[1]
+			assert.Equal(t, camtCredit, credit.CdtDbtInd)
+			assert.Nil(t, credit.Details.RelatedParties)
+			assert.Nil(t, credit.Details.Remittance)
+		}
+	}
+}
+
+func TestEncoder_Golden(t *testing.T) {
+	owner := uuid.MustParse("8c5593a0-37d3-11ec-8d3d-0242ac130001")
+	counterparty := uuid.MustParse("6e726185-586e-49a7-89a4-6cfc2b03b0a2")
+	entries := []Entry{
+		{Id: 6, Date: time.Date(2021, 11, 10, 14, 23, 11, 0, time.UTC), Type: entity.TransactionTopUp, Amount: 500005, BalanceAfter: 600005, Description: "VISA top-up"},
+		{Id: 8, Date: time.Date(2021, 11, 10, 14, 24, 17, 0, time.UTC), Type: entity.TransactionOutgoingTransfer, CounterpartyId: counterparty, Amount: -300, BalanceAfter: 599705, Description: "happy birthday!"},
+		{Id: 9, Date: time.Date(2021, 11, 12, 8, 0, 0, 0, time.UTC), Type: entity.TransactionWithdrawal, Amount: -599710, BalanceAfter: -5},
+	}
+
+	for _, currency := range []string{"RUB", "JPY"} {
+		for _, format := range []string{FormatCSV, FormatOFX, FormatCamt053} {
+			var buf bytes.Buffer
+			enc, err := NewEncoder(format, &buf)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			assert.NoError(t, enc.Begin(Statement{
+				OwnerId:        owner,
+				Currency:       currency,
+				From:           time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+				To:             time.Date(2021, 11, 30, 0, 0, 0, 0, time.UTC),
+				OpeningBalance: 100000,
+				ClosingBalance: -5,
+				CreatedAt:      time.Date(2021, 12, 1, 10, 0, 0, 0, time.UTC),
+			}))
+			for _, e := range entries {
+				assert.NoError(t, enc.Encode(e))
+			}
+			assert.NoError(t, enc.End())
+
+			golden := filepath.Join("testdata", strings.ToLower(currency)+"."+format)
+			if *update {
+				assert.NoError(t, ioutil.WriteFile(golden, buf.Bytes(), 0644))
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if assert.NoError(t, err) {
+				assert.Equal(t, string(expected), buf.String(), golden)
+			}
+		}
+	}
+}
@@ -2,6 +2,9 @@ package transaction
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"time"
 
 	dbx "github.com/go-ozzo/ozzo-dbx"
 	"github.com/google/uuid"
@@ -12,14 +15,101 @@ import (
 
 // Repository encapsulates the logic to access transactions from the database.
 type Repository interface {
-	// Create saves a new Transaction in the storage.
+	// Get returns the Transaction with the specified id.
+	Get(ctx context.Context, id int64) (entity.Transaction, error)
+	// Lock returns the Transaction with the specified id and locks it until the end of the DB transaction.
+	Lock(ctx context.Context, id int64) (entity.Transaction, error)
+	// GetMany returns the transactions with the specified ids which exist, ordered by id.
+	GetMany(ctx context.Context, ids []int64) ([]entity.Transaction, error)
+	// Create saves a new Transaction in the storage. A Transaction without status is saved as completed.
 	// Transaction tx is assigned an id from database in case of successful transaction.
 	Create(ctx context.Context, tx *entity.Transaction) error
+	// CreateStatusChange saves a new TransactionStatusChange in the storage.
+	// TransactionStatusChange c is assigned an id from database in case of success.
+	CreateStatusChange(ctx context.Context, c *entity.TransactionStatusChange) error
+	// StatusChanges returns the status history of the Transaction with the given id in chronological order.
+	StatusChanges(ctx context.Context, id int64) ([]entity.TransactionStatusChange, error)
+	// Update updates the changes to the given Transaction to db.
+	Update(ctx context.Context, tx entity.Transaction) error
+	// Each calls f for every Transaction in the order of their ids, stopping at the first error.
+	Each(ctx context.Context, f func(tx entity.Transaction) error) error
 	Count(ctx context.Context) (int64, error)
-	// GetForUser returns a list of all transactions related to given userId.
-	GetForUser(ctx context.Context, ownerId uuid.UUID, orderBy, orderDirection string, offset, limit int) ([]entity.Transaction, error)
+	// Outgoing returns the total amount and the number of non-reversal transactions sent by the user with the given id
+	// to others in each currency, which were created since the given time. Failed transactions are not counted.
+	Outgoing(ctx context.Context, ownerId uuid.UUID, since time.Time) ([]OutgoingTotal, error)
+	// Pending returns the total amount of pending transactions in the given currency sent by the user with the given id.
+	Pending(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error)
+	// GetForUser returns a list of all transactions related to given userId which match the filter.
+	// If after is not nil, only the transactions following it in the given order are returned.
+	GetForUser(ctx context.Context, ownerId uuid.UUID, filter HistoryFilter, orderBy, orderDirection string, after *Cursor, offset, limit int) ([]entity.Transaction, error)
+	// EachForUser calls f for every settled Transaction which changed the deposit of the user with the given id
+	// in the given currency in the period [from, to), in the order of their dates, stopping at the first error.
+	EachForUser(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, f func(tx entity.Transaction) error) error
+	// Analytics returns the totals of settled money received and sent by the user with the given id in the given currency
+	// in the period [from, to), bucketed by interval (day, week or month) and optionally split by groupBy
+	// (counterparty or tag). Buckets are ordered by their start and then by the group.
+	Analytics(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, interval, groupBy string) ([]AnalyticsBucket, error)
 }
 
+// Cursor represents the position of a transaction in the history of a user ordered by OrderBy in OrderDirection.
+// Transactions with equal order keys are ordered by id.
+type Cursor struct {
+	OrderBy        string `json:"o"`
+	OrderDirection string `json:"d"`
+	// TransactionDate or Amount of the transaction, depending on OrderBy.
+	TransactionDate time.Time `json:"t,omitempty"`
+	Amount          int64     `json:"a,omitempty"`
+	Id              int64     `json:"i"`
+}
+
+// HistoryFilter represents the conditions which transactions of a user are filtered by. Zero fields are ignored.
+type HistoryFilter struct {
+	// From and To limit the transaction date, both inclusive.
+	From, To time.Time
+	// Types are the types of transactions from the user's point of view, e.g. entity.TransactionTopUp.
+	Types []string
+	// Statuses are the statuses of transactions, e.g. entity.TransactionPending.
+	Statuses []string
+	// CounterpartyId is the UUID of the other party of transfers.
+	CounterpartyId uuid.UUID
+	// MinAmount and MaxAmount limit the amount of transactions, both inclusive.
+	MinAmount, MaxAmount int64
+	// Description is a case-insensitive substring of the description of transactions.
+	Description string
+	// Tags must all be attached to transactions.
+	Tags []string
+	// Metadata are the key-value pairs which must all be present in the metadata of transactions.
+	Metadata map[string]string
+}
+
+// OutgoingTotal represents the total amount and the number of withdrawals and outgoing transfers of a user
+// in one currency.
+type OutgoingTotal struct {
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+	Count    int64  `json:"count"`
+}
+
+// AnalyticsBucket represents the totals of money received and sent by a user during a period,
+// optionally for a single counterparty or tag.
+type AnalyticsBucket struct {
+	// PeriodStart is the start of the day, week (Monday) or month in UTC.
+	PeriodStart time.Time `json:"period_start"`
+	// CounterpartyId is the UUID of the other party, or Nil UUID for top-ups and withdrawals.
+	// Nil unless grouped by counterparty.
+	CounterpartyId *uuid.UUID `json:"counterparty_id,omitempty"`
+	// Tag is one of the tags of the transactions, or empty for the transactions without tags.
+	// Nil unless grouped by tag.
+	Tag            *string `json:"tag,omitempty"`
+	IncomingAmount int64   `json:"incoming_amount"`
+	IncomingCount  int64   `json:"incoming_count"`
+	OutgoingAmount int64   `json:"outgoing_amount"`
+	OutgoingCount  int64   `json:"outgoing_count"`
+}
+
+// settled selects the transactions whose money has been moved between the deposits.
+var settled = dbx.In("status", entity.TransactionCompleted, entity.TransactionReversed)
+
 // repository persists Transaction in database
 type repository struct {
 	db     *dbcontext.DB
@@ -31,34 +121,313 @@ func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
 	return repository{db, logger}
 }
 
+// Get reads the Transaction with the specified id from the database.
+func (r repository) Get(ctx context.Context, id int64) (entity.Transaction, error) {
+	var tx entity.Transaction
+	err := r.db.With(ctx).Select().Model(id, &tx)
+	return tx, err
+}
+
+// Lock reads the Transaction with the specified id from the database and locks its row with SELECT ... FOR UPDATE,
+// so that concurrent DB transactions changing the status of the same Transaction are serialized.
+func (r repository) Lock(ctx context.Context, id int64) (entity.Transaction, error) {
+	var tx entity.Transaction
+	err := r.db.With(ctx).
+		NewQuery("SELECT * FROM transaction WHERE id = {:id} FOR UPDATE").
+		Bind(dbx.Params{"id": id}).
+		One(&tx)
+	return tx, err
+}
+
+// GetMany reads the Transaction records with the specified ids from the database. Missing ids are skipped.
+func (r repository) GetMany(ctx context.Context, ids []int64) ([]entity.Transaction, error) {
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+
+	var result []entity.Transaction
+	err := r.db.With(ctx).Select().Where(dbx.In("id", values...)).OrderBy("id").All(&result)
+	return result, err
+}
+
 // Create saves a new Transaction record in the database.
-// Transaction is assigned an auto-incremented id from database.
+// Transaction is assigned an auto-incremented id from database. A zero CreatedAt is set to TransactionDate.
 func (r repository) Create(ctx context.Context, tx *entity.Transaction) error {
+	if tx.Status == "" {
+		tx.Status = entity.TransactionCompleted
+	}
+	if tx.CreatedAt.IsZero() {
+		tx.CreatedAt = tx.TransactionDate
+	}
 	return r.db.With(ctx).Model(tx).Insert()
 }
 
+// CreateStatusChange saves a new TransactionStatusChange record in the database.
+// TransactionStatusChange is assigned an auto-incremented id from database.
+func (r repository) CreateStatusChange(ctx context.Context, c *entity.TransactionStatusChange) error {
+	return r.db.With(ctx).Model(c).Insert()
+}
+
+// StatusChanges reads the status history of the Transaction with the given id from the database.
+func (r repository) StatusChanges(ctx context.Context, id int64) ([]entity.TransactionStatusChange, error) {
+	var result []entity.TransactionStatusChange
+	err := r.db.With(ctx).Select().
+		Where(dbx.HashExp{"transaction_id": id}).
+		OrderBy("changed_at", "id").
+		All(&result)
+	return result, err
+}
+
+// Update saves the changes to the Transaction in the database.
+func (r repository) Update(ctx context.Context, tx entity.Transaction) error {
+	return r.db.With(ctx).Model(&tx).Update()
+}
+
+// Each reads all Transaction records from the database in the order of their ids and calls f for each of them.
+// Records are streamed, so that they are never loaded into memory all at once.
+func (r repository) Each(ctx context.Context, f func(tx entity.Transaction) error) error {
+	rows, err := r.db.With(ctx).Select().From("transaction").OrderBy("id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tx entity.Transaction
+		if err = rows.ScanStruct(&tx); err != nil {
+			return err
+		}
+		if err = f(tx); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 func (r repository) Count(ctx context.Context) (int64, error) {
 	var count int64
 	err := r.db.With(ctx).Select("COUNT(*)").From("transaction").Row(&count)
 	return count, err
 }
 
-// GetForUser returns all transactions from and to the user with given id.
-func (r repository) GetForUser(ctx context.Context, ownerId uuid.UUID, orderBy, orderDirection string, offset, limit int) ([]entity.Transaction, error) {
+// Outgoing returns the total amount and the number of withdrawals and outgoing transfers in each currency
+// made by the user with given id, which were created since the given time, ordered by currency.
+// Reversals, failed transactions and exchanges between the user's own deposits are not counted, while pending ones
+// are, since their money is already held.
+// Pending transactions are counted as of their creation, even if they are completed later.
+func (r repository) Outgoing(ctx context.Context, ownerId uuid.UUID, since time.Time) ([]OutgoingTotal, error) {
+	var result []OutgoingTotal
+	err := r.db.With(ctx).Select("currency", "SUM(amount) AS amount", "COUNT(*) AS count").
+		From("transaction").
+		Where(dbx.HashExp{"sender_id": ownerId, "reversal_of": 0}).
+		AndWhere(dbx.Not(dbx.HashExp{"status": entity.TransactionFailed})).
+		AndWhere(dbx.NewExp("recipient_id IS DISTINCT FROM sender_id")).
+		AndWhere(dbx.NewExp("created_at >= {:since}", dbx.Params{"since": since})).
+		GroupBy("currency").
+		OrderBy("currency").
+		All(&result)
+	return result, err
+}
+
+// Pending returns the total amount of pending withdrawals and outgoing transfers in the given currency
+// made by the user with given id.
+func (r repository) Pending(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error) {
+	var amount int64
+	err := r.db.With(ctx).Select("COALESCE(SUM(amount), 0)").
+		From("transaction").
+		Where(dbx.HashExp{"sender_id": ownerId, "currency": currency, "status": entity.TransactionPending}).
+		Row(&amount)
+	return amount, err
+}
+
+// GetForUser returns all transactions from and to the user with given id which match the filter.
+// Transactions are ordered by orderBy (transaction_date by default) and then by id, both in orderDirection
+// (ASC by default), so that the order is stable and keyset pagination with after never skips nor repeats them.
+func (r repository) GetForUser(ctx context.Context, ownerId uuid.UUID, filter HistoryFilter, orderBy, orderDirection string, after *Cursor, offset, limit int) ([]entity.Transaction, error) {
+	if orderBy == "" {
+		orderBy = "transaction_date"
+	}
+	if orderBy != "transaction_date" && orderBy != "amount" {
+		return nil, fmt.Errorf("transaction: unsupported order %q", orderBy)
+	}
+	operator := ">"
+	if orderDirection == "DESC" {
+		operator = "<"
+	} else {
+		orderDirection = "ASC"
+	}
+
 	var result []entity.Transaction
 	query := r.db.With(ctx).Select().
-		Where(dbx.Or(dbx.HashExp{"sender_id": ownerId}, dbx.HashExp{"recipient_id": ownerId})).
+		Where(historyConditions(ownerId, filter)).
+		OrderBy(orderBy+" "+orderDirection, "id "+orderDirection).
 		Offset(int64(offset)).
 		Limit(int64(limit))
 
-	if orderBy != "" {
-		if orderDirection == "" {
-			query.OrderBy(orderBy)
-		} else {
-			query.OrderBy(orderBy + " " + orderDirection)
+	if after != nil {
+		var key interface{} = after.TransactionDate
+		if orderBy == "amount" {
+			key = after.Amount
 		}
+		// row comparison selects the transactions following the cursor in the order
+		query.AndWhere(dbx.NewExp(
+			fmt.Sprintf("(%s, id) %s ({:cursor_key}, {:cursor_id})", orderBy, operator),
+			dbx.Params{"cursor_key": key, "cursor_id": after.Id},
+		))
 	}
 
 	err := query.All(&result)
 	return result, err
-}
\ No newline at end of file
+}
+
+// EachForUser reads the settled transactions which changed the deposit of the user with given id in the given currency
+// in the period [from, to) and calls f for each of them. Transactions are ordered by transaction_date and then by id.
+// Records are streamed, so that they are never loaded into memory all at once.
+func (r repository) EachForUser(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, f func(tx entity.Transaction) error) error {
+	rows, err := r.db.With(ctx).Select().
+		From("transaction").
+		Where(dbx.Or(
+			dbx.HashExp{"sender_id": ownerId, "currency": currency},
+			// the recipient is credited in recipient_currency, unless it's empty
+			dbx.HashExp{"recipient_id": ownerId, "recipient_currency": currency},
+			dbx.HashExp{"recipient_id": ownerId, "recipient_currency": "", "currency": currency},
+		)).
+		AndWhere(settled).
+		AndWhere(dbx.NewExp("transaction_date >= {:date_from} AND transaction_date < {:date_to}", dbx.Params{"date_from": from, "date_to": to})).
+		OrderBy("transaction_date", "id").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tx entity.Transaction
+		if err = rows.ScanStruct(&tx); err != nil {
+			return err
+		}
+		if err = f(tx); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Analytics aggregates the settled transactions of the user with given id in the given currency in the period [from, to).
+// Incoming money is counted in the credited currency, so that converted transfers are counted once on each side.
+// When grouped by tag, a transaction with several tags is counted in the bucket of each of them.
+func (r repository) Analytics(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, interval, groupBy string) ([]AnalyticsBucket, error) {
+	if interval != "day" && interval != "week" && interval != "month" {
+		return nil, fmt.Errorf("transaction: unsupported interval %q", interval)
+	}
+
+	incoming := "recipient_id = {:owner_id} AND (recipient_currency = {:currency} OR recipient_currency = '' AND currency = {:currency})"
+	outgoing := "sender_id = {:owner_id} AND currency = {:currency}"
+	query := r.db.With(ctx).Select(
+		"date_trunc({:interval}, transaction_date) AS period_start",
+		"COALESCE(SUM(CASE WHEN recipient_currency = '' THEN amount ELSE recipient_amount END) FILTER (WHERE "+incoming+"), 0) AS incoming_amount",
+		"COUNT(*) FILTER (WHERE "+incoming+") AS incoming_count",
+		"COALESCE(SUM(amount) FILTER (WHERE "+outgoing+"), 0) AS outgoing_amount",
+		"COUNT(*) FILTER (WHERE "+outgoing+") AS outgoing_count",
+	).
+		From("transaction").
+		Where(dbx.Or(dbx.NewExp(incoming), dbx.NewExp(outgoing))).
+		AndWhere(settled).
+		AndWhere(dbx.NewExp("transaction_date >= {:date_from} AND transaction_date < {:date_to}", dbx.Params{"date_from": from, "date_to": to})).
+		AndBind(dbx.Params{"owner_id": ownerId, "currency": currency, "interval": interval})
+
+	switch groupBy {
+	case "":
+		query.GroupBy("period_start").OrderBy("period_start")
+	case "counterparty":
+		query.AndSelect("(CASE WHEN sender_id = {:owner_id} THEN recipient_id ELSE sender_id END) AS counterparty_id").
+			GroupBy("period_start", "counterparty_id").
+			OrderBy("period_start", "counterparty_id")
+	case "tag":
+		// set-returning functions in FROM can refer to the preceding tables, transactions without tags are kept
+		query.AndSelect("COALESCE(t.tag, '') AS tag").
+			LeftJoin("jsonb_array_elements_text(tags) AS t(tag)", dbx.NewExp("TRUE")).
+			GroupBy("period_start", "tag").
+			OrderBy("period_start", "tag")
+	default:
+		return nil, fmt.Errorf("transaction: unsupported grouping %q", groupBy)
+	}
+
+	var result []AnalyticsBucket
+	err := query.All(&result)
+	return result, err
+}
+
+// historyConditions returns the expression which selects the transactions from and to the user with given id
+// matching the filter. All values are bound as query parameters.
+func historyConditions(ownerId uuid.UUID, filter HistoryFilter) dbx.Expression {
+	conditions := []dbx.Expression{
+		dbx.Or(dbx.HashExp{"sender_id": ownerId}, dbx.HashExp{"recipient_id": ownerId}),
+	}
+
+	if !filter.From.IsZero() {
+		conditions = append(conditions, dbx.NewExp("transaction_date >= {:date_from}", dbx.Params{"date_from": filter.From}))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, dbx.NewExp("transaction_date <= {:date_to}", dbx.Params{"date_to": filter.To}))
+	}
+
+	if len(filter.Types) > 0 {
+		var byType []dbx.Expression
+		for _, t := range filter.Types {
+			switch t {
+			case entity.TransactionTopUp:
+				byType = append(byType, dbx.HashExp{"sender_id": uuid.Nil, "recipient_id": ownerId})
+			case entity.TransactionWithdrawal:
+				byType = append(byType, dbx.HashExp{"sender_id": ownerId, "recipient_id": uuid.Nil})
+			case entity.TransactionIncomingTransfer:
+				byType = append(byType, dbx.And(dbx.HashExp{"recipient_id": ownerId}, dbx.Not(dbx.HashExp{"sender_id": uuid.Nil})))
+			case entity.TransactionOutgoingTransfer:
+				byType = append(byType, dbx.And(dbx.HashExp{"sender_id": ownerId}, dbx.Not(dbx.HashExp{"recipient_id": uuid.Nil})))
+			}
+		}
+		conditions = append(conditions, dbx.Or(byType...))
+	}
+
+	if len(filter.Statuses) > 0 {
+		statuses := make([]interface{}, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			statuses[i] = status
+		}
+		conditions = append(conditions, dbx.In("status", statuses...))
+	}
+
+	if filter.CounterpartyId != uuid.Nil {
+		conditions = append(conditions, dbx.Or(
+			dbx.HashExp{"sender_id": ownerId, "recipient_id": filter.CounterpartyId},
+			dbx.HashExp{"sender_id": filter.CounterpartyId, "recipient_id": ownerId},
+		))
+	}
+
+	if filter.MinAmount > 0 {
+		conditions = append(conditions, dbx.NewExp("amount >= {:min_amount}", dbx.Params{"min_amount": filter.MinAmount}))
+	}
+	if filter.MaxAmount > 0 {
+		conditions = append(conditions, dbx.NewExp("amount <= {:max_amount}", dbx.Params{"max_amount": filter.MaxAmount}))
+	}
+
+	if filter.Description != "" {
+		// LIKE wildcards in the substring are escaped by dbx
+		like := dbx.Like("description", filter.Description)
+		like.Like = "ILIKE"
+		conditions = append(conditions, like)
+	}
+
+	// JSONB containment is served by the GIN indexes on tags and metadata
+	if len(filter.Tags) > 0 {
+		tags, _ := json.Marshal(filter.Tags)
+		conditions = append(conditions, dbx.NewExp("tags @> {:tags}::jsonb", dbx.Params{"tags": string(tags)}))
+	}
+	if len(filter.Metadata) > 0 {
+		metadata, _ := json.Marshal(filter.Metadata)
+		conditions = append(conditions, dbx.NewExp("metadata @> {:metadata}::jsonb", dbx.Params{"metadata": string(metadata)}))
+	}
+
+	return dbx.And(conditions...)
+}
@@ -15,7 +15,7 @@ import (
 func TestRepository(t *testing.T) {
 	logger, _ := log.NewForTest()
 	db := test.DB(t)
-	test.ResetTables(t, db, "transaction")
+	test.ResetTables(t, db, "transaction", "transaction_status_change")
 	repo := NewRepository(db, logger)
 
 	ctx := context.Background()
@@ -32,6 +32,7 @@ func TestRepository(t *testing.T) {
 		SenderId:        id1,
 		RecipientId:     uuid.Nil,
 		Amount:          300,
+		Currency:        "RUB",
 		Description:     "Monthly subscription",
 		TransactionDate: time.Now(),
 	}
@@ -50,6 +51,7 @@ func TestRepository(t *testing.T) {
 		SenderId:        uuid.Nil,
 		RecipientId:     id1,
 		Amount:          500,
+		Currency:        "RUB",
 		Description:     "VISA top-up",
 		TransactionDate: time.Now(),
 	}
@@ -70,7 +72,10 @@ func TestRepository(t *testing.T) {
 		SenderId:        id1,
 		RecipientId:     id2,
 		Amount:          1500,
+		Currency:        "RUB",
 		Description:     "thanks for dinner!",
+		Metadata:        entity.Metadata{"order_id": "42"},
+		Tags:            entity.Tags{"food", "friends"},
 		TransactionDate: time.Now(),
 	}
 	err = repo.Create(ctx, &tx)
@@ -84,6 +89,70 @@ func TestRepository(t *testing.T) {
 		}
 	}
 
+	// get
+	got, err := repo.Get(ctx, tx.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tx.Amount, got.Amount)
+		assert.Equal(t, tx.Description, got.Description)
+		assert.Equal(t, tx.Metadata, got.Metadata)
+		assert.Equal(t, tx.Tags, got.Tags)
+	}
+
+	// get many, missing ids are skipped
+	txs, err := repo.GetMany(ctx, []int64{tx.Id, 0, tx.Id + 1000})
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		assert.Equal(t, tx.Id, txs[0].Id)
+	}
+
+	// update reversed amount
+	got.ReversedAmount = 500
+	err = repo.Update(ctx, got)
+	if assert.NoError(t, err) {
+		got, _ = repo.Get(ctx, tx.Id)
+		assert.EqualValues(t, 500, got.ReversedAmount)
+	}
+
+	// reversed amount exceeding amount -> db error
+	got.ReversedAmount = 5000
+	assert.Error(t, repo.Update(ctx, got))
+
+	// update balances after transaction
+	got.ReversedAmount = 500
+	senderBalance, recipientBalance := int64(200), int64(1500)
+	got.SenderBalanceAfter, got.RecipientBalanceAfter = &senderBalance, &recipientBalance
+	err = repo.Update(ctx, got)
+	if assert.NoError(t, err) {
+		got, _ = repo.Get(ctx, tx.Id)
+		assert.Equal(t, &senderBalance, got.SenderBalanceAfter)
+		assert.Equal(t, &recipientBalance, got.RecipientBalanceAfter)
+	}
+
+	// each in the order of ids
+	var ids []int64
+	err = repo.Each(ctx, func(tx entity.Transaction) error {
+		ids = append(ids, tx.Id)
+		return nil
+	})
+	if assert.NoError(t, err) && assert.Len(t, ids, int(count)) {
+		assert.Equal(t, tx.Id, ids[len(ids)-1])
+	}
+
+	// each of user's transactions in the currency for the period
+	countForUser := func(ownerId uuid.UUID, currency string, from, to time.Time) int {
+		n := 0
+		err := repo.EachForUser(ctx, ownerId, currency, from, to, func(tx entity.Transaction) error {
+			n++
+			return nil
+		})
+		assert.NoError(t, err)
+		return n
+	}
+	hourAgo, inHour := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	assert.Equal(t, 3, countForUser(id1, "RUB", hourAgo, inHour))
+	assert.Equal(t, 1, countForUser(id2, "RUB", hourAgo, inHour))
+	assert.Zero(t, countForUser(id1, "USD", hourAgo, inHour))
+	assert.Zero(t, countForUser(id1, "RUB", hourAgo.Add(-time.Hour), hourAgo))
+
 	// create with negative amount -> db error
 	err = repo.Create(ctx, &entity.Transaction{
 		Id:              0,
@@ -100,20 +169,30 @@ func TestRepository(t *testing.T) {
 		}
 	}
 
+	// outgoing money of the sender
+	outgoing, err := repo.Outgoing(ctx, id1, time.Now().Add(-time.Hour))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []OutgoingTotal{{Currency: "RUB", Amount: 1800, Count: 2}}, outgoing)
+	}
+	outgoing, err = repo.Outgoing(ctx, id1, time.Now().Add(time.Hour))
+	if assert.NoError(t, err) {
+		assert.Empty(t, outgoing)
+	}
+
 	// list for user
-	txs, err := repo.GetForUser(ctx, id1, "", "", 0, -1)
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "", "", nil, 0, -1)
 	if assert.NoError(t, err) {
 		assert.Len(t, txs, 3)
 	}
 
 	// list for user with pagination
-	txs, err = repo.GetForUser(ctx, id1, "", "", 1, 1)
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "", "", nil, 1, 1)
 	if assert.NoError(t, err) {
 		assert.Len(t, txs, 1)
 	}
 
 	// list for user with order
-	txs, err = repo.GetForUser(ctx, id1, "amount", "", 0, -1)
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "amount", "", nil, 0, -1)
 	if assert.NoError(t, err) {
 		assert.Len(t, txs, 3)
 
@@ -127,7 +206,7 @@ func TestRepository(t *testing.T) {
 	}
 
 	// list for user with order and direction
-	txs, err = repo.GetForUser(ctx, id1, "amount", "DESC", 0, -1)
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "amount", "DESC", nil, 0, -1)
 	if assert.NoError(t, err) {
 		assert.Len(t, txs, 3)
 
@@ -138,4 +217,253 @@ func TestRepository(t *testing.T) {
 
 		assert.IsNonIncreasing(t, amounts)
 	}
+
+	// list for user filtered by type
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Types: []string{entity.TransactionTopUp}}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		assert.EqualValues(t, 500, txs[0].Amount)
+	}
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{
+		Types: []string{entity.TransactionWithdrawal, entity.TransactionOutgoingTransfer},
+	}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Len(t, txs, 2)
+	}
+	txs, err = repo.GetForUser(ctx, id2, HistoryFilter{Types: []string{entity.TransactionIncomingTransfer}}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Len(t, txs, 1)
+	}
+
+	// list for user filtered by counterparty
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{CounterpartyId: id2}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		assert.EqualValues(t, 1500, txs[0].Amount)
+	}
+
+	// list for user filtered by amount and description
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{MinAmount: 400, MaxAmount: 1500}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Len(t, txs, 2)
+	}
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Description: "visa"}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		assert.EqualValues(t, 500, txs[0].Amount)
+	}
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Description: "%"}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Empty(t, txs)
+	}
+
+	// list for user filtered by tags and metadata
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Tags: []string{"friends"}}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		assert.EqualValues(t, 1500, txs[0].Amount)
+	}
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Tags: []string{"friends", "travel"}}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Empty(t, txs)
+	}
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Metadata: map[string]string{"order_id": "42"}}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		assert.EqualValues(t, 1500, txs[0].Amount)
+	}
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Metadata: map[string]string{"order_id": "43"}}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Empty(t, txs)
+	}
+
+	// list for user filtered by date
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{From: time.Now().UTC().Add(time.Hour)}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Empty(t, txs)
+	}
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{
+		From: time.Now().UTC().Add(-time.Hour),
+		To:   time.Now().UTC().Add(time.Hour),
+	}, "", "", nil, 0, -1)
+	if assert.NoError(t, err) {
+		assert.Len(t, txs, 3)
+	}
+
+	// keyset pagination by amount in descending order: 1500, 500, 300
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "amount", "DESC", nil, 0, 1)
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		assert.EqualValues(t, 1500, txs[0].Amount)
+
+		after := &Cursor{OrderBy: "amount", OrderDirection: "DESC", Amount: txs[0].Amount, Id: txs[0].Id}
+		txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "amount", "DESC", after, 0, -1)
+		if assert.NoError(t, err) && assert.Len(t, txs, 2) {
+			assert.EqualValues(t, 500, txs[0].Amount)
+			assert.EqualValues(t, 300, txs[1].Amount)
+		}
+	}
+
+	// keyset pagination by date: the transactions created after the first one
+	txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "transaction_date", "ASC", nil, 0, 1)
+	if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+		after := &Cursor{OrderBy: "transaction_date", OrderDirection: "ASC", TransactionDate: txs[0].TransactionDate, Id: txs[0].Id}
+		txs, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "transaction_date", "ASC", after, 0, -1)
+		if assert.NoError(t, err) {
+			assert.Len(t, txs, 2)
+		}
+	}
+
+	// fail unsupported order
+	_, err = repo.GetForUser(ctx, id1, HistoryFilter{}, "description", "", nil, 0, -1)
+	assert.Error(t, err)
+
+	// analytics: withdrawal of 300, top-up of 500 and transfer of 1500 to id2 tagged with food and friends
+	monthAgo, inHour := time.Now().UTC().AddDate(0, -1, 0), time.Now().UTC().Add(time.Hour)
+	buckets, err := repo.Analytics(ctx, id1, "RUB", monthAgo, inHour, "month", "")
+	if assert.NoError(t, err) && assert.NotEmpty(t, buckets) {
+		var total AnalyticsBucket
+		for _, b := range buckets {
+			assert.Nil(t, b.CounterpartyId)
+			assert.Nil(t, b.Tag)
+			total.IncomingAmount += b.IncomingAmount
+			total.IncomingCount += b.IncomingCount
+			total.OutgoingAmount += b.OutgoingAmount
+			total.OutgoingCount += b.OutgoingCount
+		}
+		assert.Equal(t, AnalyticsBucket{IncomingAmount: 500, IncomingCount: 1, OutgoingAmount: 1800, OutgoingCount: 2}, total)
+	}
+	buckets, err = repo.Analytics(ctx, id1, "RUB", monthAgo, inHour, "day", "counterparty")
+	if assert.NoError(t, err) {
+		outgoing := make(map[uuid.UUID]int64)
+		for _, b := range buckets {
+			if assert.NotNil(t, b.CounterpartyId) {
+				outgoing[*b.CounterpartyId] += b.OutgoingAmount
+			}
+		}
+		assert.Equal(t, map[uuid.UUID]int64{uuid.Nil: 300, id2: 1500}, outgoing)
+	}
+	buckets, err = repo.Analytics(ctx, id1, "RUB", monthAgo, inHour, "week", "tag")
+	if assert.NoError(t, err) {
+		outgoing := make(map[string]int64)
+		for _, b := range buckets {
+			if assert.NotNil(t, b.Tag) {
+				outgoing[*b.Tag] += b.OutgoingAmount
+			}
+		}
+		assert.Equal(t, map[string]int64{"": 300, "food": 1500, "friends": 1500}, outgoing)
+	}
+	buckets, err = repo.Analytics(ctx, id1, "USD", monthAgo, inHour, "day", "")
+	if assert.NoError(t, err) {
+		assert.Empty(t, buckets)
+	}
+
+	// fail unsupported interval and grouping
+	_, err = repo.Analytics(ctx, id1, "RUB", monthAgo, inHour, "year", "")
+	assert.Error(t, err)
+	_, err = repo.Analytics(ctx, id1, "RUB", monthAgo, inHour, "day", "currency")
+	assert.Error(t, err)
+
+	// new transactions are completed by default
+	got, err = repo.Get(ctx, tx.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionCompleted, got.Status)
+	}
+
+	// pending withdrawal holds money, but is not applied yet
+	pending := entity.Transaction{
+		SenderId:        id1,
+		RecipientId:     uuid.Nil,
+		Amount:          200,
+		Currency:        "RUB",
+		TransactionDate: time.Now(),
+		Status:          entity.TransactionPending,
+	}
+	if assert.NoError(t, repo.Create(ctx, &pending)) {
+		amount, err := repo.Pending(ctx, id1, "RUB")
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 200, amount)
+		}
+		assert.Equal(t, 3, countForUser(id1, "RUB", hourAgo, inHour))
+
+		txs, err = repo.GetForUser(ctx, id1, HistoryFilter{Statuses: []string{entity.TransactionPending}}, "", "", nil, 0, -1)
+		if assert.NoError(t, err) && assert.Len(t, txs, 1) {
+			assert.Equal(t, pending.Id, txs[0].Id)
+		}
+	}
+
+	// lock
+	got, err = repo.Lock(ctx, pending.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionPending, got.Status)
+	}
+
+	// failed transaction releases the money and is not counted as outgoing
+	got.Status = entity.TransactionFailed
+	if assert.NoError(t, repo.Update(ctx, got)) {
+		amount, err := repo.Pending(ctx, id1, "RUB")
+		if assert.NoError(t, err) {
+			assert.Zero(t, amount)
+		}
+		outgoing, err = repo.Outgoing(ctx, id1, time.Now().Add(-time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, []OutgoingTotal{{Currency: "RUB", Amount: 1800, Count: 2}}, outgoing)
+		}
+	}
+
+	// outgoing money is counted as of the creation, a transaction completed later keeps its creation time
+	completed := entity.Transaction{
+		SenderId:        id1,
+		Amount:          50,
+		Currency:        "USD",
+		TransactionDate: time.Now(),
+		CreatedAt:       time.Now().Add(-2 * time.Hour),
+	}
+	if assert.NoError(t, repo.Create(ctx, &completed)) {
+		outgoing, err = repo.Outgoing(ctx, id1, time.Now().Add(-time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, []OutgoingTotal{{Currency: "RUB", Amount: 1800, Count: 2}}, outgoing)
+		}
+		outgoing, err = repo.Outgoing(ctx, id1, time.Now().Add(-3*time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, []OutgoingTotal{{Currency: "RUB", Amount: 1800, Count: 2}, {Currency: "USD", Amount: 50, Count: 1}}, outgoing)
+		}
+	}
+
+	// exchange between own deposits is not outgoing money
+	exchange := entity.Transaction{
+		SenderId:          id1,
+		RecipientId:       id1,
+		Amount:            100,
+		Currency:          "RUB",
+		RecipientCurrency: "USD",
+		RecipientAmount:   1,
+		ExchangeRate:      0.01,
+		TransactionDate:   time.Now(),
+	}
+	if assert.NoError(t, repo.Create(ctx, &exchange)) {
+		outgoing, err = repo.Outgoing(ctx, id1, time.Now().Add(-time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, []OutgoingTotal{{Currency: "RUB", Amount: 1800, Count: 2}}, outgoing)
+		}
+	}
+
+	// unknown status -> db error
+	got.Status = "cancelled"
+	assert.Error(t, repo.Update(ctx, got))
+
+	// status history in chronological order
+	now := time.Now().UTC()
+	changes := []entity.TransactionStatusChange{
+		{TransactionId: pending.Id, Status: entity.TransactionPending, ChangedAt: now},
+		{TransactionId: pending.Id, PreviousStatus: entity.TransactionPending, Status: entity.TransactionFailed, Reason: "declined", ChangedAt: now.Add(time.Minute)},
+	}
+	for i := range changes {
+		if assert.NoError(t, repo.CreateStatusChange(ctx, &changes[i])) {
+			assert.NotZero(t, changes[i].Id)
+		}
+	}
+	history, err := repo.StatusChanges(ctx, pending.Id)
+	if assert.NoError(t, err) && assert.Len(t, history, 2) {
+		assert.Equal(t, changes[0].Id, history[0].Id)
+		assert.Equal(t, "declined", history[1].Reason)
+	}
+	history, err = repo.StatusChanges(ctx, tx.Id)
+	if assert.NoError(t, err) {
+		assert.Empty(t, history)
+	}
 }
\ No newline at end of file
@@ -2,22 +2,64 @@ package transaction
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"users-balance-microservice/internal/entity"
+	"users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/money"
 	"users-balance-microservice/internal/requests"
 	"users-balance-microservice/pkg/log"
 )
 
 // Service encapsulates usecase logic for transactions.
 type Service interface {
-	// CreateUpdateTransaction creates a Transaction based on UpdateBalanceRequest.
+	// Get returns the Transaction with the given id.
+	Get(ctx context.Context, id int64) (Transaction, error)
+	// GetMany returns the transactions with the ids listed in GetTransactionsRequest in the same order.
+	// It fails if any of them doesn't exist or, when the owner is specified, the owner is not a party to it.
+	GetMany(ctx context.Context, req requests.GetTransactionsRequest) ([]Transaction, error)
+	// CreateUpdateTransaction creates a Transaction based on UpdateBalanceRequest, pending if requested.
 	CreateUpdateTransaction(ctx context.Context, req requests.UpdateBalanceRequest) (Transaction, error)
-	// CreateTransferTransaction creates a Transaction based on TransferRequest.
-	CreateTransferTransaction(ctx context.Context, req requests.TransferRequest) (Transaction, error)
-	// GetHistory returns a list of all transactions related to the user with the given ID.
-	GetHistory(ctx context.Context, req requests.GetHistoryRequest) ([]entity.Transaction, error)
+	// CreateTransferTransaction creates a Transaction based on TransferRequest, pending if requested. If the currencies of the request differ,
+	// the amount credited to the recipient is converted at rate, i.e. units of RecipientCurrency per unit of Currency,
+	// and rounded to the minor units of RecipientCurrency.
+	CreateTransferTransaction(ctx context.Context, req requests.TransferRequest, rate float64) (Transaction, error)
+	// CreateReversalTransaction creates a Transaction which reverses the Transaction with the given id
+	// according to ReverseRequest and marks the original one as (partially) reversed.
+	CreateReversalTransaction(ctx context.Context, id int64, req requests.ReverseRequest) (Transaction, error)
+	// Complete marks the pending Transaction with the given id as completed as of now.
+	// Moving the money is up to the caller.
+	Complete(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (Transaction, error)
+	// Fail marks the pending Transaction with the given id as failed, which releases its held money.
+	Fail(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (Transaction, error)
+	// StatusHistory returns the status changes of the Transaction with the given id in chronological order.
+	StatusHistory(ctx context.Context, id int64) ([]entity.TransactionStatusChange, error)
+	// Outgoing returns the total amount and the number of withdrawals and outgoing transfers in each currency
+	// made by the user with the given id since the given time, as of their creation.
+	// Reversals, failed transactions and exchanges between the user's own deposits are not counted.
+	Outgoing(ctx context.Context, ownerId uuid.UUID, since time.Time) ([]OutgoingTotal, error)
+	// Pending returns the total amount of pending withdrawals and outgoing transfers in the given currency
+	// made by the user with the given id, i.e. the money held by them.
+	Pending(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error)
+	// RecordBalances saves the balances of the parties after the given Transaction, which must be already created.
+	RecordBalances(ctx context.Context, tx entity.Transaction) error
+	// BackfillBalances computes the balances of the parties after each Transaction which does not have them
+	// from the transaction log. It returns the number of updated Transactions.
+	BackfillBalances(ctx context.Context) (int64, error)
+	// GetHistory returns a page of the list of all transactions related to the user with the given ID.
+	GetHistory(ctx context.Context, req requests.GetHistoryRequest) (History, error)
+	// EachForUser calls f for every Transaction which changed the deposit of the user with the given id
+	// in the given currency in the period [from, to), in the order of their dates, stopping at the first error.
+	EachForUser(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, f func(tx entity.Transaction) error) error
+	// GetAnalytics returns the totals of money received and sent by the user for a period, bucketed by time
+	// and optionally split by counterparty or tag.
+	GetAnalytics(ctx context.Context, req requests.AnalyticsRequest) (Analytics, error)
 	// Count returns a number of all Transactions in the database. Mainly used for testing purposes.
 	Count(ctx context.Context) (int64, error)
 }
@@ -27,14 +69,96 @@ type Transaction struct {
 	entity.Transaction
 }
 
+// History represents a page of the transaction history of a user.
+type History struct {
+	Transactions []HistoryItem `json:"transactions"`
+	// NextCursor is an opaque token which points to the last returned transaction. Empty if there are no more pages.
+	NextCursor string `json:"next_cursor,omitempty"`
+	// HasMore tells whether there are more transactions after the returned ones.
+	HasMore bool `json:"has_more"`
+	// ConvertedCurrency is the currency the amounts were converted into. Empty if no conversion was requested.
+	ConvertedCurrency string `json:"converted_currency,omitempty"`
+}
+
+// HistoryItem represents a transaction in the history of a user.
+type HistoryItem struct {
+	entity.Transaction
+	// BalanceAfter is the balance of user's deposit in the currency of user's side of the transaction right after it.
+	// Nil if unknown.
+	BalanceAfter *int64 `json:"balance_after,omitempty"`
+	// ConvertedAmount is the amount of user's side of the transaction in History.ConvertedCurrency at the exchange rate
+	// as of the transaction date. Nil if no conversion was requested or the rate is unknown.
+	ConvertedAmount *int64 `json:"converted_amount,omitempty"`
+}
+
+// Analytics represents the totals of money received and sent by a user, bucketed by time.
+type Analytics struct {
+	Currency string            `json:"currency"`
+	Interval string            `json:"interval"`
+	GroupBy  string            `json:"group_by,omitempty"`
+	Buckets  []AnalyticsBucket `json:"buckets"`
+}
+
 type service struct {
-	repo   Repository
-	logger log.Logger
+	repo     Repository
+	rounding money.RoundingMode
+	logger   log.Logger
 }
 
 // NewService creates a new Transaction service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger}
+func NewService(repo Repository, rounding money.RoundingMode, logger log.Logger) Service {
+	return service{repo, rounding, logger}
+}
+
+func (s service) Get(ctx context.Context, id int64) (Transaction, error) {
+	tx, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{tx}, nil
+}
+
+func (s service) GetMany(ctx context.Context, req requests.GetTransactionsRequest) ([]Transaction, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	txs, err := s.repo.GetMany(ctx, req.Ids)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int64]entity.Transaction, len(txs))
+	for _, tx := range txs {
+		found[tx.Id] = tx
+	}
+
+	var ownerUUID uuid.UUID
+	if req.OwnerId != "" {
+		ownerUUID = uuid.MustParse(req.OwnerId)
+	}
+
+	// the transactions of other users are reported as missing, so that their existence is not revealed
+	result := make([]Transaction, 0, len(req.Ids))
+	var missing []string
+	for _, id := range req.Ids {
+		tx, ok := found[id]
+		if ok && ownerUUID != uuid.Nil {
+			ok = tx.SenderId == ownerUUID || tx.RecipientId == ownerUUID
+		}
+		if !ok {
+			missing = append(missing, strconv.FormatInt(id, 10))
+			continue
+		}
+		result = append(result, Transaction{tx})
+	}
+
+	switch {
+	case len(missing) == 1:
+		return nil, errors.NotFound(fmt.Sprintf("Transaction %s is not found.", missing[0]))
+	case len(missing) > 1:
+		return nil, errors.NotFound(fmt.Sprintf("Transactions %s are not found.", strings.Join(missing, ", ")))
+	}
+	return result, nil
 }
 
 func (s service) CreateUpdateTransaction(ctx context.Context, req requests.UpdateBalanceRequest) (Transaction, error) {
@@ -42,10 +166,18 @@ func (s service) CreateUpdateTransaction(ctx context.Context, req requests.Updat
 		return Transaction{}, err
 	}
 
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+
 	ownerUUID := uuid.MustParse(req.OwnerId)
 	tx := entity.Transaction{
+		Currency:        req.Currency,
 		Description:     req.Description,
+		Metadata:        req.Metadata,
+		Tags:            req.Tags,
 		TransactionDate: time.Now().UTC(),
+		Status:          initialStatus(req.Pending),
 	}
 	if req.Amount < 0 {
 		tx.SenderId = ownerUUID
@@ -55,48 +187,412 @@ func (s service) CreateUpdateTransaction(ctx context.Context, req requests.Updat
 		tx.Amount = req.Amount
 	}
 
-	err := s.repo.Create(ctx, &tx)
-	if err != nil {
+	if err := s.create(ctx, &tx); err != nil {
 		return Transaction{}, err
 	}
-	return Transaction{tx}, err
+	return Transaction{tx}, nil
 }
 
-func (s service) CreateTransferTransaction(ctx context.Context, req requests.TransferRequest) (Transaction, error) {
+func (s service) CreateTransferTransaction(ctx context.Context, req requests.TransferRequest, rate float64) (Transaction, error) {
 	if err := req.Validate(); err != nil {
 		return Transaction{}, err
 	}
 
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+	if req.RecipientCurrency == "" {
+		req.RecipientCurrency = req.Currency
+	}
+
 	senderUUID, recipientUUID := uuid.MustParse(req.SenderId), uuid.MustParse(req.RecipientId)
 	tx := entity.Transaction{
 		Id:              0, // will be auto-incremented
 		SenderId:        senderUUID,
 		RecipientId:     recipientUUID,
 		Amount:          req.Amount,
+		Currency:        req.Currency,
 		Description:     req.Description,
+		Metadata:        req.Metadata,
+		Tags:            req.Tags,
 		TransactionDate: time.Now().UTC(),
+		Status:          initialStatus(req.Pending),
+	}
+	if req.RecipientCurrency != req.Currency {
+		if rate <= 0 {
+			return Transaction{}, fmt.Errorf("transaction: invalid exchange rate %v from %s to %s", rate, req.Currency, req.RecipientCurrency)
+		}
+		tx.RecipientCurrency = req.RecipientCurrency
+		tx.RecipientAmount = s.rounding.Round(money.Convert(req.Amount, req.Currency, req.RecipientCurrency, money.Rate64(rate)))
+		tx.ExchangeRate = rate
+		if tx.RecipientAmount == 0 {
+			return Transaction{}, errors.BadRequest("Transfer amount is too small to be converted.")
+		}
 	}
 
-	err := s.repo.Create(ctx, &tx)
+	if err := s.create(ctx, &tx); err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{tx}, nil
+}
+
+// initialStatus returns the status of a new Transaction.
+func initialStatus(pending bool) string {
+	if pending {
+		return entity.TransactionPending
+	}
+	return entity.TransactionCompleted
+}
+
+// create saves the new Transaction and starts its status history.
+func (s service) create(ctx context.Context, tx *entity.Transaction) error {
+	if err := s.repo.Create(ctx, tx); err != nil {
+		return err
+	}
+	return s.repo.CreateStatusChange(ctx, &entity.TransactionStatusChange{
+		TransactionId: tx.Id,
+		Status:        tx.Status,
+		ChangedAt:     tx.TransactionDate,
+	})
+}
+
+// setStatus changes the status of the Transaction and records the change in its status history.
+func (s service) setStatus(ctx context.Context, tx *entity.Transaction, status, reason string, changedAt time.Time) error {
+	change := entity.TransactionStatusChange{
+		TransactionId:  tx.Id,
+		PreviousStatus: tx.Status,
+		Status:         status,
+		Reason:         reason,
+		ChangedAt:      changedAt,
+	}
+	tx.Status = status
+	if err := s.repo.Update(ctx, *tx); err != nil {
+		return err
+	}
+	if err := s.repo.CreateStatusChange(ctx, &change); err != nil {
+		return err
+	}
+
+	s.logger.With(ctx).Infof("status of transaction %d changed from %s to %s: %s", tx.Id, change.PreviousStatus, status, reason)
+	return nil
+}
+
+// lockPending locks the Transaction with the given id, which must be pending, and returns it.
+func (s service) lockPending(ctx context.Context, id int64) (entity.Transaction, error) {
+	tx, err := s.repo.Lock(ctx, id)
+	if err != nil {
+		return entity.Transaction{}, err
+	}
+	if tx.Status != entity.TransactionPending {
+		return entity.Transaction{}, errors.Conflict(fmt.Sprintf("Transaction is %s, only pending transactions can be completed or failed.", tx.Status))
+	}
+	return tx, nil
+}
+
+func (s service) Complete(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (Transaction, error) {
+	if err := req.Validate(); err != nil {
+		return Transaction{}, err
+	}
+
+	tx, err := s.lockPending(ctx, id)
 	if err != nil {
 		return Transaction{}, err
 	}
-	return Transaction{tx}, err
+	// the money is moved now, so the transaction is dated by its completion
+	tx.TransactionDate = time.Now().UTC()
+	if err = s.setStatus(ctx, &tx, entity.TransactionCompleted, req.Reason, tx.TransactionDate); err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{tx}, nil
 }
 
-func (s service) GetHistory(ctx context.Context, req requests.GetHistoryRequest) ([]entity.Transaction, error) {
+func (s service) Fail(ctx context.Context, id int64, req requests.ChangeTransactionStatusRequest) (Transaction, error) {
 	if err := req.Validate(); err != nil {
+		return Transaction{}, err
+	}
+
+	tx, err := s.lockPending(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if err = s.setStatus(ctx, &tx, entity.TransactionFailed, req.Reason, time.Now().UTC()); err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{tx}, nil
+}
+
+func (s service) StatusHistory(ctx context.Context, id int64) ([]entity.TransactionStatusChange, error) {
+	if _, err := s.repo.Get(ctx, id); err != nil {
 		return nil, err
 	}
+	changes, err := s.repo.StatusChanges(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if changes == nil {
+		changes = []entity.TransactionStatusChange{}
+	}
+	return changes, nil
+}
 
-	// if limit not specified, set equal to -1(meaning no limit in SQL)
-	if req.Limit == 0 {
-		req.Limit = -1
+func (s service) CreateReversalTransaction(ctx context.Context, id int64, req requests.ReverseRequest) (Transaction, error) {
+	if err := req.Validate(); err != nil {
+		return Transaction{}, err
+	}
+
+	// the original Transaction stays locked until the end of the DB transaction, so that concurrent partial reversals
+	// can't refund more than it moved
+	original, err := s.repo.Lock(ctx, id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if original.ReversalOf != 0 {
+		return Transaction{}, errors.Conflict("Reversal transaction can't be reversed.")
+	}
+	if original.Remaining() == 0 {
+		return Transaction{}, errors.Conflict("Transaction is already fully reversed.")
+	}
+	if original.Status != entity.TransactionCompleted {
+		return Transaction{}, errors.Conflict(fmt.Sprintf("Transaction is %s, only completed transactions can be reversed.", original.Status))
+	}
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = original.Remaining()
+	}
+	if amount > original.Remaining() {
+		return Transaction{}, errors.BadRequest("Reversal amount exceeds the remaining amount of the transaction.")
+	}
+
+	description := req.Description
+	if description == "" {
+		description = fmt.Sprintf("Reversal of transaction %d", original.Id)
+	}
+
+	// money goes back from the original recipient to the original sender
+	tx := entity.Transaction{
+		SenderId:        original.RecipientId,
+		RecipientId:     original.SenderId,
+		Amount:          amount,
+		Currency:        original.Currency,
+		Description:     description,
+		TransactionDate: time.Now().UTC(),
+		Status:          entity.TransactionCompleted,
+		ReversalOf:      original.Id,
+	}
+	// a converted amount goes back at the originally applied rate
+	if original.RecipientCurrency != "" {
+		tx.Currency = original.RecipientCurrency
+		tx.Amount = s.rounding.Round(money.Convert(amount, original.Currency, original.RecipientCurrency, money.Rate64(original.ExchangeRate)))
+		tx.RecipientCurrency = original.Currency
+		tx.RecipientAmount = amount
+		tx.ExchangeRate = 1 / original.ExchangeRate
+		if tx.Amount == 0 {
+			return Transaction{}, errors.BadRequest("Reversal amount is too small to be converted.")
+		}
+	}
+	if err = s.create(ctx, &tx); err != nil {
+		return Transaction{}, err
+	}
+
+	original.ReversedAmount += amount
+	if original.Remaining() == 0 {
+		reason := fmt.Sprintf("Reversed by transaction %d", tx.Id)
+		err = s.setStatus(ctx, &original, entity.TransactionReversed, reason, tx.TransactionDate)
+	} else {
+		err = s.repo.Update(ctx, original)
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{tx}, nil
+}
+
+func (s service) Outgoing(ctx context.Context, ownerId uuid.UUID, since time.Time) ([]OutgoingTotal, error) {
+	return s.repo.Outgoing(ctx, ownerId, since)
+}
+
+func (s service) Pending(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error) {
+	return s.repo.Pending(ctx, ownerId, currency)
+}
+
+func (s service) RecordBalances(ctx context.Context, tx entity.Transaction) error {
+	return s.repo.Update(ctx, tx)
+}
+
+// BackfillBalances replays the transaction log in the order of ids, starting from zero balance of every deposit.
+// Transactions which already have the balances are only checked against the replayed ones.
+// Pending and failed transactions have not changed the balances, so they are skipped.
+func (s service) BackfillBalances(ctx context.Context) (int64, error) {
+	type account struct {
+		ownerId  uuid.UUID
+		currency string
+	}
+	balances := make(map[account]int64)
+	var updated int64
+
+	err := s.repo.Each(ctx, func(tx entity.Transaction) error {
+		if !tx.Settled() {
+			return nil
+		}
+		changed := false
+		if tx.SenderId != uuid.Nil {
+			a := account{tx.SenderId, tx.Currency}
+			balances[a] -= tx.Amount
+			if balance := balances[a]; tx.SenderBalanceAfter == nil {
+				tx.SenderBalanceAfter = &balance
+				changed = true
+			} else if *tx.SenderBalanceAfter != balance {
+				s.logger.With(ctx).Errorf("transaction %d: stored sender balance %d differs from the replayed %d",
+					tx.Id, *tx.SenderBalanceAfter, balance)
+			}
+		}
+		if tx.RecipientId != uuid.Nil {
+			currency, amount := tx.Credited()
+			a := account{tx.RecipientId, currency}
+			balances[a] += amount
+			if balance := balances[a]; tx.RecipientBalanceAfter == nil {
+				tx.RecipientBalanceAfter = &balance
+				changed = true
+			} else if *tx.RecipientBalanceAfter != balance {
+				s.logger.With(ctx).Errorf("transaction %d: stored recipient balance %d differs from the replayed %d",
+					tx.Id, *tx.RecipientBalanceAfter, balance)
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+		updated++
+		return s.repo.Update(ctx, tx)
+	})
+	return updated, err
+}
+
+// encodeCursor returns the opaque token representing the Cursor.
+func encodeCursor(c Cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses the token created by encodeCursor.
+func decodeCursor(token string) (Cursor, error) {
+	var c Cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+func (s service) GetHistory(ctx context.Context, req requests.GetHistoryRequest) (History, error) {
+	if err := req.Validate(); err != nil {
+		return History{}, err
+	}
+
+	if req.OrderBy == "" {
+		req.OrderBy = "transaction_date"
+	}
+	if req.OrderDirection == "" {
+		req.OrderDirection = "ASC"
+	}
+	var after *Cursor
+	if req.Cursor != "" {
+		c, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return History{}, errors.BadRequest("Invalid cursor.")
+		}
+		if c.OrderBy != req.OrderBy || c.OrderDirection != req.OrderDirection {
+			return History{}, errors.BadRequest("Cursor does not match the requested order.")
+		}
+		after = &c
+	}
+
+	// one more transaction is requested to find out whether there are more of them;
+	// if limit not specified, it is equal to -1 (meaning no limit in SQL)
+	limit := -1
+	if req.Limit > 0 {
+		limit = req.Limit + 1
 	}
 
 	ownerUUID := uuid.MustParse(req.OwnerId)
+	filter := HistoryFilter{
+		Types:       req.Types,
+		Statuses:    req.Statuses,
+		MinAmount:   req.MinAmount,
+		MaxAmount:   req.MaxAmount,
+		Description: req.Description,
+		Tags:        req.Tags,
+		Metadata:    req.Metadata,
+	}
+	// dates and counterparty are already validated, transaction dates are stored in UTC
+	if req.DateFrom != "" {
+		from, _ := time.Parse(time.RFC3339, req.DateFrom)
+		filter.From = from.UTC()
+	}
+	if req.DateTo != "" {
+		to, _ := time.Parse(time.RFC3339, req.DateTo)
+		filter.To = to.UTC()
+	}
+	if req.CounterpartyId != "" {
+		filter.CounterpartyId = uuid.MustParse(req.CounterpartyId)
+	}
+
+	txs, err := s.repo.GetForUser(ctx, ownerUUID, filter, req.OrderBy, req.OrderDirection, after, req.Offset, limit)
+	if err != nil {
+		return History{}, err
+	}
+
+	history := History{Transactions: make([]HistoryItem, 0, len(txs))}
+	for _, tx := range txs {
+		// an exchange between user's own deposits is shown with the balance of the deposit it is credited to
+		currency := tx.Currency
+		if tx.RecipientId == ownerUUID {
+			currency, _ = tx.Credited()
+		}
+		history.Transactions = append(history.Transactions, HistoryItem{Transaction: tx, BalanceAfter: tx.BalanceAfter(ownerUUID, currency)})
+	}
+	if req.Limit > 0 && len(txs) > req.Limit {
+		history.Transactions = history.Transactions[:req.Limit]
+		history.HasMore = true
 
-	return s.repo.GetForUser(ctx, ownerUUID, req.OrderBy, req.OrderDirection, req.Offset, req.Limit)
+		last := txs[req.Limit-1]
+		next := Cursor{OrderBy: req.OrderBy, OrderDirection: req.OrderDirection, Id: last.Id}
+		if req.OrderBy == "amount" {
+			next.Amount = last.Amount
+		} else {
+			next.TransactionDate = last.TransactionDate
+		}
+		history.NextCursor = encodeCursor(next)
+	}
+	return history, nil
+}
+
+func (s service) EachForUser(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, f func(tx entity.Transaction) error) error {
+	return s.repo.EachForUser(ctx, ownerId, currency, from, to, f)
+}
+
+func (s service) GetAnalytics(ctx context.Context, req requests.AnalyticsRequest) (Analytics, error) {
+	if err := req.Validate(); err != nil {
+		return Analytics{}, err
+	}
+
+	if req.Currency == "" {
+		req.Currency = entity.DefaultCurrency
+	}
+	// dates are already validated, the last day is included
+	from, _ := time.Parse(requests.DateLayout, req.DateFrom)
+	to, _ := time.Parse(requests.DateLayout, req.DateTo)
+
+	buckets, err := s.repo.Analytics(ctx, uuid.MustParse(req.OwnerId), req.Currency, from, to.AddDate(0, 0, 1), req.Interval, req.GroupBy)
+	if err != nil {
+		return Analytics{}, err
+	}
+	if buckets == nil {
+		buckets = []AnalyticsBucket{}
+	}
+	return Analytics{Currency: req.Currency, Interval: req.Interval, GroupBy: req.GroupBy, Buckets: buckets}, nil
 }
 
 func (s service) Count(ctx context.Context) (int64, error) {
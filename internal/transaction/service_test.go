@@ -2,13 +2,18 @@ package transaction
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"users-balance-microservice/internal/entity"
+	apperrors "users-balance-microservice/internal/errors"
+	"users-balance-microservice/internal/money"
 	"users-balance-microservice/internal/requests"
 	"users-balance-microservice/pkg/log"
 )
@@ -21,7 +26,7 @@ var (
 
 func TestService_CreateUpdateTransaction(t *testing.T) {
 	id1 := uuid.New()
-	s := NewService(&mockTransactionRepository{}, logger)
+	s := NewService(&mockTransactionRepository{}, money.RoundHalfEven, logger)
 
 	// initial count
 	count, err := s.Count(ctx)
@@ -39,6 +44,7 @@ func TestService_CreateUpdateTransaction(t *testing.T) {
 		assert.Equal(t, uuid.Nil, tx.SenderId)
 		assert.Equal(t, id1, tx.RecipientId)
 		assert.EqualValues(t, 1000, tx.Amount)
+		assert.Equal(t, entity.DefaultCurrency, tx.Currency)
 		assert.Equal(t, "visa top-up", tx.Description)
 
 		count2, err := s.Count(ctx)
@@ -67,6 +73,27 @@ func TestService_CreateUpdateTransaction(t *testing.T) {
 		}
 	}
 
+	// success with metadata and tags
+	tx, err = s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{
+		OwnerId:  id1.String(),
+		Amount:   500,
+		Metadata: map[string]string{"invoice_id": "INV-1"},
+		Tags:     []string{"cashback", "promo"},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.Metadata{"invoice_id": "INV-1"}, tx.Metadata)
+		assert.Equal(t, entity.Tags{"cashback", "promo"}, tx.Tags)
+		count++
+	}
+
+	// fail too many tags
+	_, err = s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{
+		OwnerId: id1.String(),
+		Amount:  500,
+		Tags:    make([]string, requests.MaxTags+1),
+	})
+	assert.Error(t, err)
+
 	// fail invalid ownerId
 	tx, err = s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{
 		OwnerId:     "1234-5678-9",
@@ -96,7 +123,7 @@ func TestService_CreateUpdateTransaction(t *testing.T) {
 
 func TestService_CreateTransferTransaction(t *testing.T) {
 	id1, id2 := uuid.New(), uuid.New()
-	s := NewService(&mockTransactionRepository{}, logger)
+	s := NewService(&mockTransactionRepository{}, money.RoundHalfEven, logger)
 
 	// initial count
 	count, err := s.Count(ctx)
@@ -110,11 +137,13 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 		RecipientId: id2.String(),
 		Amount:      1000,
 		Description: "thanks for dinner!",
-	})
+	}, 1)
 	if assert.NoError(t, err) {
 		assert.Equal(t, id1, tx.SenderId)
 		assert.Equal(t, id2, tx.RecipientId)
 		assert.EqualValues(t, 1000, tx.Amount)
+		assert.Equal(t, entity.DefaultCurrency, tx.Currency)
+		assert.Empty(t, tx.RecipientCurrency)
 		assert.Equal(t, "thanks for dinner!", tx.Description)
 
 		count2, err := s.Count(ctx)
@@ -130,7 +159,7 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 		RecipientId: id2.String(),
 		Amount:      1000,
 		Description: "",
-	})
+	}, 1)
 	if assert.NoError(t, err) {
 		assert.Equal(t, id1, tx.SenderId)
 		assert.Equal(t, id2, tx.RecipientId)
@@ -144,13 +173,68 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 		}
 	}
 
+	// success cross-currency
+	tx, err = s.CreateTransferTransaction(ctx, requests.TransferRequest{
+		SenderId:          id1.String(),
+		RecipientId:       id2.String(),
+		Amount:            1000,
+		Currency:          "USD",
+		RecipientCurrency: "RUB",
+	}, 75.5)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, tx.Amount)
+		assert.Equal(t, "USD", tx.Currency)
+		assert.Equal(t, "RUB", tx.RecipientCurrency)
+		assert.EqualValues(t, 75500, tx.RecipientAmount)
+		assert.Equal(t, 75.5, tx.ExchangeRate)
+		count++
+	}
+
+	// success cross-currency, minor units of the currencies are respected: 10.00 RUB at 1.5 JPY per RUB
+	tx, err = s.CreateTransferTransaction(ctx, requests.TransferRequest{
+		SenderId:          id1.String(),
+		RecipientId:       id2.String(),
+		Amount:            1000,
+		Currency:          "RUB",
+		RecipientCurrency: "JPY",
+	}, 1.5)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 15, tx.RecipientAmount)
+		count++
+	}
+
+	// success cross-currency, halves are rounded with the rounding mode: 1.50 and 2.50 RUB at 1 JPY per RUB
+	for amount, expected := range map[int64]int64{150: 2, 250: 2} {
+		tx, err = s.CreateTransferTransaction(ctx, requests.TransferRequest{
+			SenderId:          id1.String(),
+			RecipientId:       id2.String(),
+			Amount:            amount,
+			Currency:          "RUB",
+			RecipientCurrency: "JPY",
+		}, 1)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, expected, tx.RecipientAmount)
+			count++
+		}
+	}
+
+	// fail converted amount rounds to zero
+	tx, err = s.CreateTransferTransaction(ctx, requests.TransferRequest{
+		SenderId:          id1.String(),
+		RecipientId:       id2.String(),
+		Amount:            1,
+		Currency:          "RUB",
+		RecipientCurrency: "USD",
+	}, 0.01)
+	assert.Error(t, err)
+
 	// fail negative amount
 	tx, err = s.CreateTransferTransaction(ctx, requests.TransferRequest{
 		SenderId:    id1.String(),
 		RecipientId: id2.String(),
 		Amount:      -1000,
 		Description: "hacker attack!",
-	})
+	}, 1)
 	if assert.Error(t, err) {
 		count2, err := s.Count(ctx)
 		if assert.NoError(t, err) {
@@ -164,7 +248,7 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 		RecipientId: id2.String(),
 		Amount:      1000,
 		Description: "hacker attack!",
-	})
+	}, 1)
 	if assert.Error(t, err) {
 		count2, err := s.Count(ctx)
 		if assert.NoError(t, err) {
@@ -178,7 +262,7 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 		RecipientId: "",
 		Amount:      1000,
 		Description: "hacker attack!",
-	})
+	}, 1)
 	if assert.Error(t, err) {
 		count2, err := s.Count(ctx)
 		if assert.NoError(t, err) {
@@ -192,7 +276,7 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 		RecipientId: id2.String(),
 		Amount:      1000,
 		Description: strings.Repeat("test", 100),
-	})
+	}, 1)
 	if assert.Error(t, err) {
 		count2, err := s.Count(ctx)
 		if assert.NoError(t, err) {
@@ -206,7 +290,7 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 		RecipientId: id2.String(),
 		Amount:      1000,
 		Description: "",
-	})
+	}, 1)
 	if assert.Error(t, err) {
 		count2, err := s.Count(ctx)
 		if assert.NoError(t, err) {
@@ -215,6 +299,230 @@ func TestService_CreateTransferTransaction(t *testing.T) {
 	}
 }
 
+func TestService_Get(t *testing.T) {
+	id1 := uuid.New()
+	s := NewService(&mockTransactionRepository{}, money.RoundHalfEven, logger)
+
+	created, err := s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 1000})
+	assert.NoError(t, err)
+
+	// success
+	tx, err := s.Get(ctx, created.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, created, tx)
+	}
+
+	// fail not found
+	_, err = s.Get(ctx, 100)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestService_GetMany(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	s := NewService(&mockTransactionRepository{}, money.RoundHalfEven, logger)
+
+	topUp, err := s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: 1000})
+	assert.NoError(t, err)
+	transfer, err := s.CreateTransferTransaction(ctx, requests.TransferRequest{SenderId: id1.String(), RecipientId: id2.String(), Amount: 300}, 1)
+	assert.NoError(t, err)
+
+	// success in the requested order
+	txs, err := s.GetMany(ctx, requests.GetTransactionsRequest{Ids: []int64{transfer.Id, topUp.Id}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Transaction{transfer, topUp}, txs)
+	}
+
+	// success the owner is a party
+	txs, err = s.GetMany(ctx, requests.GetTransactionsRequest{Ids: []int64{transfer.Id}, OwnerId: id2.String()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Transaction{transfer}, txs)
+	}
+
+	// fail the owner is not a party
+	_, err = s.GetMany(ctx, requests.GetTransactionsRequest{Ids: []int64{topUp.Id, transfer.Id}, OwnerId: id2.String()})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusNotFound, err.(apperrors.ErrorResponse).StatusCode())
+	}
+
+	// fail not found
+	_, err = s.GetMany(ctx, requests.GetTransactionsRequest{Ids: []int64{topUp.Id, 100, 101}})
+	if assert.Error(t, err) {
+		assert.Equal(t, "Transactions 100, 101 are not found.", err.Error())
+	}
+
+	// fail invalid request
+	_, err = s.GetMany(ctx, requests.GetTransactionsRequest{Ids: []int64{topUp.Id}, OwnerId: "123-456-789"})
+	assert.Error(t, err)
+}
+
+func TestService_CreateReversalTransaction(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	s := NewService(&mockTransactionRepository{}, money.RoundHalfEven, logger)
+
+	original, err := s.CreateTransferTransaction(ctx, requests.TransferRequest{
+		SenderId:    id1.String(),
+		RecipientId: id2.String(),
+		Amount:      1000,
+	}, 1)
+	assert.NoError(t, err)
+
+	// partial reversal
+	tx, err := s.CreateReversalTransaction(ctx, original.Id, requests.ReverseRequest{Amount: 400})
+	if assert.NoError(t, err) {
+		assert.Equal(t, id2, tx.SenderId)
+		assert.Equal(t, id1, tx.RecipientId)
+		assert.EqualValues(t, 400, tx.Amount)
+		assert.Equal(t, original.Id, tx.ReversalOf)
+		assert.NotEmpty(t, tx.Description)
+
+		original, _ = s.Get(ctx, original.Id)
+		assert.EqualValues(t, 400, original.ReversedAmount)
+	}
+
+	// fail amount exceeds remaining
+	_, err = s.CreateReversalTransaction(ctx, original.Id, requests.ReverseRequest{Amount: 700})
+	assert.Error(t, err)
+
+	// fail reversing a reversal
+	_, err = s.CreateReversalTransaction(ctx, tx.Id, requests.ReverseRequest{})
+	assert.Error(t, err)
+
+	// reverse the rest
+	tx, err = s.CreateReversalTransaction(ctx, original.Id, requests.ReverseRequest{Description: "refund"})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 600, tx.Amount)
+		assert.Equal(t, "refund", tx.Description)
+
+		original, _ = s.Get(ctx, original.Id)
+		assert.EqualValues(t, 1000, original.ReversedAmount)
+		assert.Equal(t, entity.TransactionReversed, original.Status)
+	}
+
+	// fail already fully reversed
+	_, err = s.CreateReversalTransaction(ctx, original.Id, requests.ReverseRequest{})
+	assert.Error(t, err)
+
+	// fail not found
+	_, err = s.CreateReversalTransaction(ctx, 100, requests.ReverseRequest{})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// fail invalid request
+	_, err = s.CreateReversalTransaction(ctx, original.Id, requests.ReverseRequest{Amount: -1})
+	assert.Error(t, err)
+
+	// fail pending transaction
+	pending, err := s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -100, Pending: true})
+	assert.NoError(t, err)
+	_, err = s.CreateReversalTransaction(ctx, pending.Id, requests.ReverseRequest{})
+	assert.Error(t, err)
+
+	// cross-currency transfer is reversed at the originally applied rate
+	original, err = s.CreateTransferTransaction(ctx, requests.TransferRequest{
+		SenderId:          id1.String(),
+		RecipientId:       id2.String(),
+		Amount:            100,
+		Currency:          "USD",
+		RecipientCurrency: "RUB",
+	}, 75)
+	assert.NoError(t, err)
+	tx, err = s.CreateReversalTransaction(ctx, original.Id, requests.ReverseRequest{Amount: 40})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "RUB", tx.Currency)
+		assert.EqualValues(t, 3000, tx.Amount)
+		assert.Equal(t, "USD", tx.RecipientCurrency)
+		assert.EqualValues(t, 40, tx.RecipientAmount)
+
+		original, _ = s.Get(ctx, original.Id)
+		assert.EqualValues(t, 40, original.ReversedAmount)
+	}
+
+	// minor units of the currencies are respected: 5 JPY at 0.55 RUB per JPY
+	original, err = s.CreateTransferTransaction(ctx, requests.TransferRequest{
+		SenderId:          id1.String(),
+		RecipientId:       id2.String(),
+		Amount:            1000,
+		Currency:          "JPY",
+		RecipientCurrency: "RUB",
+	}, 0.55)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 55000, original.RecipientAmount)
+	}
+	tx, err = s.CreateReversalTransaction(ctx, original.Id, requests.ReverseRequest{Amount: 5})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "RUB", tx.Currency)
+		assert.EqualValues(t, 275, tx.Amount)
+		assert.EqualValues(t, 5, tx.RecipientAmount)
+	}
+}
+
+func TestService_ChangeStatus(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	s := NewService(&mockTransactionRepository{}, money.RoundHalfEven, logger)
+
+	pending, err := s.CreateTransferTransaction(ctx, requests.TransferRequest{
+		SenderId:    id1.String(),
+		RecipientId: id2.String(),
+		Amount:      1000,
+		Pending:     true,
+	}, 1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionPending, pending.Status)
+	}
+	amount, err := s.Pending(ctx, id1, entity.DefaultCurrency)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, amount)
+	}
+
+	// success complete
+	tx, err := s.Complete(ctx, pending.Id, requests.ChangeTransactionStatusRequest{Reason: "confirmed"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionCompleted, tx.Status)
+		assert.False(t, tx.TransactionDate.Before(pending.TransactionDate))
+	}
+	amount, _ = s.Pending(ctx, id1, entity.DefaultCurrency)
+	assert.Zero(t, amount)
+
+	// fail not pending anymore
+	_, err = s.Complete(ctx, pending.Id, requests.ChangeTransactionStatusRequest{})
+	assert.Error(t, err)
+	_, err = s.Fail(ctx, pending.Id, requests.ChangeTransactionStatusRequest{})
+	assert.Error(t, err)
+
+	// success fail
+	pending, _ = s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -300, Pending: true})
+	tx, err = s.Fail(ctx, pending.Id, requests.ChangeTransactionStatusRequest{Reason: "declined by the bank"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, entity.TransactionFailed, tx.Status)
+	}
+
+	// failed transactions are not counted towards spending limits
+	outgoing, err := s.Outgoing(ctx, id1, time.Time{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []OutgoingTotal{{Currency: entity.DefaultCurrency, Amount: 1000, Count: 1}}, outgoing)
+	}
+
+	// status history
+	changes, err := s.StatusHistory(ctx, pending.Id)
+	if assert.NoError(t, err) && assert.Len(t, changes, 2) {
+		assert.Equal(t, entity.TransactionPending, changes[0].Status)
+		assert.Empty(t, changes[0].PreviousStatus)
+		assert.Equal(t, entity.TransactionPending, changes[1].PreviousStatus)
+		assert.Equal(t, entity.TransactionFailed, changes[1].Status)
+		assert.Equal(t, "declined by the bank", changes[1].Reason)
+	}
+
+	// fail invalid request
+	pending, _ = s.CreateUpdateTransaction(ctx, requests.UpdateBalanceRequest{OwnerId: id1.String(), Amount: -300, Pending: true})
+	_, err = s.Fail(ctx, pending.Id, requests.ChangeTransactionStatusRequest{Reason: strings.Repeat("test", 100)})
+	assert.Error(t, err)
+
+	// fail not found
+	_, err = s.Complete(ctx, 100, requests.ChangeTransactionStatusRequest{})
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.StatusHistory(ctx, 100)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
 func TestService_GetHistory(t *testing.T) {
 	id1, id2 := uuid.New(), uuid.New()
 	txsList := []entity.Transaction{
@@ -224,42 +532,236 @@ func TestService_GetHistory(t *testing.T) {
 		{Id: 3, SenderId: uuid.Nil, RecipientId: id1, Amount: 4000, Description: "top-up"},
 		{Id: 4, SenderId: id1, RecipientId: uuid.Nil, Amount: 5000, Description: "withdrawal"},
 	}
-	s := NewService(&mockTransactionRepository{items: txsList}, logger)
+	repo := &mockTransactionRepository{items: txsList}
+	s := NewService(repo, money.RoundHalfEven, logger)
 
 	// success id1's transactions
-	txs, err := s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String()})
+	history, err := s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String()})
 	if assert.NoError(t, err) {
-		assert.Equal(t, txsList, txs)
+		assert.Equal(t, History{Transactions: []HistoryItem{
+			{Transaction: txsList[0]}, {Transaction: txsList[1]}, {Transaction: txsList[2]}, {Transaction: txsList[3]}, {Transaction: txsList[4]},
+		}}, history)
 	}
 
 	// success id2's transactions
-	txs, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id2.String()})
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id2.String()})
 	if assert.NoError(t, err) {
-		assert.Equal(t, txsList[:3], txs)
+		assert.Equal(t, History{Transactions: []HistoryItem{{Transaction: txsList[0]}, {Transaction: txsList[1]}, {Transaction: txsList[2]}}}, history)
 	}
 
-	// success id2's transactions
-	txs, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id2.String()})
+	// success no transactions -> empty list, not null
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: uuid.NewString()})
 	if assert.NoError(t, err) {
-		assert.Equal(t, txsList[:3], txs)
+		assert.Equal(t, History{Transactions: []HistoryItem{}}, history)
 	}
 
+	// success id1's transactions page by page
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), Limit: 3, OrderBy: "amount"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []HistoryItem{{Transaction: txsList[0]}, {Transaction: txsList[1]}, {Transaction: txsList[2]}}, history.Transactions)
+		assert.True(t, history.HasMore)
+		assert.NotEmpty(t, history.NextCursor)
+	}
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), Limit: 3, OrderBy: "amount", Cursor: history.NextCursor})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Cursor{OrderBy: "amount", OrderDirection: "ASC", Amount: 3000, Id: 2}, repo.lastCursor)
+		assert.Equal(t, History{Transactions: []HistoryItem{{Transaction: txsList[3]}, {Transaction: txsList[4]}}}, history)
+	}
+
+	// fail cursor of another order
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), Limit: 3})
+	if assert.NoError(t, err) {
+		_, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), OrderDirection: "DESC", Cursor: history.NextCursor})
+		assert.Error(t, err)
+	}
+
+	// fail malformed cursor
+	_, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), Cursor: "not a cursor"})
+	assert.Error(t, err)
+
+	// filter is passed to the repository
+	_, err = s.GetHistory(ctx, requests.GetHistoryRequest{
+		OwnerId:        id1.String(),
+		DateFrom:       "2021-11-01T03:00:00+03:00",
+		DateTo:         "2021-11-30T00:00:00Z",
+		Types:          []string{entity.TransactionIncomingTransfer},
+		CounterpartyId: id2.String(),
+		MinAmount:      100,
+		MaxAmount:      5000,
+		Description:    "transfer",
+		Tags:           []string{"gift"},
+		Metadata:       map[string]string{"order_id": "42"},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, HistoryFilter{
+			From:           time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+			To:             time.Date(2021, 11, 30, 0, 0, 0, 0, time.UTC),
+			Types:          []string{entity.TransactionIncomingTransfer},
+			CounterpartyId: id2,
+			MinAmount:      100,
+			MaxAmount:      5000,
+			Description:    "transfer",
+			Tags:           []string{"gift"},
+			Metadata:       map[string]string{"order_id": "42"},
+		}, repo.lastFilter)
+	}
+
+	// fail invalid filter
+	_, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), Types: []string{"refund"}})
+	assert.Error(t, err)
+
 	// fail invalid OwnerId
-	txs, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: "123-456-789"})
+	_, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: "123-456-789"})
 	assert.Error(t, err)
 
 	// fail invalid limit and offset
-	txs, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), Limit: -1, Offset: -1})
+	_, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String(), Limit: -1, Offset: -1})
 	assert.Error(t, err)
 
 	// fail database error
-	txs, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: "11111111-1111-1111-1111-111111111111"})
+	_, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: "11111111-1111-1111-1111-111111111111"})
 	assert.Error(t, err)
 }
 
+func TestService_GetAnalytics(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	day1 := time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)
+	day2 := time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC)
+	repo := &mockTransactionRepository{items: []entity.Transaction{
+		{Id: 1, RecipientId: id1, Amount: 1000, Currency: "RUB", TransactionDate: day1},
+		{Id: 2, SenderId: id1, RecipientId: id2, Amount: 300, Currency: "RUB", TransactionDate: day1},
+		{Id: 3, SenderId: id2, RecipientId: id1, Amount: 10, Currency: "USD", RecipientCurrency: "RUB", RecipientAmount: 700, TransactionDate: day2},
+		{Id: 4, SenderId: id1, Amount: 50, Currency: "USD", TransactionDate: day2},
+		{Id: 5, RecipientId: id1, Amount: 100, Currency: "RUB", TransactionDate: day2.AddDate(0, 0, 1)},
+	}}
+	s := NewService(repo, money.RoundHalfEven, logger)
+
+	// success, the last day is included
+	analytics, err := s.GetAnalytics(ctx, requests.AnalyticsRequest{OwnerId: id1.String(), DateFrom: "2021-11-01", DateTo: "2021-11-02", Interval: "day"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, Analytics{
+			Currency: entity.DefaultCurrency,
+			Interval: "day",
+			Buckets: []AnalyticsBucket{
+				{PeriodStart: day1.Truncate(24 * time.Hour), IncomingAmount: 1000, IncomingCount: 1, OutgoingAmount: 300, OutgoingCount: 1},
+				{PeriodStart: day2.Truncate(24 * time.Hour), IncomingAmount: 700, IncomingCount: 1},
+			},
+		}, analytics)
+	}
+
+	// success no transactions -> empty list, not null
+	analytics, err = s.GetAnalytics(ctx, requests.AnalyticsRequest{OwnerId: id2.String(), Currency: "EUR", DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "week", GroupBy: "tag"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, Analytics{Currency: "EUR", Interval: "week", GroupBy: "tag", Buckets: []AnalyticsBucket{}}, analytics)
+	}
+
+	// fail invalid request
+	_, err = s.GetAnalytics(ctx, requests.AnalyticsRequest{OwnerId: id1.String(), DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "year"})
+	assert.Error(t, err)
+
+	// fail database error
+	_, err = s.GetAnalytics(ctx, requests.AnalyticsRequest{OwnerId: "11111111-1111-1111-1111-111111111111", DateFrom: "2021-11-01", DateTo: "2021-11-30", Interval: "day"})
+	assert.Error(t, err)
+}
+
+func TestService_GetHistoryBalances(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	balance := func(v int64) *int64 { return &v }
+	txsList := []entity.Transaction{
+		{Id: 0, RecipientId: id1, Amount: 1000, Currency: "RUB", RecipientBalanceAfter: balance(1000)},
+		{Id: 1, SenderId: id1, RecipientId: id2, Amount: 300, Currency: "RUB", SenderBalanceAfter: balance(700), RecipientBalanceAfter: balance(300)},
+		{Id: 2, SenderId: id1, RecipientId: id1, Amount: 200, Currency: "RUB", RecipientCurrency: "USD", RecipientAmount: 3, ExchangeRate: 0.015,
+			SenderBalanceAfter: balance(500), RecipientBalanceAfter: balance(3)},
+	}
+	s := NewService(&mockTransactionRepository{items: txsList}, money.RoundHalfEven, logger)
+
+	// each party sees the balance of its own side, an exchange between own deposits is shown with the credited one
+	history, err := s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id1.String()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []HistoryItem{
+			{Transaction: txsList[0], BalanceAfter: balance(1000)},
+			{Transaction: txsList[1], BalanceAfter: balance(700)},
+			{Transaction: txsList[2], BalanceAfter: balance(3)},
+		}, history.Transactions)
+	}
+	history, err = s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id2.String()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []HistoryItem{{Transaction: txsList[1], BalanceAfter: balance(300)}}, history.Transactions)
+	}
+}
+
+func TestService_BackfillBalances(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	stored := int64(700)
+	repo := &mockTransactionRepository{items: []entity.Transaction{
+		{Id: 1, SenderId: uuid.Nil, RecipientId: id1, Amount: 1000, Currency: "RUB", Description: "top-up", Status: entity.TransactionCompleted},
+		{Id: 2, SenderId: id1, RecipientId: id2, Amount: 300, Currency: "RUB", Description: "transfer", SenderBalanceAfter: &stored, Status: entity.TransactionCompleted},
+		{Id: 3, SenderId: id2, RecipientId: id1, Amount: 200, Currency: "RUB", RecipientCurrency: "USD", RecipientAmount: 3, ExchangeRate: 0.015, Status: entity.TransactionCompleted},
+		{Id: 4, SenderId: id1, RecipientId: uuid.Nil, Amount: 500, Currency: "RUB", Description: "withdrawal", Status: entity.TransactionCompleted},
+		{Id: 5, SenderId: id1, RecipientId: uuid.Nil, Amount: 100, Currency: "RUB", Description: "pending withdrawal", Status: entity.TransactionPending},
+	}}
+	s := NewService(repo, money.RoundHalfEven, logger)
+
+	balance := func(v int64) *int64 { return &v }
+
+	// success only missing balances are computed
+	updated, err := s.BackfillBalances(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 4, updated)
+		assert.Nil(t, repo.items[0].SenderBalanceAfter)
+		assert.Equal(t, balance(1000), repo.items[0].RecipientBalanceAfter)
+		assert.Equal(t, balance(700), repo.items[1].SenderBalanceAfter)
+		assert.Equal(t, balance(300), repo.items[1].RecipientBalanceAfter)
+		assert.Equal(t, balance(100), repo.items[2].SenderBalanceAfter)
+		assert.Equal(t, balance(3), repo.items[2].RecipientBalanceAfter)
+		assert.Equal(t, balance(200), repo.items[3].SenderBalanceAfter)
+		assert.Nil(t, repo.items[3].RecipientBalanceAfter)
+		// pending transactions did not move money yet
+		assert.Nil(t, repo.items[4].SenderBalanceAfter)
+	}
+
+	// success nothing to backfill
+	updated, err = s.BackfillBalances(ctx)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0, updated)
+	}
+
+	// balances are shown from the owner's perspective
+	history, err := s.GetHistory(ctx, requests.GetHistoryRequest{OwnerId: id2.String()})
+	if assert.NoError(t, err) && assert.Len(t, history.Transactions, 2) {
+		assert.Equal(t, balance(300), history.Transactions[0].BalanceAfter)
+		assert.Equal(t, balance(100), history.Transactions[1].BalanceAfter)
+	}
+}
+
 type mockTransactionRepository struct {
 	items          []entity.Transaction
 	lastInsertedId int64
+	statusChanges  []entity.TransactionStatusChange
+	lastFilter     HistoryFilter
+	lastCursor     *Cursor
+}
+
+func (m *mockTransactionRepository) Get(ctx context.Context, id int64) (entity.Transaction, error) {
+	for _, tx := range m.items {
+		if tx.Id == id {
+			return tx, nil
+		}
+	}
+	return entity.Transaction{}, sql.ErrNoRows
+}
+
+func (m *mockTransactionRepository) GetMany(ctx context.Context, ids []int64) ([]entity.Transaction, error) {
+	var result []entity.Transaction
+	for _, tx := range m.items {
+		for _, id := range ids {
+			if tx.Id == id {
+				result = append(result, tx)
+				break
+			}
+		}
+	}
+	return result, nil
 }
 
 func (m *mockTransactionRepository) Create(ctx context.Context, tx *entity.Transaction) error {
@@ -271,15 +773,55 @@ func (m *mockTransactionRepository) Create(ctx context.Context, tx *entity.Trans
 		return databaseError
 	}
 
-	tx.Id = m.lastInsertedId
+	if tx.Status == "" {
+		tx.Status = entity.TransactionCompleted
+	}
+	if tx.CreatedAt.IsZero() {
+		tx.CreatedAt = tx.TransactionDate
+	}
+
+	// ids are auto-incremented starting from 1, like bigserial does
 	m.lastInsertedId++
+	tx.Id = m.lastInsertedId
 	m.items = append(m.items, *tx)
 	return nil
 }
 
-// Offset, limit and order are ignored for simplicity
-func (m *mockTransactionRepository) GetForUser(ctx context.Context, ownerId uuid.UUID, orderBy, orderDirection string, offset, limit int) ([]entity.Transaction, error) {
+func (m *mockTransactionRepository) Each(ctx context.Context, f func(tx entity.Transaction) error) error {
+	for _, tx := range m.items {
+		if err := f(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Currencies are listed in the order of their first transactions for simplicity.
+func (m *mockTransactionRepository) Outgoing(ctx context.Context, ownerId uuid.UUID, since time.Time) ([]OutgoingTotal, error) {
+	var result []OutgoingTotal
+	for _, tx := range m.items {
+		if tx.SenderId != ownerId || tx.RecipientId == ownerId || tx.ReversalOf != 0 || tx.Status == entity.TransactionFailed || tx.CreatedAt.Before(since) {
+			continue
+		}
+		i := 0
+		for i < len(result) && result[i].Currency != tx.Currency {
+			i++
+		}
+		if i == len(result) {
+			result = append(result, OutgoingTotal{Currency: tx.Currency})
+		}
+		result[i].Amount += tx.Amount
+		result[i].Count++
+	}
+	return result, nil
+}
+
+// Offset and order are ignored for simplicity: items are considered ordered by id.
+// Filter and cursor are recorded.
+func (m *mockTransactionRepository) GetForUser(ctx context.Context, ownerId uuid.UUID, filter HistoryFilter, orderBy, orderDirection string, after *Cursor, offset, limit int) ([]entity.Transaction, error) {
 	var result []entity.Transaction
+	m.lastFilter = filter
+	m.lastCursor = after
 
 	// simulate database error
 	if ownerId.String() == "11111111-1111-1111-1111-111111111111" {
@@ -287,14 +829,115 @@ func (m *mockTransactionRepository) GetForUser(ctx context.Context, ownerId uuid
 	}
 
 	for _, tx := range m.items {
+		if after != nil && tx.Id <= after.Id {
+			continue
+		}
 		if tx.SenderId == ownerId || tx.RecipientId == ownerId {
 			result = append(result, tx)
 		}
 	}
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result, nil
+}
 
+// Analytics sums up the transactions of the user by day, regardless of interval and grouping.
+func (m *mockTransactionRepository) Analytics(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, interval, groupBy string) ([]AnalyticsBucket, error) {
+	// simulate database error
+	if ownerId.String() == "11111111-1111-1111-1111-111111111111" {
+		return nil, databaseError
+	}
+
+	var result []AnalyticsBucket
+	for _, tx := range m.items {
+		if tx.TransactionDate.Before(from) || !tx.TransactionDate.Before(to) {
+			continue
+		}
+		creditCurrency, amount := tx.Credited()
+		incoming := tx.RecipientId == ownerId && creditCurrency == currency
+		outgoing := tx.SenderId == ownerId && tx.Currency == currency
+		if !incoming && !outgoing {
+			continue
+		}
+
+		day := tx.TransactionDate.Truncate(24 * time.Hour)
+		if len(result) == 0 || !result[len(result)-1].PeriodStart.Equal(day) {
+			result = append(result, AnalyticsBucket{PeriodStart: day})
+		}
+		bucket := &result[len(result)-1]
+		if incoming {
+			bucket.IncomingAmount += amount
+			bucket.IncomingCount++
+		}
+		if outgoing {
+			bucket.OutgoingAmount += tx.Amount
+			bucket.OutgoingCount++
+		}
+	}
 	return result, nil
 }
 
+func (m *mockTransactionRepository) EachForUser(ctx context.Context, ownerId uuid.UUID, currency string, from, to time.Time, f func(tx entity.Transaction) error) error {
+	for _, tx := range m.items {
+		if !tx.Settled() {
+			continue
+		}
+		creditCurrency, _ := tx.Credited()
+		if !(tx.SenderId == ownerId && tx.Currency == currency || tx.RecipientId == ownerId && creditCurrency == currency) {
+			continue
+		}
+		if tx.TransactionDate.Before(from) || !tx.TransactionDate.Before(to) {
+			continue
+		}
+		if err := f(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockTransactionRepository) Update(ctx context.Context, tx entity.Transaction) error {
+	for i, item := range m.items {
+		if item.Id == tx.Id {
+			m.items[i] = tx
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
 func (m *mockTransactionRepository) Count(ctx context.Context) (int64, error) {
 	return int64(len(m.items)), nil
+}
+
+func (m *mockTransactionRepository) Lock(ctx context.Context, id int64) (entity.Transaction, error) {
+	return m.Get(ctx, id)
+}
+
+func (m *mockTransactionRepository) CreateStatusChange(ctx context.Context, change *entity.TransactionStatusChange) error {
+	change.Id = int64(len(m.statusChanges) + 1)
+	m.statusChanges = append(m.statusChanges, *change)
+	return nil
+}
+
+func (m *mockTransactionRepository) StatusChanges(ctx context.Context, id int64) ([]entity.TransactionStatusChange, error) {
+	var result []entity.TransactionStatusChange
+	for _, change := range m.statusChanges {
+		if change.TransactionId == id {
+			result = append(result, change)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockTransactionRepository) Pending(ctx context.Context, ownerId uuid.UUID, currency string) (int64, error) {
+	var amount int64
+	for _, tx := range m.items {
+		if tx.SenderId == ownerId && tx.Currency == currency && tx.Status == entity.TransactionPending {
+			amount += tx.Amount
+		}
+	}
+	return amount, nil
 }
\ No newline at end of file
@@ -4,6 +4,7 @@ package dbcontext
 
 import (
 	"context"
+	"database/sql"
 
 	dbx "github.com/go-ozzo/ozzo-dbx"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
@@ -61,4 +62,18 @@ func (db *DB) TransactionHandler() routing.Handler {
 			return c.Next()
 		})
 	}
+}
+
+// ReadOnlyTransactionHandler returns a middleware that starts a read-only transaction with repeatable read isolation,
+// so that all queries made while handling the request see the same snapshot of the database.
+// The transaction started is kept in the context and can be accessed via With().
+func (db *DB) ReadOnlyTransactionHandler() routing.Handler {
+	opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	return func(c *routing.Context) error {
+		return db.db.TransactionalContext(c.Request.Context(), opts, func(tx *dbx.Tx) error {
+			ctx := context.WithValue(c.Request.Context(), txKey, tx)
+			c.Request = c.Request.WithContext(ctx)
+			return c.Next()
+		})
+	}
 }
\ No newline at end of file
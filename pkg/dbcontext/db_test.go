@@ -104,6 +104,47 @@ func TestDB_TransactionHandler(t *testing.T) {
 	})
 }
 
+func TestDB_ReadOnlyTransactionHandler(t *testing.T) {
+	runDBTest(t, func(db *dbx.DB) {
+		assert.Zero(t, runCountQuery(t, db))
+		dbc := New(db)
+		txHandler := dbc.ReadOnlyTransactionHandler()
+
+		// writes are forbidden
+		{
+			res := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://127.0.0.1/users", nil)
+			err := routing.NewContext(res, req, txHandler, func(c *routing.Context) error {
+				_, err := dbc.With(c.Request.Context()).Insert("dbcontexttest", dbx.Params{"id": "1", "name": "name1"}).Execute()
+				return err
+			}).Next()
+			assert.Error(t, err)
+			assert.Zero(t, runCountQuery(t, db))
+		}
+
+		// changes committed after the first query are not seen
+		{
+			res := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://127.0.0.1/users", nil)
+			err := routing.NewContext(res, req, txHandler, func(c *routing.Context) error {
+				ctx := c.Request.Context()
+				var count int
+				assert.NoError(t, dbc.With(ctx).NewQuery("SELECT COUNT(*) FROM dbcontexttest").Row(&count))
+				assert.Zero(t, count)
+
+				_, err := db.Insert("dbcontexttest", dbx.Params{"id": "2", "name": "name2"}).Execute()
+				assert.NoError(t, err)
+
+				assert.NoError(t, dbc.With(ctx).NewQuery("SELECT COUNT(*) FROM dbcontexttest").Row(&count))
+				assert.Zero(t, count)
+				return nil
+			}).Next()
+			assert.NoError(t, err)
+			assert.Equal(t, 1, runCountQuery(t, db))
+		}
+	})
+}
+
 func runDBTest(t *testing.T, f func(db *dbx.DB)) {
 	dsn, ok := os.LookupEnv("APP_DSN")
 	if !ok {
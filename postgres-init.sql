@@ -1,19 +1,177 @@
 CREATE TABLE IF NOT EXISTS Deposit(
-    owner_id UUID PRIMARY KEY,
+    owner_id UUID NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
     balance BIGINT,
+    credit_limit BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'active',
+    daily_amount_limit BIGINT NOT NULL DEFAULT 0,
+    daily_count_limit BIGINT NOT NULL DEFAULT 0,
+    monthly_amount_limit BIGINT NOT NULL DEFAULT 0,
+    monthly_count_limit BIGINT NOT NULL DEFAULT 0,
 
-    CONSTRAINT chk_balance_not_negative
-    CHECK(balance >= 0) /* super-safe :) */
+    PRIMARY KEY(owner_id, currency),
+
+    CONSTRAINT chk_deposit_status
+    CHECK(status IN ('active', 'frozen_debit', 'frozen_all', 'closed')),
+    CONSTRAINT chk_closed_balance_zero
+    CHECK(status <> 'closed' OR balance = 0),
+    CONSTRAINT chk_spending_limits_not_negative
+    CHECK(daily_amount_limit >= 0 AND daily_count_limit >= 0 AND monthly_amount_limit >= 0 AND monthly_count_limit >= 0),
+
+    CONSTRAINT chk_credit_limit_not_negative
+    CHECK(credit_limit >= 0),
+    CONSTRAINT chk_balance_within_credit_limit
+    CHECK(balance + credit_limit >= 0) /* super-safe :) */
+);
+
+CREATE TABLE IF NOT EXISTS Deposit_Status_Change(
+    id bigserial PRIMARY KEY,
+    owner_id UUID NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    previous_status VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    changed_by VARCHAR(100) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    changed_at TIMESTAMP NOT NULL
 );
 
+CREATE INDEX IF NOT EXISTS idx_deposit_status_change_owner_id ON Deposit_Status_Change(owner_id, currency);
+
 CREATE TABLE IF NOT EXISTS Transaction(
     id bigserial PRIMARY KEY,
     sender_id UUID NULL,
     recipient_id UUID NULL,
     amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
+    recipient_currency VARCHAR(3) NOT NULL DEFAULT '',
+    recipient_amount BIGINT NOT NULL DEFAULT 0,
+    exchange_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
     description VARCHAR(100) NULL,
     transaction_date TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'completed',
+    reversal_of BIGINT NOT NULL DEFAULT 0,
+    reversed_amount BIGINT NOT NULL DEFAULT 0,
+    sender_balance_after BIGINT NULL,
+    recipient_balance_after BIGINT NULL,
+    metadata JSONB NOT NULL DEFAULT '{}',
+    tags JSONB NOT NULL DEFAULT '[]',
 
     CONSTRAINT chk_amount_not_negative
-    CHECK(amount > 0)
+    CHECK(amount > 0),
+    CONSTRAINT chk_transaction_status
+    CHECK(status IN ('pending', 'completed', 'failed', 'reversed')),
+    CONSTRAINT chk_reversed_amount_within_amount
+    CHECK(reversed_amount >= 0 AND reversed_amount <= amount)
+);
+
+CREATE INDEX IF NOT EXISTS idx_transaction_sender_id ON Transaction(sender_id, currency, transaction_date);
+CREATE INDEX IF NOT EXISTS idx_transaction_metadata ON Transaction USING GIN(metadata);
+CREATE INDEX IF NOT EXISTS idx_transaction_tags ON Transaction USING GIN(tags);
+CREATE INDEX IF NOT EXISTS idx_transaction_sender_id_created_at ON Transaction(sender_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_transaction_pending ON Transaction(sender_id, currency) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS Transaction_Status_Change(
+    id bigserial PRIMARY KEY,
+    transaction_id BIGINT NOT NULL,
+    previous_status VARCHAR(20) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    changed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_transaction_status_change_transaction_id ON Transaction_Status_Change(transaction_id);
+
+CREATE TABLE IF NOT EXISTS Posting(
+    id bigserial PRIMARY KEY,
+    transaction_id BIGINT NOT NULL,
+    account_id UUID NOT NULL,
+    amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
+    posting_date TIMESTAMP NOT NULL,
+    balance_after BIGINT NOT NULL DEFAULT 0,
+
+    CONSTRAINT chk_posting_amount_not_zero
+    CHECK(amount <> 0)
+);
+
+/* covers the balance of an account, so that it is summed up from the index alone */
+DROP INDEX IF EXISTS idx_posting_account_id;
+CREATE INDEX IF NOT EXISTS idx_posting_account_balance ON Posting(account_id, currency, posting_date, amount);
+CREATE INDEX IF NOT EXISTS idx_posting_transaction_id ON Posting(transaction_id);
+/* finds the last posting of an account, which holds its running balance */
+CREATE INDEX IF NOT EXISTS idx_posting_account_last ON Posting(account_id, currency, id);
+
+CREATE TABLE IF NOT EXISTS Reservation(
+    id bigserial PRIMARY KEY,
+    owner_id UUID NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
+    amount BIGINT NOT NULL,
+    captured_amount BIGINT NOT NULL DEFAULT 0,
+    description VARCHAR(100) NULL,
+    status VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    CONSTRAINT chk_reservation_amount_positive
+    CHECK(amount > 0),
+    CONSTRAINT chk_captured_amount_within_reserved
+    CHECK(captured_amount >= 0 AND captured_amount <= amount)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reservation_owner_id ON Reservation(owner_id);
+
+CREATE TABLE IF NOT EXISTS Rate(
+    id bigserial PRIMARY KEY,
+    currency VARCHAR(3) NOT NULL,
+    rate DOUBLE PRECISION NOT NULL,
+    fetched_at TIMESTAMP NOT NULL,
+
+    CONSTRAINT chk_rate_positive
+    CHECK(rate > 0)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_currency_fetched_at ON Rate(currency, fetched_at);
+
+CREATE TABLE IF NOT EXISTS Rate_Override(
+    id bigserial PRIMARY KEY,
+    currency VARCHAR(3) NOT NULL,
+    rate DOUBLE PRECISION NOT NULL,
+    set_by VARCHAR(100) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    set_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    removed_by VARCHAR(100) NOT NULL DEFAULT '',
+
+    CONSTRAINT chk_rate_override_rate_positive
+    CHECK(rate > 0)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_override_currency_expires_at ON Rate_Override(currency, expires_at);
+
+CREATE TABLE IF NOT EXISTS Quote(
+    id UUID PRIMARY KEY,
+    currency VARCHAR(3) NOT NULL,
+    amount BIGINT NOT NULL,
+    target_currency VARCHAR(3) NOT NULL,
+    target_amount BIGINT NOT NULL,
+    rate DOUBLE PRECISION NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    CONSTRAINT chk_quote_amount_positive
+    CHECK(amount > 0),
+    CONSTRAINT chk_quote_rate_positive
+    CHECK(rate > 0)
+);
+
+CREATE INDEX IF NOT EXISTS idx_quote_active_expires_at ON Quote(expires_at) WHERE status = 'active';
+
+CREATE TABLE IF NOT EXISTS Idempotency_Key(
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64) NOT NULL,
+    transaction_id BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
 );
\ No newline at end of file
@@ -1,10 +1,15 @@
-INSERT INTO transaction (sender_id, recipient_id, amount, description, transaction_date)
-VALUES (NULL, '11111111-3a7a-4d5e-8a6c-febc8c5b3f13', 2000, 'VISA TRANSFER', now()),
-       (NULL, '22222222-3a7a-4d5e-8a6c-febc8c5b3f13', 3590, 'MASTERCARD TRANSFER', now() - interval '13s'),
-       (NULL, '33333333-3a7a-4d5e-8a6c-febc8c5b3f13', 150, 'PROMO', now() - interval '25s'),
-       ('22222222-3a7a-4d5e-8a6c-febc8c5b3f13', '11111111-3a7a-4d5e-8a6c-febc8c5b3f13', 1000, 'FOR DINNER', now() - interval '33s');
+INSERT INTO transaction (sender_id, recipient_id, amount, description, transaction_date, created_at)
+VALUES (NULL, '11111111-3a7a-4d5e-8a6c-febc8c5b3f13', 2000, 'VISA TRANSFER', now(), now()),
+       (NULL, '22222222-3a7a-4d5e-8a6c-febc8c5b3f13', 3590, 'MASTERCARD TRANSFER', now() - interval '13s', now() - interval '13s'),
+       (NULL, '33333333-3a7a-4d5e-8a6c-febc8c5b3f13', 150, 'PROMO', now() - interval '25s', now() - interval '25s'),
+       ('22222222-3a7a-4d5e-8a6c-febc8c5b3f13', '11111111-3a7a-4d5e-8a6c-febc8c5b3f13', 1000, 'FOR DINNER', now() - interval '33s', now() - interval '33s');
 
 INSERT INTO deposit (owner_id, balance)
 VALUES ('11111111-3a7a-4d5e-8a6c-febc8c5b3f13', 3000),
        ('22222222-3a7a-4d5e-8a6c-febc8c5b3f13', 2590),
-       ('33333333-3a7a-4d5e-8a6c-febc8c5b3f13', 150);
\ No newline at end of file
+       ('33333333-3a7a-4d5e-8a6c-febc8c5b3f13', 150);
+
+INSERT INTO posting (transaction_id, account_id, amount, posting_date)
+SELECT id, COALESCE(sender_id, '00000000-0000-0000-0000-000000000001'), -amount, transaction_date FROM transaction
+UNION ALL
+SELECT id, COALESCE(recipient_id, '00000000-0000-0000-0000-000000000002'), amount, transaction_date FROM transaction;
\ No newline at end of file